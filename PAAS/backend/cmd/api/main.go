@@ -1,17 +1,38 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	"backend/internal/server"
+
+	"golang.org/x/term"
 )
 
+const usage = `usage: api [command] [flags]
+
+commands:
+  serve            run the API server (the default)
+  create-admin     create an admin user, or promote an existing user to admin
+  reset-password   set a user's password, revoking their sessions and API tokens
+  reconcile        run one instance status sync and exit
+  reseal-secrets   seal stored secrets under SECRETS_KEY after it was rotated
+
+Passwords are read from the terminal, or from the first line of stdin when it is not one.
+The commands use the same environment (MongoDB, cluster, JWT_SECRET, SECRETS_KEY, password
+policy) as serve.
+`
+
 func gracefulShutdown(apiServer *http.Server, done chan bool) {
 	// Create context that listens for the interrupt signal from the OS.
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
@@ -37,8 +58,7 @@ func gracefulShutdown(apiServer *http.Server, done chan bool) {
 	done <- true
 }
 
-func main() {
-
+func serve() {
 	server := server.NewServer()
 
 	// Create a done channel to signal when the shutdown is complete
@@ -56,3 +76,122 @@ func main() {
 	<-done
 	log.Println("Graceful shutdown complete.")
 }
+
+// readPassword prompts for a password twice on a terminal, or reads one line from stdin.
+func readPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", fmt.Errorf("read password from stdin: %w", err)
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	first, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprint(os.Stderr, "Repeat password: ")
+	second, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if string(first) != string(second) {
+		return "", errors.New("passwords do not match")
+	}
+	return string(first), nil
+}
+
+// parseEmail parses the flags of a command that acts on one user.
+func parseEmail(command string, args []string) string {
+	fs := flag.NewFlagSet(command, flag.ExitOnError)
+	email := fs.String("email", "", "email of the user")
+	_ = fs.Parse(args)
+	if *email == "" {
+		fmt.Fprintf(os.Stderr, "%s: -email is required\n", command)
+		os.Exit(2)
+	}
+	return *email
+}
+
+func createAdmin(args []string) {
+	email := parseEmail("create-admin", args)
+	ctx := context.Background()
+	srv := server.New()
+
+	// Only a new user needs a password, so an existing one is promoted without a prompt.
+	password := ""
+	if exists, err := srv.UserExists(ctx, email); err != nil {
+		log.Fatalf("create-admin: %v", err)
+	} else if !exists {
+		if password, err = readPassword(); err != nil {
+			log.Fatalf("create-admin: %v", err)
+		}
+	}
+
+	created, err := srv.CreateAdmin(ctx, email, password)
+	if err != nil {
+		log.Fatalf("create-admin: %v", err)
+	}
+	if created {
+		fmt.Printf("created admin %s\n", email)
+	} else {
+		fmt.Printf("%s is an admin\n", email)
+	}
+}
+
+func resetPassword(args []string) {
+	email := parseEmail("reset-password", args)
+	srv := server.New()
+	password, err := readPassword()
+	if err != nil {
+		log.Fatalf("reset-password: %v", err)
+	}
+	if err := srv.ResetPassword(context.Background(), email, password); err != nil {
+		log.Fatalf("reset-password: %v", err)
+	}
+	fmt.Printf("password of %s reset; all their sessions and API tokens were revoked\n", email)
+}
+
+func reconcile() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	server.New().Reconcile(ctx)
+}
+
+func resealSecrets() {
+	resealed, err := server.New().ResealSecrets(context.Background())
+	if err != nil {
+		log.Fatalf("reseal-secrets: %d secrets resealed; %v", resealed, err)
+	}
+	fmt.Printf("%d secrets resealed; SECRETS_KEY_PREVIOUS can be removed\n", resealed)
+}
+
+func main() {
+	command, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	switch command {
+	case "serve":
+		serve()
+	case "create-admin":
+		createAdmin(args)
+	case "reset-password":
+		resetPassword(args)
+	case "reconcile":
+		reconcile()
+	case "reseal-secrets":
+		resealSecrets()
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", command, usage)
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,185 @@
+// Package archive stores the compressed log archives written before old log entries are
+// purged, through a pluggable Store: a local directory or an S3-compatible bucket.
+package archive
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type Store interface {
+	// Put stores size bytes from body under name, a relative slash-separated path. An
+	// existing archive with the same name is replaced.
+	Put(ctx context.Context, name string, body io.ReadSeeker, size int64) error
+	// Location describes where an archive with this name ends up, for logs and audit entries.
+	Location(name string) string
+}
+
+// checkName rejects names that could escape the directory or prefix they are stored under.
+func checkName(name string) error {
+	if name == "" || strings.HasPrefix(name, "/") || path.Clean(name) != name || strings.HasPrefix(name, "../") || name == ".." {
+		return fmt.Errorf("archive: invalid name %q", name)
+	}
+	return nil
+}
+
+// Dir stores archives as files below a local directory, which may be a mounted volume.
+type Dir struct {
+	Path string
+}
+
+func (d *Dir) Put(_ context.Context, name string, body io.ReadSeeker, _ int64) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	dest := filepath.Join(d.Path, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(dest), 0o750); err != nil {
+		return fmt.Errorf("archive: %w", err)
+	}
+
+	// Written under a temporary name first, so a half-written archive never looks complete.
+	tmp, err := os.CreateTemp(filepath.Dir(dest), ".partial-*")
+	if err != nil {
+		return fmt.Errorf("archive: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		return fmt.Errorf("archive: write %s: %w", name, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("archive: write %s: %w", name, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("archive: write %s: %w", name, err)
+	}
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		return fmt.Errorf("archive: %w", err)
+	}
+	return nil
+}
+
+func (d *Dir) Location(name string) string {
+	return filepath.Join(d.Path, filepath.FromSlash(name))
+}
+
+// S3 stores archives as objects in a bucket of an S3-compatible store (AWS S3, MinIO, Ceph
+// and the like). Requests use path-style URLs, which all of them accept, and are signed
+// with AWS Signature Version 4.
+type S3 struct {
+	Endpoint        string // e.g. https://s3.eu-central-1.amazonaws.com
+	Region          string // defaults to us-east-1
+	Bucket          string
+	Prefix          string // prepended to every object name, e.g. "paas/"
+	AccessKeyID     string
+	SecretAccessKey string
+	Client          *http.Client // defaults to a client with a 5 minute timeout
+}
+
+func (s *S3) Put(ctx context.Context, name string, body io.ReadSeeker, size int64) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	if s.Endpoint == "" || s.Bucket == "" {
+		return errors.New("archive: S3 endpoint and bucket are required")
+	}
+
+	// The payload hash is part of the signature, so the body is read twice.
+	hash := sha256.New()
+	if _, err := io.Copy(hash, body); err != nil {
+		return fmt.Errorf("archive: read %s: %w", name, err)
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("archive: read %s: %w", name, err)
+	}
+	payloadHash := hex.EncodeToString(hash.Sum(nil))
+
+	target, err := url.Parse(strings.TrimSuffix(s.Endpoint, "/") + "/" + s.Bucket + "/" + s.Prefix + name)
+	if err != nil {
+		return fmt.Errorf("archive: invalid S3 endpoint: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, target.String(), io.NopCloser(body))
+	if err != nil {
+		return fmt.Errorf("archive: %w", err)
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/gzip")
+	s.sign(req, payloadHash, time.Now().UTC())
+
+	client := s.Client
+	if client == nil {
+		client = &http.Client{Timeout: 5 * time.Minute}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("archive: upload %s: %w", name, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("archive: upload %s: %s: %s", name, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+func (s *S3) Location(name string) string {
+	return "s3://" + s.Bucket + "/" + s.Prefix + name
+}
+
+// sign adds the AWS Signature Version 4 headers to req.
+func (s *S3) sign(req *http.Request, payloadHash string, now time.Time) {
+	region := s.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "content-type;host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "content-type:" + req.Header.Get("Content-Type") + "\n" +
+		"host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretAccessKey), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.AccessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,86 @@
+package database
+
+import (
+	"backend/internal/models"
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func (s *service) CreateAPIToken(ctx context.Context, token *models.APIToken) error {
+	collection := s.db.Database("paas").Collection("api_tokens")
+	if token.ID.IsZero() {
+		token.ID = primitive.NewObjectID()
+	}
+	_, err := collection.InsertOne(ctx, token)
+	return err
+}
+
+// GetAPITokens returns the user's tokens, newest first, including revoked and expired ones.
+func (s *service) GetAPITokens(ctx context.Context, userEmail string) ([]models.APIToken, error) {
+	collection := s.db.Database("paas").Collection("api_tokens")
+	findOpts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}})
+	cursor, err := collection.Find(ctx, bson.M{"user_email": userEmail}, findOpts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	tokens := []models.APIToken{}
+	if err := cursor.All(ctx, &tokens); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// GetAPITokenByHash returns the token with the given hash, or nil if there is none.
+func (s *service) GetAPITokenByHash(ctx context.Context, tokenHash string) (*models.APIToken, error) {
+	collection := s.db.Database("paas").Collection("api_tokens")
+	var token models.APIToken
+	err := collection.FindOne(ctx, bson.M{"token_hash": tokenHash}).Decode(&token)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &token, nil
+}
+
+// RevokeAPIToken revokes one of the user's tokens. It returns false if the user has no such
+// active token.
+func (s *service) RevokeAPIToken(ctx context.Context, id primitive.ObjectID, userEmail string) (bool, error) {
+	collection := s.db.Database("paas").Collection("api_tokens")
+	res, err := collection.UpdateOne(ctx,
+		bson.M{"_id": id, "user_email": userEmail, "revoked_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revoked_at": time.Now()}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
+
+// RevokeUserAPITokens revokes every active token of the user and returns how many were revoked.
+func (s *service) RevokeUserAPITokens(ctx context.Context, userEmail string) (int64, error) {
+	collection := s.db.Database("paas").Collection("api_tokens")
+	res, err := collection.UpdateMany(ctx,
+		bson.M{"user_email": userEmail, "revoked_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revoked_at": time.Now()}},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.ModifiedCount, nil
+}
+
+func (s *service) TouchAPIToken(ctx context.Context, id primitive.ObjectID, usedAt time.Time) error {
+	collection := s.db.Database("paas").Collection("api_tokens")
+	_, err := collection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"last_used_at": usedAt}})
+	return err
+}
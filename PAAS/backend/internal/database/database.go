@@ -6,28 +6,68 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"math/rand"
 	"os"
 	"time"
 
 	_ "github.com/joho/godotenv/autoload"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
-// GetAuditLogsOptions configures listing audit logs (limit, skip, admin-only and action-type filters).
+// GetAuditLogsOptions configures listing audit logs (pagination and filters). Empty filters
+// match everything.
 type GetAuditLogsOptions struct {
-	Limit            int    // default 50, max 50
-	Skip             int    // offset for pagination
-	ActionType       string // optional: filter by action.action (e.g. create, update, delete, login, register)
-	IncludeAdminOnly bool   // if true (admin only), return only entries with admin_info=true
+	Limit            int      // default 50, max 50
+	Skip             int      // offset for pagination
+	ActionType       string   // optional: filter by action.action (e.g. create, update, delete, login, register)
+	IncludeAdminOnly bool     // if true (admin only), return only entries with admin_info=true
+	Namespaces       []string // non-admins also see non-admin entries for instances in these namespaces
+	AllNamespaces    bool     // non-admins see the non-admin entries of every namespace
+
+	From         *time.Time // entries at or after this time
+	To           *time.Time // entries before this time
+	UserEmail    string     // admins only: entries by this user
+	InstanceName string     // action.name
+	Namespace    string     // action.namespace
+	ClientIP     string
+	Outcome      string // models.AuditSuccess, AuditFailure or AuditDenied
+	RequestID    string
+	Search       string // words to look for in action.details (text index)
 }
 
-// GetServiceLogsOptions configures listing service logs (pagination).
+// GetServiceLogsOptions configures listing service logs (pagination, time range and the
+// request that led to them).
 type GetServiceLogsOptions struct {
-	Limit int // default 50, max 50
-	Skip  int // offset for pagination
+	Limit     int        // default 50, max 50
+	Skip      int        // offset for pagination
+	From      *time.Time // entries at or after this time
+	To        *time.Time // entries before this time
+	RequestID string
+}
+
+// GetUsersOptions configures listing users (search and pagination).
+type GetUsersOptions struct {
+	Email  string // optional: exact email
+	Search string // optional: case-insensitive substring of the email
+	Limit  int    // default 50, max 50
+	Skip   int    // offset for pagination
+}
+
+// GetPendingChangesOptions filters queued maintenance changes; empty fields match everything.
+type GetPendingChangesOptions struct {
+	InstanceName string
+	Namespace    string
+	Status       string // e.g. models.PendingChangePending
+}
+
+// GetRoleBindingsOptions filters role bindings; empty fields match everything.
+type GetRoleBindingsOptions struct {
+	UserEmail string
+	Namespace string
 }
 
 type Service interface {
@@ -35,16 +75,103 @@ type Service interface {
 	Register(user *models.User, ctx context.Context) error
 	FindUserByEmail(ctx context.Context, email string) (*models.User, error)
 	InsertAuditLog(ctx context.Context, log *models.AuditLog) error
+	WalkAuditChain(ctx context.Context, fn func(*models.AuditLog) error) error
 	GetAuditLogs(ctx context.Context, userEmail string, isAdmin bool, opts GetAuditLogsOptions) ([]models.AuditLog, int64, error)
+	ExportAuditLogs(ctx context.Context, userEmail string, isAdmin bool, opts GetAuditLogsOptions, fn func(*models.AuditLog) error) error
 
 	InsertServiceLog(ctx context.Context, log *models.ServiceLog) error
 	GetServiceLogs(ctx context.Context, isAdmin bool, allowedNamespaces []string, instanceName, namespace string, opts GetServiceLogsOptions) ([]models.ServiceLog, int64, error)
+	ExportServiceLogs(ctx context.Context, isAdmin bool, allowedNamespaces []string, instanceName, namespace string, opts GetServiceLogsOptions, fn func(*models.ServiceLog) error) error
 	GetInstanceStatusCache(ctx context.Context, instanceName, namespace string) (status string, err error)
 	SetInstanceStatusCache(ctx context.Context, instanceName, namespace, status string) error
+
+	GetAuditChainAnchor(ctx context.Context) (*models.AuditChainAnchor, error)
+	GetAuditPurgeBoundary(ctx context.Context, before time.Time) (throughSeq int64, err error)
+	WalkPurgeableAuditLogs(ctx context.Context, before time.Time, throughSeq int64, fn func(*models.AuditLog) error) error
+	PurgeAuditLogs(ctx context.Context, before time.Time, throughSeq int64) (int64, error)
+	PurgeServiceLogs(ctx context.Context, before time.Time) (int64, error)
+	GetInstanceStatusCaches(ctx context.Context) ([]models.InstanceStatusCache, error)
+	DeleteInstanceStatusCache(ctx context.Context, instanceName, namespace string, notAfter time.Time) error
+
+	GetSettings(ctx context.Context) (*models.Settings, error)
+	UpdateSettings(ctx context.Context, settings *models.Settings) error
+
+	InsertPendingChange(ctx context.Context, change *models.PendingChange) error
+	GetPendingChanges(ctx context.Context, opts GetPendingChangesOptions) ([]models.PendingChange, error)
+	SetPendingChangeStatus(ctx context.Context, id primitive.ObjectID, status, errMsg string) error
+	SupersedePendingChanges(ctx context.Context, instanceName, namespace string) error
+
+	InsertSpecRevision(ctx context.Context, rev *models.SpecRevision) error
+	GetSpecRevisions(ctx context.Context, instanceName, namespace string) ([]models.SpecRevision, error)
+	GetSpecRevision(ctx context.Context, instanceName, namespace string, revision int) (*models.SpecRevision, error)
+
+	InsertDeletedInstance(ctx context.Context, instance *models.DeletedInstance) error
+	GetDeletedInstance(ctx context.Context, name, namespace string) (*models.DeletedInstance, error)
+	GetDeletedInstances(ctx context.Context, namespaces []string) ([]models.DeletedInstance, error)
+	DeleteDeletedInstance(ctx context.Context, name, namespace string) (bool, error)
+
+	CreateSession(ctx context.Context, session *models.Session) error
+	GetSession(ctx context.Context, id string) (*models.Session, error)
+	RotateRefreshToken(ctx context.Context, id, oldHash, newHash string, expiresAt time.Time) (bool, error)
+	RevokeSession(ctx context.Context, id, reason string) error
+	RevokeUserSessions(ctx context.Context, email, reason string) (int64, error)
+	GetSessions(ctx context.Context, email string) ([]models.Session, error)
+	TouchSession(ctx context.Context, id string, usedAt time.Time) error
+	SetSessionTwoFactor(ctx context.Context, id string) error
+
+	CreateAPIToken(ctx context.Context, token *models.APIToken) error
+	GetAPITokens(ctx context.Context, userEmail string) ([]models.APIToken, error)
+	GetAPITokenByHash(ctx context.Context, tokenHash string) (*models.APIToken, error)
+	RevokeAPIToken(ctx context.Context, id primitive.ObjectID, userEmail string) (bool, error)
+	RevokeUserAPITokens(ctx context.Context, userEmail string) (int64, error)
+	TouchAPIToken(ctx context.Context, id primitive.ObjectID, usedAt time.Time) error
+
+	CreateRoleBinding(ctx context.Context, binding *models.RoleBinding) error
+	GetRoleBindings(ctx context.Context, opts GetRoleBindingsOptions) ([]models.RoleBinding, error)
+	DeleteRoleBinding(ctx context.Context, id primitive.ObjectID) (*models.RoleBinding, error)
+
+	CreateTeam(ctx context.Context, team *models.Team) error
+	GetTeam(ctx context.Context, slug string) (*models.Team, error)
+	GetTeams(ctx context.Context, memberEmail string) ([]models.Team, error)
+	AddTeamMember(ctx context.Context, slug string, member models.TeamMember) (bool, error)
+	SetTeamMemberRole(ctx context.Context, slug, email, role string) (bool, error)
+	RemoveTeamMember(ctx context.Context, slug, email string) (bool, error)
+
+	SetUserAdmin(ctx context.Context, email string, isAdmin bool) error
+	SetUserOIDCSubject(ctx context.Context, email, subject string) error
+	IncrementFailedLogins(ctx context.Context, email string) (int, error)
+	LockUser(ctx context.Context, email string, until time.Time) error
+	ResetLoginFailures(ctx context.Context, email string) error
+	SetUserPassword(ctx context.Context, email, passwordHash string) error
+	GetUsers(ctx context.Context, opts GetUsersOptions) ([]models.User, int64, error)
+	SetUserDisabled(ctx context.Context, email string, disabled bool) error
+	DeleteUser(ctx context.Context, email string) (bool, error)
+	SetVerificationSent(ctx context.Context, email string, at time.Time) error
+	SetUserVerified(ctx context.Context, email string) (bool, error)
+
+	GetTwoFactor(ctx context.Context, email string) (*models.TwoFactor, error)
+	GetTwoFactors(ctx context.Context) ([]models.TwoFactor, error)
+	SaveTwoFactor(ctx context.Context, tf *models.TwoFactor) error
+	ResealTwoFactorSecret(ctx context.Context, email string, old, sealed []byte) (bool, error)
+	EnableTwoFactor(ctx context.Context, email string, recoveryCodes []string, step int64) (bool, error)
+	DisableTwoFactor(ctx context.Context, email string) error
+	SetRecoveryCodes(ctx context.Context, email string, recoveryCodes []string) error
+	UseTOTPStep(ctx context.Context, email string, step int64) (bool, error)
+	UseRecoveryCode(ctx context.Context, email, codeHash string) (bool, error)
+
+	CreatePasswordReset(ctx context.Context, reset *models.PasswordReset) error
+	GetPasswordReset(ctx context.Context, tokenHash string) (*models.PasswordReset, error)
+	UsePasswordReset(ctx context.Context, tokenHash string) (bool, error)
+
+	GetSigningKeys(ctx context.Context) ([]models.SigningKey, error)
+	InsertSigningKey(ctx context.Context, key *models.SigningKey) error
+	RetireSigningKeys(ctx context.Context, createdBefore, expiresAt time.Time) error
+	ResealSigningKey(ctx context.Context, id string, old, sealed []byte) (bool, error)
 }
 
 type service struct {
-	db *mongo.Client
+	db       *mongo.Client
+	auditKey []byte // keys the audit hash chain and its anchor; never written to the database
 }
 
 var (
@@ -52,7 +179,8 @@ var (
 	password = os.Getenv("MONGO_DB_ATLAS_PASSWORD")
 )
 
-func New() Service {
+// New connects to MongoDB. auditKey keys the HMACs of the audit log's hash chain.
+func New(auditKey []byte) Service {
 	// Use the SetServerAPIOptions() method to set the version of the Stable API on the client
 	serverAPI := options.ServerAPI(options.ServerAPIVersion1)
 
@@ -75,8 +203,15 @@ func New() Service {
 	}
 	fmt.Println("Pinged your deployment. You successfully connected to MongoDB!")
 
+	indexCtx, cancelIndexes := context.WithTimeout(context.Background(), time.Minute)
+	defer cancelIndexes()
+	if err := ensureIndexes(indexCtx, client); err != nil {
+		log.Fatal(err)
+	}
+
 	return &service{
-		db: client,
+		db:       client,
+		auditKey: auditKey,
 	}
 }
 
@@ -128,15 +263,27 @@ func (s *service) Register(user *models.User, ctx context.Context) error {
 
 // userLoginFields is used only for decoding; we project just these fields to avoid
 // decode errors from _id or date fields stored in an unexpected format in the DB.
+// The _id is kept raw and only used when it is an ObjectID.
 type userLoginFields struct {
-	Email    string `bson:"email"`
-	Password string `bson:"password"`
-	IsAdmin  bool   `bson:"is_admin"`
+	ID           bson.RawValue `bson:"_id"`
+	Email        string        `bson:"email"`
+	Password     string        `bson:"password"`
+	IsAdmin      bool          `bson:"is_admin"`
+	OIDCSubject  string        `bson:"oidc_subject"`
+	FailedLogins int           `bson:"failed_logins"`
+	Lockouts     int           `bson:"lockouts"`
+	LockedUntil  *time.Time    `bson:"locked_until"`
+	Disabled     bool          `bson:"disabled"`
+	Pending      bool          `bson:"pending_verification"`
+	SentAt       *time.Time    `bson:"verification_sent_at"`
+	TwoFactor    bool          `bson:"two_factor_enabled"`
 }
 
 func (s *service) FindUserByEmail(ctx context.Context, email string) (*models.User, error) {
 	collection := s.db.Database("paas").Collection("users")
-	projection := bson.M{"email": 1, "password": 1, "is_admin": 1}
+	projection := bson.M{"_id": 1, "email": 1, "password": 1, "is_admin": 1, "oidc_subject": 1,
+		"failed_logins": 1, "lockouts": 1, "locked_until": 1, "disabled": 1,
+		"pending_verification": 1, "verification_sent_at": 1, "two_factor_enabled": 1}
 	opts := options.FindOne().SetProjection(projection)
 	var fields userLoginFields
 	err := collection.FindOne(ctx, bson.M{"email": email}, opts).Decode(&fields)
@@ -146,17 +293,77 @@ func (s *service) FindUserByEmail(ctx context.Context, email string) (*models.Us
 		}
 		return nil, err
 	}
+	id, _ := fields.ID.ObjectIDOK()
 	return &models.User{
-		Email:    fields.Email,
-		Password: fields.Password,
-		IsAdmin:  fields.IsAdmin,
+		ID:           id,
+		Email:        fields.Email,
+		Password:     fields.Password,
+		IsAdmin:      fields.IsAdmin,
+		OIDCSubject:  fields.OIDCSubject,
+		FailedLogins: fields.FailedLogins,
+		Lockouts:     fields.Lockouts,
+		LockedUntil:  fields.LockedUntil,
+		Disabled:     fields.Disabled,
+
+		PendingVerification: fields.Pending,
+		VerificationSentAt:  fields.SentAt,
+		TwoFactorEnabled:    fields.TwoFactor,
 	}, nil
 }
 
+// auditChainRetries bounds how often InsertAuditLog retries after losing a race for the
+// next sequence number.
+const auditChainRetries = 50
+
+// InsertAuditLog appends the entry to the audit hash chain. Replicas writing at the same time
+// may pick the same sequence number; the unique index on seq lets only one of them have it,
+// and the others link after the new last entry and try again.
 func (s *service) InsertAuditLog(ctx context.Context, log *models.AuditLog) error {
 	collection := s.db.Database("paas").Collection("audit_logs")
-	_, err := collection.InsertOne(ctx, log)
-	return err
+	findLast := options.FindOne().
+		SetSort(bson.D{{Key: "seq", Value: -1}}).
+		SetProjection(bson.M{"seq": 1, "hash": 1})
+
+	var err error
+	for attempt := 0; attempt < auditChainRetries; attempt++ {
+		var last models.AuditLog
+		switch findErr := collection.FindOne(ctx, bson.M{"seq": bson.M{"$gt": 0}}, findLast).Decode(&last); {
+		case errors.Is(findErr, mongo.ErrNoDocuments):
+			log.Chain(nil, s.auditKey)
+		case findErr != nil:
+			return findErr
+		default:
+			log.Chain(&last, s.auditKey)
+		}
+
+		if _, err = collection.InsertOne(ctx, log); !mongo.IsDuplicateKeyError(err) {
+			return err
+		}
+		time.Sleep(time.Duration(rand.Intn(5*(attempt+1))) * time.Millisecond)
+	}
+	return fmt.Errorf("append audit log: still losing the race for a sequence number after %d attempts: %w", auditChainRetries, err)
+}
+
+// WalkAuditChain calls fn for every chained audit entry in sequence order, streaming from the
+// cursor. An error from fn stops the walk and is returned.
+func (s *service) WalkAuditChain(ctx context.Context, fn func(*models.AuditLog) error) error {
+	collection := s.db.Database("paas").Collection("audit_logs")
+	cursor, err := collection.Find(ctx, bson.M{"seq": bson.M{"$gt": 0}}, options.Find().SetSort(bson.D{{Key: "seq", Value: 1}}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var entry models.AuditLog
+		if err := cursor.Decode(&entry); err != nil {
+			return err
+		}
+		if err := fn(&entry); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
 }
 
 func (s *service) GetAuditLogs(ctx context.Context, userEmail string, isAdmin bool, opts GetAuditLogsOptions) ([]models.AuditLog, int64, error) {
@@ -174,21 +381,7 @@ func (s *service) GetAuditLogs(ctx context.Context, userEmail string, isAdmin bo
 		skip = 0
 	}
 
-	filter := bson.M{}
-	if isAdmin {
-		// Admins see all actions; optionally restrict to admin-only entries (e.g. logins)
-		if opts.IncludeAdminOnly {
-			filter["admin_info"] = true
-		}
-	} else {
-		// Non-admins see only their own actions, and only non-admin entries
-		filter["user_email"] = userEmail
-		filter["admin_info"] = false
-	}
-	if opts.ActionType != "" {
-		filter["action.action"] = opts.ActionType
-	}
-
+	filter := auditLogFilter(userEmail, isAdmin, opts)
 	total, err := collection.CountDocuments(ctx, filter)
 	if err != nil {
 		return nil, 0, err
@@ -211,6 +404,97 @@ func (s *service) GetAuditLogs(ctx context.Context, userEmail string, isAdmin bo
 	return logs, total, nil
 }
 
+// addTimeRange restricts filter to entries with a timestamp in [from, to); nil bounds are open.
+func addTimeRange(filter bson.M, from, to *time.Time) {
+	if from == nil && to == nil {
+		return
+	}
+	timestamp := bson.M{}
+	if from != nil {
+		timestamp["$gte"] = *from
+	}
+	if to != nil {
+		timestamp["$lt"] = *to
+	}
+	filter["timestamp"] = timestamp
+}
+
+// ExportAuditLogs calls fn for every entry GetAuditLogs would list, ignoring Limit and Skip,
+// oldest first. Entries are read from the cursor one by one, so exports of any size take
+// constant memory. An error from fn stops the export and is returned.
+func (s *service) ExportAuditLogs(ctx context.Context, userEmail string, isAdmin bool, opts GetAuditLogsOptions, fn func(*models.AuditLog) error) error {
+	collection := s.db.Database("paas").Collection("audit_logs")
+	findOpts := options.Find().SetSort(bson.D{{Key: "timestamp", Value: 1}, {Key: "_id", Value: 1}})
+	cursor, err := collection.Find(ctx, auditLogFilter(userEmail, isAdmin, opts), findOpts)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var entry models.AuditLog
+		if err := cursor.Decode(&entry); err != nil {
+			return err
+		}
+		if err := fn(&entry); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// auditLogFilter is the query for the audit log entries userEmail may see that match opts.
+func auditLogFilter(userEmail string, isAdmin bool, opts GetAuditLogsOptions) bson.M {
+	filter := bson.M{}
+	if isAdmin {
+		// Admins see all actions; optionally restrict to admin-only entries (e.g. logins)
+		if opts.IncludeAdminOnly {
+			filter["admin_info"] = true
+		}
+		if opts.UserEmail != "" {
+			filter["user_email"] = opts.UserEmail
+		}
+	} else {
+		// Non-admins see their own actions plus actions on instances in namespaces they may
+		// read the audit trail of, and only non-admin entries
+		switch {
+		case opts.AllNamespaces:
+			// a role in every namespace: no restriction beyond admin_info
+		case len(opts.Namespaces) > 0:
+			filter["$or"] = bson.A{
+				bson.M{"user_email": userEmail},
+				bson.M{"action.namespace": bson.M{"$in": opts.Namespaces}},
+			}
+		default:
+			filter["user_email"] = userEmail
+		}
+		filter["admin_info"] = false
+	}
+	if opts.ActionType != "" {
+		filter["action.action"] = opts.ActionType
+	}
+	addTimeRange(filter, opts.From, opts.To)
+	if opts.InstanceName != "" {
+		filter["action.name"] = opts.InstanceName
+	}
+	if opts.Namespace != "" {
+		filter["action.namespace"] = opts.Namespace
+	}
+	if opts.ClientIP != "" {
+		filter["client_ip"] = opts.ClientIP
+	}
+	if opts.Outcome != "" {
+		filter["outcome"] = opts.Outcome
+	}
+	if opts.RequestID != "" {
+		filter["request_id"] = opts.RequestID
+	}
+	if opts.Search != "" {
+		filter["$text"] = bson.M{"$search": opts.Search}
+	}
+	return filter
+}
+
 func (s *service) InsertServiceLog(ctx context.Context, log *models.ServiceLog) error {
 	collection := s.db.Database("paas").Collection("service_logs")
 	_, err := collection.InsertOne(ctx, log)
@@ -232,19 +516,10 @@ func (s *service) GetServiceLogs(ctx context.Context, isAdmin bool, allowedNames
 		skip = 0
 	}
 
-	filter := bson.M{}
-	if instanceName != "" {
-		filter["instance_name"] = instanceName
-	}
-	if namespace != "" {
-		filter["namespace"] = namespace
-	} else if !isAdmin {
-		if len(allowedNamespaces) == 0 {
-			return nil, 0, nil
-		}
-		filter["namespace"] = bson.M{"$in": allowedNamespaces}
+	filter, ok := serviceLogFilter(isAdmin, allowedNamespaces, instanceName, namespace, opts)
+	if !ok {
+		return nil, 0, nil
 	}
-
 	total, err := collection.CountDocuments(ctx, filter)
 	if err != nil {
 		return nil, 0, err
@@ -267,6 +542,55 @@ func (s *service) GetServiceLogs(ctx context.Context, isAdmin bool, allowedNames
 	return logs, total, nil
 }
 
+// serviceLogFilter is the query for the service logs matching the arguments. ok is false if
+// a non-admin may read no namespace at all, so nothing can match.
+func serviceLogFilter(isAdmin bool, allowedNamespaces []string, instanceName, namespace string, opts GetServiceLogsOptions) (filter bson.M, ok bool) {
+	filter = bson.M{}
+	if instanceName != "" {
+		filter["instance_name"] = instanceName
+	}
+	if namespace != "" {
+		filter["namespace"] = namespace
+	} else if !isAdmin {
+		if len(allowedNamespaces) == 0 {
+			return nil, false
+		}
+		filter["namespace"] = bson.M{"$in": allowedNamespaces}
+	}
+	addTimeRange(filter, opts.From, opts.To)
+	if opts.RequestID != "" {
+		filter["request_id"] = opts.RequestID
+	}
+	return filter, true
+}
+
+// ExportServiceLogs calls fn for every entry GetServiceLogs would list, ignoring Limit and
+// Skip, oldest first; like ExportAuditLogs it streams from the cursor.
+func (s *service) ExportServiceLogs(ctx context.Context, isAdmin bool, allowedNamespaces []string, instanceName, namespace string, opts GetServiceLogsOptions, fn func(*models.ServiceLog) error) error {
+	filter, ok := serviceLogFilter(isAdmin, allowedNamespaces, instanceName, namespace, opts)
+	if !ok {
+		return nil
+	}
+	collection := s.db.Database("paas").Collection("service_logs")
+	findOpts := options.Find().SetSort(bson.D{{Key: "timestamp", Value: 1}, {Key: "_id", Value: 1}})
+	cursor, err := collection.Find(ctx, filter, findOpts)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var entry models.ServiceLog
+		if err := cursor.Decode(&entry); err != nil {
+			return err
+		}
+		if err := fn(&entry); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
 func (s *service) GetInstanceStatusCache(ctx context.Context, instanceName, namespace string) (string, error) {
 	collection := s.db.Database("paas").Collection("instance_status_cache")
 	var doc models.InstanceStatusCache
@@ -296,3 +620,25 @@ func (s *service) SetInstanceStatusCache(ctx context.Context, instanceName, name
 	)
 	return err
 }
+
+// GetSettings returns the platform settings, or the zero-value defaults if none were saved yet.
+func (s *service) GetSettings(ctx context.Context) (*models.Settings, error) {
+	collection := s.db.Database("paas").Collection("settings")
+	var settings models.Settings
+	err := collection.FindOne(ctx, bson.M{"_id": models.SettingsID}).Decode(&settings)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return &models.Settings{ID: models.SettingsID}, nil
+		}
+		return nil, err
+	}
+	return &settings, nil
+}
+
+func (s *service) UpdateSettings(ctx context.Context, settings *models.Settings) error {
+	collection := s.db.Database("paas").Collection("settings")
+	settings.ID = models.SettingsID
+	opts := options.Replace().SetUpsert(true)
+	_, err := collection.ReplaceOne(ctx, bson.M{"_id": models.SettingsID}, settings, opts)
+	return err
+}
@@ -0,0 +1,71 @@
+package database
+
+import (
+	"backend/internal/models"
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// InsertDeletedInstance stores a soft-deleted instance. There is at most one per name and
+// namespace, so a second soft delete of the same name fails until the first is purged.
+func (s *service) InsertDeletedInstance(ctx context.Context, instance *models.DeletedInstance) error {
+	collection := s.db.Database("paas").Collection("deleted_instances")
+	if instance.ID.IsZero() {
+		instance.ID = primitive.NewObjectID()
+	}
+	_, err := collection.InsertOne(ctx, instance)
+	return err
+}
+
+// GetDeletedInstance returns the soft-deleted instance with the given name, or nil if there is none.
+func (s *service) GetDeletedInstance(ctx context.Context, name, namespace string) (*models.DeletedInstance, error) {
+	collection := s.db.Database("paas").Collection("deleted_instances")
+	var instance models.DeletedInstance
+	err := collection.FindOne(ctx, bson.M{"name": name, "namespace": namespace}).Decode(&instance)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	instance.Spec = normalizeDocument(instance.Spec)
+	return &instance, nil
+}
+
+// GetDeletedInstances returns the soft-deleted instances in namespaces, or in all namespaces
+// when namespaces is nil.
+func (s *service) GetDeletedInstances(ctx context.Context, namespaces []string) ([]models.DeletedInstance, error) {
+	collection := s.db.Database("paas").Collection("deleted_instances")
+	filter := bson.M{}
+	if namespaces != nil {
+		filter["namespace"] = bson.M{"$in": namespaces}
+	}
+	cursor, err := collection.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	instances := []models.DeletedInstance{}
+	if err := cursor.All(ctx, &instances); err != nil {
+		return nil, err
+	}
+	for i := range instances {
+		instances[i].Spec = normalizeDocument(instances[i].Spec)
+	}
+	return instances, nil
+}
+
+// DeleteDeletedInstance removes a soft-deleted instance and reports whether there was one.
+func (s *service) DeleteDeletedInstance(ctx context.Context, name, namespace string) (bool, error) {
+	collection := s.db.Database("paas").Collection("deleted_instances")
+	result, err := collection.DeleteOne(ctx, bson.M{"name": name, "namespace": namespace})
+	if err != nil {
+		return false, err
+	}
+	return result.DeletedCount > 0, nil
+}
@@ -0,0 +1,112 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// requiredIndexes lists the unique indexes that correctness depends on, per collection.
+// Concurrent writers rely on them to turn a race into a duplicate key error: without the
+// one on seq, two replicas would fork the audit log's hash chain without noticing. The
+// service does not start unless all of them exist.
+var requiredIndexes = map[string][]mongo.IndexModel{
+	"api_tokens": {
+		{Keys: bson.D{{Key: "token_hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+	},
+	"audit_logs": {
+		// Only one entry can take each place in the hash chain. Entries from before the chain
+		// have no seq and are left out of the index.
+		{
+			Keys:    bson.D{{Key: "seq", Value: 1}},
+			Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"seq": bson.M{"$gt": 0}}),
+		},
+	},
+	"deleted_instances": {
+		// An undelete recreates the RedisFailover by name, so each name keeps one copy.
+		{
+			Keys:    bson.D{{Key: "namespace", Value: 1}, {Key: "name", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+	},
+	"role_bindings": {
+		{
+			Keys:    bson.D{{Key: "user_email", Value: 1}, {Key: "namespace", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+	},
+	"teams": {
+		{Keys: bson.D{{Key: "slug", Value: 1}}, Options: options.Index().SetUnique(true)},
+	},
+}
+
+// collectionIndexes lists the indexes the queries in this package rely on for speed, per
+// collection.
+var collectionIndexes = map[string][]mongo.IndexModel{
+	"api_tokens": {
+		{Keys: bson.D{{Key: "user_email", Value: 1}, {Key: "created_at", Value: -1}}},
+	},
+	"audit_logs": {
+		{Keys: bson.D{{Key: "timestamp", Value: -1}}},
+		{Keys: bson.D{{Key: "user_email", Value: 1}, {Key: "timestamp", Value: -1}}},
+		{Keys: bson.D{{Key: "action.action", Value: 1}, {Key: "timestamp", Value: -1}}},
+		{Keys: bson.D{{Key: "action.namespace", Value: 1}, {Key: "action.name", Value: 1}, {Key: "timestamp", Value: -1}}},
+		{Keys: bson.D{{Key: "client_ip", Value: 1}, {Key: "timestamp", Value: -1}}},
+		{Keys: bson.D{{Key: "outcome", Value: 1}, {Key: "timestamp", Value: -1}}},
+		{Keys: bson.D{{Key: "request_id", Value: 1}}},
+		// The details search uses $text, which needs a text index; a collection can only have one.
+		{Keys: bson.D{{Key: "action.details", Value: "text"}}},
+	},
+	"password_resets": {
+		{Keys: bson.D{{Key: "token_hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		// Expired resets are useless, so MongoDB may drop them an hour after they expire.
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(3600)},
+	},
+	"service_logs": {
+		{Keys: bson.D{{Key: "namespace", Value: 1}, {Key: "instance_name", Value: 1}, {Key: "timestamp", Value: -1}}},
+		{Keys: bson.D{{Key: "timestamp", Value: -1}}},
+		{Keys: bson.D{{Key: "request_id", Value: 1}}},
+	},
+	"sessions": {
+		{Keys: bson.D{{Key: "user_email", Value: 1}}},
+	},
+	"signing_keys": {
+		// Expired keys verify nothing, so MongoDB may drop them.
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	},
+	"spec_revisions": {
+		{
+			Keys:    bson.D{{Key: "namespace", Value: 1}, {Key: "instance_name", Value: 1}, {Key: "revision", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+	},
+	"teams": {
+		{Keys: bson.D{{Key: "members.email", Value: 1}}},
+	},
+}
+
+// ensureIndexes creates any missing indexes, one at a time so that one failure does not
+// keep the others from being created. It fails if a required index cannot be created; the
+// others only make queries faster, so failures to create them are just logged.
+func ensureIndexes(ctx context.Context, client *mongo.Client) error {
+	db := client.Database("paas")
+	for collection, indexes := range requiredIndexes {
+		for _, index := range indexes {
+			if _, err := db.Collection(collection).Indexes().CreateOne(ctx, index); err != nil {
+				return fmt.Errorf("failed to create required index on %s: %w", collection, err)
+			}
+		}
+	}
+	for collection, indexes := range collectionIndexes {
+		for _, index := range indexes {
+			if _, err := db.Collection(collection).Indexes().CreateOne(ctx, index); err != nil {
+				log.Printf("[database] failed to create index on %s: %v", collection, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package database
+
+import (
+	"backend/internal/models"
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func (s *service) CreatePasswordReset(ctx context.Context, reset *models.PasswordReset) error {
+	collection := s.db.Database("paas").Collection("password_resets")
+	_, err := collection.InsertOne(ctx, reset)
+	return err
+}
+
+// GetPasswordReset returns the unused, unexpired reset with the given token hash, or nil.
+func (s *service) GetPasswordReset(ctx context.Context, tokenHash string) (*models.PasswordReset, error) {
+	collection := s.db.Database("paas").Collection("password_resets")
+	var reset models.PasswordReset
+	err := collection.FindOne(ctx, bson.M{
+		"token_hash": tokenHash,
+		"used_at":    bson.M{"$exists": false},
+		"expires_at": bson.M{"$gt": time.Now()},
+	}).Decode(&reset)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &reset, nil
+}
+
+// UsePasswordReset marks the reset as used. It returns false if it was used concurrently or
+// has expired since it was looked up.
+func (s *service) UsePasswordReset(ctx context.Context, tokenHash string) (bool, error) {
+	collection := s.db.Database("paas").Collection("password_resets")
+	now := time.Now()
+	res, err := collection.UpdateOne(ctx,
+		bson.M{"token_hash": tokenHash, "used_at": bson.M{"$exists": false}, "expires_at": bson.M{"$gt": now}},
+		bson.M{"$set": bson.M{"used_at": now}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
@@ -0,0 +1,77 @@
+package database
+
+import (
+	"backend/internal/models"
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func (s *service) InsertPendingChange(ctx context.Context, change *models.PendingChange) error {
+	collection := s.db.Database("paas").Collection("pending_changes")
+	if change.ID.IsZero() {
+		change.ID = primitive.NewObjectID()
+	}
+	_, err := collection.InsertOne(ctx, change)
+	return err
+}
+
+// GetPendingChanges returns matching changes oldest first, which is the order they are applied in.
+func (s *service) GetPendingChanges(ctx context.Context, opts GetPendingChangesOptions) ([]models.PendingChange, error) {
+	collection := s.db.Database("paas").Collection("pending_changes")
+
+	filter := bson.M{}
+	if opts.InstanceName != "" {
+		filter["instance_name"] = opts.InstanceName
+	}
+	if opts.Namespace != "" {
+		filter["namespace"] = opts.Namespace
+	}
+	if opts.Status != "" {
+		filter["status"] = opts.Status
+	}
+
+	findOpts := options.Find().SetSort(bson.D{{Key: "requested_at", Value: 1}})
+	cursor, err := collection.Find(ctx, filter, findOpts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	changes := []models.PendingChange{}
+	if err := cursor.All(ctx, &changes); err != nil {
+		return nil, err
+	}
+	for i := range changes {
+		if changes[i].Spec != nil {
+			changes[i].Spec = normalizeDocument(changes[i].Spec)
+		}
+	}
+	return changes, nil
+}
+
+func (s *service) SetPendingChangeStatus(ctx context.Context, id primitive.ObjectID, status, errMsg string) error {
+	collection := s.db.Database("paas").Collection("pending_changes")
+	set := bson.M{"status": status}
+	if status == models.PendingChangeApplied {
+		set["applied_at"] = time.Now()
+	}
+	if errMsg != "" {
+		set["error"] = errMsg
+	}
+	_, err := collection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": set})
+	return err
+}
+
+// SupersedePendingChanges retires the queued changes of an instance once a newer change was applied directly.
+func (s *service) SupersedePendingChanges(ctx context.Context, instanceName, namespace string) error {
+	collection := s.db.Database("paas").Collection("pending_changes")
+	_, err := collection.UpdateMany(ctx,
+		bson.M{"instance_name": instanceName, "namespace": namespace, "status": models.PendingChangePending},
+		bson.M{"$set": bson.M{"status": models.PendingChangeSuperseded}},
+	)
+	return err
+}
@@ -0,0 +1,167 @@
+package database
+
+import (
+	"backend/internal/models"
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// GetAuditChainAnchor returns the anchor left by the last audit log purge, or nil if the
+// chain was never purged.
+func (s *service) GetAuditChainAnchor(ctx context.Context) (*models.AuditChainAnchor, error) {
+	collection := s.db.Database("paas").Collection("audit_chain")
+	var anchor models.AuditChainAnchor
+	err := collection.FindOne(ctx, bson.M{"_id": models.AuditChainAnchorID}).Decode(&anchor)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &anchor, nil
+}
+
+// GetAuditPurgeBoundary returns the seq up to which chained audit entries may be purged for
+// being older than before, or 0 if there are none. Entries are timestamped when created
+// but numbered when written, so the order can differ slightly; the boundary stops before
+// the first entry, by seq, that must stay, so that the rest of the chain stays whole. The
+// newest entry always stays, for the next one to link to.
+func (s *service) GetAuditPurgeBoundary(ctx context.Context, before time.Time) (int64, error) {
+	collection := s.db.Database("paas").Collection("audit_logs")
+	projection := bson.M{"seq": 1}
+
+	var entry models.AuditLog
+	err := collection.FindOne(ctx,
+		bson.M{"seq": bson.M{"$gt": 0}, "timestamp": bson.M{"$gte": before}},
+		options.FindOne().SetSort(bson.D{{Key: "seq", Value: 1}}).SetProjection(projection),
+	).Decode(&entry)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		err = collection.FindOne(ctx,
+			bson.M{"seq": bson.M{"$gt": 0}},
+			options.FindOne().SetSort(bson.D{{Key: "seq", Value: -1}}).SetProjection(projection),
+		).Decode(&entry)
+	}
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return entry.Seq - 1, nil
+}
+
+// purgeableAuditFilter matches the chained entries up to throughSeq and the entries from
+// before the chain existed that are older than before.
+func purgeableAuditFilter(before time.Time, throughSeq int64) bson.M {
+	legacy := bson.M{"seq": bson.M{"$exists": false}, "timestamp": bson.M{"$lt": before}}
+	if throughSeq <= 0 {
+		return legacy
+	}
+	return bson.M{"$or": bson.A{
+		bson.M{"seq": bson.M{"$gt": 0, "$lte": throughSeq}},
+		legacy,
+	}}
+}
+
+// WalkPurgeableAuditLogs calls fn, oldest first, for every entry PurgeAuditLogs would remove
+// with the same arguments.
+func (s *service) WalkPurgeableAuditLogs(ctx context.Context, before time.Time, throughSeq int64, fn func(*models.AuditLog) error) error {
+	collection := s.db.Database("paas").Collection("audit_logs")
+	findOpts := options.Find().SetSort(bson.D{{Key: "timestamp", Value: 1}, {Key: "_id", Value: 1}})
+	cursor, err := collection.Find(ctx, purgeableAuditFilter(before, throughSeq), findOpts)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var entry models.AuditLog
+		if err := cursor.Decode(&entry); err != nil {
+			return err
+		}
+		if err := fn(&entry); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// PurgeAuditLogs deletes the chained entries up to throughSeq and the unchained entries older
+// than before. The anchor is moved to entry throughSeq first, so the chain verifies at
+// every point, even if the deletion is cut short.
+func (s *service) PurgeAuditLogs(ctx context.Context, before time.Time, throughSeq int64) (int64, error) {
+	db := s.db.Database("paas")
+	if throughSeq > 0 {
+		var last models.AuditLog
+		err := db.Collection("audit_logs").FindOne(ctx, bson.M{"seq": throughSeq}).Decode(&last)
+		if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+			return 0, err
+		}
+		// Not found means an earlier purge already got this far.
+		if err == nil {
+			_, err = db.Collection("audit_chain").UpdateOne(ctx,
+				bson.M{"_id": models.AuditChainAnchorID, "seq": bson.M{"$lt": throughSeq}},
+				bson.M{"$set": bson.M{
+					"seq":       last.Seq,
+					"hash":      last.Hash,
+					"mac":       models.AuditAnchorMAC(s.auditKey, last.Seq, last.Hash),
+					"purged_at": time.Now(),
+				}},
+				options.Update().SetUpsert(true),
+			)
+			// A duplicate key means the anchor is already at or past throughSeq.
+			if err != nil && !mongo.IsDuplicateKeyError(err) {
+				return 0, err
+			}
+		}
+	}
+
+	res, err := db.Collection("audit_logs").DeleteMany(ctx, purgeableAuditFilter(before, throughSeq))
+	if err != nil {
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
+
+// PurgeServiceLogs deletes the service log entries older than before.
+func (s *service) PurgeServiceLogs(ctx context.Context, before time.Time) (int64, error) {
+	collection := s.db.Database("paas").Collection("service_logs")
+	res, err := collection.DeleteMany(ctx, bson.M{"timestamp": bson.M{"$lt": before}})
+	if err != nil {
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
+
+// GetInstanceStatusCaches lists the cached status of every instance the poller has seen.
+func (s *service) GetInstanceStatusCaches(ctx context.Context) ([]models.InstanceStatusCache, error) {
+	collection := s.db.Database("paas").Collection("instance_status_cache")
+	cursor, err := collection.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var caches []models.InstanceStatusCache
+	if err := cursor.All(ctx, &caches); err != nil {
+		return nil, err
+	}
+	return caches, nil
+}
+
+// DeleteInstanceStatusCache forgets the cached status of an instance, unless it was updated
+// at or after notAfter, i.e. by a poller that has seen the instance since.
+func (s *service) DeleteInstanceStatusCache(ctx context.Context, instanceName, namespace string, notAfter time.Time) error {
+	collection := s.db.Database("paas").Collection("instance_status_cache")
+	_, err := collection.DeleteOne(ctx, bson.M{
+		"instance_name": instanceName,
+		"namespace":     namespace,
+		"updated_at":    bson.M{"$lt": notAfter},
+	})
+	return err
+}
@@ -0,0 +1,112 @@
+package database
+
+import (
+	"backend/internal/models"
+	"context"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// nextSequence atomically increments and returns the named counter, starting at 1.
+func (s *service) nextSequence(ctx context.Context, name string) (int, error) {
+	collection := s.db.Database("paas").Collection("counters")
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	var doc struct {
+		Seq int `bson:"seq"`
+	}
+	err := collection.FindOneAndUpdate(ctx, bson.M{"_id": name}, bson.M{"$inc": bson.M{"seq": 1}}, opts).Decode(&doc)
+	if err != nil {
+		return 0, err
+	}
+	return doc.Seq, nil
+}
+
+// InsertSpecRevision stores rev under the next revision number of its instance and sets rev.Revision.
+func (s *service) InsertSpecRevision(ctx context.Context, rev *models.SpecRevision) error {
+	collection := s.db.Database("paas").Collection("spec_revisions")
+	seq, err := s.nextSequence(ctx, fmt.Sprintf("revision:%s/%s", rev.Namespace, rev.InstanceName))
+	if err != nil {
+		return err
+	}
+	rev.Revision = seq
+	if rev.ID.IsZero() {
+		rev.ID = primitive.NewObjectID()
+	}
+	_, err = collection.InsertOne(ctx, rev)
+	return err
+}
+
+// GetSpecRevisions returns all revisions of an instance, oldest first.
+func (s *service) GetSpecRevisions(ctx context.Context, instanceName, namespace string) ([]models.SpecRevision, error) {
+	collection := s.db.Database("paas").Collection("spec_revisions")
+	findOpts := options.Find().SetSort(bson.D{{Key: "revision", Value: 1}})
+	cursor, err := collection.Find(ctx, bson.M{"instance_name": instanceName, "namespace": namespace}, findOpts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	revisions := []models.SpecRevision{}
+	if err := cursor.All(ctx, &revisions); err != nil {
+		return nil, err
+	}
+	for i := range revisions {
+		revisions[i].Spec = normalizeDocument(revisions[i].Spec)
+	}
+	return revisions, nil
+}
+
+// GetSpecRevision returns a single revision, or nil if it does not exist.
+func (s *service) GetSpecRevision(ctx context.Context, instanceName, namespace string, revision int) (*models.SpecRevision, error) {
+	collection := s.db.Database("paas").Collection("spec_revisions")
+	var rev models.SpecRevision
+	err := collection.FindOne(ctx, bson.M{"instance_name": instanceName, "namespace": namespace, "revision": revision}).Decode(&rev)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	rev.Spec = normalizeDocument(rev.Spec)
+	return &rev, nil
+}
+
+// normalizeDocument converts the primitive.D / primitive.A values the driver decodes nested
+// documents into back to plain maps and slices, so specs compare and re-apply like unstructured objects.
+func normalizeDocument(doc map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(doc))
+	for k, v := range doc {
+		out[k] = normalizeValue(v)
+	}
+	return out
+}
+
+func normalizeValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case primitive.D:
+		m := make(map[string]interface{}, len(val))
+		for _, e := range val {
+			m[e.Key] = normalizeValue(e.Value)
+		}
+		return m
+	case primitive.M:
+		return normalizeDocument(val)
+	case map[string]interface{}:
+		return normalizeDocument(val)
+	case primitive.A:
+		out := make([]interface{}, len(val))
+		for i, e := range val {
+			out[i] = normalizeValue(e)
+		}
+		return out
+	case int32:
+		return int64(val)
+	default:
+		return v
+	}
+}
@@ -0,0 +1,62 @@
+package database
+
+import (
+	"backend/internal/models"
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// CreateRoleBinding stores binding. A user has at most one role per namespace, so binding
+// a second role in the same namespace fails with a duplicate key error.
+func (s *service) CreateRoleBinding(ctx context.Context, binding *models.RoleBinding) error {
+	collection := s.db.Database("paas").Collection("role_bindings")
+	if binding.ID.IsZero() {
+		binding.ID = primitive.NewObjectID()
+	}
+	_, err := collection.InsertOne(ctx, binding)
+	return err
+}
+
+func (s *service) GetRoleBindings(ctx context.Context, opts GetRoleBindingsOptions) ([]models.RoleBinding, error) {
+	collection := s.db.Database("paas").Collection("role_bindings")
+
+	filter := bson.M{}
+	if opts.UserEmail != "" {
+		filter["user_email"] = opts.UserEmail
+	}
+	if opts.Namespace != "" {
+		filter["namespace"] = opts.Namespace
+	}
+
+	findOpts := options.Find().SetSort(bson.D{{Key: "user_email", Value: 1}, {Key: "namespace", Value: 1}})
+	cursor, err := collection.Find(ctx, filter, findOpts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	bindings := []models.RoleBinding{}
+	if err := cursor.All(ctx, &bindings); err != nil {
+		return nil, err
+	}
+	return bindings, nil
+}
+
+// DeleteRoleBinding removes a binding and returns it, or nil if there was none.
+func (s *service) DeleteRoleBinding(ctx context.Context, id primitive.ObjectID) (*models.RoleBinding, error) {
+	collection := s.db.Database("paas").Collection("role_bindings")
+	var binding models.RoleBinding
+	err := collection.FindOneAndDelete(ctx, bson.M{"_id": id}).Decode(&binding)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &binding, nil
+}
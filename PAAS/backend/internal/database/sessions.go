@@ -0,0 +1,103 @@
+package database
+
+import (
+	"backend/internal/models"
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func (s *service) CreateSession(ctx context.Context, session *models.Session) error {
+	collection := s.db.Database("paas").Collection("sessions")
+	_, err := collection.InsertOne(ctx, session)
+	return err
+}
+
+// GetSession returns the session with the given ID, or nil if there is none.
+func (s *service) GetSession(ctx context.Context, id string) (*models.Session, error) {
+	collection := s.db.Database("paas").Collection("sessions")
+	var session models.Session
+	err := collection.FindOne(ctx, bson.M{"_id": id}).Decode(&session)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &session, nil
+}
+
+// RotateRefreshToken swaps the session's refresh token hash, but only if oldHash is still
+// current and the session is not revoked. It returns false when another refresh won the race.
+func (s *service) RotateRefreshToken(ctx context.Context, id, oldHash, newHash string, expiresAt time.Time) (bool, error) {
+	collection := s.db.Database("paas").Collection("sessions")
+	res, err := collection.UpdateOne(ctx,
+		bson.M{"_id": id, "refresh_token_hash": oldHash, "revoked_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"refresh_token_hash": newHash, "expires_at": expiresAt}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
+
+func (s *service) RevokeSession(ctx context.Context, id, reason string) error {
+	collection := s.db.Database("paas").Collection("sessions")
+	_, err := collection.UpdateOne(ctx,
+		bson.M{"_id": id, "revoked_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revoked_at": time.Now(), "revoked_reason": reason}},
+	)
+	return err
+}
+
+// RevokeUserSessions revokes every active session of the user and returns how many there were.
+func (s *service) RevokeUserSessions(ctx context.Context, email, reason string) (int64, error) {
+	collection := s.db.Database("paas").Collection("sessions")
+	res, err := collection.UpdateMany(ctx,
+		bson.M{"user_email": email, "revoked_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revoked_at": time.Now(), "revoked_reason": reason}},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.ModifiedCount, nil
+}
+
+// GetSessions returns the user's active sessions, most recently used first.
+func (s *service) GetSessions(ctx context.Context, email string) ([]models.Session, error) {
+	collection := s.db.Database("paas").Collection("sessions")
+	filter := bson.M{
+		"user_email": email,
+		"revoked_at": bson.M{"$exists": false},
+		"expires_at": bson.M{"$gt": time.Now()},
+	}
+	cursor, err := collection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "last_used_at", Value: -1}, {Key: "created_at", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	sessions := []models.Session{}
+	if err := cursor.All(ctx, &sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// SetSessionTwoFactor records that the session has passed a second factor.
+func (s *service) SetSessionTwoFactor(ctx context.Context, id string) error {
+	collection := s.db.Database("paas").Collection("sessions")
+	_, err := collection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"two_factor": true}})
+	return err
+}
+
+// TouchSession records that the session was used at the given time.
+func (s *service) TouchSession(ctx context.Context, id string, usedAt time.Time) error {
+	collection := s.db.Database("paas").Collection("sessions")
+	_, err := collection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"last_used_at": usedAt}})
+	return err
+}
@@ -0,0 +1,57 @@
+package database
+
+import (
+	"backend/internal/models"
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// GetSigningKeys returns the signing keys that have not expired, newest first.
+func (s *service) GetSigningKeys(ctx context.Context) ([]models.SigningKey, error) {
+	collection := s.db.Database("paas").Collection("signing_keys")
+	filter := bson.M{"$or": bson.A{
+		bson.M{"expires_at": bson.M{"$exists": false}},
+		bson.M{"expires_at": bson.M{"$gt": time.Now()}},
+	}}
+	cursor, err := collection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	keys := []models.SigningKey{}
+	if err := cursor.All(ctx, &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (s *service) InsertSigningKey(ctx context.Context, key *models.SigningKey) error {
+	collection := s.db.Database("paas").Collection("signing_keys")
+	_, err := collection.InsertOne(ctx, key)
+	return err
+}
+
+// RetireSigningKeys sets expiresAt on every unexpiring key created before createdBefore.
+func (s *service) RetireSigningKeys(ctx context.Context, createdBefore, expiresAt time.Time) error {
+	collection := s.db.Database("paas").Collection("signing_keys")
+	_, err := collection.UpdateMany(ctx,
+		bson.M{"created_at": bson.M{"$lt": createdBefore}, "expires_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"expires_at": expiresAt}},
+	)
+	return err
+}
+
+// ResealSigningKey replaces the key's sealed private key old with sealed. It returns false
+// if the key is gone or was resealed meanwhile.
+func (s *service) ResealSigningKey(ctx context.Context, id string, old, sealed []byte) (bool, error) {
+	collection := s.db.Database("paas").Collection("signing_keys")
+	res, err := collection.UpdateOne(ctx, bson.M{"_id": id, "private_key": old}, bson.M{"$set": bson.M{"private_key": sealed}})
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
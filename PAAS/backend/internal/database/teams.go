@@ -0,0 +1,99 @@
+package database
+
+import (
+	"backend/internal/models"
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// CreateTeam stores team. Slugs are unique, so a second team with the same slug fails with
+// a duplicate key error.
+func (s *service) CreateTeam(ctx context.Context, team *models.Team) error {
+	collection := s.db.Database("paas").Collection("teams")
+	if team.ID.IsZero() {
+		team.ID = primitive.NewObjectID()
+	}
+	_, err := collection.InsertOne(ctx, team)
+	return err
+}
+
+// GetTeam returns the team with slug, or nil if there is none.
+func (s *service) GetTeam(ctx context.Context, slug string) (*models.Team, error) {
+	collection := s.db.Database("paas").Collection("teams")
+	var team models.Team
+	err := collection.FindOne(ctx, bson.M{"slug": slug}).Decode(&team)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &team, nil
+}
+
+// GetTeams returns the teams memberEmail belongs to, or every team if memberEmail is empty.
+// memberEmail must be normalized with models.NormalizeMemberEmail, as stored member emails are.
+func (s *service) GetTeams(ctx context.Context, memberEmail string) ([]models.Team, error) {
+	collection := s.db.Database("paas").Collection("teams")
+	filter := bson.M{}
+	if memberEmail != "" {
+		filter["members.email"] = memberEmail
+	}
+
+	cursor, err := collection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "slug", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	teams := []models.Team{}
+	if err := cursor.All(ctx, &teams); err != nil {
+		return nil, err
+	}
+	return teams, nil
+}
+
+// AddTeamMember adds member to the team. It returns false if the team does not exist or
+// already has a member with that email.
+func (s *service) AddTeamMember(ctx context.Context, slug string, member models.TeamMember) (bool, error) {
+	collection := s.db.Database("paas").Collection("teams")
+	res, err := collection.UpdateOne(ctx,
+		bson.M{"slug": slug, "members.email": bson.M{"$ne": member.Email}},
+		bson.M{"$push": bson.M{"members": member}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
+
+// SetTeamMemberRole changes a member's role. It returns false if there is no such member.
+func (s *service) SetTeamMemberRole(ctx context.Context, slug, email, role string) (bool, error) {
+	collection := s.db.Database("paas").Collection("teams")
+	res, err := collection.UpdateOne(ctx,
+		bson.M{"slug": slug, "members.email": email},
+		bson.M{"$set": bson.M{"members.$.role": role}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount == 1, nil
+}
+
+// RemoveTeamMember removes a member. It returns false if there is no such member.
+func (s *service) RemoveTeamMember(ctx context.Context, slug, email string) (bool, error) {
+	collection := s.db.Database("paas").Collection("teams")
+	res, err := collection.UpdateOne(ctx,
+		bson.M{"slug": slug},
+		bson.M{"$pull": bson.M{"members": bson.M{"email": email}}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
@@ -0,0 +1,127 @@
+package database
+
+import (
+	"backend/internal/models"
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// GetTwoFactor returns the user's 2FA enrolment, confirmed or not, or nil if there is none.
+func (s *service) GetTwoFactor(ctx context.Context, email string) (*models.TwoFactor, error) {
+	collection := s.db.Database("paas").Collection("two_factor")
+	var tf models.TwoFactor
+	err := collection.FindOne(ctx, bson.M{"_id": email}).Decode(&tf)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &tf, nil
+}
+
+// GetTwoFactors returns every 2FA enrolment, confirmed or not.
+func (s *service) GetTwoFactors(ctx context.Context) ([]models.TwoFactor, error) {
+	collection := s.db.Database("paas").Collection("two_factor")
+	cursor, err := collection.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	enrolments := []models.TwoFactor{}
+	if err := cursor.All(ctx, &enrolments); err != nil {
+		return nil, err
+	}
+	return enrolments, nil
+}
+
+// SaveTwoFactor stores a new, unconfirmed enrolment, replacing any earlier unconfirmed one.
+func (s *service) SaveTwoFactor(ctx context.Context, tf *models.TwoFactor) error {
+	collection := s.db.Database("paas").Collection("two_factor")
+	_, err := collection.ReplaceOne(ctx, bson.M{"_id": tf.UserEmail}, tf, options.Replace().SetUpsert(true))
+	return err
+}
+
+// EnableTwoFactor confirms the pending enrolment with its first recovery codes and the step
+// of the code that confirmed it, then turns on 2FA for the user. It returns false if there
+// was no pending enrolment.
+func (s *service) EnableTwoFactor(ctx context.Context, email string, recoveryCodes []string, step int64) (bool, error) {
+	db := s.db.Database("paas")
+	now := time.Now()
+	res, err := db.Collection("two_factor").UpdateOne(ctx,
+		bson.M{"_id": email, "confirmed_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"confirmed_at": now, "recovery_codes": recoveryCodes, "last_step": step}},
+	)
+	if err != nil || res.ModifiedCount == 0 {
+		return false, err
+	}
+	return true, s.updateUser(ctx, email, bson.M{"two_factor_enabled": true})
+}
+
+// DisableTwoFactor removes the enrolment and turns off 2FA for the user.
+func (s *service) DisableTwoFactor(ctx context.Context, email string) error {
+	db := s.db.Database("paas")
+	if _, err := db.Collection("two_factor").DeleteOne(ctx, bson.M{"_id": email}); err != nil {
+		return err
+	}
+	_, err := db.Collection("users").UpdateOne(ctx, bson.M{"email": email}, bson.M{
+		"$unset": bson.M{"two_factor_enabled": ""},
+		"$set":   bson.M{"updated_at": time.Now()},
+	})
+	return err
+}
+
+// SetRecoveryCodes replaces the recovery codes of a confirmed enrolment.
+func (s *service) SetRecoveryCodes(ctx context.Context, email string, recoveryCodes []string) error {
+	collection := s.db.Database("paas").Collection("two_factor")
+	_, err := collection.UpdateOne(ctx,
+		bson.M{"_id": email, "confirmed_at": bson.M{"$exists": true}},
+		bson.M{"$set": bson.M{"recovery_codes": recoveryCodes}},
+	)
+	return err
+}
+
+// UseTOTPStep records that a code from the given time step was accepted. It returns false if
+// that step or a later one was already used, which stops a seen code from being replayed.
+func (s *service) UseTOTPStep(ctx context.Context, email string, step int64) (bool, error) {
+	collection := s.db.Database("paas").Collection("two_factor")
+	res, err := collection.UpdateOne(ctx,
+		bson.M{"_id": email, "last_step": bson.M{"$lt": step}},
+		bson.M{"$set": bson.M{"last_step": step}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
+
+// UseRecoveryCode removes the recovery code with the given hash. It returns false if the
+// user has no such code, e.g. because it was already used.
+func (s *service) UseRecoveryCode(ctx context.Context, email, codeHash string) (bool, error) {
+	collection := s.db.Database("paas").Collection("two_factor")
+	res, err := collection.UpdateOne(ctx,
+		bson.M{"_id": email, "recovery_codes": codeHash},
+		bson.M{"$pull": bson.M{"recovery_codes": codeHash}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
+
+// ResealTwoFactorSecret replaces the user's sealed TOTP secret old with sealed. It returns
+// false if the secret is no longer old, e.g. because the user enrolled again meanwhile.
+func (s *service) ResealTwoFactorSecret(ctx context.Context, email string, old, sealed []byte) (bool, error) {
+	collection := s.db.Database("paas").Collection("two_factor")
+	res, err := collection.UpdateOne(ctx, bson.M{"_id": email, "secret": old}, bson.M{"$set": bson.M{"secret": sealed}})
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
@@ -0,0 +1,199 @@
+package database
+
+import (
+	"backend/internal/models"
+	"context"
+	"regexp"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func (s *service) updateUser(ctx context.Context, email string, set bson.M) error {
+	collection := s.db.Database("paas").Collection("users")
+	set["updated_at"] = time.Now()
+	_, err := collection.UpdateOne(ctx, bson.M{"email": email}, bson.M{"$set": set})
+	return err
+}
+
+func (s *service) SetUserAdmin(ctx context.Context, email string, isAdmin bool) error {
+	return s.updateUser(ctx, email, bson.M{"is_admin": isAdmin})
+}
+
+// SetUserOIDCSubject links the user to an identity at the configured OIDC provider.
+func (s *service) SetUserOIDCSubject(ctx context.Context, email, subject string) error {
+	return s.updateUser(ctx, email, bson.M{"oidc_subject": subject})
+}
+
+// SetUserPassword stores a new password hash.
+func (s *service) SetUserPassword(ctx context.Context, email, passwordHash string) error {
+	return s.updateUser(ctx, email, bson.M{"password": passwordHash})
+}
+
+// IncrementFailedLogins counts a failed login and returns the number of consecutive failures.
+func (s *service) IncrementFailedLogins(ctx context.Context, email string) (int, error) {
+	collection := s.db.Database("paas").Collection("users")
+	var fields struct {
+		FailedLogins int `bson:"failed_logins"`
+	}
+	err := collection.FindOneAndUpdate(ctx,
+		bson.M{"email": email},
+		bson.M{"$inc": bson.M{"failed_logins": 1}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After).SetProjection(bson.M{"failed_logins": 1}),
+	).Decode(&fields)
+	return fields.FailedLogins, err
+}
+
+// LockUser locks the account until the given time and starts counting failures afresh.
+func (s *service) LockUser(ctx context.Context, email string, until time.Time) error {
+	collection := s.db.Database("paas").Collection("users")
+	_, err := collection.UpdateOne(ctx, bson.M{"email": email}, bson.M{
+		"$set": bson.M{"locked_until": until, "failed_logins": 0},
+		"$inc": bson.M{"lockouts": 1},
+	})
+	return err
+}
+
+// ResetLoginFailures clears failures, lockouts and any lock, after a successful login or an admin unlock.
+func (s *service) ResetLoginFailures(ctx context.Context, email string) error {
+	collection := s.db.Database("paas").Collection("users")
+	_, err := collection.UpdateOne(ctx, bson.M{"email": email}, bson.M{
+		"$set":   bson.M{"failed_logins": 0, "lockouts": 0},
+		"$unset": bson.M{"locked_until": ""},
+	})
+	return err
+}
+
+// userListFields is what GetUsers returns; the password hash never leaves the database.
+type userListFields struct {
+	ID          primitive.ObjectID `bson:"_id"`
+	Email       string             `bson:"email"`
+	IsAdmin     bool               `bson:"is_admin"`
+	OIDCSubject string             `bson:"oidc_subject"`
+	LockedUntil *time.Time         `bson:"locked_until"`
+	Disabled    bool               `bson:"disabled"`
+	Pending     bool               `bson:"pending_verification"`
+	TwoFactor   bool               `bson:"two_factor_enabled"`
+	CreatedAt   time.Time          `bson:"created_at"`
+	UpdatedAt   time.Time          `bson:"updated_at"`
+}
+
+// GetUsers lists users sorted by email, without their password hashes.
+func (s *service) GetUsers(ctx context.Context, opts GetUsersOptions) ([]models.User, int64, error) {
+	collection := s.db.Database("paas").Collection("users")
+
+	limit := opts.Limit
+	if limit <= 0 || limit > 50 {
+		limit = 50
+	}
+	filter := bson.M{}
+	if opts.Search != "" {
+		filter["email"] = bson.M{"$regex": regexp.QuoteMeta(opts.Search), "$options": "i"}
+	}
+	if opts.Email != "" {
+		filter["email"] = opts.Email
+	}
+
+	total, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, 0, err
+	}
+	findOpts := options.Find().
+		SetSort(bson.D{{Key: "email", Value: 1}}).
+		SetSkip(int64(opts.Skip)).
+		SetLimit(int64(limit)).
+		SetProjection(bson.M{"password": 0})
+	cursor, err := collection.Find(ctx, filter, findOpts)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer cursor.Close(ctx)
+
+	users := []models.User{}
+	for cursor.Next(ctx) {
+		var fields userListFields
+		if err := cursor.Decode(&fields); err != nil {
+			return nil, 0, err
+		}
+		users = append(users, models.User{
+			ID:          fields.ID,
+			Email:       fields.Email,
+			IsAdmin:     fields.IsAdmin,
+			OIDCSubject: fields.OIDCSubject,
+			LockedUntil: fields.LockedUntil,
+			Disabled:    fields.Disabled,
+
+			PendingVerification: fields.Pending,
+			TwoFactorEnabled:    fields.TwoFactor,
+			CreatedAt:           fields.CreatedAt,
+			UpdatedAt:           fields.UpdatedAt,
+		})
+	}
+	return users, total, cursor.Err()
+}
+
+func (s *service) SetUserDisabled(ctx context.Context, email string, disabled bool) error {
+	return s.updateUser(ctx, email, bson.M{"disabled": disabled})
+}
+
+// DeleteUser removes the user and everything that grants them access: role bindings, team
+// memberships, sessions, API tokens and 2FA enrolment. Without that, someone registering the
+// same email later would inherit them. It returns false if there was no such user.
+func (s *service) DeleteUser(ctx context.Context, email string) (bool, error) {
+	db := s.db.Database("paas")
+	res, err := db.Collection("users").DeleteOne(ctx, bson.M{"email": email})
+	if err != nil {
+		return false, err
+	}
+	if res.DeletedCount == 0 {
+		return false, nil
+	}
+
+	now := time.Now()
+	if _, err := db.Collection("role_bindings").DeleteMany(ctx, bson.M{"user_email": email}); err != nil {
+		return true, err
+	}
+	if _, err := db.Collection("teams").UpdateMany(ctx,
+		bson.M{"members.email": email},
+		bson.M{"$pull": bson.M{"members": bson.M{"email": email}}},
+	); err != nil {
+		return true, err
+	}
+	if _, err := db.Collection("sessions").UpdateMany(ctx,
+		bson.M{"user_email": email, "revoked_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revoked_at": now, "revoked_reason": "user deleted"}},
+	); err != nil {
+		return true, err
+	}
+	if _, err := db.Collection("api_tokens").UpdateMany(ctx,
+		bson.M{"user_email": email, "revoked_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revoked_at": now}},
+	); err != nil {
+		return true, err
+	}
+	_, err = db.Collection("two_factor").DeleteOne(ctx, bson.M{"_id": email})
+	return true, err
+}
+
+func (s *service) SetVerificationSent(ctx context.Context, email string, at time.Time) error {
+	return s.updateUser(ctx, email, bson.M{"verification_sent_at": at})
+}
+
+// SetUserVerified clears the pending verification flag. It returns false if the user was
+// not pending verification.
+func (s *service) SetUserVerified(ctx context.Context, email string) (bool, error) {
+	collection := s.db.Database("paas").Collection("users")
+	res, err := collection.UpdateOne(ctx,
+		bson.M{"email": email, "pending_verification": true},
+		bson.M{
+			"$unset": bson.M{"pending_verification": "", "verification_sent_at": ""},
+			"$set":   bson.M{"updated_at": time.Now()},
+		},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
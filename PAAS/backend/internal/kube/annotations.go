@@ -0,0 +1,59 @@
+package kube
+
+import (
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// annotationPrefix namespaces the annotations the backend stores on RedisFailovers.
+const annotationPrefix = "ryanpaas.stackit.gg/"
+
+const (
+	// AnnotationExpiresAt holds the RFC 3339 time after which the reaper deletes the instance.
+	AnnotationExpiresAt = annotationPrefix + "expires-at"
+	// AnnotationExpiryWarnedFor records the expiry value a warning was already sent for,
+	// so extending the TTL re-arms the warning.
+	AnnotationExpiryWarnedFor = annotationPrefix + "expiry-warned-for"
+
+	// AnnotationDeletionRequestedAt marks a soft-deleted instance; its RedisFailover is stored
+	// in the database with these annotations until it is undeleted or purged.
+	AnnotationDeletionRequestedAt = annotationPrefix + "deletion-requested-at"
+	// AnnotationDeletionRequestedBy records who (or "system") asked for the deletion.
+	AnnotationDeletionRequestedBy = annotationPrefix + "deletion-requested-by"
+	// AnnotationPurgeAt holds the RFC 3339 time after which a soft-deleted instance is removed for good.
+	AnnotationPurgeAt = annotationPrefix + "purge-at"
+
+	// AnnotationDeletionProtection is "true" while the instance must not be deleted.
+	AnnotationDeletionProtection = annotationPrefix + "deletion-protection"
+
+	// AnnotationMaintenanceWindow holds the instance's weekly maintenance window as JSON.
+	AnnotationMaintenanceWindow = annotationPrefix + "maintenance-window"
+
+	// AnnotationRequestID holds the X-Request-ID of the API request that created the instance
+	// or last changed it, so later service logs can refer back to it.
+	AnnotationRequestID = annotationPrefix + "request-id"
+)
+
+// SetAnnotation sets a single annotation on obj, keeping the existing ones.
+func SetAnnotation(obj *unstructured.Unstructured, key, value string) {
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[key] = value
+	obj.SetAnnotations(annotations)
+}
+
+// RemoveAnnotation deletes a single annotation from obj if it is set.
+func RemoveAnnotation(obj *unstructured.Unstructured, key string) {
+	annotations := obj.GetAnnotations()
+	if _, ok := annotations[key]; !ok {
+		return
+	}
+	delete(annotations, key)
+	obj.SetAnnotations(annotations)
+}
+
+// GetAnnotation returns the value of a single annotation, or "" if it is not set.
+func GetAnnotation(obj *unstructured.Unstructured, key string) string {
+	return obj.GetAnnotations()[key]
+}
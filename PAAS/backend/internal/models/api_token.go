@@ -0,0 +1,42 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// APITokenPrefix marks personal access tokens so the auth middleware can tell them from JWTs.
+const APITokenPrefix = "paas_pat_"
+
+// API token scopes. A token without scopes can do whatever its owner can, except manage tokens.
+const (
+	ScopeReadOnly       = "read-only"       // GET requests only
+	ScopeInstancesWrite = "instances:write" // reads plus creating, changing and deleting instances
+)
+
+// APIToken is a personal access token for automation. Only a hash of the secret is stored.
+type APIToken struct {
+	ID         primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Name       string             `json:"name" bson:"name"`
+	UserEmail  string             `json:"user_email" bson:"user_email"`
+	TokenHash  string             `json:"-" bson:"token_hash"`
+	Hint       string             `json:"hint" bson:"hint"` // last characters of the token, to tell tokens apart
+	Scopes     []string           `json:"scopes" bson:"scopes"`
+	TwoFactor  bool               `json:"two_factor" bson:"two_factor"` // copied from the session that created the token
+	CreatedAt  time.Time          `json:"created_at" bson:"created_at"`
+	ExpiresAt  time.Time          `json:"expires_at" bson:"expires_at"`
+	LastUsedAt *time.Time         `json:"last_used_at,omitempty" bson:"last_used_at,omitempty"`
+	RevokedAt  *time.Time         `json:"revoked_at,omitempty" bson:"revoked_at,omitempty"`
+}
+
+// Active reports whether the token may be used at now.
+func (t *APIToken) Active(now time.Time) bool {
+	return t.RevokedAt == nil && now.Before(t.ExpiresAt)
+}
+
+type CreateAPITokenRequest struct {
+	Name          string   `json:"name"`
+	ExpiresInDays int      `json:"expiresInDays"` // defaults to 30
+	Scopes        []string `json:"scopes"`
+}
@@ -1,11 +1,21 @@
 package models
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+// AuditLog is one audit trail entry. Entries form a hash chain: each has the next sequence
+// number and an HMAC over its contents and the previous entry's hash, so editing or deleting
+// an entry breaks the chain from there on. The HMAC key is not stored with the entries, so
+// write access to the database is not enough to re-hash the chain after an edit. Entries
+// written before the chain existed have no sequence number and are not part of it.
 type AuditLog struct {
 	ID            primitive.ObjectID `json:"id" bson:"_id,omitempty"`
 	UserEmail     string             `json:"user_email" bson:"user_email"`
@@ -16,8 +26,97 @@ type AuditLog struct {
 	RequestPath   string             `json:"request_path,omitempty" bson:"request_path,omitempty"`
 	ClientIP      string             `json:"client_ip,omitempty" bson:"client_ip,omitempty"`
 	UserAgent     string             `json:"user_agent,omitempty" bson:"user_agent,omitempty"`
+	TokenName     string             `json:"token_name,omitempty" bson:"token_name,omitempty"` // set when the request used a personal API token
+	RequestID     string             `json:"request_id,omitempty" bson:"request_id,omitempty"` // the request's X-Request-ID
+	Outcome       string             `json:"outcome,omitempty" bson:"outcome,omitempty"`       // AuditSuccess, AuditFailure or AuditDenied; empty on older entries
+	Error         string             `json:"error,omitempty" bson:"error,omitempty"`           // summary of the error the request failed with
+	Seq           int64              `json:"seq,omitempty" bson:"seq,omitempty"`
+	PrevHash      string             `json:"prev_hash,omitempty" bson:"prev_hash,omitempty"`
+	Hash          string             `json:"hash,omitempty" bson:"hash,omitempty"`
 }
 
+// auditHashInput is what an entry's hash covers. Fields added later must be omitempty, so
+// the hashes of entries written before them stay the same.
+type auditHashInput struct {
+	Seq           int64  `json:"seq"`
+	PrevHash      string `json:"prev_hash"`
+	UserEmail     string `json:"user_email"`
+	Action        Action `json:"action"`
+	AdminInfo     bool   `json:"admin_info"`
+	Timestamp     string `json:"timestamp"`
+	RequestMethod string `json:"request_method,omitempty"`
+	RequestPath   string `json:"request_path,omitempty"`
+	ClientIP      string `json:"client_ip,omitempty"`
+	UserAgent     string `json:"user_agent,omitempty"`
+	TokenName     string `json:"token_name,omitempty"`
+	Outcome       string `json:"outcome,omitempty"`
+	Error         string `json:"error,omitempty"`
+	RequestID     string `json:"request_id,omitempty"`
+}
+
+// ChainHash computes the entry's hash from its contents, Seq and PrevHash with key. The
+// timestamp is taken at the millisecond precision MongoDB stores, in UTC.
+func (l *AuditLog) ChainHash(key []byte) string {
+	payload, _ := json.Marshal(auditHashInput{
+		Seq:           l.Seq,
+		PrevHash:      l.PrevHash,
+		UserEmail:     l.UserEmail,
+		Action:        l.Action,
+		AdminInfo:     l.AdminInfo,
+		Timestamp:     l.Timestamp.UTC().Truncate(time.Millisecond).Format(time.RFC3339Nano),
+		RequestMethod: l.RequestMethod,
+		RequestPath:   l.RequestPath,
+		ClientIP:      l.ClientIP,
+		UserAgent:     l.UserAgent,
+		TokenName:     l.TokenName,
+		Outcome:       l.Outcome,
+		Error:         l.Error,
+		RequestID:     l.RequestID,
+	})
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Chain links the entry after prev (nil for the first entry) and sets its hash.
+func (l *AuditLog) Chain(prev *AuditLog, key []byte) {
+	l.Seq, l.PrevHash = 1, ""
+	if prev != nil {
+		l.Seq, l.PrevHash = prev.Seq+1, prev.Hash
+	}
+	l.Timestamp = l.Timestamp.UTC().Truncate(time.Millisecond)
+	l.Hash = l.ChainHash(key)
+}
+
+// AuditChainAnchorID is the _id of the single audit chain anchor document.
+const AuditChainAnchorID = "anchor"
+
+// AuditChainAnchor stands in for the audit entries the retention job purged: the oldest
+// remaining entry links to the last purged one, whose seq and hash are kept here. MAC covers
+// both with the chain's key, so the anchor cannot be moved to hide deleted entries as a purge.
+type AuditChainAnchor struct {
+	ID       string    `json:"-" bson:"_id"`
+	Seq      int64     `json:"seq" bson:"seq"`
+	Hash     string    `json:"hash" bson:"hash"`
+	MAC      string    `json:"-" bson:"mac"`
+	PurgedAt time.Time `json:"purged_at" bson:"purged_at"`
+}
+
+// AuditAnchorMAC authenticates an anchor at seq with hash under the chain's key.
+func AuditAnchorMAC(key []byte, seq int64, hash string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("audit-anchor\x00" + strconv.FormatInt(seq, 10) + "\x00" + hash))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Audit outcomes. A request is denied when it is answered with 401 or 403, and fails when
+// it is answered with any other error status.
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+	AuditDenied  = "denied"
+)
+
 type Action struct {
 	Action    string `json:"action" bson:"action"`
 	Name      string `json:"name" bson:"name"`
@@ -0,0 +1,21 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// DeletedInstance is a soft-deleted RedisFailover, kept until it is undeleted or purged.
+// The custom resource itself is deleted; this holds what is needed to recreate it.
+type DeletedInstance struct {
+	ID          primitive.ObjectID     `json:"id" bson:"_id,omitempty"`
+	Name        string                 `json:"name" bson:"name"`
+	Namespace   string                 `json:"namespace" bson:"namespace"`
+	Labels      map[string]string      `json:"labels,omitempty" bson:"labels,omitempty"`
+	Annotations map[string]string      `json:"annotations,omitempty" bson:"annotations,omitempty"` // include the deletion annotations
+	Spec        map[string]interface{} `json:"spec" bson:"spec"`
+	DeletedBy   string                 `json:"deleted_by" bson:"deleted_by"`
+	DeletedAt   time.Time              `json:"deleted_at" bson:"deleted_at"`
+	PurgeAt     time.Time              `json:"purge_at" bson:"purge_at"`
+}
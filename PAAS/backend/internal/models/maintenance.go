@@ -0,0 +1,107 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MaintenanceWindow is a weekly slot (in UTC) during which disruptive changes to an instance are applied.
+type MaintenanceWindow struct {
+	Day             string `json:"day" bson:"day"`                          // weekday, e.g. "sunday"
+	Start           string `json:"start" bson:"start"`                      // "HH:MM", UTC
+	DurationMinutes int    `json:"durationMinutes" bson:"duration_minutes"` // at most one week
+}
+
+// Pending change statuses.
+const (
+	PendingChangePending    = "pending"
+	PendingChangeApplied    = "applied"
+	PendingChangeFailed     = "failed"
+	PendingChangeSuperseded = "superseded" // replaced by a change applied immediately
+)
+
+// PendingChange is a disruptive change queued until the instance's maintenance window opens.
+type PendingChange struct {
+	ID               primitive.ObjectID     `json:"id" bson:"_id,omitempty"`
+	InstanceName     string                 `json:"instance_name" bson:"instance_name"`
+	Namespace        string                 `json:"namespace" bson:"namespace"`
+	RedisReplicas    *int                   `json:"redis_replicas,omitempty" bson:"redis_replicas,omitempty"`
+	SentinelReplicas *int                   `json:"sentinel_replicas,omitempty" bson:"sentinel_replicas,omitempty"`
+	Spec             map[string]interface{} `json:"spec,omitempty" bson:"spec,omitempty"` // the whole spec, for rollbacks
+	RequestedBy      string                 `json:"requested_by" bson:"requested_by"`
+	RequestedAt      time.Time              `json:"requested_at" bson:"requested_at"`
+	RequestID        string                 `json:"request_id,omitempty" bson:"request_id,omitempty"`
+	Status           string                 `json:"status" bson:"status"`
+	AppliedAt        *time.Time             `json:"applied_at,omitempty" bson:"applied_at,omitempty"`
+	Error            string                 `json:"error,omitempty" bson:"error,omitempty"`
+}
+
+// Describe renders the change for audit details and service log messages.
+func (p *PendingChange) Describe() string {
+	parts := make([]string, 0, 3)
+	if p.Spec != nil {
+		parts = append(parts, "spec: rolled back")
+	}
+	if p.RedisReplicas != nil {
+		parts = append(parts, fmt.Sprintf("redisReplicas: %d", *p.RedisReplicas))
+	}
+	if p.SentinelReplicas != nil {
+		parts = append(parts, fmt.Sprintf("sentinelReplicas: %d", *p.SentinelReplicas))
+	}
+	return strings.Join(parts, ", ")
+}
+
+var weekdays = map[string]time.Weekday{
+	"sunday":    time.Sunday,
+	"monday":    time.Monday,
+	"tuesday":   time.Tuesday,
+	"wednesday": time.Wednesday,
+	"thursday":  time.Thursday,
+	"friday":    time.Friday,
+	"saturday":  time.Saturday,
+}
+
+// Validate checks the window is a weekday, an HH:MM start and a duration of up to a week.
+func (w *MaintenanceWindow) Validate() error {
+	if _, ok := weekdays[strings.ToLower(w.Day)]; !ok {
+		return errors.New("maintenanceWindow.day must be a weekday such as \"sunday\"")
+	}
+	if _, err := time.Parse("15:04", w.Start); err != nil {
+		return errors.New("maintenanceWindow.start must be a UTC time in HH:MM format")
+	}
+	if w.DurationMinutes <= 0 || w.DurationMinutes > 7*24*60 {
+		return errors.New("maintenanceWindow.durationMinutes must be between 1 and 10080")
+	}
+	return nil
+}
+
+// lastStart returns the most recent window opening at or before t.
+func (w *MaintenanceWindow) lastStart(t time.Time) time.Time {
+	t = t.UTC()
+	start, _ := time.Parse("15:04", w.Start)
+	day := weekdays[strings.ToLower(w.Day)]
+
+	opening := time.Date(t.Year(), t.Month(), t.Day(), start.Hour(), start.Minute(), 0, 0, time.UTC)
+	opening = opening.AddDate(0, 0, -int((t.Weekday()-day+7)%7))
+	if opening.After(t) {
+		opening = opening.AddDate(0, 0, -7)
+	}
+	return opening
+}
+
+// Contains reports whether the window is open at t.
+func (w *MaintenanceWindow) Contains(t time.Time) bool {
+	return t.Before(w.lastStart(t).Add(time.Duration(w.DurationMinutes) * time.Minute))
+}
+
+// NextOpen returns when changes queued at t will be applied: t itself if the window is open.
+func (w *MaintenanceWindow) NextOpen(t time.Time) time.Time {
+	if w.Contains(t) {
+		return t
+	}
+	return w.lastStart(t).AddDate(0, 0, 7)
+}
@@ -0,0 +1,74 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Permissions checked by the API handlers.
+const (
+	PermInstancesRead   = "instances:read"
+	PermInstancesCreate = "instances:create"
+	PermInstancesUpdate = "instances:update" // TTL, maintenance window and deletion protection
+	PermInstancesScale  = "instances:scale"
+	PermInstancesDelete = "instances:delete" // also covers undelete
+	PermAuditRead       = "audit:read"
+)
+
+// Roles that can be bound to a user in a namespace.
+const (
+	RoleViewer        = "viewer"
+	RoleOperator      = "operator"
+	RoleOwner         = "owner"
+	RolePlatformAdmin = "platform-admin" // every permission in every namespace, plus the admin API
+)
+
+// AllNamespaces binds a role in every namespace. platform-admin can only be bound this way.
+const AllNamespaces = "*"
+
+var rolePermissions = map[string][]string{
+	RoleViewer:   {PermInstancesRead},
+	RoleOperator: {PermInstancesRead, PermInstancesScale, PermAuditRead},
+	RoleOwner: {PermInstancesRead, PermInstancesCreate, PermInstancesUpdate, PermInstancesScale,
+		PermInstancesDelete, PermAuditRead},
+	RolePlatformAdmin: {PermInstancesRead, PermInstancesCreate, PermInstancesUpdate, PermInstancesScale,
+		PermInstancesDelete, PermAuditRead},
+}
+
+// ValidRole reports whether role is one of the known roles.
+func ValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// RoleGrants reports whether role includes permission.
+func RoleGrants(role, permission string) bool {
+	for _, p := range rolePermissions[role] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// RoleBinding grants a user a role in one namespace, or in all of them.
+type RoleBinding struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	UserEmail string             `json:"user_email" bson:"user_email"`
+	Role      string             `json:"role" bson:"role"`
+	Namespace string             `json:"namespace" bson:"namespace"`
+	CreatedBy string             `json:"created_by,omitempty" bson:"created_by,omitempty"`
+	CreatedAt time.Time          `json:"created_at" bson:"created_at"`
+}
+
+// Covers reports whether the binding applies in namespace.
+func (b *RoleBinding) Covers(namespace string) bool {
+	return b.Namespace == AllNamespaces || b.Namespace == namespace
+}
+
+type CreateRoleBindingRequest struct {
+	UserEmail string `json:"userEmail"`
+	Role      string `json:"role"`
+	Namespace string `json:"namespace"`
+}
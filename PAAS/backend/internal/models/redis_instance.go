@@ -1,24 +1,32 @@
 package models
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
 	"strconv"
 	"time"
 
+	"backend/internal/kube"
+
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 )
 
 type RedisInstance struct {
-	ID               string    `json:"id" bson:"_id"`
-	Name             string    `json:"name" bson:"name"`
-	Namespace        string    `json:"namespace" bson:"namespace"`
-	RedisReplicas    int       `json:"redisReplicas" bson:"redis_replicas"`
-	SentinelReplicas int       `json:"sentinelReplicas" bson:"sentinel_replicas"`
-	Status           string    `json:"status" bson:"status"`
-	CreatedAt        time.Time `json:"createdAt" bson:"created_at"`
-	UpdatedAt        time.Time `json:"updatedAt" bson:"updated_at"`
+	ID               string     `json:"id" bson:"_id"`
+	Name             string     `json:"name" bson:"name"`
+	Namespace        string     `json:"namespace" bson:"namespace"`
+	RedisReplicas    int        `json:"redisReplicas" bson:"redis_replicas"`
+	SentinelReplicas int        `json:"sentinelReplicas" bson:"sentinel_replicas"`
+	Status           string     `json:"status" bson:"status"`
+	CreatedAt        time.Time  `json:"createdAt" bson:"created_at"`
+	UpdatedAt        time.Time  `json:"updatedAt" bson:"updated_at"`
+	ExpiresAt        *time.Time `json:"expiresAt,omitempty" bson:"expires_at,omitempty"`
+	PurgeAt          *time.Time `json:"purgeAt,omitempty" bson:"purge_at,omitempty"` // set while the instance is Deleting
+
+	DeletionProtection bool               `json:"deletionProtection" bson:"deletion_protection"`
+	MaintenanceWindow  *MaintenanceWindow `json:"maintenanceWindow,omitempty" bson:"maintenance_window,omitempty"`
 
 	ExternalHost string `json:"externalHost,omitempty" bson:"-"`
 	ExternalPort int    `json:"externalPort,omitempty" bson:"-"`
@@ -26,10 +34,16 @@ type RedisInstance struct {
 }
 
 type CreateInstanceRequest struct {
-	Name             string `json:"name" bson:"name"`
-	Namespace        string `json:"namespace" bson:"namespace"`
-	RedisReplicas    int    `json:"redisReplicas" bson:"redis_replicas"`
-	SentinelReplicas int    `json:"sentinelReplicas" bson:"sentinel_replicas"`
+	Name             string     `json:"name" bson:"name"`
+	Namespace        string     `json:"namespace" bson:"namespace"`
+	Team             string     `json:"team,omitempty" bson:"team,omitempty"` // team slug; creates the instance in the team's namespace
+	RedisReplicas    int        `json:"redisReplicas" bson:"redis_replicas"`
+	SentinelReplicas int        `json:"sentinelReplicas" bson:"sentinel_replicas"`
+	TTL              string     `json:"ttl,omitempty" bson:"ttl,omitempty"`              // Go duration, e.g. "72h"; takes precedence over expiresAt
+	ExpiresAt        *time.Time `json:"expiresAt,omitempty" bson:"expires_at,omitempty"` // absolute expiry time
+
+	DeletionProtection bool               `json:"deletionProtection,omitempty" bson:"deletion_protection,omitempty"`
+	MaintenanceWindow  *MaintenanceWindow `json:"maintenanceWindow,omitempty" bson:"maintenance_window,omitempty"`
 }
 
 type DeleteInstanceRequest struct {
@@ -37,9 +51,22 @@ type DeleteInstanceRequest struct {
 }
 
 type UpdateInstanceRequest struct {
-	Namespace        *string `json:"namespace,omitempty" bson:"namespace,omitempty"`
-	RedisReplicas    *int    `json:"redisReplicas,omitempty" bson:"redis_replicas,omitempty"`
-	SentinelReplicas *int    `json:"sentinelReplicas,omitempty" bson:"sentinel_replicas,omitempty"`
+	Namespace        *string    `json:"namespace,omitempty" bson:"namespace,omitempty"`
+	RedisReplicas    *int       `json:"redisReplicas,omitempty" bson:"redis_replicas,omitempty"`
+	SentinelReplicas *int       `json:"sentinelReplicas,omitempty" bson:"sentinel_replicas,omitempty"`
+	TTL              *string    `json:"ttl,omitempty" bson:"ttl,omitempty"`              // extends the expiry to now + ttl
+	ExpiresAt        *time.Time `json:"expiresAt,omitempty" bson:"expires_at,omitempty"` // moves the expiry to an absolute time
+
+	// DeletionProtection can only be changed on its own, so clearing it is a separate audited call.
+	DeletionProtection *bool `json:"deletionProtection,omitempty" bson:"deletion_protection,omitempty"`
+
+	// MaintenanceWindow replaces the instance's window; an empty day clears it. Replica changes
+	// requested outside the window are queued unless applyImmediately=true is passed.
+	MaintenanceWindow *MaintenanceWindow `json:"maintenanceWindow,omitempty" bson:"maintenance_window,omitempty"`
+
+	// Spec replaces the whole spec. Only rollbacks set it; they pass its replica counts as
+	// RedisReplicas and SentinelReplicas too, so those are validated like a PATCH.
+	Spec map[string]interface{} `json:"-" bson:"-"`
 }
 
 func (r *RedisInstance) GetConnectionInfo(portOverride int) error {
@@ -91,7 +118,32 @@ func (r *RedisInstance) ConvertUnstructuredToRedisInstace(item *unstructured.Uns
 		}
 	}
 
+	r.ExpiresAt = nil
+	if v := kube.GetAnnotation(item, kube.AnnotationExpiresAt); v != "" {
+		if t, err := time.Parse(time.RFC3339, v); err == nil {
+			r.ExpiresAt = &t
+		}
+	}
+
 	r.Status = extractStatusFromUnstructured(item)
+
+	r.DeletionProtection = kube.GetAnnotation(item, kube.AnnotationDeletionProtection) == "true"
+
+	r.MaintenanceWindow = nil
+	if v := kube.GetAnnotation(item, kube.AnnotationMaintenanceWindow); v != "" {
+		var window MaintenanceWindow
+		if err := json.Unmarshal([]byte(v), &window); err == nil {
+			r.MaintenanceWindow = &window
+		}
+	}
+
+	r.PurgeAt = nil
+	if v := kube.GetAnnotation(item, kube.AnnotationPurgeAt); v != "" {
+		r.Status = "Deleting"
+		if t, err := time.Parse(time.RFC3339, v); err == nil {
+			r.PurgeAt = &t
+		}
+	}
 }
 
 func extractStatusFromUnstructured(item *unstructured.Unstructured) string {
@@ -0,0 +1,91 @@
+package models
+
+import (
+	"reflect"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// SpecRevision is a numbered snapshot of a RedisFailover spec as it was applied.
+type SpecRevision struct {
+	ID           primitive.ObjectID     `json:"id" bson:"_id,omitempty"`
+	InstanceName string                 `json:"instance_name" bson:"instance_name"`
+	Namespace    string                 `json:"namespace" bson:"namespace"`
+	Revision     int                    `json:"revision" bson:"revision"`
+	Spec         map[string]interface{} `json:"spec" bson:"spec"`
+	Source       string                 `json:"source" bson:"source"` // create, update, maintenance or rollback
+	AppliedBy    string                 `json:"applied_by" bson:"applied_by"`
+	AppliedAt    time.Time              `json:"applied_at" bson:"applied_at"`
+}
+
+// SpecChange is one field that differs between two specs, addressed by its dotted path.
+type SpecChange struct {
+	Path string      `json:"path"`
+	From interface{} `json:"from,omitempty"`
+	To   interface{} `json:"to,omitempty"`
+}
+
+// DiffSpecs returns the leaf fields that differ between from and to, sorted by path.
+func DiffSpecs(from, to map[string]interface{}) []SpecChange {
+	changes := []SpecChange{}
+	diffValues("", from, to, &changes)
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes
+}
+
+func diffValues(path string, from, to interface{}, changes *[]SpecChange) {
+	fromMap, fromIsMap := from.(map[string]interface{})
+	toMap, toIsMap := to.(map[string]interface{})
+	if fromIsMap && toIsMap {
+		for k, v := range fromMap {
+			diffValues(joinPath(path, k), v, toMap[k], changes)
+		}
+		for k, v := range toMap {
+			if _, ok := fromMap[k]; !ok {
+				diffValues(joinPath(path, k), nil, v, changes)
+			}
+		}
+		return
+	}
+	if !reflect.DeepEqual(from, to) {
+		*changes = append(*changes, SpecChange{Path: path, From: from, To: to})
+	}
+}
+
+func joinPath(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+// ReplicasFromSpec reads the replica counts the API manages out of a stored spec.
+func ReplicasFromSpec(spec map[string]interface{}) (redisReplicas, sentinelReplicas *int) {
+	if redis, ok := spec["redis"].(map[string]interface{}); ok {
+		if n, ok := toInt(redis["replicas"]); ok {
+			redisReplicas = &n
+		}
+	}
+	if sentinel, ok := spec["sentinel"].(map[string]interface{}); ok {
+		if n, ok := toInt(sentinel["replicas"]); ok {
+			sentinelReplicas = &n
+		}
+	}
+	return redisReplicas, sentinelReplicas
+}
+
+func toInt(v interface{}) (int, bool) {
+	switch n := v.(type) {
+	case int64:
+		return int(n), true
+	case int32:
+		return int(n), true
+	case int:
+		return n, true
+	case float64:
+		return int(n), true
+	}
+	return 0, false
+}
@@ -15,6 +15,7 @@ type ServiceLog struct {
 	ToStatus     string             `json:"to_status" bson:"to_status"`
 	Message      string             `json:"message" bson:"message"`
 	Details      string             `json:"details,omitempty" bson:"details,omitempty"`
+	RequestID    string             `json:"request_id,omitempty" bson:"request_id,omitempty"` // the API request that led to this event, if any
 	Timestamp    time.Time          `json:"timestamp" bson:"timestamp"`
 }
 
@@ -0,0 +1,29 @@
+package models
+
+import "time"
+
+// Session is one login. Its ID is the jti of every access token issued for it, and it holds
+// the hash of the current refresh token, which is replaced on every refresh.
+type Session struct {
+	ID               string     `json:"id" bson:"_id"`
+	UserEmail        string     `json:"user_email" bson:"user_email"`
+	RefreshTokenHash string     `json:"-" bson:"refresh_token_hash"`
+	ClientIP         string     `json:"client_ip,omitempty" bson:"client_ip,omitempty"`   // where the user logged in from
+	UserAgent        string     `json:"user_agent,omitempty" bson:"user_agent,omitempty"` // of the login request
+	TwoFactor        bool       `json:"two_factor" bson:"two_factor"`                     // the login passed a second factor
+	CreatedAt        time.Time  `json:"created_at" bson:"created_at"`
+	LastUsedAt       *time.Time `json:"last_used_at,omitempty" bson:"last_used_at,omitempty"` // updated at most once a minute
+	ExpiresAt        time.Time  `json:"expires_at" bson:"expires_at"`                         // when the current refresh token stops working
+	RevokedAt        *time.Time `json:"revoked_at,omitempty" bson:"revoked_at,omitempty"`
+	RevokedReason    string     `json:"revoked_reason,omitempty" bson:"revoked_reason,omitempty"`
+	Current          bool       `json:"current,omitempty" bson:"-"` // set when listing: the session making the request
+}
+
+// Active reports whether tokens of this session may still be used at now.
+func (s *Session) Active(now time.Time) bool {
+	return s.RevokedAt == nil && now.Before(s.ExpiresAt)
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
@@ -0,0 +1,46 @@
+package models
+
+import "time"
+
+// SettingsID is the _id of the single platform settings document.
+const SettingsID = "platform"
+
+// Settings holds platform-wide options that admins can change at runtime.
+type Settings struct {
+	ID                  string `json:"-" bson:"_id"`
+	MaxInstanceTTLHours int    `json:"max_instance_ttl_hours" bson:"max_instance_ttl_hours"` // 0 = no limit; applies to non-admins only
+	RequireAdmin2FA     bool   `json:"require_admin_2fa" bson:"require_admin_2fa"`           // admins with a password act as regular users until they enable 2FA
+
+	AuditLogRetentionDays   int  `json:"audit_log_retention_days" bson:"audit_log_retention_days"`     // 0 = keep forever
+	ServiceLogRetentionDays int  `json:"service_log_retention_days" bson:"service_log_retention_days"` // 0 = keep forever
+	ArchiveLogs             bool `json:"archive_logs" bson:"archive_logs"`                             // archive entries before they are purged
+
+	UpdatedAt time.Time `json:"updated_at" bson:"updated_at"`
+	UpdatedBy string    `json:"updated_by,omitempty" bson:"updated_by,omitempty"`
+}
+
+type UpdateSettingsRequest struct {
+	MaxInstanceTTLHours *int  `json:"max_instance_ttl_hours,omitempty"`
+	RequireAdmin2FA     *bool `json:"require_admin_2fa,omitempty"`
+
+	AuditLogRetentionDays   *int  `json:"audit_log_retention_days,omitempty"`
+	ServiceLogRetentionDays *int  `json:"service_log_retention_days,omitempty"`
+	ArchiveLogs             *bool `json:"archive_logs,omitempty"`
+}
+
+// MaxInstanceTTL returns the maximum TTL for non-admin instances, or 0 if there is no limit.
+func (s *Settings) MaxInstanceTTL() time.Duration {
+	if s == nil || s.MaxInstanceTTLHours <= 0 {
+		return 0
+	}
+	return time.Duration(s.MaxInstanceTTLHours) * time.Hour
+}
+
+// RetentionCutoff returns the time before which entries kept for days are purged, or the
+// zero time if they are kept forever.
+func RetentionCutoff(now time.Time, days int) time.Time {
+	if days <= 0 {
+		return time.Time{}
+	}
+	return now.AddDate(0, 0, -days)
+}
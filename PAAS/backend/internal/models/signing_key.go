@@ -0,0 +1,20 @@
+package models
+
+import "time"
+
+// Access token signing algorithms.
+const (
+	SigningRS256 = "RS256"
+	SigningEdDSA = "EdDSA"
+)
+
+// SigningKey is a key pair for signing access tokens. The newest key signs; older ones
+// only verify, until ExpiresAt, by when every token they signed has expired.
+type SigningKey struct {
+	ID         string     `json:"kid" bson:"_id"`
+	Algorithm  string     `json:"alg" bson:"algorithm"`
+	PrivateKey []byte     `json:"-" bson:"private_key"` // PKCS #8, sealed with a key derived from SECRETS_KEY
+	PublicKey  []byte     `json:"-" bson:"public_key"`  // PKIX
+	CreatedAt  time.Time  `json:"created_at" bson:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty" bson:"expires_at,omitempty"` // set once a newer key takes over
+}
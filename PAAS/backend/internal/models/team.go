@@ -0,0 +1,100 @@
+package models
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TeamNamespacePrefix is prepended to a team's slug to form its namespace.
+const TeamNamespacePrefix = "team-"
+
+// Team is a group of users sharing one namespace. Members hold a role in that namespace
+// (viewer, operator or owner) exactly as if they had a role binding for it.
+type Team struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Name      string             `json:"name" bson:"name"`
+	Slug      string             `json:"slug" bson:"slug"`
+	Namespace string             `json:"namespace" bson:"namespace"`
+	Members   []TeamMember       `json:"members" bson:"members"`
+	CreatedBy string             `json:"created_by" bson:"created_by"`
+	CreatedAt time.Time          `json:"created_at" bson:"created_at"`
+}
+
+type TeamMember struct {
+	Email   string    `json:"email" bson:"email"`
+	Role    string    `json:"role" bson:"role"`
+	AddedBy string    `json:"added_by,omitempty" bson:"added_by,omitempty"`
+	AddedAt time.Time `json:"added_at" bson:"added_at"`
+}
+
+// NormalizeMemberEmail is the form in which member emails are stored and looked up. Emails
+// are matched regardless of case, since users do not always register with the same casing
+// their teammates type.
+func NormalizeMemberEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// Member returns the member with email, or nil.
+func (t *Team) Member(email string) *TeamMember {
+	email = NormalizeMemberEmail(email)
+	for i := range t.Members {
+		if NormalizeMemberEmail(t.Members[i].Email) == email {
+			return &t.Members[i]
+		}
+	}
+	return nil
+}
+
+// OwnerCount returns how many members are owners.
+func (t *Team) OwnerCount() int {
+	n := 0
+	for _, m := range t.Members {
+		if m.Role == RoleOwner {
+			n++
+		}
+	}
+	return n
+}
+
+// ValidTeamRole reports whether role can be given to a team member.
+func ValidTeamRole(role string) bool {
+	return role == RoleViewer || role == RoleOperator || role == RoleOwner
+}
+
+var slugInvalid = regexp.MustCompile(`[^a-z0-9]+`)
+
+// TeamSlug derives a team's slug from its name. The slug must fit in a Kubernetes namespace
+// name once TeamNamespacePrefix is added.
+func TeamSlug(name string) (string, error) {
+	slug := strings.Trim(slugInvalid.ReplaceAllString(strings.ToLower(name), "-"), "-")
+	if slug == "" {
+		return "", errors.New("team name must contain letters or digits")
+	}
+	if len(TeamNamespacePrefix)+len(slug) > 63 {
+		return "", errors.New("team name is too long")
+	}
+	// Personal namespaces always contain "-at-", from the "@" of the owner's email, so a
+	// team namespace must not: team "acme-at-x-io" would own the namespace of team-acme@x.io.
+	if strings.Contains(TeamNamespace(slug), "-at-") {
+		return "", errors.New(`team name must not contain the word "at"`)
+	}
+	return slug, nil
+}
+
+// TeamNamespace returns the namespace of the team with slug.
+func TeamNamespace(slug string) string {
+	return TeamNamespacePrefix + slug
+}
+
+type CreateTeamRequest struct {
+	Name string `json:"name"`
+}
+
+type TeamMemberRequest struct {
+	Email string `json:"email"`
+	Role  string `json:"role"`
+}
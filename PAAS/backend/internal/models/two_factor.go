@@ -0,0 +1,32 @@
+package models
+
+import "time"
+
+// TwoFactor is a user's TOTP (RFC 6238) enrolment, kept apart from the user document. It
+// exists unconfirmed from enrolment until the user proves their authenticator works; only
+// then is User.TwoFactorEnabled set and the second step required at login.
+type TwoFactor struct {
+	UserEmail     string     `json:"user_email" bson:"_id"`
+	Secret        []byte     `json:"-" bson:"secret"`                                      // sealed with a key derived from SECRETS_KEY
+	RecoveryCodes []string   `json:"-" bson:"recovery_codes,omitempty"`                    // hashes of the unused codes
+	LastStep      int64      `json:"-" bson:"last_step"`                                   // newest time step accepted, so a code works once
+	ConfirmedAt   *time.Time `json:"confirmed_at,omitempty" bson:"confirmed_at,omitempty"` // nil while enrolment is pending
+	CreatedAt     time.Time  `json:"created_at" bson:"created_at"`
+}
+
+type TwoFactorCodeRequest struct {
+	Code string `json:"code"`
+}
+
+type DisableTwoFactorRequest struct {
+	Password string `json:"password"`
+	Code     string `json:"code"` // a TOTP or recovery code
+}
+
+// TwoFactorLoginRequest is the second login step: the challenge token from the first step
+// and either a TOTP code or one of the recovery codes.
+type TwoFactorLoginRequest struct {
+	ChallengeToken string `json:"challenge_token"`
+	Code           string `json:"code"`
+	RecoveryCode   string `json:"recovery_code"`
+}
@@ -8,12 +8,24 @@ import (
 )
 
 type User struct {
-	ID        primitive.ObjectID `json:"id" bson:"_id"`
-	Email     string             `json:"email" bson:"email"`
-	Password  string             `json:"password" bson:"password"`
-	IsAdmin   bool               `json:"is_admin" bson:"is_admin"`
-	CreatedAt time.Time          `json:"created_at" bson:"created_at"`
-	UpdatedAt time.Time          `json:"updated_at" bson:"updated_at"`
+	ID          primitive.ObjectID `json:"id" bson:"_id"`
+	Email       string             `json:"email" bson:"email"`
+	Password    string             `json:"password" bson:"password"`
+	IsAdmin     bool               `json:"is_admin" bson:"is_admin"`
+	OIDCSubject string             `json:"oidc_subject,omitempty" bson:"oidc_subject,omitempty"` // subject at the SSO provider; SSO-created users have no password
+	// Login throttling: consecutive failures, lockouts since the last successful login, and
+	// the end of the current lock.
+	FailedLogins int        `json:"failed_logins,omitempty" bson:"failed_logins,omitempty"`
+	Lockouts     int        `json:"lockouts,omitempty" bson:"lockouts,omitempty"`
+	LockedUntil  *time.Time `json:"locked_until,omitempty" bson:"locked_until,omitempty"`
+	Disabled     bool       `json:"disabled,omitempty" bson:"disabled,omitempty"` // set by an admin; refused at login and on every request
+	// Self-registered users cannot log in until they follow the link sent to their address.
+	PendingVerification bool       `json:"pending_verification,omitempty" bson:"pending_verification,omitempty"`
+	VerificationSentAt  *time.Time `json:"-" bson:"verification_sent_at,omitempty"`
+	TwoFactorEnabled    bool       `json:"two_factor_enabled,omitempty" bson:"two_factor_enabled,omitempty"` // password logins need a TOTP or recovery code
+
+	CreatedAt time.Time `json:"created_at" bson:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" bson:"updated_at"`
 }
 
 type RegisterRequest struct {
@@ -21,6 +33,50 @@ type RegisterRequest struct {
 	Password string `json:"password"`
 }
 
+// UserInfo is a user as shown to admins: everything but the password hash.
+type UserInfo struct {
+	ID          primitive.ObjectID `json:"id"`
+	Email       string             `json:"email"`
+	IsAdmin     bool               `json:"is_admin"`
+	Disabled    bool               `json:"disabled"`
+	Unverified  bool               `json:"unverified,omitempty"` // has not followed the verification link yet
+	SSO         bool               `json:"sso"`                  // linked to a single sign-on identity
+	TwoFactor   bool               `json:"two_factor"`
+	LockedUntil *time.Time         `json:"locked_until,omitempty"`
+	CreatedAt   time.Time          `json:"created_at"`
+	UpdatedAt   time.Time          `json:"updated_at"`
+}
+
+func (u *User) Info() UserInfo {
+	return UserInfo{
+		ID:          u.ID,
+		Email:       u.Email,
+		IsAdmin:     u.IsAdmin,
+		Disabled:    u.Disabled,
+		Unverified:  u.PendingVerification,
+		SSO:         u.OIDCSubject != "",
+		TwoFactor:   u.TwoFactorEnabled,
+		LockedUntil: u.LockedUntil,
+		CreatedAt:   u.CreatedAt,
+		UpdatedAt:   u.UpdatedAt,
+	}
+}
+
+type ResendVerificationRequest struct {
+	Email string `json:"email"`
+}
+
+type VerifyEmailRequest struct {
+	Email string `json:"email"`
+	Token string `json:"token"`
+}
+
+// UpdateUserRequest is an admin change to a user; nil fields are left alone.
+type UpdateUserRequest struct {
+	IsAdmin  *bool `json:"is_admin"`
+	Disabled *bool `json:"disabled"`
+}
+
 type RegisterResponse struct {
 	Message string `json:"message"`
 	User    User   `json:"user"`
@@ -0,0 +1,132 @@
+// Package policy holds the rules self-registered accounts must satisfy: password strength
+// and which email addresses may sign up.
+package policy
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"net/mail"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+//go:embed common_passwords.txt
+var commonPasswordList string
+
+var commonPasswords = loadCommonPasswords()
+
+func loadCommonPasswords() map[string]bool {
+	set := map[string]bool{}
+	scanner := bufio.NewScanner(strings.NewReader(commonPasswordList))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			set[line] = true
+		}
+	}
+	return set
+}
+
+// Character classes a password policy can require.
+const (
+	ClassUpper  = "upper"
+	ClassLower  = "lower"
+	ClassDigit  = "digit"
+	ClassSymbol = "symbol"
+)
+
+// PasswordPolicy is the set of rules a new password must satisfy. The zero value accepts
+// any password.
+type PasswordPolicy struct {
+	MinLength      int
+	RequireClasses []string // any of ClassUpper, ClassLower, ClassDigit, ClassSymbol
+	RejectCommon   bool     // reject passwords on the built-in common/breached list
+}
+
+// Check returns every rule password breaks, as messages suitable for the user; none means
+// the password is acceptable. email is used to reject passwords that merely repeat it.
+func (p PasswordPolicy) Check(password, email string) []string {
+	var problems []string
+	if n := utf8.RuneCountInString(password); n < p.MinLength {
+		problems = append(problems, fmt.Sprintf("must be at least %d characters long", p.MinLength))
+	}
+	if len(password) > 72 {
+		// bcrypt ignores everything after 72 bytes.
+		problems = append(problems, "must be at most 72 bytes long")
+	}
+
+	var hasUpper, hasLower, hasDigit, hasSymbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		default:
+			hasSymbol = true
+		}
+	}
+	for _, class := range p.RequireClasses {
+		switch {
+		case class == ClassUpper && !hasUpper:
+			problems = append(problems, "must contain an upper-case letter")
+		case class == ClassLower && !hasLower:
+			problems = append(problems, "must contain a lower-case letter")
+		case class == ClassDigit && !hasDigit:
+			problems = append(problems, "must contain a digit")
+		case class == ClassSymbol && !hasSymbol:
+			problems = append(problems, "must contain a symbol")
+		}
+	}
+
+	if p.RejectCommon {
+		lower := strings.ToLower(password)
+		local, _, _ := strings.Cut(strings.ToLower(email), "@")
+		if commonPasswords[lower] {
+			problems = append(problems, "is too common; choose a less predictable password")
+		} else if local != "" && (lower == local || lower == strings.ToLower(email)) {
+			problems = append(problems, "must not be your email address")
+		}
+	}
+	return problems
+}
+
+// ValidClass reports whether class is a known character class.
+func ValidClass(class string) bool {
+	switch class {
+	case ClassUpper, ClassLower, ClassDigit, ClassSymbol:
+		return true
+	}
+	return false
+}
+
+// CheckEmail validates the syntax of a bare email address (no display name) and, when
+// allowedDomains is not empty, that its domain is one of them.
+func CheckEmail(email string, allowedDomains []string) []string {
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || addr.Name != "" {
+		return []string{"must be a valid email address such as name@example.com"}
+	}
+	if len(email) > 254 {
+		return []string{"must be at most 254 characters long"}
+	}
+	_, domain, _ := strings.Cut(email, "@")
+	domain = strings.ToLower(domain)
+	if !strings.Contains(domain, ".") || strings.HasPrefix(domain, ".") || strings.HasSuffix(domain, ".") {
+		return []string{"must be a valid email address such as name@example.com"}
+	}
+
+	if len(allowedDomains) == 0 {
+		return nil
+	}
+	for _, allowed := range allowedDomains {
+		if domain == strings.ToLower(allowed) {
+			return nil
+		}
+	}
+	return []string{"registration is limited to addresses at " + strings.Join(allowedDomains, ", ")}
+}
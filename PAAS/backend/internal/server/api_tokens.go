@@ -0,0 +1,126 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"backend/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	defaultAPITokenDays = 30
+	maxAPITokenDays     = 365
+)
+
+func (s *Server) createAPITokenHandler(c *gin.Context) {
+	var req models.CreateAPITokenRequest
+	if err := c.ShouldBindBodyWithJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "invalid request body",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name is required"})
+		return
+	}
+	if req.ExpiresInDays == 0 {
+		req.ExpiresInDays = defaultAPITokenDays
+	}
+	if req.ExpiresInDays < 0 || req.ExpiresInDays > maxAPITokenDays {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expiresInDays must be between 1 and 365"})
+		return
+	}
+	scopes := []string{}
+	for _, scope := range req.Scopes {
+		if scope != models.ScopeReadOnly && scope != models.ScopeInstancesWrite {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "unknown scope " + scope + "; valid scopes are " + models.ScopeReadOnly + " and " + models.ScopeInstancesWrite,
+			})
+			return
+		}
+		scopes = append(scopes, scope)
+	}
+
+	secret, err := randomToken(32)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
+		return
+	}
+	raw := models.APITokenPrefix + secret
+
+	now := time.Now()
+	token := &models.APIToken{
+		Name:      req.Name,
+		UserEmail: c.GetString("user_email"),
+		TokenHash: hashToken(raw),
+		Hint:      raw[len(raw)-4:],
+		Scopes:    scopes,
+		TwoFactor: c.GetBool("two_factor_ok"),
+		CreatedAt: now,
+		ExpiresAt: now.AddDate(0, 0, req.ExpiresInDays),
+	}
+	if err := s.db.CreateAPIToken(c.Request.Context(), token); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to create api token",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	details := "scopes: " + strings.Join(scopes, ",") + ", expiresAt: " + token.ExpiresAt.UTC().Format(time.RFC3339)
+	s.logAudit(c, token.UserEmail, models.Action{Action: "create_token", Name: token.Name, Details: details}, false)
+	c.JSON(http.StatusCreated, gin.H{
+		"message":  "api token created; store it now, it will not be shown again",
+		"token":    raw,
+		"apiToken": token,
+	})
+}
+
+func (s *Server) getAPITokensHandler(c *gin.Context) {
+	tokens, err := s.db.GetAPITokens(c.Request.Context(), c.GetString("user_email"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to get api tokens",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"tokens": tokens,
+		"count":  len(tokens),
+	})
+}
+
+func (s *Server) revokeAPITokenHandler(c *gin.Context) {
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid token id"})
+		return
+	}
+
+	email := c.GetString("user_email")
+	revoked, err := s.db.RevokeAPIToken(c.Request.Context(), id, email)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to revoke api token",
+			"details": err.Error(),
+		})
+		return
+	}
+	if !revoked {
+		c.JSON(http.StatusNotFound, gin.H{"error": "api token not found or already revoked"})
+		return
+	}
+
+	s.logAudit(c, email, models.Action{Action: "revoke_token", Details: "token id: " + id.Hex()}, false)
+	c.JSON(http.StatusOK, gin.H{"message": "api token revoked"})
+}
@@ -1,17 +1,52 @@
 package server
 
 import (
+	"context"
 	"log"
+	"net/http"
+	"strings"
 	"time"
 
+	"backend/internal/database"
 	"backend/internal/models"
 
 	"github.com/gin-gonic/gin"
 )
 
+// systemActor is the user_email recorded for actions the backend takes on its own.
+const systemActor = "system"
+
 // logAudit writes an audit log entry to MongoDB. It does not fail the request on error.
+// Behind AuditMiddleware the entry is held until the handler returns, so that it records
+// the request's outcome.
 func (s *Server) logAudit(c *gin.Context, userEmail string, action models.Action, adminInfo bool) {
-	entry := models.AuditLog{
+	s.recordAudit(c, requestAuditEntry(c, userEmail, action, adminInfo))
+}
+
+// logAuditError is logAudit for a request that failed after its response status was sent,
+// e.g. an export cut off mid-stream: the entry records err instead of the status's outcome.
+func (s *Server) logAuditError(c *gin.Context, userEmail string, action models.Action, adminInfo bool, err error) {
+	entry := requestAuditEntry(c, userEmail, action, adminInfo)
+	entry.Outcome, entry.Error = models.AuditFailure, truncateAuditError(err.Error())
+	s.recordAudit(c, entry)
+}
+
+func (s *Server) recordAudit(c *gin.Context, entry models.AuditLog) {
+	if record, ok := c.Get(auditRecordKey); ok {
+		record.(*auditRecord).entries = append(record.(*auditRecord).entries, entry)
+		return
+	}
+	if entry.Outcome == "" {
+		entry.Outcome = auditOutcome(c.Writer.Status())
+	}
+	if err := s.db.InsertAuditLog(c.Request.Context(), &entry); err != nil {
+		log.Printf("[audit] failed to write audit log: %v", err)
+	}
+}
+
+// requestAuditEntry is an audit entry for action with the details of the request.
+func requestAuditEntry(c *gin.Context, userEmail string, action models.Action, adminInfo bool) models.AuditLog {
+	return models.AuditLog{
 		UserEmail:     userEmail,
 		Action:        action,
 		AdminInfo:     adminInfo,
@@ -20,8 +55,79 @@ func (s *Server) logAudit(c *gin.Context, userEmail string, action models.Action
 		RequestPath:   c.FullPath(),
 		ClientIP:      c.ClientIP(),
 		UserAgent:     c.Request.UserAgent(),
+		TokenName:     c.GetString("auth_token_name"),
+		RequestID:     c.GetString("request_id"),
 	}
-	if err := s.db.InsertAuditLog(c.Request.Context(), &entry); err != nil {
-		log.Printf("[audit] failed to write audit log: %v", err)
+}
+
+// logSystemAudit writes an audit log entry for background jobs (e.g. the expiry reaper),
+// which have no request to take the method, path and client details from.
+func (s *Server) logSystemAudit(ctx context.Context, action models.Action) {
+	entry := models.AuditLog{
+		UserEmail: systemActor,
+		Action:    action,
+		AdminInfo: false,
+		Timestamp: time.Now(),
+		Outcome:   models.AuditSuccess,
+	}
+	if err := s.db.InsertAuditLog(ctx, &entry); err != nil {
+		log.Printf("[audit] failed to write system audit log: %v", err)
+	}
+}
+
+// timeRangeQuery reads the optional from and to query parameters. On a bad value it writes
+// a 400 and returns false.
+func timeRangeQuery(c *gin.Context) (from, to *time.Time, ok bool) {
+	for _, bound := range []struct {
+		param string
+		dest  **time.Time
+	}{{"from", &from}, {"to", &to}} {
+		value := strings.TrimSpace(c.Query(bound.param))
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": bound.param + " must be an RFC 3339 timestamp, e.g. 2024-05-01T00:00:00Z",
+			})
+			return nil, nil, false
+		}
+		*bound.dest = &t
+	}
+	if from != nil && to != nil && !from.Before(*to) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from must be before to"})
+		return nil, nil, false
+	}
+	return from, to, true
+}
+
+// auditLogFilters reads the audit log filters from the query string into opts. On a bad
+// value it writes a 400 (or a 403 for an admin-only filter) and returns false.
+func auditLogFilters(c *gin.Context, isAdmin bool, opts *database.GetAuditLogsOptions) bool {
+	var ok bool
+	if opts.From, opts.To, ok = timeRangeQuery(c); !ok {
+		return false
+	}
+
+	opts.UserEmail = strings.TrimSpace(c.Query("user_email"))
+	if opts.UserEmail != "" && !isAdmin {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only admins can filter by user_email"})
+		return false
+	}
+	opts.ActionType = strings.TrimSpace(c.Query("type"))
+	opts.IncludeAdminOnly = c.Query("admin_only") == "true" && isAdmin
+	opts.InstanceName = strings.TrimSpace(c.Query("instance"))
+	opts.Namespace = strings.TrimSpace(c.Query("namespace"))
+	opts.ClientIP = strings.TrimSpace(c.Query("client_ip"))
+	opts.RequestID = strings.TrimSpace(c.Query("request_id"))
+	opts.Outcome = strings.TrimSpace(c.Query("outcome"))
+	switch opts.Outcome {
+	case "", models.AuditSuccess, models.AuditFailure, models.AuditDenied:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "outcome must be success, failure or denied"})
+		return false
 	}
+	opts.Search = strings.TrimSpace(c.Query("search"))
+	return true
 }
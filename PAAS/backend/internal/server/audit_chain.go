@@ -0,0 +1,105 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"backend/internal/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errChainBroken stops the walk over the audit chain at the first broken link.
+var errChainBroken = errors.New("audit chain broken")
+
+// auditChainReport is the result of checking the audit hash chain.
+type auditChainReport struct {
+	Valid         bool   `json:"valid"`
+	Checked       int64  `json:"checked"`                  // entries checked, up to and including a broken one
+	PurgedThrough int64  `json:"purged_through,omitempty"` // entries up to this seq were purged by the retention job
+	FirstSeq      int64  `json:"first_seq,omitempty"`
+	LastSeq       int64  `json:"last_seq,omitempty"`
+	LastHash      string `json:"last_hash,omitempty"` // worth noting down elsewhere: a later check proves nothing before it changed
+	BrokenAt      int64  `json:"broken_at,omitempty"` // seq of the first entry whose link does not hold
+	Problem       string `json:"problem,omitempty"`
+}
+
+// verifyAuditChain walks the chain in sequence order and stops at the first entry that was
+// changed, or that follows a changed or missing entry. Deleting entries from the very end
+// leaves a valid, shorter chain, which only a LastHash recorded elsewhere reveals. After a
+// purge the chain starts at the anchor, which stands in for the last purged entry.
+func (s *Server) verifyAuditChain(ctx context.Context) (*auditChainReport, error) {
+	anchor, err := s.db.GetAuditChainAnchor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	report := &auditChainReport{Valid: true}
+	var prev *models.AuditLog
+	if anchor != nil {
+		if !hmac.Equal([]byte(anchor.MAC), []byte(models.AuditAnchorMAC(s.auditChainKey, anchor.Seq, anchor.Hash))) {
+			report.Valid, report.BrokenAt = false, anchor.Seq
+			report.Problem = "the anchor left by the last purge was changed"
+			return report, nil
+		}
+		report.PurgedThrough = anchor.Seq
+		prev = &models.AuditLog{Seq: anchor.Seq, Hash: anchor.Hash}
+	}
+	err = s.db.WalkAuditChain(ctx, func(entry *models.AuditLog) error {
+		if anchor != nil && entry.Seq <= anchor.Seq {
+			return nil // left over from a purge that was cut short
+		}
+		report.Checked++
+		problem := ""
+		switch {
+		case prev == nil && entry.Seq != 1:
+			problem = fmt.Sprintf("entries 1 to %d are missing", entry.Seq-1)
+		case prev == nil && entry.PrevHash != "":
+			problem = "the first entry links to a previous one"
+		case prev != nil && entry.Seq != prev.Seq+1:
+			problem = fmt.Sprintf("entries %d to %d are missing", prev.Seq+1, entry.Seq-1)
+		case prev != nil && entry.PrevHash != prev.Hash && prev.Seq == report.PurgedThrough:
+			problem = fmt.Sprintf("the entry does not link to the last purged entry %d", prev.Seq)
+		case prev != nil && entry.PrevHash != prev.Hash:
+			problem = fmt.Sprintf("entry %d was changed: its hash does not match this entry's prev_hash", prev.Seq)
+		case !hmac.Equal([]byte(entry.Hash), []byte(entry.ChainHash(s.auditChainKey))):
+			problem = "the entry's contents do not match its hash"
+		}
+		if problem != "" {
+			report.Valid, report.BrokenAt, report.Problem = false, entry.Seq, problem
+			return errChainBroken
+		}
+
+		if report.FirstSeq == 0 {
+			report.FirstSeq = entry.Seq
+		}
+		report.LastSeq, report.LastHash = entry.Seq, entry.Hash
+		prev = entry
+		return nil
+	})
+	if err != nil && !errors.Is(err, errChainBroken) {
+		return nil, err
+	}
+	return report, nil
+}
+
+// verifyAuditLogsHandler checks that no audit entry was edited or deleted behind the API's back.
+func (s *Server) verifyAuditLogsHandler(c *gin.Context) {
+	report, err := s.verifyAuditChain(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to verify audit logs",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	details := fmt.Sprintf("valid, %d entries up to seq %d", report.Checked, report.LastSeq)
+	if !report.Valid {
+		details = fmt.Sprintf("broken at seq %d: %s", report.BrokenAt, report.Problem)
+	}
+	s.logAudit(c, c.GetString("user_email"), models.Action{Action: "verify_audit_logs", Details: details}, true)
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+
+	"backend/internal/database"
+	"backend/internal/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// roleBindings returns the bindings that apply to the current user: the stored ones, one per
+// team membership, and two implicit ones kept from the original access model, namely owner
+// of the user's personal namespace and, for users with is_admin, platform-admin everywhere.
+// Platform-admin bindings are dropped while the platform requires 2FA for admins and the
+// user has not enabled it. They are loaded once per request.
+func (s *Server) roleBindings(c *gin.Context) ([]models.RoleBinding, error) {
+	if cached, ok := c.Get("role_bindings"); ok {
+		return cached.([]models.RoleBinding), nil
+	}
+
+	email := c.GetString("user_email")
+	bindings := []models.RoleBinding{{UserEmail: email, Role: models.RoleOwner, Namespace: emailToNamespace(email)}}
+	if c.GetBool("user_is_admin") {
+		bindings = append(bindings, models.RoleBinding{UserEmail: email, Role: models.RolePlatformAdmin, Namespace: models.AllNamespaces})
+	}
+	if email != "" {
+		stored, err := s.db.GetRoleBindings(c.Request.Context(), database.GetRoleBindingsOptions{UserEmail: email})
+		if err != nil {
+			return nil, err
+		}
+		bindings = append(bindings, stored...)
+
+		teams, err := s.userTeams(c)
+		if err != nil {
+			return nil, err
+		}
+		for _, team := range teams {
+			if member := team.Member(email); member != nil {
+				bindings = append(bindings, models.RoleBinding{UserEmail: email, Role: member.Role, Namespace: team.Namespace})
+			}
+		}
+	}
+
+	bindings, err := s.dropAdminWithout2FA(c, bindings)
+	if err != nil {
+		return nil, err
+	}
+	c.Set("role_bindings", bindings)
+	return bindings, nil
+}
+
+// dropAdminWithout2FA removes platform-admin bindings if the user lacks the 2FA the platform
+// requires of admins, and notes that in the context for AdminMiddleware's error.
+func (s *Server) dropAdminWithout2FA(c *gin.Context, bindings []models.RoleBinding) ([]models.RoleBinding, error) {
+	admin := false
+	for _, b := range bindings {
+		admin = admin || b.Role == models.RolePlatformAdmin
+	}
+	if !admin {
+		return bindings, nil
+	}
+	missing, err := s.adminTwoFactorMissing(c)
+	if err != nil || !missing {
+		return bindings, err
+	}
+
+	kept := bindings[:0]
+	for _, b := range bindings {
+		if b.Role != models.RolePlatformAdmin {
+			kept = append(kept, b)
+		}
+	}
+	c.Set("admin_2fa_required", true)
+	return kept, nil
+}
+
+// userTeams returns the teams the current user is a member of, loaded once per request.
+func (s *Server) userTeams(c *gin.Context) ([]models.Team, error) {
+	if cached, ok := c.Get("teams"); ok {
+		return cached.([]models.Team), nil
+	}
+	teams, err := s.db.GetTeams(c.Request.Context(), models.NormalizeMemberEmail(c.GetString("user_email")))
+	if err != nil {
+		return nil, err
+	}
+	c.Set("teams", teams)
+	return teams, nil
+}
+
+// can reports whether the current user holds permission in namespace.
+func (s *Server) can(c *gin.Context, permission, namespace string) (bool, error) {
+	bindings, err := s.roleBindings(c)
+	if err != nil {
+		return false, err
+	}
+	for _, b := range bindings {
+		if b.Covers(namespace) && models.RoleGrants(b.Role, permission) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// authorize is the check every handler runs before touching a namespace. On failure it has
+// already written the error response and the handler must return.
+func (s *Server) authorize(c *gin.Context, permission, namespace string) bool {
+	ok, err := s.can(c, permission, namespace)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to load role bindings",
+			"details": err.Error(),
+		})
+		return false
+	}
+	if !ok {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "permission " + permission + " required in namespace " + namespace,
+		})
+		return false
+	}
+	return true
+}
+
+// isPlatformAdmin reports whether the current user is bound to platform-admin. Errors loading
+// bindings count as not being one.
+func (s *Server) isPlatformAdmin(c *gin.Context) bool {
+	bindings, err := s.roleBindings(c)
+	if err != nil {
+		return false
+	}
+	for _, b := range bindings {
+		if b.Role == models.RolePlatformAdmin && b.Namespace == models.AllNamespaces {
+			return true
+		}
+	}
+	return false
+}
+
+// requestNamespace returns the namespace a request targets: the namespace query parameter,
+// the namespace of the team query parameter, or by default "default" for platform admins
+// and the personal namespace for everyone else.
+func (s *Server) requestNamespace(c *gin.Context) string {
+	if namespace := c.Query("namespace"); namespace != "" {
+		return namespace
+	}
+	if team := c.Query("team"); team != "" {
+		return models.TeamNamespace(team)
+	}
+	if s.isPlatformAdmin(c) {
+		return "default"
+	}
+	return emailToNamespace(c.GetString("user_email"))
+}
+
+// namespacesWith returns the namespaces in which the current user holds permission. all is
+// true when a binding covers every namespace, in which case the list is not meaningful.
+func (s *Server) namespacesWith(c *gin.Context, permission string) (all bool, namespaces []string, err error) {
+	bindings, err := s.roleBindings(c)
+	if err != nil {
+		return false, nil, err
+	}
+	seen := map[string]bool{}
+	for _, b := range bindings {
+		if !models.RoleGrants(b.Role, permission) {
+			continue
+		}
+		if b.Namespace == models.AllNamespaces {
+			return true, nil, nil
+		}
+		if !seen[b.Namespace] {
+			seen[b.Namespace] = true
+			namespaces = append(namespaces, b.Namespace)
+		}
+	}
+	sort.Strings(namespaces)
+	return false, namespaces, nil
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"backend/internal/models"
+	"backend/internal/policy"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// commandActor is the user_email recorded for changes made with the cmd/api subcommands.
+const commandActor = "cli"
+
+// logCommandAudit writes an admin-only audit entry for a maintenance command.
+func (s *Server) logCommandAudit(ctx context.Context, action models.Action) {
+	entry := models.AuditLog{
+		UserEmail: commandActor,
+		Action:    action,
+		AdminInfo: true,
+		Timestamp: time.Now(),
+		Outcome:   models.AuditSuccess,
+	}
+	if err := s.db.InsertAuditLog(ctx, &entry); err != nil {
+		log.Printf("[audit] failed to write command audit log: %v", err)
+	}
+}
+
+func (s *Server) checkPassword(password, email string) error {
+	if problems := s.passwordPolicy.Check(password, email); len(problems) > 0 {
+		return fmt.Errorf("password %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// UserExists reports whether there is a user with this email.
+func (s *Server) UserExists(ctx context.Context, email string) (bool, error) {
+	user, err := s.db.FindUserByEmail(ctx, strings.TrimSpace(email))
+	return user != nil, err
+}
+
+// CreateAdmin promotes the user with this email to admin, or creates them as an admin with
+// the given password if they do not exist yet. It reports whether a user was created. The
+// registration domain allowlist does not apply, but the password policy does.
+func (s *Server) CreateAdmin(ctx context.Context, email, password string) (bool, error) {
+	email = strings.TrimSpace(email)
+	user, err := s.db.FindUserByEmail(ctx, email)
+	if err != nil {
+		return false, err
+	}
+
+	if user != nil {
+		if user.IsAdmin {
+			return false, nil
+		}
+		if err := s.db.SetUserAdmin(ctx, email, true); err != nil {
+			return false, err
+		}
+		s.logCommandAudit(ctx, models.Action{Action: "promote_admin", Details: "user: " + email})
+		return false, nil
+	}
+
+	if problems := policy.CheckEmail(email, nil); len(problems) > 0 {
+		return false, fmt.Errorf("email %s", strings.Join(problems, "; "))
+	}
+	if password == "" {
+		return false, errors.New("a password is required to create a new user")
+	}
+	if err := s.checkPassword(password, email); err != nil {
+		return false, err
+	}
+	now := time.Now()
+	user = &models.User{
+		ID:        primitive.NewObjectID(),
+		Email:     email,
+		Password:  password,
+		IsAdmin:   true,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := user.HashPassword(); err != nil {
+		return false, err
+	}
+	if err := s.db.Register(user, ctx); err != nil {
+		return false, err
+	}
+	s.logCommandAudit(ctx, models.Action{Action: "create_admin", Details: "user: " + email})
+	return true, nil
+}
+
+// ResetPassword sets a user's password, revokes their sessions and API tokens and lifts any
+// login lockout.
+func (s *Server) ResetPassword(ctx context.Context, email, password string) error {
+	user, err := s.db.FindUserByEmail(ctx, email)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return fmt.Errorf("no user with email %s", email)
+	}
+	if err := s.checkPassword(password, email); err != nil {
+		return err
+	}
+
+	sessions, tokens, err := s.setPassword(ctx, email, password)
+	if err != nil {
+		return err
+	}
+	if err := s.db.ResetLoginFailures(ctx, email); err != nil {
+		return err
+	}
+	s.logCommandAudit(ctx, models.Action{Action: "reset_password", Details: fmt.Sprintf("user: %s, %d sessions and %d API tokens revoked", email, sessions, tokens)})
+	return nil
+}
+
+// ResealSecrets seals the signing keys and TOTP secrets still sealed under
+// SECRETS_KEY_PREVIOUS again under SECRETS_KEY, the step that finishes a rotation of
+// SECRETS_KEY (see New). It returns how many it resealed, and fails if any secret opens
+// with neither key, after resealing the rest.
+func (s *Server) ResealSecrets(ctx context.Context) (int, error) {
+	if s.oldSecretsKey == "" {
+		return 0, errors.New("SECRETS_KEY_PREVIOUS is not set; there is nothing to reseal")
+	}
+	resealed, unreadable := 0, 0
+
+	keyBox, err := newSigningKeyBox(s.secretsKey, s.oldSecretsKey)
+	if err != nil {
+		return 0, err
+	}
+	keys, err := s.db.GetSigningKeys(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for _, key := range keys {
+		privateDER, stale, err := keyBox.open(key.PrivateKey, []byte(key.ID))
+		if err != nil {
+			log.Printf("[keys] cannot open signing key %s: %v", key.ID, err)
+			unreadable++
+			continue
+		}
+		if !stale {
+			continue
+		}
+		sealed, err := keyBox.seal(privateDER, []byte(key.ID))
+		if err != nil {
+			return resealed, err
+		}
+		if ok, err := s.db.ResealSigningKey(ctx, key.ID, key.PrivateKey, sealed); err != nil {
+			return resealed, err
+		} else if ok {
+			resealed++
+		}
+	}
+
+	totpBox, err := s.twoFactorBox()
+	if err != nil {
+		return resealed, err
+	}
+	enrolments, err := s.db.GetTwoFactors(ctx)
+	if err != nil {
+		return resealed, err
+	}
+	for _, tf := range enrolments {
+		secret, stale, err := totpBox.open(tf.Secret, []byte(tf.UserEmail))
+		if err != nil {
+			log.Printf("[2fa] cannot open the totp secret of %s: %v", tf.UserEmail, err)
+			unreadable++
+			continue
+		}
+		if !stale {
+			continue
+		}
+		sealed, err := totpBox.seal(secret, []byte(tf.UserEmail))
+		if err != nil {
+			return resealed, err
+		}
+		if ok, err := s.db.ResealTwoFactorSecret(ctx, tf.UserEmail, tf.Secret, sealed); err != nil {
+			return resealed, err
+		} else if ok {
+			resealed++
+		}
+	}
+
+	s.logCommandAudit(ctx, models.Action{Action: "reseal_secrets", Details: fmt.Sprintf("%d secrets resealed, %d unreadable", resealed, unreadable)})
+	if unreadable > 0 {
+		return resealed, fmt.Errorf("%d secrets open with neither SECRETS_KEY nor SECRETS_KEY_PREVIOUS", unreadable)
+	}
+	return resealed, nil
+}
+
+// Reconcile runs one pass of the status sync that the server otherwise runs periodically.
+func (s *Server) Reconcile(ctx context.Context) {
+	s.runStatusSyncOnce(ctx)
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"backend/internal/kube"
+	"backend/internal/models"
+
+	"github.com/gin-gonic/gin"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+var errNotPendingDeletion = errors.New("instance is not pending deletion")
+
+// softDeleteInstance marks obj as Deleting instead of removing it for good: the resource is
+// stored in the database with the deletion annotations and then deleted, and the purge is
+// scheduled after the grace period. Scaling to zero is not enough, because the operator
+// treats zero replicas as unset and scales the instance back up. Data on persistent storage
+// outlives the resource only if its storage sets keepAfterDeletion.
+func (s *Server) softDeleteInstance(ctx context.Context, obj *unstructured.Unstructured, actor, reason string) (time.Time, error) {
+	spec, _, _ := unstructured.NestedMap(obj.Object, "spec")
+	now := time.Now()
+	purgeAt := now.Add(s.deleteGracePeriod)
+	kube.SetAnnotation(obj, kube.AnnotationDeletionRequestedAt, now.UTC().Format(time.RFC3339))
+	kube.SetAnnotation(obj, kube.AnnotationDeletionRequestedBy, actor)
+	kube.SetAnnotation(obj, kube.AnnotationPurgeAt, purgeAt.UTC().Format(time.RFC3339))
+	setRequestIDAnnotation(ctx, obj)
+
+	deleted := &models.DeletedInstance{
+		Name:        obj.GetName(),
+		Namespace:   obj.GetNamespace(),
+		Labels:      obj.GetLabels(),
+		Annotations: obj.GetAnnotations(),
+		Spec:        spec,
+		DeletedBy:   actor,
+		DeletedAt:   now,
+		PurgeAt:     purgeAt,
+	}
+	if err := s.db.InsertDeletedInstance(ctx, deleted); err != nil {
+		return time.Time{}, fmt.Errorf("store deleted instance: %w", err)
+	}
+	if err := s.kubeClient.Resource(kube.RedisFailOver).Namespace(obj.GetNamespace()).Delete(ctx, obj.GetName(), v1.DeleteOptions{}); err != nil {
+		// The instance is still running, so it must not show up as pending deletion too.
+		if _, rmErr := s.db.DeleteDeletedInstance(ctx, deleted.Name, deleted.Namespace); rmErr != nil {
+			log.Printf("[deletion] remove stored copy of %s/%s: %v", deleted.Namespace, deleted.Name, rmErr)
+		}
+		return time.Time{}, err
+	}
+
+	svcLog := &models.ServiceLog{
+		InstanceName: obj.GetName(),
+		Namespace:    obj.GetNamespace(),
+		EventType:    "deletion_scheduled",
+		ToStatus:     "Deleting",
+		Message:      reason + "; RedisFailover deleted, spec kept until the purge at " + purgeAt.UTC().Format(time.RFC3339),
+		RequestID:    requestIDFrom(ctx),
+		Timestamp:    now,
+	}
+	_ = s.db.InsertServiceLog(ctx, svcLog)
+	return purgeAt, nil
+}
+
+// deletedInstanceObject rebuilds the RedisFailover a soft delete removed, deletion
+// annotations included.
+func deletedInstanceObject(deleted *models.DeletedInstance) (*unstructured.Unstructured, error) {
+	obj := kube.BuildRedisFailover(deleted.Name, deleted.Namespace, 0, 0)
+	if err := unstructured.SetNestedMap(obj.Object, deleted.Spec, "spec"); err != nil {
+		return nil, err
+	}
+	obj.SetLabels(deleted.Labels)
+	obj.SetAnnotations(deleted.Annotations)
+	return obj, nil
+}
+
+// deletedInstanceView is how a soft-deleted instance is listed: with status Deleting and its purge time.
+func deletedInstanceView(deleted *models.DeletedInstance) models.RedisInstance {
+	var instance models.RedisInstance
+	if obj, err := deletedInstanceObject(deleted); err == nil {
+		instance.ConvertUnstructuredToRedisInstace(obj)
+	}
+	instance.Name, instance.Namespace, instance.ID = deleted.Name, deleted.Namespace, deleted.Name
+	instance.Status = "Deleting"
+	purgeAt := deleted.PurgeAt
+	instance.PurgeAt = &purgeAt
+	return instance
+}
+
+// restoredInstanceObject is the RedisFailover an undelete recreates: the deleted one without
+// the deletion annotations.
+func restoredInstanceObject(deleted *models.DeletedInstance) (*unstructured.Unstructured, error) {
+	obj, err := deletedInstanceObject(deleted)
+	if err != nil {
+		return nil, fmt.Errorf("restore spec: %w", err)
+	}
+	kube.RemoveAnnotation(obj, kube.AnnotationDeletionRequestedAt)
+	kube.RemoveAnnotation(obj, kube.AnnotationDeletionRequestedBy)
+	kube.RemoveAnnotation(obj, kube.AnnotationPurgeAt)
+	return obj, nil
+}
+
+// instanceNotFound answers a request for an instance whose RedisFailover does not exist:
+// 409 if it is pending deletion, 404 otherwise.
+func (s *Server) instanceNotFound(c *gin.Context, name, namespace string, getErr error) {
+	deleted, err := s.db.GetDeletedInstance(c.Request.Context(), name, namespace)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to get deleted instance",
+			"details": err.Error(),
+		})
+		return
+	}
+	if deleted != nil {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":   "instance is pending deletion; undelete it first",
+			"purgeAt": deleted.PurgeAt,
+		})
+		return
+	}
+	c.JSON(http.StatusNotFound, gin.H{
+		"error":   "instance not found",
+		"details": getErr.Error(),
+	})
+}
+
+// setDeletionProtection stores the deletion protection flag on obj; clearing it drops the annotation.
+func setDeletionProtection(obj *unstructured.Unstructured, enabled bool) {
+	if enabled {
+		kube.SetAnnotation(obj, kube.AnnotationDeletionProtection, "true")
+		return
+	}
+	kube.RemoveAnnotation(obj, kube.AnnotationDeletionProtection)
+}
+
+// purgeInstance removes a soft-deleted instance for good once its grace period is over.
+func (s *Server) purgeInstance(ctx context.Context, deleted *models.DeletedInstance) error {
+	removed, err := s.db.DeleteDeletedInstance(ctx, deleted.Name, deleted.Namespace)
+	if err != nil || !removed {
+		// Not removed means it was undeleted in the meantime.
+		return err
+	}
+
+	svcLog := &models.ServiceLog{
+		InstanceName: deleted.Name,
+		Namespace:    deleted.Namespace,
+		EventType:    "purged",
+		FromStatus:   "Deleting",
+		ToStatus:     "Deleted",
+		Message:      "Instance purged after the deletion grace period",
+		Timestamp:    time.Now(),
+	}
+	_ = s.db.InsertServiceLog(ctx, svcLog)
+
+	details := "requestedBy: " + deleted.DeletedBy +
+		", requestedAt: " + deleted.DeletedAt.UTC().Format(time.RFC3339)
+	s.logSystemAudit(ctx, models.Action{
+		Action:    "purge",
+		Name:      deleted.Name,
+		Namespace: deleted.Namespace,
+		Details:   details,
+	})
+	return nil
+}
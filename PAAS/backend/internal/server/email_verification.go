@@ -0,0 +1,173 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"backend/internal/mail"
+	"backend/internal/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// verificationResendInterval is the least time between two verification emails to one address.
+const verificationResendInterval = time.Minute
+
+var (
+	errNoMailer            = errors.New("no mailer is configured")
+	errVerificationInvalid = errors.New("invalid verification token")
+	errVerificationExpired = errors.New("verification link expired; request a new one")
+)
+
+// verificationMAC signs the user's ID and email with the expiry, so a link only verifies
+// the account it was sent for, and not a later account registered with the same address.
+func (s *Server) verificationMAC(user *models.User, expires string) string {
+	mac := hmac.New(sha256.New, []byte(s.jwtSecret))
+	mac.Write([]byte("verify-email\x00" + user.ID.Hex() + "\x00" + user.Email + "\x00" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verificationToken returns "<expiry unix>.<mac>"; it needs no database state.
+func (s *Server) verificationToken(user *models.User, expiresAt time.Time) string {
+	expires := strconv.FormatInt(expiresAt.Unix(), 10)
+	return expires + "." + s.verificationMAC(user, expires)
+}
+
+func (s *Server) checkVerificationToken(user *models.User, token string) error {
+	expires, sig, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(s.verificationMAC(user, expires))) {
+		return errVerificationInvalid
+	}
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return errVerificationInvalid
+	}
+	if time.Now().After(time.Unix(unix, 0)) {
+		return errVerificationExpired
+	}
+	return nil
+}
+
+// sendVerificationEmail mails a fresh verification link to user. The send is only recorded,
+// which starts the resend interval, once the mailer has accepted the message.
+func (s *Server) sendVerificationEmail(c *gin.Context, user *models.User) error {
+	if s.mailer == nil {
+		return errNoMailer
+	}
+	now := time.Now()
+	expiresAt := now.Add(s.emailVerificationTTL)
+	msg := s.verificationMessage(user.Email, s.verificationToken(user, expiresAt), expiresAt)
+	if err := s.mailer.Send(c.Request.Context(), msg); err != nil {
+		log.Printf("[mail] failed to send verification email to %s: %v", msg.To, err)
+		return err
+	}
+
+	if err := s.db.SetVerificationSent(c.Request.Context(), user.Email, now); err != nil {
+		log.Printf("[mail] failed to record verification email to %s: %v", user.Email, err)
+	}
+	s.logAudit(c, user.Email, models.Action{Action: "send_verification", Details: "expires at " + expiresAt.UTC().Format(time.RFC3339)}, true)
+	return nil
+}
+
+func (s *Server) verificationMessage(email, token string, expiresAt time.Time) mail.Message {
+	var body strings.Builder
+	body.WriteString("Welcome! Please confirm that " + email + " is your address.\n\n")
+	if link, err := url.Parse(s.emailVerificationURL); err == nil && s.emailVerificationURL != "" {
+		query := link.Query()
+		query.Set("email", email)
+		query.Set("token", token)
+		link.RawQuery = query.Encode()
+		body.WriteString("Open this link to verify it:\n\n" + link.String() + "\n\n")
+	} else {
+		body.WriteString("Your verification token is:\n\n" + token + "\n\n")
+	}
+	body.WriteString("The link expires at " + expiresAt.UTC().Format(time.RFC1123) + ".\n")
+	body.WriteString("If you did not sign up, you can ignore this email.\n")
+	return mail.Message{To: email, Subject: "Verify your email address", Body: body.String()}
+}
+
+func (s *Server) verifyEmailHandler(c *gin.Context) {
+	var req models.VerifyEmailRequest
+	if err := c.ShouldBindBodyWithJSON(&req); err != nil || req.Email == "" || req.Token == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "email and token are required"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	user, err := s.db.FindUserByEmail(ctx, req.Email)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to look up user",
+			"details": err.Error(),
+		})
+		return
+	}
+	if user == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": errVerificationInvalid.Error()})
+		return
+	}
+	if !user.PendingVerification {
+		c.JSON(http.StatusOK, gin.H{"message": "email already verified"})
+		return
+	}
+	if err := s.checkVerificationToken(user, req.Token); err != nil {
+		s.logAudit(c, user.Email, models.Action{Action: "verify_email_failed", Details: "reason: " + err.Error()}, true)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, err := s.db.SetUserVerified(ctx, user.Email); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to verify email",
+			"details": err.Error(),
+		})
+		return
+	}
+	s.logAudit(c, user.Email, models.Action{Action: "verify_email"}, true)
+	c.JSON(http.StatusOK, gin.H{"message": "email verified; you can log in now"})
+}
+
+// resendVerificationHandler sends a new link to an unverified account. Like the password
+// reset request, it answers the same whether or not the address has an account.
+func (s *Server) resendVerificationHandler(c *gin.Context) {
+	var req models.ResendVerificationRequest
+	if err := c.ShouldBindBodyWithJSON(&req); err != nil || strings.TrimSpace(req.Email) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "email is required"})
+		return
+	}
+
+	accepted := gin.H{"message": "if the address belongs to an unverified account, a new link has been sent"}
+	user, err := s.db.FindUserByEmail(c.Request.Context(), strings.TrimSpace(req.Email))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to look up user",
+			"details": err.Error(),
+		})
+		return
+	}
+	if user == nil || !user.PendingVerification {
+		c.JSON(http.StatusAccepted, accepted)
+		return
+	}
+	if user.VerificationSentAt != nil && time.Since(*user.VerificationSentAt) < verificationResendInterval {
+		c.JSON(http.StatusAccepted, accepted)
+		return
+	}
+
+	if err := s.sendVerificationEmail(c, user); err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{
+			"error":   "failed to send verification email",
+			"details": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusAccepted, accepted)
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"backend/internal/kube"
+	"backend/internal/models"
+
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const reaperPollSeconds = 60
+
+// resolveExpiry works out when an instance should expire from a requested ttl or
+// absolute expiresAt (ttl wins if both are set). Non-admins are bound by maxTTL,
+// which also becomes their expiry when they don't ask for one. A nil result means
+// the instance never expires.
+func resolveExpiry(now time.Time, ttl string, expiresAt *time.Time, maxTTL time.Duration, isAdmin bool) (*time.Time, error) {
+	var expiry *time.Time
+	if ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil {
+			return nil, fmt.Errorf("ttl must be a duration such as \"24h\" or \"90m\"")
+		}
+		if d <= 0 {
+			return nil, errors.New("ttl must be greater than 0")
+		}
+		t := now.Add(d)
+		expiry = &t
+	} else if expiresAt != nil {
+		if !expiresAt.After(now) {
+			return nil, errors.New("expiresAt must be in the future")
+		}
+		t := *expiresAt
+		expiry = &t
+	}
+
+	if isAdmin || maxTTL <= 0 {
+		return expiry, nil
+	}
+	limit := now.Add(maxTTL)
+	if expiry == nil {
+		return &limit, nil
+	}
+	if expiry.After(limit) {
+		return nil, fmt.Errorf("expiry exceeds the maximum TTL of %s for non-admin users", maxTTL)
+	}
+	return expiry, nil
+}
+
+// setExpiryAnnotation stores expiry on the RedisFailover in the format the reaper reads back.
+func setExpiryAnnotation(obj *unstructured.Unstructured, expiry *time.Time) {
+	if expiry == nil {
+		return
+	}
+	kube.SetAnnotation(obj, kube.AnnotationExpiresAt, expiry.UTC().Format(time.RFC3339))
+}
+
+// RunInstanceReaper periodically deletes expired instances, warns their owners ahead of time
+// and purges soft-deleted instances whose grace period is over.
+func (s *Server) RunInstanceReaper(ctx context.Context) {
+	ticker := time.NewTicker(reaperPollSeconds * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.reapInstancesOnce(ctx)
+		}
+	}
+}
+
+func (s *Server) reapInstancesOnce(ctx context.Context) {
+	list, err := s.listAllRedisFailovers(ctx)
+	if err != nil {
+		log.Printf("[reaper] ERROR list redis failovers: %v", err)
+		return
+	}
+
+	now := time.Now()
+	numReaped, numPurged := 0, 0
+	for i := range list.Items {
+		item := &list.Items[i]
+		var instance models.RedisInstance
+		instance.ConvertUnstructuredToRedisInstace(item)
+
+		// Protected instances outlive their TTL until the flag is cleared.
+		if instance.ExpiresAt == nil || instance.DeletionProtection {
+			continue
+		}
+
+		if !now.Before(*instance.ExpiresAt) {
+			if err := s.expireInstance(ctx, item, instance); err != nil {
+				log.Printf("[reaper] expire %s/%s: %v", instance.Namespace, instance.Name, err)
+				continue
+			}
+			numReaped++
+			continue
+		}
+
+		if s.expiryWarning > 0 && instance.ExpiresAt.Sub(now) <= s.expiryWarning {
+			if err := s.warnInstanceExpiry(ctx, item, instance); err != nil {
+				log.Printf("[reaper] warn %s/%s: %v", instance.Namespace, instance.Name, err)
+			}
+		}
+	}
+
+	deleted, err := s.db.GetDeletedInstances(ctx, nil)
+	if err != nil {
+		log.Printf("[reaper] ERROR list deleted instances: %v", err)
+	}
+	for i := range deleted {
+		if now.Before(deleted[i].PurgeAt) {
+			continue
+		}
+		if err := s.purgeInstance(ctx, &deleted[i]); err != nil {
+			log.Printf("[reaper] purge %s/%s: %v", deleted[i].Namespace, deleted[i].Name, err)
+			continue
+		}
+		numPurged++
+	}
+	if numReaped > 0 || numPurged > 0 {
+		log.Printf("[reaper] %d expired instances deleted, %d soft-deleted instances purged", numReaped, numPurged)
+	}
+}
+
+// expireInstance deletes an instance whose TTL ran out. With a deletion grace period it
+// goes through the same soft delete as a user-requested delete, so it can be undeleted.
+func (s *Server) expireInstance(ctx context.Context, item *unstructured.Unstructured, instance models.RedisInstance) error {
+	expiresAt := instance.ExpiresAt.UTC().Format(time.RFC3339)
+	details := fmt.Sprintf("expiresAt: %s, redisReplicas: %d, sentinelReplicas: %d", expiresAt, instance.RedisReplicas, instance.SentinelReplicas)
+
+	if s.deleteGracePeriod > 0 {
+		purgeAt, err := s.softDeleteInstance(ctx, item, systemActor, "TTL expired at "+expiresAt)
+		if err != nil {
+			return err
+		}
+		details += ", purgeAt: " + purgeAt.UTC().Format(time.RFC3339)
+	} else {
+		err := s.kubeClient.Resource(kube.RedisFailOver).Namespace(instance.Namespace).Delete(ctx, instance.Name, v1.DeleteOptions{})
+		if err != nil {
+			return err
+		}
+		svcLog := &models.ServiceLog{
+			InstanceName: instance.Name,
+			Namespace:    instance.Namespace,
+			EventType:    "expired",
+			FromStatus:   instance.Status,
+			ToStatus:     "Deleted",
+			Message:      "Instance deleted: TTL expired at " + expiresAt,
+			Timestamp:    time.Now(),
+		}
+		if err := s.db.InsertServiceLog(ctx, svcLog); err != nil {
+			log.Printf("[reaper] service log %s/%s: %v", instance.Namespace, instance.Name, err)
+		}
+	}
+
+	s.logSystemAudit(ctx, models.Action{
+		Action:    "expire",
+		Name:      instance.Name,
+		Namespace: instance.Namespace,
+		Details:   details,
+	})
+	return nil
+}
+
+// warnInstanceExpiry writes a single expiry warning per expiry value; extending the TTL re-arms it.
+func (s *Server) warnInstanceExpiry(ctx context.Context, item *unstructured.Unstructured, instance models.RedisInstance) error {
+	expiresAt := instance.ExpiresAt.UTC().Format(time.RFC3339)
+	if kube.GetAnnotation(item, kube.AnnotationExpiryWarnedFor) == expiresAt {
+		return nil
+	}
+
+	kube.SetAnnotation(item, kube.AnnotationExpiryWarnedFor, expiresAt)
+	if _, err := s.kubeClient.Resource(kube.RedisFailOver).Namespace(instance.Namespace).Update(ctx, item, v1.UpdateOptions{}); err != nil {
+		return err
+	}
+
+	remaining := time.Until(*instance.ExpiresAt).Round(time.Minute)
+	svcLog := &models.ServiceLog{
+		InstanceName: instance.Name,
+		Namespace:    instance.Namespace,
+		EventType:    "expiry_warning",
+		ToStatus:     instance.Status,
+		Message:      fmt.Sprintf("Instance expires at %s (in %s); extend its TTL to keep it", expiresAt, remaining),
+		Timestamp:    time.Now(),
+	}
+	return s.db.InsertServiceLog(ctx, svcLog)
+}
+
+// formatExpiry renders an optional expiry for audit details.
+func formatExpiry(t *time.Time) string {
+	if t == nil {
+		return "never"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
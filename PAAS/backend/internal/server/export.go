@@ -0,0 +1,227 @@
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"backend/internal/database"
+	"backend/internal/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// exportFlushEvery is how many rows an export buffers before flushing them to the client.
+const exportFlushEvery = 500
+
+var (
+	auditLogColumns = []string{"timestamp", "user_email", "action", "name", "namespace", "details", "admin_info",
+		"request_method", "request_path", "client_ip", "user_agent", "token_name", "outcome", "error", "request_id"}
+	serviceLogColumns = []string{"timestamp", "instance_name", "namespace", "event_type", "from_status", "to_status",
+		"message", "details", "request_id"}
+)
+
+// logExporter streams rows to the response as CSV or NDJSON. The response status is sent
+// before the first row, so failures halfway are reported in the X-Export-Status trailer, the
+// server log and the audit entry rather than the status code.
+type logExporter struct {
+	c    *gin.Context
+	csv  *csv.Writer // nil for NDJSON
+	json *json.Encoder
+	rows int
+}
+
+// exportFormat reads the format query parameter, csv by default. On a bad value it writes a
+// 400 and returns false.
+func exportFormat(c *gin.Context) (string, bool) {
+	format := c.DefaultQuery("format", "csv")
+	if format != "csv" && format != "ndjson" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be csv or ndjson"})
+		return "", false
+	}
+	return format, true
+}
+
+// newLogExporter starts the response of an export in format.
+func newLogExporter(c *gin.Context, format, name string, columns []string) *logExporter {
+	filename := fmt.Sprintf("%s-%s.%s", name, time.Now().UTC().Format("20060102T150405Z"), format)
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+	c.Header("Cache-Control", "no-store")
+	c.Header("Trailer", "X-Export-Status, X-Export-Rows")
+	e := &logExporter{c: c}
+	if format == "csv" {
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		c.Status(http.StatusOK)
+		e.csv = csv.NewWriter(c.Writer)
+		_ = e.csv.Write(columns)
+	} else {
+		c.Header("Content-Type", "application/x-ndjson")
+		c.Status(http.StatusOK)
+		e.json = json.NewEncoder(c.Writer)
+	}
+	return e
+}
+
+// write adds one row: record for CSV, value for NDJSON.
+func (e *logExporter) write(record []string, value interface{}) error {
+	var err error
+	if e.csv != nil {
+		for i, cell := range record {
+			record[i] = csvSafe(cell)
+		}
+		err = e.csv.Write(record)
+	} else {
+		err = e.json.Encode(value)
+	}
+	if err != nil {
+		return err
+	}
+	e.rows++
+	if e.rows%exportFlushEvery == 0 {
+		e.flush()
+	}
+	return nil
+}
+
+func (e *logExporter) flush() {
+	if e.csv != nil {
+		e.csv.Flush()
+	}
+	e.c.Writer.Flush()
+}
+
+// finish flushes the last rows and reports in the trailers whether the export is complete.
+// It returns the error that cut the export off, if any.
+func (e *logExporter) finish(name string, err error) error {
+	e.flush()
+	status := "complete"
+	if err == nil && e.csv != nil {
+		err = e.csv.Error()
+	}
+	if err != nil {
+		status = "failed"
+		log.Printf("[export] %s export for %s stopped after %d rows: %v", name, e.c.GetString("user_email"), e.rows, err)
+	}
+	e.c.Writer.Header().Set("X-Export-Status", status)
+	e.c.Writer.Header().Set("X-Export-Rows", strconv.Itoa(e.rows))
+	return err
+}
+
+// logExport records a finished export with the number of rows sent, as a failure if err
+// cut it off.
+func (s *Server) logExport(c *gin.Context, actionName string, e *logExporter, err error) {
+	action := models.Action{Action: actionName, Details: fmt.Sprintf("%s, %d rows", exportDetails(c), e.rows)}
+	if err != nil {
+		s.logAuditError(c, c.GetString("user_email"), action, true, err)
+		return
+	}
+	s.logAudit(c, c.GetString("user_email"), action, true)
+}
+
+// csvSafe keeps spreadsheet programs from running a cell that starts like a formula; audit
+// details can contain user input.
+func csvSafe(cell string) string {
+	if cell != "" && strings.ContainsRune("=+-@\t\r", rune(cell[0])) {
+		return "'" + cell
+	}
+	return cell
+}
+
+// exportDetails describes an export for its audit entry.
+func exportDetails(c *gin.Context) string {
+	details := "format " + c.DefaultQuery("format", "csv")
+	if query := c.Request.URL.Query(); len(query) > 0 {
+		query.Del("format")
+		if encoded := query.Encode(); encoded != "" {
+			details += ", filters " + encoded
+		}
+	}
+	return details
+}
+
+// exportAuditLogsHandler streams every audit entry the caller may read that matches the same
+// filters as getAuditLogsHandler, oldest first.
+func (s *Server) exportAuditLogsHandler(c *gin.Context) {
+	var opts database.GetAuditLogsOptions
+	isAdmin, ok := s.auditLogScope(c, &opts)
+	if !ok {
+		return
+	}
+	if !auditLogFilters(c, isAdmin, &opts) {
+		return
+	}
+	format, ok := exportFormat(c)
+	if !ok {
+		return
+	}
+	email := c.GetString("user_email")
+
+	e := newLogExporter(c, format, "audit-logs", auditLogColumns)
+	err := s.db.ExportAuditLogs(c.Request.Context(), email, isAdmin, opts, func(entry *models.AuditLog) error {
+		return e.write([]string{
+			entry.Timestamp.UTC().Format(time.RFC3339Nano),
+			entry.UserEmail,
+			entry.Action.Action,
+			entry.Action.Name,
+			entry.Action.Namespace,
+			entry.Action.Details,
+			strconv.FormatBool(entry.AdminInfo),
+			entry.RequestMethod,
+			entry.RequestPath,
+			entry.ClientIP,
+			entry.UserAgent,
+			entry.TokenName,
+			entry.Outcome,
+			entry.Error,
+			entry.RequestID,
+		}, entry)
+	})
+	s.logExport(c, "export_audit_logs", e, e.finish("audit log", err))
+}
+
+// exportServiceLogsHandler streams every service log entry the caller may read that matches
+// the same filters as getServiceLogsHandler, oldest first.
+func (s *Server) exportServiceLogsHandler(c *gin.Context) {
+	isAdmin, allowedNamespaces, err := s.namespacesWith(c, models.PermInstancesRead)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to load role bindings",
+			"details": err.Error(),
+		})
+		return
+	}
+	instanceFilter := strings.TrimSpace(c.Query("instance"))
+	namespaceFilter := strings.TrimSpace(c.Query("namespace"))
+	if namespaceFilter != "" && !s.authorize(c, models.PermInstancesRead, namespaceFilter) {
+		return
+	}
+	from, to, ok := timeRangeQuery(c)
+	if !ok {
+		return
+	}
+	format, ok := exportFormat(c)
+	if !ok {
+		return
+	}
+	e := newLogExporter(c, format, "service-logs", serviceLogColumns)
+	opts := database.GetServiceLogsOptions{From: from, To: to, RequestID: strings.TrimSpace(c.Query("request_id"))}
+	err = s.db.ExportServiceLogs(c.Request.Context(), isAdmin, allowedNamespaces, instanceFilter, namespaceFilter, opts, func(entry *models.ServiceLog) error {
+		return e.write([]string{
+			entry.Timestamp.UTC().Format(time.RFC3339Nano),
+			entry.InstanceName,
+			entry.Namespace,
+			entry.EventType,
+			entry.FromStatus,
+			entry.ToStatus,
+			entry.Message,
+			entry.Details,
+			entry.RequestID,
+		}, entry)
+	})
+	s.logExport(c, "export_service_logs", e, e.finish("service log", err))
+}
@@ -3,6 +3,8 @@ package server
 import (
 	"time"
 
+	"backend/internal/models"
+
 	"github.com/golang-jwt/jwt/v5"
 )
 
@@ -12,26 +14,56 @@ type jwtClaims struct {
 	jwt.RegisteredClaims
 }
 
-func (s *Server) generateToken(email string, isAdmin bool) (string, error) {
+// generateToken issues an access token for a session; the session ID is carried as the jti
+// so that revoking the session also invalidates its outstanding access tokens.
+func (s *Server) generateToken(user *models.User, sessionID string) (string, error) {
 	now := time.Now()
 	claims := jwtClaims{
-		Email:   email,
-		IsAdmin: isAdmin,
+		Email:   user.Email,
+		IsAdmin: user.IsAdmin,
 		RegisteredClaims: jwt.RegisteredClaims{
-			Subject:   "admin",
+			Issuer:    s.jwtIssuer,
+			ID:        sessionID,
 			IssuedAt:  jwt.NewNumericDate(now),
 			ExpiresAt: jwt.NewNumericDate(now.Add(time.Duration(s.jwtTTLMinutes) * time.Minute)),
 		},
 	}
+	// Users whose _id predates ObjectIDs have no ID to put in the subject.
+	if !user.ID.IsZero() {
+		claims.Subject = user.ID.Hex()
+	}
+	if s.jwtAudience != "" {
+		claims.Audience = jwt.ClaimStrings{s.jwtAudience}
+	}
 
+	if s.keys != nil {
+		return s.keys.sign(claims)
+	}
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	return token.SignedString([]byte(s.jwtSecret))
 }
 
 func (s *Server) parseAndValidateToken(tokenString string) (*jwtClaims, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &jwtClaims{}, func(t *jwt.Token) (interface{}, error) {
+	// Only the configured kind of key is accepted, so an HS256 token can never be checked
+	// against a public key or the other way round.
+	keyFunc := func(*jwt.Token) (interface{}, error) {
 		return []byte(s.jwtSecret), nil
-	})
+	}
+	methods := []string{jwt.SigningMethodHS256.Alg()}
+	if s.keys != nil {
+		keyFunc = s.keys.verificationKey
+		methods = []string{models.SigningRS256, models.SigningEdDSA}
+	}
+
+	opts := []jwt.ParserOption{jwt.WithValidMethods(methods)}
+	if s.jwtIssuer != "" {
+		opts = append(opts, jwt.WithIssuer(s.jwtIssuer))
+	}
+	if s.jwtAudience != "" {
+		opts = append(opts, jwt.WithAudience(s.jwtAudience))
+	}
+
+	token, err := jwt.ParseWithClaims(tokenString, &jwtClaims{}, keyFunc, opts...)
 	if err != nil {
 		return nil, err
 	}
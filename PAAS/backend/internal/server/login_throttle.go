@@ -0,0 +1,140 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"backend/internal/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ipThrottle counts failed logins per client IP in a sliding window. It lives in memory, so
+// each replica throttles on its own; the per-account lockout is stored and shared.
+type ipThrottle struct {
+	maxFailures int
+	window      time.Duration
+
+	mu       sync.Mutex
+	failures map[string][]time.Time
+	calls    int
+}
+
+func newIPThrottle(maxFailures int, window time.Duration) *ipThrottle {
+	return &ipThrottle{maxFailures: maxFailures, window: window, failures: map[string][]time.Time{}}
+}
+
+// recent drops failures older than the window and returns the rest. Callers hold mu.
+func (t *ipThrottle) recent(ip string, now time.Time) []time.Time {
+	kept := t.failures[ip][:0]
+	for _, at := range t.failures[ip] {
+		if now.Sub(at) < t.window {
+			kept = append(kept, at)
+		}
+	}
+	if len(kept) == 0 {
+		delete(t.failures, ip)
+		return nil
+	}
+	t.failures[ip] = kept
+	return kept
+}
+
+// blocked reports whether ip has used up its failures, and when the oldest one expires.
+func (t *ipThrottle) blocked(ip string, now time.Time) (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	recent := t.recent(ip, now)
+	if len(recent) < t.maxFailures {
+		return 0, false
+	}
+	return t.window - now.Sub(recent[0]), true
+}
+
+func (t *ipThrottle) fail(ip string, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.failures[ip] = append(t.recent(ip, now), now)
+
+	// Sweep IPs that stopped trying now and then so the map does not grow without bound.
+	t.calls++
+	if t.calls%1000 == 0 {
+		for other := range t.failures {
+			t.recent(other, now)
+		}
+	}
+}
+
+// lockoutDuration doubles the lock for every lockout since the last successful login.
+func lockoutDuration(base, max time.Duration, previousLockouts int) time.Duration {
+	d := base
+	for i := 0; i < previousLockouts && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+func tooManyAttempts(c *gin.Context, message string, retryAfter time.Duration) {
+	seconds := int(retryAfter.Seconds()) + 1
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	c.JSON(http.StatusTooManyRequests, gin.H{
+		"error":       message,
+		"retry_after": seconds,
+	})
+}
+
+// recordLoginFailure counts a failed password for an existing account and locks it once it
+// reaches loginMaxFailures. It reports whether this failure locked the account.
+func (s *Server) recordLoginFailure(c *gin.Context, user *models.User) (bool, time.Time) {
+	ctx := c.Request.Context()
+	failures, err := s.db.IncrementFailedLogins(ctx, user.Email)
+	if err != nil || s.loginMaxFailures <= 0 || failures < s.loginMaxFailures {
+		return false, time.Time{}
+	}
+
+	until := time.Now().Add(lockoutDuration(s.loginLockout, s.loginMaxLockout, user.Lockouts))
+	if err := s.db.LockUser(ctx, user.Email, until); err != nil {
+		return false, time.Time{}
+	}
+	s.logAudit(c, user.Email, models.Action{
+		Action:  "account_locked",
+		Details: "after " + strconv.Itoa(failures) + " failed logins, until " + until.UTC().Format(time.RFC3339),
+	}, true)
+	return true, until
+}
+
+func (s *Server) unlockUserHandler(c *gin.Context) {
+	email := c.Param("email")
+	user, err := s.db.FindUserByEmail(c.Request.Context(), email)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to look up user",
+			"details": err.Error(),
+		})
+		return
+	}
+	if user == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+
+	if err := s.db.ResetLoginFailures(c.Request.Context(), email); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to unlock user",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	details := "user: " + email
+	if user.LockedUntil != nil && user.LockedUntil.After(time.Now()) {
+		details += ", was locked until " + user.LockedUntil.UTC().Format(time.RFC3339)
+	}
+	s.logAudit(c, c.GetString("user_email"), models.Action{Action: "unlock_account", Details: details}, true)
+	c.JSON(http.StatusOK, gin.H{"message": "user unlocked"})
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"backend/internal/database"
+	"backend/internal/kube"
+	"backend/internal/models"
+
+	"github.com/gin-gonic/gin"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const maintenancePollSeconds = 60
+
+// applyReplicaChanges sets the requested replica counts on obj; nil leaves a count unchanged.
+func applyReplicaChanges(obj *unstructured.Unstructured, redisReplicas, sentinelReplicas *int) error {
+	if redisReplicas != nil {
+		if err := unstructured.SetNestedField(obj.Object, int64(*redisReplicas), "spec", "redis", "replicas"); err != nil {
+			return fmt.Errorf("set redis replicas: %w", err)
+		}
+	}
+	if sentinelReplicas != nil {
+		if err := unstructured.SetNestedField(obj.Object, int64(*sentinelReplicas), "spec", "sentinel", "replicas"); err != nil {
+			return fmt.Errorf("set sentinel replicas: %w", err)
+		}
+	}
+	return nil
+}
+
+// setMaintenanceWindow stores window on obj; a nil window removes it.
+func setMaintenanceWindow(obj *unstructured.Unstructured, window *models.MaintenanceWindow) error {
+	if window == nil {
+		kube.RemoveAnnotation(obj, kube.AnnotationMaintenanceWindow)
+		return nil
+	}
+	window.Day = strings.ToLower(window.Day)
+	raw, err := json.Marshal(window)
+	if err != nil {
+		return err
+	}
+	kube.SetAnnotation(obj, kube.AnnotationMaintenanceWindow, string(raw))
+	return nil
+}
+
+// formatMaintenanceWindow renders an optional window for audit details.
+func formatMaintenanceWindow(window *models.MaintenanceWindow) string {
+	if window == nil {
+		return "none"
+	}
+	return fmt.Sprintf("%s %s UTC for %dm", window.Day, window.Start, window.DurationMinutes)
+}
+
+func (s *Server) getPendingChangesHandler(c *gin.Context) {
+	id := c.Param("id")
+	if id == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "instance id required"})
+		return
+	}
+
+	namespace := s.requestNamespace(c)
+	if !s.authorize(c, models.PermInstancesRead, namespace) {
+		return
+	}
+
+	// Only queued changes by default; status=all includes applied, failed and superseded ones.
+	status := c.DefaultQuery("status", models.PendingChangePending)
+	if status == "all" {
+		status = ""
+	}
+
+	changes, err := s.db.GetPendingChanges(c.Request.Context(), database.GetPendingChangesOptions{
+		InstanceName: id,
+		Namespace:    namespace,
+		Status:       status,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to get pending changes",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"pending_changes": changes,
+		"count":           len(changes),
+	})
+}
+
+// RunMaintenanceApplier periodically applies queued changes whose maintenance window is open.
+func (s *Server) RunMaintenanceApplier(ctx context.Context) {
+	ticker := time.NewTicker(maintenancePollSeconds * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.applyPendingChangesOnce(ctx)
+		}
+	}
+}
+
+func (s *Server) applyPendingChangesOnce(ctx context.Context) {
+	changes, err := s.db.GetPendingChanges(ctx, database.GetPendingChangesOptions{Status: models.PendingChangePending})
+	if err != nil {
+		log.Printf("[maintenance] ERROR list pending changes: %v", err)
+		return
+	}
+
+	numApplied := 0
+	for i := range changes {
+		change := &changes[i]
+		applied, err := s.applyPendingChange(ctx, change)
+		if err != nil {
+			log.Printf("[maintenance] apply %s/%s: %v", change.Namespace, change.InstanceName, err)
+			if err := s.db.SetPendingChangeStatus(ctx, change.ID, models.PendingChangeFailed, err.Error()); err != nil {
+				log.Printf("[maintenance] mark change %s failed: %v", change.ID.Hex(), err)
+			}
+			continue
+		}
+		if applied {
+			numApplied++
+		}
+	}
+	if numApplied > 0 {
+		log.Printf("[maintenance] %d pending changes applied", numApplied)
+	}
+}
+
+// applyPendingChange applies change if its instance's window is open (or was removed since).
+// Instances pending deletion keep their changes queued until they are undeleted or purged.
+func (s *Server) applyPendingChange(ctx context.Context, change *models.PendingChange) (bool, error) {
+	obj, err := s.kubeClient.Resource(kube.RedisFailOver).Namespace(change.Namespace).Get(ctx, change.InstanceName, v1.GetOptions{})
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			if deleted, dbErr := s.db.GetDeletedInstance(ctx, change.InstanceName, change.Namespace); dbErr == nil && deleted != nil {
+				return false, nil
+			}
+		}
+		return false, err
+	}
+
+	var before models.RedisInstance
+	before.ConvertUnstructuredToRedisInstace(obj)
+	if before.MaintenanceWindow != nil && !before.MaintenanceWindow.Contains(time.Now()) {
+		return false, nil
+	}
+
+	if change.Spec != nil {
+		if err := unstructured.SetNestedMap(obj.Object, change.Spec, "spec"); err != nil {
+			return false, fmt.Errorf("set spec: %w", err)
+		}
+	}
+	if err := applyReplicaChanges(obj, change.RedisReplicas, change.SentinelReplicas); err != nil {
+		return false, err
+	}
+	// The change is still the work of the request that queued it.
+	setRequestIDAnnotation(withRequestID(ctx, change.RequestID), obj)
+	updated, err := s.kubeClient.Resource(kube.RedisFailOver).Namespace(change.Namespace).Update(ctx, obj, v1.UpdateOptions{})
+	if err != nil {
+		return false, err
+	}
+	s.recordRevision(ctx, updated, "maintenance", change.RequestedBy)
+	if err := s.db.SetPendingChangeStatus(ctx, change.ID, models.PendingChangeApplied, ""); err != nil {
+		log.Printf("[maintenance] mark change %s applied: %v", change.ID.Hex(), err)
+	}
+
+	svcLog := &models.ServiceLog{
+		InstanceName: change.InstanceName,
+		Namespace:    change.Namespace,
+		EventType:    "maintenance_applied",
+		ToStatus:     before.Status,
+		Message:      "Queued change applied in maintenance window: " + change.Describe(),
+		RequestID:    change.RequestID,
+		Timestamp:    time.Now(),
+	}
+	_ = s.db.InsertServiceLog(ctx, svcLog)
+	s.logSystemAudit(ctx, models.Action{
+		Action:    "apply_pending_change",
+		Name:      change.InstanceName,
+		Namespace: change.Namespace,
+		Details:   fmt.Sprintf("%s, requestedBy: %s, redisReplicas before: %d, sentinelReplicas before: %d", change.Describe(), change.RequestedBy, before.RedisReplicas, before.SentinelReplicas),
+	})
+	return true, nil
+}
@@ -0,0 +1,31 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AdminMiddleware rejects requests from users who are not platform admins, either through
+// is_admin or a platform-admin role binding. It must run after JWTMiddleware.
+func (s *Server) AdminMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !s.isPlatformAdmin(c) {
+			if c.GetBool("admin_2fa_required") {
+				c.JSON(http.StatusForbidden, gin.H{
+					"error":               "admins must enable two-factor authentication first, at /api/2fa",
+					"two_factor_required": true,
+				})
+				c.Abort()
+				return
+			}
+			c.JSON(http.StatusForbidden, gin.H{
+				"error": "admin access required",
+			})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
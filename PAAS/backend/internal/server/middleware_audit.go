@@ -0,0 +1,154 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"backend/internal/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// auditRecordKey is the gin context key of the request's *auditRecord.
+	auditRecordKey = "audit_record"
+	// auditBodyLimit is how much of an error response is kept to summarise the error.
+	auditBodyLimit = 4096
+	// auditErrorLimit caps the error summary stored with an entry.
+	auditErrorLimit = 300
+)
+
+// auditRecord collects what a handler wants on the audit trail for one request. Entries
+// are only written once the response status, and so the outcome, is known.
+type auditRecord struct {
+	userEmail string
+	action    *models.Action // what the request is about, set before the handler can fail
+	adminInfo bool
+	entries   []models.AuditLog
+}
+
+// setAuditAction tells AuditMiddleware what the request is about, so that it can record
+// the action if the handler gives up before calling logAudit. Call it as soon as the
+// instance, user or team the request acts on is known, before checking permissions.
+func setAuditAction(c *gin.Context, userEmail string, action models.Action, adminInfo bool) {
+	if value, ok := c.Get(auditRecordKey); ok {
+		record := value.(*auditRecord)
+		record.userEmail, record.action, record.adminInfo = userEmail, &action, adminInfo
+	}
+}
+
+// auditedRequest reports whether a request belongs on the audit trail whatever its
+// result: every request that changes something, and the single sign-on callback, the one
+// login that arrives as a GET. Reads are only recorded when their handler logs them.
+func auditedRequest(c *gin.Context) bool {
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return c.FullPath() == "/auth/oidc/callback"
+	}
+	return true
+}
+
+// auditOutcome classifies a response status.
+func auditOutcome(status int) string {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return models.AuditDenied
+	case status >= http.StatusBadRequest:
+		return models.AuditFailure
+	}
+	return models.AuditSuccess
+}
+
+// auditResponseWriter keeps the start of error responses for the error summary.
+type auditResponseWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *auditResponseWriter) Write(data []byte) (int, error) {
+	w.keep(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *auditResponseWriter) WriteString(data string) (int, error) {
+	w.keep([]byte(data))
+	return w.ResponseWriter.WriteString(data)
+}
+
+func (w *auditResponseWriter) keep(data []byte) {
+	if w.Status() < http.StatusBadRequest || w.body.Len() >= auditBodyLimit {
+		return
+	}
+	w.body.Write(data[:min(len(data), auditBodyLimit-w.body.Len())])
+}
+
+// errorSummary is the error and details of a JSON error response, or the status text if
+// the response is something else.
+func (w *auditResponseWriter) errorSummary() string {
+	status := w.Status()
+	if status < http.StatusBadRequest {
+		return ""
+	}
+	var body struct {
+		Error   string `json:"error"`
+		Details any    `json:"details"`
+	}
+	summary := http.StatusText(status)
+	if json.Unmarshal(w.body.Bytes(), &body) == nil && body.Error != "" {
+		summary = body.Error
+		if details, ok := body.Details.(string); ok && details != "" {
+			summary += ": " + details
+		}
+	}
+	return truncateAuditError(summary)
+}
+
+// truncateAuditError caps an error summary at auditErrorLimit bytes.
+func truncateAuditError(summary string) string {
+	if len(summary) > auditErrorLimit {
+		summary = strings.ToValidUTF8(summary[:auditErrorLimit], "") + "…"
+	}
+	return summary
+}
+
+// AuditMiddleware puts failed and denied requests on the audit trail next to the successful
+// ones. Handlers keep calling logAudit on success; the middleware holds those entries until
+// the handler returns and stamps them with the outcome, unless the handler recorded its own
+// (see logAuditError). An audited request (see auditedRequest) whose handler logged nothing
+// gets an entry of its own, for the action set with setAuditAction, or a generic "request"
+// action if the handler never got that far, e.g. because a middleware turned it away.
+func (s *Server) AuditMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		record := &auditRecord{}
+		c.Set(auditRecordKey, record)
+		writer := &auditResponseWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+
+		c.Next()
+
+		if len(record.entries) == 0 && c.FullPath() != "" && (record.action != nil || auditedRequest(c)) {
+			email, action, adminInfo := c.GetString("user_email"), models.Action{Action: "request"}, true
+			if record.action != nil {
+				email, action, adminInfo = record.userEmail, *record.action, record.adminInfo
+			}
+			record.entries = append(record.entries, requestAuditEntry(c, email, action, adminInfo))
+		}
+
+		outcome, summary := auditOutcome(writer.Status()), writer.errorSummary()
+		// The client may be gone by now; the entry is written regardless.
+		ctx := context.WithoutCancel(c.Request.Context())
+		for i := range record.entries {
+			entry := &record.entries[i]
+			if entry.Outcome == "" {
+				entry.Outcome, entry.Error = outcome, summary
+			}
+			if err := s.db.InsertAuditLog(ctx, entry); err != nil {
+				log.Printf("[audit] failed to write audit log: %v", err)
+			}
+		}
+	}
+}
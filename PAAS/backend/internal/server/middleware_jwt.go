@@ -1,8 +1,12 @@
 package server
 
 import (
+	"log"
 	"net/http"
 	"strings"
+	"time"
+
+	"backend/internal/models"
 
 	"github.com/gin-gonic/gin"
 )
@@ -27,6 +31,11 @@ func (s *Server) JWTMiddleware() gin.HandlerFunc {
 			return
 		}
 
+		if strings.HasPrefix(parts[1], models.APITokenPrefix) {
+			s.authenticateAPIToken(c, parts[1])
+			return
+		}
+
 		claims, err := s.parseAndValidateToken(parts[1])
 		if err != nil {
 			c.JSON(http.StatusUnauthorized, gin.H{
@@ -36,8 +45,65 @@ func (s *Server) JWTMiddleware() gin.HandlerFunc {
 			return
 		}
 
+		if claims.ID == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": "invalid or expired token",
+			})
+			c.Abort()
+			return
+		}
+		session, err := s.db.GetSession(c.Request.Context(), claims.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":   "failed to look up session",
+				"details": err.Error(),
+			})
+			c.Abort()
+			return
+		}
+		if session == nil || session.RevokedAt != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": "session has been revoked",
+			})
+			c.Abort()
+			return
+		}
+		if now := time.Now(); session.LastUsedAt == nil || now.Sub(*session.LastUsedAt) > sessionTouchInterval {
+			if err := s.db.TouchSession(c.Request.Context(), session.ID, now); err != nil {
+				log.Printf("[auth] failed to record session use: %v", err)
+			}
+		}
+
+		// The user is read on every request so deleting or disabling an account, or changing
+		// its admin flag, takes effect at once rather than when the access token expires.
+		user, err := s.db.FindUserByEmail(c.Request.Context(), claims.Email)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":   "failed to look up user",
+				"details": err.Error(),
+			})
+			c.Abort()
+			return
+		}
+		if user == nil {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": "user no longer exists",
+			})
+			c.Abort()
+			return
+		}
+		if user.Disabled {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error": "account is disabled",
+			})
+			c.Abort()
+			return
+		}
+
 		c.Set("user_email", claims.Email)
-		c.Set("user_is_admin", claims.IsAdmin)
+		c.Set("user_is_admin", user.IsAdmin)
+		c.Set("two_factor_ok", session.TwoFactor)
+		c.Set("session_id", claims.ID)
 
 		c.Next()
 	}
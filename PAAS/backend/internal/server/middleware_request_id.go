@@ -0,0 +1,103 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"backend/internal/kube"
+
+	"github.com/gin-gonic/gin"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// requestIDHeader carries the request ID in both directions.
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength caps the IDs accepted from clients; longer ones are replaced.
+const maxRequestIDLength = 128
+
+// requestIDContextKey is the context.Context key of the request ID, for code that only
+// gets the request's context, like softDeleteInstance.
+type requestIDContextKey struct{}
+
+// withRequestID returns ctx carrying id.
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey{}, id)
+}
+
+// requestIDFrom returns the request ID ctx carries, or "" for background work.
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// validRequestID accepts IDs made of letters, digits and - _ . : so that a client-chosen ID
+// is safe to put in log lines, annotations and response headers.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.', r == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// RequestIDMiddleware gives every request an ID that links its log line, audit entries and
+// the service logs that follow: the client's X-Request-ID if it sent a usable one, a new
+// one otherwise. The ID is returned in the X-Request-ID response header, kept in the gin
+// context as "request_id" and carried by the request's context.Context.
+func (s *Server) RequestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		c.Set("request_id", id)
+		c.Request = c.Request.WithContext(withRequestID(c.Request.Context(), id))
+		c.Header(requestIDHeader, id)
+		c.Next()
+	}
+}
+
+// requestLogFormatter is gin's default log line, without colours, plus the request ID.
+func requestLogFormatter(param gin.LogFormatterParams) string {
+	if param.Latency > time.Minute {
+		param.Latency = param.Latency.Truncate(time.Second)
+	}
+	requestID, _ := param.Keys["request_id"].(string)
+	return fmt.Sprintf("[GIN] %v | %3d | %13v | %15s | %-7s %#v | request_id=%s\n%s",
+		param.TimeStamp.Format("2006/01/02 - 15:04:05"),
+		param.StatusCode,
+		param.Latency,
+		param.ClientIP,
+		param.Method,
+		param.Path,
+		requestID,
+		param.ErrorMessage,
+	)
+}
+
+// setRequestIDAnnotation records on obj the ID of the request changing it, so the service
+// logs the poller writes later point back to that request. A change made by a background
+// job clears it.
+func setRequestIDAnnotation(ctx context.Context, obj *unstructured.Unstructured) {
+	if id := requestIDFrom(ctx); id != "" {
+		kube.SetAnnotation(obj, kube.AnnotationRequestID, id)
+		return
+	}
+	kube.RemoveAnnotation(obj, kube.AnnotationRequestID)
+}
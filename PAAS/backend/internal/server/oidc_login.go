@@ -0,0 +1,300 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"backend/internal/models"
+	"backend/internal/policy"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/oauth2"
+)
+
+const (
+	oidcStateCookie = "paas_oidc"
+	oidcStateTTL    = 10 * time.Minute
+)
+
+// oidcState is what the login step remembers for the callback. It travels in a cookie signed
+// with SECRETS_KEY, so the server keeps no per-login state.
+type oidcState struct {
+	State    string    `json:"state"`
+	Nonce    string    `json:"nonce"`
+	Verifier string    `json:"verifier"`
+	Expires  time.Time `json:"expires"`
+}
+
+func (s *Server) signOIDCState(st oidcState) (string, error) {
+	raw, err := json.Marshal(st)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(raw)
+	mac := hmac.New(sha256.New, []byte(s.secretsKey))
+	mac.Write([]byte(payload))
+	return payload + "." + hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+func (s *Server) parseOIDCState(cookie string) (*oidcState, error) {
+	payload, sig, ok := strings.Cut(cookie, ".")
+	if !ok {
+		return nil, errors.New("malformed login state")
+	}
+	mac := hmac.New(sha256.New, []byte(s.secretsKey))
+	mac.Write([]byte(payload))
+	want := hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(sig), []byte(want)) {
+		return nil, errors.New("login state signature mismatch")
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, err
+	}
+	var st oidcState
+	if err := json.Unmarshal(raw, &st); err != nil {
+		return nil, err
+	}
+	if time.Now().After(st.Expires) {
+		return nil, errors.New("login state expired")
+	}
+	return &st, nil
+}
+
+func (s *Server) setOIDCStateCookie(c *gin.Context, value string, maxAge int) {
+	secure := c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https"
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, value, maxAge, "/auth/oidc", "", secure, true)
+}
+
+// authMethodsHandler tells the login page which ways of signing in are enabled.
+func (s *Server) authMethodsHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"password": !s.passwordLoginDisabled,
+		"oidc":     s.oidc != nil,
+	})
+}
+
+// oidcLoginHandler starts an authorization code + PKCE login by redirecting to the provider.
+func (s *Server) oidcLoginHandler(c *gin.Context) {
+	if s.oidc == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "single sign-on is not configured"})
+		return
+	}
+
+	state, err1 := randomToken(24)
+	nonce, err2 := randomToken(24)
+	if err1 != nil || err2 != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start login"})
+		return
+	}
+	st := oidcState{State: state, Nonce: nonce, Verifier: oauth2.GenerateVerifier(), Expires: time.Now().Add(oidcStateTTL)}
+
+	authURL, err := s.oidc.AuthCodeURL(c.Request.Context(), st.State, st.Nonce, st.Verifier)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{
+			"error":   "single sign-on provider unavailable",
+			"details": err.Error(),
+		})
+		return
+	}
+	cookie, err := s.signOIDCState(st)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start login"})
+		return
+	}
+	s.setOIDCStateCookie(c, cookie, int(oidcStateTTL.Seconds()))
+	c.Redirect(http.StatusFound, authURL)
+}
+
+// oidcCallbackHandler completes the login: it checks the state, redeems the code, creates the
+// user on first login and issues a session exactly like password login does.
+func (s *Server) oidcCallbackHandler(c *gin.Context) {
+	if s.oidc == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "single sign-on is not configured"})
+		return
+	}
+
+	cookie, _ := c.Cookie(oidcStateCookie)
+	s.setOIDCStateCookie(c, "", -1)
+	st, err := s.parseOIDCState(cookie)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "invalid login state; start the login again",
+			"details": err.Error(),
+		})
+		return
+	}
+	if idpErr := c.Query("error"); idpErr != "" {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error":   "single sign-on failed: " + idpErr,
+			"details": c.Query("error_description"),
+		})
+		return
+	}
+	if c.Query("state") != st.State {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid login state; start the login again"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	identity, err := s.oidc.Exchange(ctx, c.Query("code"), st.Verifier, st.Nonce)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error":   "single sign-on failed",
+			"details": err.Error(),
+		})
+		return
+	}
+	if identity.Email == "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "the identity provider did not return an email address"})
+		return
+	}
+	// Personal namespaces are derived from the email and must not collide with team namespaces
+	// (see models.TeamSlug), which relies on every email containing an "@".
+	if problems := policy.CheckEmail(identity.Email, nil); len(problems) > 0 {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error":   "the identity provider returned an invalid email address",
+			"details": problems[0],
+		})
+		return
+	}
+	if !identity.EmailVerified && !s.oidcTrustEmail {
+		c.JSON(http.StatusForbidden, gin.H{"error": "the identity provider has not verified this email address"})
+		return
+	}
+
+	user, err := s.db.FindUserByEmail(ctx, identity.Email)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to look up user",
+			"details": err.Error(),
+		})
+		return
+	}
+	switch {
+	case user == nil:
+		now := time.Now()
+		user = &models.User{
+			ID:          primitive.NewObjectID(),
+			Email:       identity.Email,
+			OIDCSubject: identity.Subject,
+			IsAdmin:     s.oidcGroupsGrantAdmin(identity.Groups),
+			CreatedAt:   now,
+			UpdatedAt:   now,
+		}
+		if err := s.db.Register(user, ctx); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":   "failed to create user",
+				"details": err.Error(),
+			})
+			return
+		}
+		s.logAudit(c, user.Email, models.Action{Action: "register", Details: "created on first single sign-on login"}, false)
+	case user.OIDCSubject == "":
+		if err := s.db.SetUserOIDCSubject(ctx, user.Email, identity.Subject); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":   "failed to link user",
+				"details": err.Error(),
+			})
+			return
+		}
+		user.OIDCSubject = identity.Subject
+	case user.OIDCSubject != identity.Subject:
+		c.JSON(http.StatusForbidden, gin.H{"error": "this email is linked to a different single sign-on identity"})
+		return
+	}
+	if user.Disabled {
+		s.logAudit(c, user.Email, models.Action{Action: "login_failed", Details: "reason: account disabled"}, true)
+		c.JSON(http.StatusForbidden, gin.H{"error": "account is disabled"})
+		return
+	}
+
+	// With a group mapping configured the provider is the source of truth for admin rights,
+	// so they are granted and revoked on every login.
+	if len(s.oidcAdminGroups) > 0 {
+		if isAdmin := s.oidcGroupsGrantAdmin(identity.Groups); isAdmin != user.IsAdmin {
+			if err := s.db.SetUserAdmin(ctx, user.Email, isAdmin); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"error":   "failed to update user",
+					"details": err.Error(),
+				})
+				return
+			}
+			s.logAudit(c, user.Email, models.Action{Action: "admin_sync", Details: "is_admin set to " + strconv.FormatBool(isAdmin) + " from identity provider groups"}, true)
+			user.IsAdmin = isAdmin
+		}
+	}
+
+	// The provider's login replaces the password, not the second factor: users who enrolled
+	// get the same challenge as after a password and finish at /auth/login/2fa.
+	if user.TwoFactorEnabled {
+		challenge := s.twoFactorChallenge(user, time.Now().Add(twoFactorChallengeTTL))
+		expiresIn := int(twoFactorChallengeTTL.Seconds())
+		if s.oidcPostLoginURL != "" {
+			fragment := url.Values{}
+			fragment.Set("two_factor_required", "true")
+			fragment.Set("challenge_token", challenge)
+			fragment.Set("expires_in", strconv.Itoa(expiresIn))
+			c.Redirect(http.StatusFound, s.oidcPostLoginURL+"#"+fragment.Encode())
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"two_factor_required": true,
+			"challenge_token":     challenge,
+			"expires_in":          expiresIn,
+		})
+		return
+	}
+
+	// Without a password the provider is the only way in, and it is responsible for the second factor.
+	tokens, err := s.issueSession(ctx, user, clientOf(c), user.Password == "")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "failed to generate token",
+		})
+		return
+	}
+	s.logAudit(c, user.Email, models.Action{Action: "login", Details: "User logged in via single sign-on"}, true)
+
+	// Browsers are sent back to the frontend with the tokens in the fragment, which is never
+	// sent to a server or written to access logs.
+	if s.oidcPostLoginURL != "" {
+		fragment := url.Values{}
+		fragment.Set("token", tokens.AccessToken)
+		fragment.Set("refresh_token", tokens.RefreshToken)
+		fragment.Set("expires_in", strconv.Itoa(s.jwtTTLMinutes*60))
+		c.Redirect(http.StatusFound, s.oidcPostLoginURL+"#"+fragment.Encode())
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    s.jwtTTLMinutes * 60,
+		"user": gin.H{
+			"email":    user.Email,
+			"is_admin": user.IsAdmin,
+		},
+	})
+}
+
+func (s *Server) oidcGroupsGrantAdmin(groups []string) bool {
+	for _, g := range groups {
+		for _, admin := range s.oidcAdminGroups {
+			if g == admin {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,262 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"backend/internal/mail"
+	"backend/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const revokedPasswordChanged = "password changed"
+
+// checkNewPassword validates a new password against the policy and writes the same 400
+// response as registration if it fails.
+func (s *Server) checkNewPassword(c *gin.Context, password, email string) bool {
+	var problems []string
+	if password == "" {
+		problems = []string{"is required"}
+	} else {
+		problems = s.passwordPolicy.Check(password, email)
+	}
+	if len(problems) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":  "validation failed",
+			"fields": map[string][]string{"new_password": problems},
+		})
+		return false
+	}
+	return true
+}
+
+// setPassword stores the new password and revokes every session and API token of the user,
+// so a stolen token stops working as soon as the password is changed. It returns how many
+// sessions and API tokens were revoked.
+func (s *Server) setPassword(ctx context.Context, email, password string) (sessions, tokens int64, err error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := s.db.SetUserPassword(ctx, email, string(hash)); err != nil {
+		return 0, 0, err
+	}
+	if sessions, err = s.db.RevokeUserSessions(ctx, email, revokedPasswordChanged); err != nil {
+		return 0, 0, err
+	}
+	if tokens, err = s.db.RevokeUserAPITokens(ctx, email); err != nil {
+		return sessions, 0, err
+	}
+	return sessions, tokens, nil
+}
+
+// changePasswordHandler lets a logged in user change their password. All their sessions,
+// including the current one, are revoked; the response carries a fresh session instead.
+func (s *Server) changePasswordHandler(c *gin.Context) {
+	if s.passwordLoginDisabled {
+		c.JSON(http.StatusForbidden, gin.H{"error": "password login is disabled; sign in with single sign-on"})
+		return
+	}
+
+	var req models.ChangePasswordRequest
+	if err := c.ShouldBindBodyWithJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	email := c.GetString("user_email")
+	user, err := s.db.FindUserByEmail(ctx, email)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to look up user",
+			"details": err.Error(),
+		})
+		return
+	}
+	if user == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "user not found"})
+		return
+	}
+	if user.Password == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "this account signs in with single sign-on and has no password"})
+		return
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.OldPassword)); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "old password is incorrect"})
+		return
+	}
+	if !s.checkNewPassword(c, req.NewPassword, email) {
+		return
+	}
+
+	revokedSessions, revokedTokens, err := s.setPassword(ctx, email, req.NewPassword)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to change password",
+			"details": err.Error(),
+		})
+		return
+	}
+	s.logAudit(c, email, models.Action{Action: "change_password", Details: fmt.Sprintf("%d sessions and %d API tokens revoked", revokedSessions, revokedTokens)}, true)
+
+	// The new session is as strong as the one that changed the password.
+	tokens, err := s.issueSession(ctx, user, clientOf(c), c.GetBool("two_factor_ok"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message":       "password changed",
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    s.jwtTTLMinutes * 60,
+	})
+}
+
+// forgotPasswordHandler emails a reset token to the address if it belongs to a password
+// account. The response is the same either way, so it cannot be used to discover accounts.
+func (s *Server) forgotPasswordHandler(c *gin.Context) {
+	if s.passwordLoginDisabled || s.mailer == nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "password reset is not available"})
+		return
+	}
+
+	var req models.ForgotPasswordRequest
+	if err := c.ShouldBindBodyWithJSON(&req); err != nil || strings.TrimSpace(req.Email) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "email is required"})
+		return
+	}
+
+	accepted := gin.H{"message": "if the address belongs to an account, a reset link has been sent"}
+	ctx := c.Request.Context()
+	user, err := s.db.FindUserByEmail(ctx, strings.TrimSpace(req.Email))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to look up user",
+			"details": err.Error(),
+		})
+		return
+	}
+	if user == nil || user.Password == "" {
+		c.JSON(http.StatusAccepted, accepted)
+		return
+	}
+
+	token, err := randomToken(32)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
+		return
+	}
+	now := time.Now()
+	reset := &models.PasswordReset{
+		ID:        primitive.NewObjectID(),
+		UserEmail: user.Email,
+		TokenHash: hashToken(token),
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.passwordResetTTL),
+	}
+	if err := s.db.CreatePasswordReset(ctx, reset); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to create password reset",
+			"details": err.Error(),
+		})
+		return
+	}
+	s.logAudit(c, user.Email, models.Action{Action: "request_password_reset"}, true)
+
+	// Sent in the background so the response time does not reveal whether the account exists.
+	msg := s.passwordResetMessage(user.Email, token, reset.ExpiresAt)
+	go func() {
+		if err := s.mailer.Send(context.Background(), msg); err != nil {
+			log.Printf("[mail] failed to send password reset to %s: %v", msg.To, err)
+		}
+	}()
+	c.JSON(http.StatusAccepted, accepted)
+}
+
+func (s *Server) passwordResetMessage(email, token string, expiresAt time.Time) mail.Message {
+	var body strings.Builder
+	body.WriteString("Someone asked to reset the password of your account " + email + ".\n\n")
+	if link, err := url.Parse(s.passwordResetURL); err == nil && s.passwordResetURL != "" {
+		query := link.Query()
+		query.Set("token", token)
+		link.RawQuery = query.Encode()
+		body.WriteString("Open this link to choose a new password:\n\n" + link.String() + "\n\n")
+	} else {
+		body.WriteString("Your reset token is:\n\n" + token + "\n\n")
+	}
+	body.WriteString("It works once and expires at " + expiresAt.UTC().Format(time.RFC1123) + ".\n")
+	body.WriteString("If you did not ask for this, you can ignore this email.\n")
+	return mail.Message{To: email, Subject: "Reset your password", Body: body.String()}
+}
+
+// resetPasswordHandler sets a new password using an emailed reset token. The token works
+// once; all of the user's sessions are revoked and any login lockout is lifted.
+func (s *Server) resetPasswordHandler(c *gin.Context) {
+	if s.passwordLoginDisabled {
+		c.JSON(http.StatusForbidden, gin.H{"error": "password reset is not available"})
+		return
+	}
+
+	var req models.ResetPasswordRequest
+	if err := c.ShouldBindBodyWithJSON(&req); err != nil || req.Token == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "token is required"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	tokenHash := hashToken(req.Token)
+	reset, err := s.db.GetPasswordReset(ctx, tokenHash)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to look up password reset",
+			"details": err.Error(),
+		})
+		return
+	}
+	if reset == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or expired reset token"})
+		return
+	}
+	// The policy is checked before the token is used up, so a rejected password can be retried.
+	if !s.checkNewPassword(c, req.NewPassword, reset.UserEmail) {
+		return
+	}
+
+	used, err := s.db.UsePasswordReset(ctx, tokenHash)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to use password reset",
+			"details": err.Error(),
+		})
+		return
+	}
+	if !used {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or expired reset token"})
+		return
+	}
+
+	sessions, tokens, err := s.setPassword(ctx, reset.UserEmail, req.NewPassword)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to reset password",
+			"details": err.Error(),
+		})
+		return
+	}
+	if err := s.db.ResetLoginFailures(ctx, reset.UserEmail); err != nil {
+		log.Printf("[login] failed to reset login failures for %s: %v", reset.UserEmail, err)
+	}
+
+	s.logAudit(c, reset.UserEmail, models.Action{Action: "reset_password", Details: fmt.Sprintf("%d sessions and %d API tokens revoked", sessions, tokens)}, true)
+	c.JSON(http.StatusOK, gin.H{"message": "password reset; log in with the new password"})
+}
@@ -36,6 +36,16 @@ func (s *Server) listRedisFailoversByNamespace(ctx context.Context) (*unstructur
 	return out, nil
 }
 
+// listAllRedisFailovers lists RedisFailovers cluster-wide, falling back to a per-namespace
+// list when the cluster-wide list is forbidden.
+func (s *Server) listAllRedisFailovers(ctx context.Context) (*unstructured.UnstructuredList, error) {
+	list, err := s.kubeClient.Resource(kube.RedisFailOver).List(ctx, v1.ListOptions{})
+	if err != nil && (strings.Contains(err.Error(), "Forbidden") || strings.Contains(err.Error(), "forbidden")) {
+		return s.listRedisFailoversByNamespace(ctx)
+	}
+	return list, err
+}
+
 func (s *Server) processInstanceStatus(ctx context.Context, item *unstructured.Unstructured) (wrote bool, err error) {
 	var instance models.RedisInstance
 	instance.ConvertUnstructuredToRedisInstace(item)
@@ -64,6 +74,7 @@ func (s *Server) processInstanceStatus(ctx context.Context, item *unstructured.U
 			FromStatus:   "",
 			ToStatus:     current,
 			Message:      msg,
+			RequestID:    kube.GetAnnotation(item, kube.AnnotationRequestID),
 			Timestamp:    time.Now(),
 		}
 		if err := s.db.InsertServiceLog(ctx, svcLog); err != nil {
@@ -89,6 +100,7 @@ func (s *Server) processInstanceStatus(ctx context.Context, item *unstructured.U
 		FromStatus:   cached,
 		ToStatus:     current,
 		Message:      msg,
+		RequestID:    kube.GetAnnotation(item, kube.AnnotationRequestID),
 		Timestamp:    time.Now(),
 	}
 	if err := s.db.InsertServiceLog(ctx, svcLog); err != nil {
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"backend/internal/database"
+	"backend/internal/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+const retentionPollSeconds = 3600
+
+// errNoArchive stops a purge that should archive first when there is nowhere to archive to.
+var errNoArchive = errors.New("archive_logs is on but no archive location is configured (LOG_ARCHIVE_DIR or LOG_ARCHIVE_S3_BUCKET)")
+
+// retentionReport says what one run of the retention job removed.
+type retentionReport struct {
+	AuditLogs   int64    `json:"audit_logs"`
+	ServiceLogs int64    `json:"service_logs"`
+	StatusCache int64    `json:"status_cache"` // entries of instances that no longer exist
+	Archives    []string `json:"archives,omitempty"`
+	Errors      []string `json:"errors,omitempty"`
+}
+
+// RunLogRetention periodically purges audit and service log entries older than the
+// retention set in the platform settings, archiving them first if asked to, and forgets
+// the cached status of instances that no longer exist.
+func (s *Server) RunLogRetention(ctx context.Context) {
+	ticker := time.NewTicker(retentionPollSeconds * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if report, ok := s.applyRetentionOnce(ctx); ok && len(report.Errors) > 0 {
+				log.Printf("[retention] %s", strings.Join(report.Errors, "; "))
+			}
+		}
+	}
+}
+
+// applyRetentionOnce runs the retention job once. It returns false if another run is
+// still in progress. A failure in one collection does not stop the others.
+func (s *Server) applyRetentionOnce(ctx context.Context) (*retentionReport, bool) {
+	if !s.retentionMu.TryLock() {
+		return nil, false
+	}
+	defer s.retentionMu.Unlock()
+
+	report := &retentionReport{}
+	fail := func(what string, err error) {
+		report.Errors = append(report.Errors, what+": "+err.Error())
+	}
+	settings, err := s.db.GetSettings(ctx)
+	if err != nil {
+		fail("settings", err)
+		return report, true
+	}
+
+	now := time.Now()
+	var details []string
+	if cutoff := models.RetentionCutoff(now, settings.AuditLogRetentionDays); !cutoff.IsZero() {
+		if err := s.purgeAuditLogs(ctx, cutoff, settings.ArchiveLogs, report); err != nil {
+			fail("audit_logs", err)
+		} else if report.AuditLogs > 0 {
+			details = append(details, fmt.Sprintf("audit_logs: %d entries before %s", report.AuditLogs, cutoff.UTC().Format(time.RFC3339)))
+		}
+	}
+	if cutoff := models.RetentionCutoff(now, settings.ServiceLogRetentionDays); !cutoff.IsZero() {
+		if err := s.purgeServiceLogs(ctx, cutoff, settings.ArchiveLogs, report); err != nil {
+			fail("service_logs", err)
+		} else if report.ServiceLogs > 0 {
+			details = append(details, fmt.Sprintf("service_logs: %d entries before %s", report.ServiceLogs, cutoff.UTC().Format(time.RFC3339)))
+		}
+	}
+	if err := s.pruneStatusCache(ctx, report); err != nil {
+		fail("instance_status_cache", err)
+	}
+
+	if len(details) > 0 {
+		if len(report.Archives) > 0 {
+			details = append(details, "archived to "+strings.Join(report.Archives, ", "))
+		}
+		s.logSystemAudit(ctx, models.Action{Action: "purge_logs", Details: strings.Join(details, ", ")})
+		log.Printf("[retention] %s", strings.Join(details, ", "))
+	}
+	return report, true
+}
+
+// purgeAuditLogs archives and deletes the audit entries older than cutoff, leaving the
+// chain whole (see GetAuditPurgeBoundary).
+func (s *Server) purgeAuditLogs(ctx context.Context, cutoff time.Time, archive bool, report *retentionReport) error {
+	throughSeq, err := s.db.GetAuditPurgeBoundary(ctx, cutoff)
+	if err != nil {
+		return err
+	}
+	if archive {
+		location, err := s.archiveLogs(ctx, "audit_logs", func(emit func(any) error) error {
+			return s.db.WalkPurgeableAuditLogs(ctx, cutoff, throughSeq, func(entry *models.AuditLog) error { return emit(entry) })
+		})
+		if err != nil {
+			return err
+		}
+		if location == "" {
+			return nil
+		}
+		report.Archives = append(report.Archives, location)
+	}
+	report.AuditLogs, err = s.db.PurgeAuditLogs(ctx, cutoff, throughSeq)
+	return err
+}
+
+// purgeServiceLogs archives and deletes the service log entries older than cutoff.
+func (s *Server) purgeServiceLogs(ctx context.Context, cutoff time.Time, archive bool, report *retentionReport) error {
+	if archive {
+		location, err := s.archiveLogs(ctx, "service_logs", func(emit func(any) error) error {
+			opts := database.GetServiceLogsOptions{To: &cutoff}
+			return s.db.ExportServiceLogs(ctx, true, nil, "", "", opts, func(entry *models.ServiceLog) error { return emit(entry) })
+		})
+		if err != nil {
+			return err
+		}
+		if location == "" {
+			return nil
+		}
+		report.Archives = append(report.Archives, location)
+	}
+	var err error
+	report.ServiceLogs, err = s.db.PurgeServiceLogs(ctx, cutoff)
+	return err
+}
+
+// archiveLogs writes the entries walk emits to a gzip-compressed NDJSON file in the archive
+// store and returns its location, or "" if there were no entries. The file is put together
+// in a temporary file first, so its size is known before the upload.
+func (s *Server) archiveLogs(ctx context.Context, collection string, walk func(emit func(any) error) error) (string, error) {
+	if s.archive == nil {
+		return "", errNoArchive
+	}
+	tmp, err := os.CreateTemp("", collection+"-*.ndjson.gz")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	gz := gzip.NewWriter(tmp)
+	enc := json.NewEncoder(gz)
+	rows := 0
+	if err := walk(func(entry any) error {
+		rows++
+		return enc.Encode(entry)
+	}); err != nil {
+		return "", err
+	}
+	if err := gz.Close(); err != nil {
+		return "", err
+	}
+	if rows == 0 {
+		return "", nil
+	}
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	name := fmt.Sprintf("%s/%s-%s.ndjson.gz", collection, collection, time.Now().UTC().Format("20060102T150405Z"))
+	if err := s.archive.Put(ctx, name, tmp, size); err != nil {
+		return "", err
+	}
+	return s.archive.Location(name), nil
+}
+
+// pruneStatusCache forgets the cached status of instances that no longer exist. Entries
+// the poller writes while this runs are left alone, since their instance may be new.
+func (s *Server) pruneStatusCache(ctx context.Context, report *retentionReport) error {
+	started := time.Now()
+	list, err := s.listAllRedisFailovers(ctx)
+	if err != nil {
+		return err
+	}
+	exists := make(map[string]bool, len(list.Items))
+	for _, item := range list.Items {
+		exists[item.GetNamespace()+"/"+item.GetName()] = true
+	}
+
+	caches, err := s.db.GetInstanceStatusCaches(ctx)
+	if err != nil {
+		return err
+	}
+	for _, cache := range caches {
+		if exists[cache.Namespace+"/"+cache.InstanceName] {
+			continue
+		}
+		if err := s.db.DeleteInstanceStatusCache(ctx, cache.InstanceName, cache.Namespace, started); err != nil {
+			return err
+		}
+		report.StatusCache++
+	}
+	return nil
+}
+
+// runRetentionHandler runs the retention job now instead of waiting for the next hourly run.
+func (s *Server) runRetentionHandler(c *gin.Context) {
+	report, ok := s.applyRetentionOnce(c.Request.Context())
+	if !ok {
+		c.JSON(http.StatusConflict, gin.H{"error": "the retention job is already running"})
+		return
+	}
+	if len(report.Errors) > 0 {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "retention job failed",
+			"details": strings.Join(report.Errors, "; "),
+			"report":  report,
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"report": report})
+}
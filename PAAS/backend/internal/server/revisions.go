@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"backend/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// revisionWithChanges is a revision plus what changed since the revision before it.
+type revisionWithChanges struct {
+	models.SpecRevision
+	Changes []models.SpecChange `json:"changes"`
+}
+
+// recordRevision stores the spec of obj as the next revision of the instance. It does not
+// fail the request on error, like logAudit.
+func (s *Server) recordRevision(ctx context.Context, obj *unstructured.Unstructured, source, actor string) {
+	spec, _, _ := unstructured.NestedMap(obj.Object, "spec")
+	rev := &models.SpecRevision{
+		InstanceName: obj.GetName(),
+		Namespace:    obj.GetNamespace(),
+		Spec:         spec,
+		Source:       source,
+		AppliedBy:    actor,
+		AppliedAt:    time.Now(),
+	}
+	if err := s.db.InsertSpecRevision(ctx, rev); err != nil {
+		log.Printf("[revisions] failed to record revision for %s/%s: %v", rev.Namespace, rev.InstanceName, err)
+	}
+}
+
+func (s *Server) getRevisionsHandler(c *gin.Context) {
+	id := c.Param("id")
+	if id == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "instance id required"})
+		return
+	}
+
+	namespace := s.requestNamespace(c)
+	if !s.authorize(c, models.PermInstancesRead, namespace) {
+		return
+	}
+
+	revisions, err := s.db.GetSpecRevisions(c.Request.Context(), id, namespace)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to get revisions",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	// Newest first, each with the diff against the revision before it.
+	out := make([]revisionWithChanges, 0, len(revisions))
+	for i := len(revisions) - 1; i >= 0; i-- {
+		var previous map[string]interface{}
+		if i > 0 {
+			previous = revisions[i-1].Spec
+		}
+		out = append(out, revisionWithChanges{
+			SpecRevision: revisions[i],
+			Changes:      models.DiffSpecs(previous, revisions[i].Spec),
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"revisions": out,
+		"count":     len(out),
+	})
+}
+
+func (s *Server) rollbackInstanceHandler(c *gin.Context) {
+	id := c.Param("id")
+	if id == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "provide the instance name you would like to roll back",
+		})
+		return
+	}
+
+	namespace := s.requestNamespace(c)
+	setAuditAction(c, c.GetString("user_email"), models.Action{Action: "rollback", Name: id, Namespace: namespace}, false)
+	if !s.authorize(c, models.PermInstancesUpdate, namespace) {
+		return
+	}
+
+	revision, err := strconv.Atoi(strings.TrimSpace(c.Query("revision")))
+	if err != nil || revision <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "provide the revision to roll back to, e.g. ?revision=2",
+		})
+		return
+	}
+
+	rev, err := s.db.GetSpecRevision(c.Request.Context(), id, namespace, revision)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to get revision",
+			"details": err.Error(),
+		})
+		return
+	}
+	if rev == nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "revision not found",
+		})
+		return
+	}
+
+	// The whole recorded spec is restored. Its replica counts go through the same validation,
+	// permission check and maintenance window handling as a PATCH with the same values.
+	if len(rev.Spec) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "revision has no spec to roll back to",
+		})
+		return
+	}
+	redisReplicas, sentinelReplicas := models.ReplicasFromSpec(rev.Spec)
+	req := models.UpdateInstanceRequest{
+		RedisReplicas:    redisReplicas,
+		SentinelReplicas: sentinelReplicas,
+		Spec:             rev.Spec,
+	}
+	s.applyInstanceUpdate(c, id, namespace, req, "rollback", "to revision "+strconv.Itoa(revision))
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"backend/internal/database"
+	"backend/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func (s *Server) getRoleBindingsHandler(c *gin.Context) {
+	bindings, err := s.db.GetRoleBindings(c.Request.Context(), database.GetRoleBindingsOptions{
+		UserEmail: strings.TrimSpace(c.Query("email")),
+		Namespace: strings.TrimSpace(c.Query("namespace")),
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to get role bindings",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"role_bindings": bindings,
+		"count":         len(bindings),
+	})
+}
+
+func (s *Server) createRoleBindingHandler(c *gin.Context) {
+	var req models.CreateRoleBindingRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid request body",
+		})
+		return
+	}
+
+	req.UserEmail = strings.TrimSpace(req.UserEmail)
+	req.Namespace = strings.TrimSpace(req.Namespace)
+	if req.UserEmail == "" || req.Namespace == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "userEmail and namespace are required",
+		})
+		return
+	}
+	if !models.ValidRole(req.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "role must be one of viewer, operator, owner or platform-admin",
+		})
+		return
+	}
+	if req.Role == models.RolePlatformAdmin && req.Namespace != models.AllNamespaces {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "platform-admin can only be bound in all namespaces (\"*\")",
+		})
+		return
+	}
+
+	email := c.GetString("user_email")
+	binding := &models.RoleBinding{
+		UserEmail: req.UserEmail,
+		Role:      req.Role,
+		Namespace: req.Namespace,
+		CreatedBy: email,
+		CreatedAt: time.Now(),
+	}
+	if err := s.db.CreateRoleBinding(c.Request.Context(), binding); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			c.JSON(http.StatusConflict, gin.H{
+				"error": "user already has a role in this namespace; delete it first",
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to create role binding",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	s.logAudit(c, email, models.Action{
+		Action:    "create_role_binding",
+		Namespace: binding.Namespace,
+		Details:   "user: " + binding.UserEmail + ", role: " + binding.Role,
+	}, true)
+	c.JSON(http.StatusCreated, gin.H{
+		"message":      "role binding created",
+		"role_binding": binding,
+	})
+}
+
+func (s *Server) deleteRoleBindingHandler(c *gin.Context) {
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid role binding id"})
+		return
+	}
+
+	binding, err := s.db.DeleteRoleBinding(c.Request.Context(), id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to delete role binding",
+			"details": err.Error(),
+		})
+		return
+	}
+	if binding == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "role binding not found"})
+		return
+	}
+
+	s.logAudit(c, c.GetString("user_email"), models.Action{
+		Action:    "delete_role_binding",
+		Namespace: binding.Namespace,
+		Details:   "user: " + binding.UserEmail + ", role: " + binding.Role,
+	}, true)
+	c.JSON(http.StatusOK, gin.H{"message": "role binding deleted"})
+}
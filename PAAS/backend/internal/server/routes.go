@@ -4,7 +4,9 @@ import (
 	"backend/internal/database"
 	"backend/internal/kube"
 	"backend/internal/models"
+	"backend/internal/policy"
 	"fmt"
+	"log"
 	"net/http"
 	"strconv"
 	"strings"
@@ -29,34 +31,42 @@ func emailToNamespace(email string) string {
 	return s
 }
 
-// getUserNamespaceAndAdmin returns the current user's namespace (derived from email) and whether they are admin.
-// Used to scope instance access: non-admins are restricted to their own namespace.
-func (s *Server) getUserNamespaceAndAdmin(c *gin.Context) (userNS string, isAdmin bool) {
-	email, _ := c.Get("user_email")
-	admin, _ := c.Get("user_is_admin")
-	emailStr, _ := email.(string)
-	isAdmin, _ = admin.(bool)
-	return emailToNamespace(emailStr), isAdmin
-}
-
 func (s *Server) RegisterRoutes() http.Handler {
-	r := gin.Default()
+	r := gin.New()
+	if err := r.SetTrustedProxies(s.trustedProxies); err != nil {
+		log.Fatalf("TRUSTED_PROXIES: %v", err)
+	}
+	r.Use(s.RequestIDMiddleware(), gin.LoggerWithFormatter(requestLogFormatter), gin.Recovery())
 
 	r.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"http://localhost:5173", "http://192.214.178.2", "http://ryan-paas.stackit.gg", "https://ryan-paas.stackit.gg", "http://ryanpaas.stackit.gg", "https://ryanpaas.stackit.gg"}, // Add your frontend URL
 		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS", "PATCH"},
-		AllowHeaders:     []string{"Accept", "Authorization", "Content-Type"},
+		AllowHeaders:     []string{"Accept", "Authorization", "Content-Type", requestIDHeader},
+		ExposeHeaders:    []string{requestIDHeader},
 		AllowCredentials: true, // Enable cookies/auth
 	}))
+	r.Use(s.AuditMiddleware())
 
 	r.GET("/", s.HelloWorldHandler)
 
 	r.GET("/health", s.healthHandler)
+	r.GET("/.well-known/jwks.json", s.jwksHandler)
 
 	authGroup := r.Group("/auth")
 	{
 		authGroup.POST("/register", s.registerHandler)
 		authGroup.POST("/login", s.loginHandler)
+		authGroup.POST("/login/2fa", s.loginTwoFactorHandler)
+		authGroup.POST("/refresh", s.refreshHandler)
+		authGroup.POST("/logout", s.JWTMiddleware(), s.logoutHandler)
+		authGroup.POST("/password", s.JWTMiddleware(), s.changePasswordHandler)
+		authGroup.POST("/password/forgot", s.forgotPasswordHandler)
+		authGroup.POST("/password/reset", s.resetPasswordHandler)
+		authGroup.POST("/verify-email", s.verifyEmailHandler)
+		authGroup.POST("/verify-email/resend", s.resendVerificationHandler)
+		authGroup.GET("/methods", s.authMethodsHandler)
+		authGroup.GET("/oidc/login", s.oidcLoginHandler)
+		authGroup.GET("/oidc/callback", s.oidcCallbackHandler)
 	}
 
 	apiGroup := r.Group("/api", s.JWTMiddleware())
@@ -66,9 +76,50 @@ func (s *Server) RegisterRoutes() http.Handler {
 		apiGroup.POST("/instances", s.createInstanceHandler)       // create new instace
 		apiGroup.PATCH("/instances/:id", s.updateInstanceHandler)  // update instance (partial)
 		apiGroup.DELETE("/instances/:id", s.deleteInstanceHandler) //delete one
+		apiGroup.POST("/instances/:id/undelete", s.undeleteInstanceHandler)
+		apiGroup.GET("/instances/:id/pending-changes", s.getPendingChangesHandler)
+		apiGroup.GET("/instances/:id/revisions", s.getRevisionsHandler)
+		apiGroup.POST("/instances/:id/rollback", s.rollbackInstanceHandler)
 		apiGroup.GET("/audit-logs", s.getAuditLogsHandler)
+		apiGroup.GET("/audit-logs/export", s.exportAuditLogsHandler)
 		apiGroup.GET("/instances/:id/service-logs", s.getInstanceServiceLogsHandler)
 		apiGroup.GET("/service-logs", s.getServiceLogsHandler)
+		apiGroup.GET("/service-logs/export", s.exportServiceLogsHandler)
+		apiGroup.POST("/tokens", s.createAPITokenHandler)
+		apiGroup.GET("/tokens", s.getAPITokensHandler)
+		apiGroup.DELETE("/tokens/:id", s.revokeAPITokenHandler)
+		apiGroup.POST("/teams", s.createTeamHandler)
+		apiGroup.GET("/teams", s.getTeamsHandler)
+		apiGroup.GET("/teams/:slug", s.getTeamHandler)
+		apiGroup.POST("/teams/:slug/members", s.addTeamMemberHandler)
+		apiGroup.PATCH("/teams/:slug/members/:email", s.updateTeamMemberHandler)
+		apiGroup.DELETE("/teams/:slug/members/:email", s.removeTeamMemberHandler)
+		apiGroup.GET("/sessions", s.getSessionsHandler)
+		apiGroup.DELETE("/sessions/:id", s.revokeSessionHandler)
+		apiGroup.GET("/2fa", s.twoFactorStatusHandler)
+		apiGroup.POST("/2fa/enroll", s.enrollTwoFactorHandler)
+		apiGroup.POST("/2fa/confirm", s.confirmTwoFactorHandler)
+		apiGroup.POST("/2fa/disable", s.disableTwoFactorHandler)
+		apiGroup.POST("/2fa/recovery-codes", s.regenerateRecoveryCodesHandler)
+	}
+
+	adminGroup := apiGroup.Group("/admin", s.AdminMiddleware())
+	{
+		adminGroup.GET("/settings", s.getSettingsHandler)
+		adminGroup.GET("/audit-logs/verify", s.verifyAuditLogsHandler)
+		adminGroup.POST("/retention/run", s.runRetentionHandler)
+		adminGroup.PATCH("/settings", s.updateSettingsHandler)
+		adminGroup.GET("/role-bindings", s.getRoleBindingsHandler)
+		adminGroup.POST("/role-bindings", s.createRoleBindingHandler)
+		adminGroup.DELETE("/role-bindings/:id", s.deleteRoleBindingHandler)
+		adminGroup.GET("/users", s.getUsersHandler)
+		adminGroup.GET("/users/:email", s.getUserHandler)
+		adminGroup.PATCH("/users/:email", s.updateUserHandler)
+		adminGroup.DELETE("/users/:email", s.deleteUserHandler)
+		adminGroup.POST("/users/:email/unlock", s.unlockUserHandler)
+		adminGroup.DELETE("/users/:email/2fa", s.resetTwoFactorHandler)
+		adminGroup.GET("/users/:email/sessions", s.getUserSessionsHandler)
+		adminGroup.DELETE("/users/:email/sessions", s.revokeUserSessionsHandler)
 	}
 	//helo
 
@@ -84,18 +135,21 @@ func (s *Server) getInstanceHandler(c *gin.Context) {
 		return
 	}
 
-	userNS, isAdmin := s.getUserNamespaceAndAdmin(c)
-	var namespace string
-	if isAdmin {
-		namespace = c.Query("namespace")
-		if namespace == "" {
-			namespace = "default"
-		}
-	} else {
-		namespace = userNS
+	namespace := s.requestNamespace(c)
+	if !s.authorize(c, models.PermInstancesRead, namespace) {
+		return
 	}
 
 	obj, err := s.kubeClient.Resource(kube.RedisFailOver).Namespace(namespace).Get(c.Request.Context(), id, v1.GetOptions{})
+	if err != nil && strings.Contains(err.Error(), "not found") {
+		if deleted, dbErr := s.db.GetDeletedInstance(c.Request.Context(), id, namespace); dbErr == nil && deleted != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"message":  "instance fetched succesfully",
+				"instance": deletedInstanceView(deleted),
+			})
+			return
+		}
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error":   "failed to get redis failover",
@@ -136,27 +190,74 @@ func (s *Server) deleteInstanceHandler(c *gin.Context) {
 		return
 	}
 
-	userNS, isAdmin := s.getUserNamespaceAndAdmin(c)
-	var namespace string
-	if isAdmin {
-		namespace = c.Query("namespace")
-		if namespace == "" {
-			namespace = "default"
+	namespace := s.requestNamespace(c)
+	setAuditAction(c, c.GetString("user_email"), models.Action{Action: "delete", Name: id, Namespace: namespace}, false)
+	if !s.authorize(c, models.PermInstancesDelete, namespace) {
+		return
+	}
+
+	// The instance is read first: its deletion protection and the grace period both depend on
+	// it, so it is never deleted without having been read.
+	obj, err := s.kubeClient.Resource(kube.RedisFailOver).Namespace(namespace).Get(c.Request.Context(), id, v1.GetOptions{})
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			s.instanceNotFound(c, id, namespace, err)
+			return
 		}
-	} else {
-		namespace = userNS
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to get redis failover",
+			"details": err.Error(),
+		})
+		return
 	}
+	var before models.RedisInstance
+	before.ConvertUnstructuredToRedisInstace(obj)
+	deletedDetails := fmt.Sprintf("redisReplicas: %d, sentinelReplicas: %d", before.RedisReplicas, before.SentinelReplicas)
+
+	if before.DeletionProtection {
+		force := c.Query("force") == "true"
+		if !force {
+			c.JSON(http.StatusConflict, gin.H{
+				"error": "instance has deletion protection enabled; clear deletionProtection before deleting",
+			})
+			return
+		}
+		if !s.isPlatformAdmin(c) {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error": "only platform admins can force-delete a protected instance",
+			})
+			return
+		}
+		deletedDetails += ", force: deletion protection overridden"
+	}
+
+	// With a grace period the instance is only stored away; the reaper purges it later.
+	if s.deleteGracePeriod > 0 {
+		email := c.GetString("user_email")
+		purgeAt, err := s.softDeleteInstance(c.Request.Context(), obj, email, "Deletion requested by "+email)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":   "failed to delete redis failover",
+				"details": err.Error(),
+			})
+			return
+		}
 
-	// Fetch instance before delete so we can log what was deleted
-	obj, getErr := s.kubeClient.Resource(kube.RedisFailOver).Namespace(namespace).Get(c.Request.Context(), id, v1.GetOptions{})
-	var deletedDetails string
-	if getErr == nil {
-		var before models.RedisInstance
-		before.ConvertUnstructuredToRedisInstace(obj)
-		deletedDetails = fmt.Sprintf("redisReplicas: %d, sentinelReplicas: %d", before.RedisReplicas, before.SentinelReplicas)
+		s.logAudit(c, email, models.Action{
+			Action:    "delete",
+			Name:      id,
+			Namespace: namespace,
+			Details:   deletedDetails + ", purgeAt: " + purgeAt.UTC().Format(time.RFC3339),
+		}, false)
+		c.JSON(http.StatusAccepted, gin.H{
+			"message": "instance scheduled for deletion",
+			"id":      id,
+			"purgeAt": purgeAt,
+		})
+		return
 	}
 
-	err := s.kubeClient.Resource(kube.RedisFailOver).Namespace(namespace).Delete(c.Request.Context(), id, v1.DeleteOptions{})
+	err = s.kubeClient.Resource(kube.RedisFailOver).Namespace(namespace).Delete(c.Request.Context(), id, v1.DeleteOptions{})
 
 	if err != nil {
 
@@ -190,26 +291,148 @@ func (s *Server) deleteInstanceHandler(c *gin.Context) {
 	})
 }
 
-func (s *Server) updateInstanceHandler(c *gin.Context) {
+func (s *Server) undeleteInstanceHandler(c *gin.Context) {
 	id := c.Param("id")
 	if id == "" {
 		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "provide the instance name you would like to update",
+			"error": "provide the instance name you would like to undelete",
 		})
 		return
 	}
 
-	userNS, isAdmin := s.getUserNamespaceAndAdmin(c)
-	var namespace string
-	if isAdmin {
-		namespace = c.Query("namespace")
-		if namespace == "" {
-			namespace = "default"
+	namespace := s.requestNamespace(c)
+	setAuditAction(c, c.GetString("user_email"), models.Action{Action: "undelete", Name: id, Namespace: namespace}, false)
+	if !s.authorize(c, models.PermInstancesDelete, namespace) {
+		return
+	}
+
+	deleted, err := s.db.GetDeletedInstance(c.Request.Context(), id, namespace)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to get deleted instance",
+			"details": err.Error(),
+		})
+		return
+	}
+	if deleted == nil {
+		_, err := s.kubeClient.Resource(kube.RedisFailOver).Namespace(namespace).Get(c.Request.Context(), id, v1.GetOptions{})
+		switch {
+		case err == nil:
+			c.JSON(http.StatusConflict, gin.H{
+				"error": errNotPendingDeletion.Error(),
+			})
+		case strings.Contains(err.Error(), "not found"):
+			c.JSON(http.StatusNotFound, gin.H{
+				"error":   "instance not found",
+				"details": err.Error(),
+			})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":   "failed to get redis failover",
+				"details": err.Error(),
+			})
 		}
-	} else {
-		namespace = userNS
+		return
 	}
 
+	obj, err := restoredInstanceObject(deleted)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to restore instance spec",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	// An instance deleted by the reaper comes back with a fresh TTL, otherwise it would expire again straight away.
+	var restored models.RedisInstance
+	restored.ConvertUnstructuredToRedisInstace(obj)
+	if restored.ExpiresAt != nil && !restored.ExpiresAt.After(time.Now()) {
+		settings, err := s.db.GetSettings(c.Request.Context())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":   "failed to get settings",
+				"details": err.Error(),
+			})
+			return
+		}
+		expiry, _ := resolveExpiry(time.Now(), "", nil, settings.MaxInstanceTTL(), s.isPlatformAdmin(c))
+		if expiry == nil {
+			kube.RemoveAnnotation(obj, kube.AnnotationExpiresAt)
+		} else {
+			setExpiryAnnotation(obj, expiry)
+		}
+	}
+
+	setRequestIDAnnotation(c.Request.Context(), obj)
+	created, err := s.kubeClient.Resource(kube.RedisFailOver).Namespace(namespace).Create(c.Request.Context(), obj, v1.CreateOptions{})
+	if err != nil {
+		if strings.Contains(err.Error(), "already exists") {
+			c.JSON(http.StatusConflict, gin.H{
+				"error":   "another instance with this name exists; delete it before undeleting",
+				"details": err.Error(),
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to create redis failover",
+			"details": err.Error(),
+		})
+		return
+	}
+	// The instance is back either way; a stored copy left behind is removed by the next purge.
+	if _, err := s.db.DeleteDeletedInstance(c.Request.Context(), id, namespace); err != nil {
+		log.Printf("[deletion] remove stored copy of %s/%s: %v", namespace, id, err)
+	}
+
+	var instance models.RedisInstance
+	instance.ConvertUnstructuredToRedisInstace(created)
+	if instance.Status == "Unknown" {
+		instance.Status = kube.GetStatusFromStatefulSets(c.Request.Context(), s.kubeClient, instance.Namespace, instance.Name, instance.RedisReplicas, instance.SentinelReplicas)
+	}
+	port, _ := kube.GetRedisServicePort(c.Request.Context(), s.kubeClient, instance.Namespace, instance.Name)
+	if err := instance.GetConnectionInfo(port); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to get connection info",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	email := c.GetString("user_email")
+	_ = s.db.InsertServiceLog(c.Request.Context(), &models.ServiceLog{
+		InstanceName: instance.Name,
+		Namespace:    instance.Namespace,
+		EventType:    "deletion_cancelled",
+		FromStatus:   "Deleting",
+		ToStatus:     instance.Status,
+		Message:      "Deletion cancelled by " + email + "; RedisFailover recreated",
+		RequestID:    c.GetString("request_id"),
+		Timestamp:    time.Now(),
+	})
+	s.logAudit(c, email, models.Action{
+		Action:    "undelete",
+		Name:      id,
+		Namespace: namespace,
+		Details:   fmt.Sprintf("redisReplicas: %d, sentinelReplicas: %d", instance.RedisReplicas, instance.SentinelReplicas),
+	}, false)
+	c.JSON(http.StatusOK, gin.H{
+		"message":  "instance restored successfully",
+		"instance": instance,
+	})
+}
+
+func (s *Server) updateInstanceHandler(c *gin.Context) {
+	id := c.Param("id")
+	if id == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "provide the instance name you would like to update",
+		})
+		return
+	}
+
+	namespace := s.requestNamespace(c)
+
 	var req models.UpdateInstanceRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
@@ -217,13 +440,31 @@ func (s *Server) updateInstanceHandler(c *gin.Context) {
 		})
 		return
 	}
-	if isAdmin && req.Namespace != nil && *req.Namespace != "" {
+	if req.Namespace != nil && *req.Namespace != "" {
 		namespace = *req.Namespace
 	}
+	setAuditAction(c, c.GetString("user_email"), models.Action{Action: "update", Name: id, Namespace: namespace}, false)
+
+	s.applyInstanceUpdate(c, id, namespace, req, "update", "")
+}
 
-	if req.RedisReplicas == nil && req.SentinelReplicas == nil {
+// applyInstanceUpdate validates req, applies it to the instance and writes the response.
+// Rollbacks go through here as well, so they get the same validation, maintenance window
+// handling and audit trail as a PATCH. action names the audit entry and the spec revision
+// source; note, if set, is prepended to the audit details. Replica changes need
+// instances:scale, everything else instances:update. A whole spec (req.Spec) is scheduled
+// like a replica change, since it may change anything about the pods.
+func (s *Server) applyInstanceUpdate(c *gin.Context, id, namespace string, req models.UpdateInstanceRequest, action, note string) {
+	otherChanges := req.RedisReplicas != nil || req.SentinelReplicas != nil || req.TTL != nil || req.ExpiresAt != nil || req.MaintenanceWindow != nil || req.Spec != nil
+	if !otherChanges && req.DeletionProtection == nil {
 		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "provide at least one of redisReplicas or sentinelReplicas to update",
+			"error": "provide at least one of redisReplicas, sentinelReplicas, ttl, expiresAt, maintenanceWindow or deletionProtection to update",
+		})
+		return
+	}
+	if otherChanges && req.DeletionProtection != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "deletionProtection must be changed on its own",
 		})
 		return
 	}
@@ -239,14 +480,54 @@ func (s *Server) updateInstanceHandler(c *gin.Context) {
 		})
 		return
 	}
+	if req.MaintenanceWindow != nil && req.MaintenanceWindow.Day != "" {
+		if err := req.MaintenanceWindow.Validate(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+	}
+
+	if req.RedisReplicas != nil || req.SentinelReplicas != nil {
+		if !s.authorize(c, models.PermInstancesScale, namespace) {
+			return
+		}
+	}
+	if req.TTL != nil || req.ExpiresAt != nil || req.MaintenanceWindow != nil || req.DeletionProtection != nil || req.Spec != nil {
+		if !s.authorize(c, models.PermInstancesUpdate, namespace) {
+			return
+		}
+	}
+	isAdmin := s.isPlatformAdmin(c)
+
+	var newExpiry *time.Time
+	if req.TTL != nil || req.ExpiresAt != nil {
+		settings, err := s.db.GetSettings(c.Request.Context())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":   "failed to get settings",
+				"details": err.Error(),
+			})
+			return
+		}
+		ttl := ""
+		if req.TTL != nil {
+			ttl = *req.TTL
+		}
+		newExpiry, err = resolveExpiry(time.Now(), ttl, req.ExpiresAt, settings.MaxInstanceTTL(), isAdmin)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+	}
 
 	obj, err := s.kubeClient.Resource(kube.RedisFailOver).Namespace(namespace).Get(c.Request.Context(), id, v1.GetOptions{})
 	if err != nil {
 		if strings.Contains(err.Error(), "not found") {
-			c.JSON(http.StatusNotFound, gin.H{
-				"error":   "instance not found",
-				"details": err.Error(),
-			})
+			s.instanceNotFound(c, id, namespace, err)
 			return
 		}
 		c.JSON(http.StatusInternalServerError, gin.H{
@@ -259,26 +540,89 @@ func (s *Server) updateInstanceHandler(c *gin.Context) {
 	// Capture current state for audit purposes before applying changes
 	var before models.RedisInstance
 	before.ConvertUnstructuredToRedisInstace(obj)
+	beforeSpec, _, _ := unstructured.NestedMap(obj.Object, "spec")
+
+	// Replica changes are disruptive: outside the maintenance window they are queued for the
+	// maintenance applier instead, unless the caller asks for them to be applied immediately.
+	window := before.MaintenanceWindow
+	if req.MaintenanceWindow != nil {
+		window = nil
+		if req.MaintenanceWindow.Day != "" {
+			window = req.MaintenanceWindow
+		}
+	}
+	email := c.GetString("user_email")
+	var pending *models.PendingChange
+	disruptive := req.RedisReplicas != nil || req.SentinelReplicas != nil || req.Spec != nil
+	if disruptive && window != nil && c.Query("applyImmediately") != "true" && !window.Contains(time.Now()) {
+		pending = &models.PendingChange{
+			InstanceName:     id,
+			Namespace:        namespace,
+			RedisReplicas:    req.RedisReplicas,
+			SentinelReplicas: req.SentinelReplicas,
+			Spec:             req.Spec,
+			RequestedBy:      email,
+			RequestedAt:      time.Now(),
+			RequestID:        c.GetString("request_id"),
+			Status:           models.PendingChangePending,
+		}
+		if err := s.db.InsertPendingChange(c.Request.Context(), pending); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":   "failed to queue change for the maintenance window",
+				"details": err.Error(),
+			})
+			return
+		}
+		req.RedisReplicas, req.SentinelReplicas, req.Spec = nil, nil, nil
+
+		appliesAt := window.NextOpen(time.Now())
+		s.logAudit(c, email, models.Action{
+			Action:    "schedule_update",
+			Name:      id,
+			Namespace: namespace,
+			Details:   pending.Describe() + ", appliesAt: " + appliesAt.UTC().Format(time.RFC3339),
+		}, false)
+		if newExpiry == nil && req.MaintenanceWindow == nil {
+			c.JSON(http.StatusAccepted, gin.H{
+				"message":       "change queued for the next maintenance window",
+				"pendingChange": pending,
+				"appliesAt":     appliesAt,
+			})
+			return
+		}
+	}
 
-	if req.RedisReplicas != nil {
-		if err := unstructured.SetNestedField(obj.Object, int64(*req.RedisReplicas), "spec", "redis", "replicas"); err != nil {
+	if req.Spec != nil {
+		if err := unstructured.SetNestedMap(obj.Object, req.Spec, "spec"); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{
-				"error":   "failed to set redis replicas",
+				"error":   "failed to set spec",
 				"details": err.Error(),
 			})
 			return
 		}
 	}
-	if req.SentinelReplicas != nil {
-		if err := unstructured.SetNestedField(obj.Object, int64(*req.SentinelReplicas), "spec", "sentinel", "replicas"); err != nil {
+	if err := applyReplicaChanges(obj, req.RedisReplicas, req.SentinelReplicas); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to set replicas",
+			"details": err.Error(),
+		})
+		return
+	}
+	setExpiryAnnotation(obj, newExpiry)
+	if req.DeletionProtection != nil {
+		setDeletionProtection(obj, *req.DeletionProtection)
+	}
+	if req.MaintenanceWindow != nil {
+		if err := setMaintenanceWindow(obj, window); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{
-				"error":   "failed to set sentinel replicas",
+				"error":   "failed to set maintenance window",
 				"details": err.Error(),
 			})
 			return
 		}
 	}
 
+	setRequestIDAnnotation(c.Request.Context(), obj)
 	updated, err := s.kubeClient.Resource(kube.RedisFailOver).Namespace(namespace).Update(c.Request.Context(), obj, v1.UpdateOptions{})
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
@@ -288,6 +632,18 @@ func (s *Server) updateInstanceHandler(c *gin.Context) {
 		return
 	}
 
+	afterSpec, _, _ := unstructured.NestedMap(updated.Object, "spec")
+	if len(models.DiffSpecs(beforeSpec, afterSpec)) > 0 {
+		s.recordRevision(c.Request.Context(), updated, action, email)
+	}
+
+	// A replica change applied now wins over anything still waiting for the window.
+	if req.RedisReplicas != nil || req.SentinelReplicas != nil || req.Spec != nil {
+		if err := s.db.SupersedePendingChanges(c.Request.Context(), id, namespace); err != nil {
+			log.Printf("[maintenance] supersede pending changes for %s/%s: %v", namespace, id, err)
+		}
+	}
+
 	var instance models.RedisInstance
 	instance.ConvertUnstructuredToRedisInstace(updated)
 	if instance.Status == "Unknown" {
@@ -302,8 +658,7 @@ func (s *Server) updateInstanceHandler(c *gin.Context) {
 		return
 	}
 
-	email, _ := c.Get("user_email")
-	if e, ok := email.(string); ok {
+	if email != "" {
 		changes := make([]string, 0, 2)
 		if req.RedisReplicas != nil && before.RedisReplicas != *req.RedisReplicas {
 			changes = append(changes, fmt.Sprintf("redisReplicas: %d -> %d", before.RedisReplicas, *req.RedisReplicas))
@@ -311,30 +666,61 @@ func (s *Server) updateInstanceHandler(c *gin.Context) {
 		if req.SentinelReplicas != nil && before.SentinelReplicas != *req.SentinelReplicas {
 			changes = append(changes, fmt.Sprintf("sentinelReplicas: %d -> %d", before.SentinelReplicas, *req.SentinelReplicas))
 		}
+		if newExpiry != nil {
+			changes = append(changes, fmt.Sprintf("expiresAt: %s -> %s", formatExpiry(before.ExpiresAt), formatExpiry(newExpiry)))
+		}
+		auditAction := action
+		if req.DeletionProtection != nil {
+			auditAction = "deletion_protection"
+			changes = append(changes, fmt.Sprintf("deletionProtection: %t -> %t", before.DeletionProtection, *req.DeletionProtection))
+		}
+		if req.MaintenanceWindow != nil {
+			changes = append(changes, "maintenanceWindow: "+formatMaintenanceWindow(before.MaintenanceWindow)+" -> "+formatMaintenanceWindow(window))
+		}
 
+		if note != "" {
+			changes = append([]string{note}, changes...)
+		}
 		details := strings.Join(changes, ", ")
-		s.logAudit(c, e, models.Action{
-			Action:    "update",
+		s.logAudit(c, email, models.Action{
+			Action:    auditAction,
 			Name:      id,
 			Namespace: namespace,
 			Details:   details,
 		}, false)
 	}
-	c.JSON(http.StatusOK, gin.H{
+	resp := gin.H{
 		"message":  "instance updated successfully",
 		"instance": instance,
-	})
+	}
+	if pending != nil {
+		resp["pendingChange"] = pending
+	}
+	c.JSON(http.StatusOK, resp)
 }
 
 func (s *Server) getAllInstancesHandler(c *gin.Context) {
-	userNS, isAdmin := s.getUserNamespaceAndAdmin(c)
+	all, namespaces, err := s.namespacesWith(c, models.PermInstancesRead)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to load role bindings",
+			"details": err.Error(),
+		})
+		return
+	}
 
-	var list *unstructured.UnstructuredList
-	var err error
-	if isAdmin {
+	list := &unstructured.UnstructuredList{}
+	if all {
 		list, err = s.kubeClient.Resource(kube.RedisFailOver).List(c.Request.Context(), v1.ListOptions{})
 	} else {
-		list, err = s.kubeClient.Resource(kube.RedisFailOver).Namespace(userNS).List(c.Request.Context(), v1.ListOptions{})
+		for _, ns := range namespaces {
+			var nsList *unstructured.UnstructuredList
+			nsList, err = s.kubeClient.Resource(kube.RedisFailOver).Namespace(ns).List(c.Request.Context(), v1.ListOptions{})
+			if err != nil {
+				break
+			}
+			list.Items = append(list.Items, nsList.Items...)
+		}
 	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
@@ -365,6 +751,23 @@ func (s *Server) getAllInstancesHandler(c *gin.Context) {
 		instances = append(instances, instance)
 	}
 
+	// Soft-deleted instances no longer have a RedisFailover but are listed until they are purged.
+	var deletedScope []string
+	if !all {
+		deletedScope = append([]string{}, namespaces...)
+	}
+	deleted, err := s.db.GetDeletedInstances(c.Request.Context(), deletedScope)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to list deleted instances",
+			"details": err.Error(),
+		})
+		return
+	}
+	for i := range deleted {
+		instances = append(instances, deletedInstanceView(&deleted[i]))
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"instances": instances,
 		"count":     len(instances),
@@ -372,8 +775,6 @@ func (s *Server) getAllInstancesHandler(c *gin.Context) {
 }
 
 func (s *Server) createInstanceHandler(c *gin.Context) {
-	userNS, isAdmin := s.getUserNamespaceAndAdmin(c)
-
 	var req models.CreateInstanceRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
@@ -389,19 +790,64 @@ func (s *Server) createInstanceHandler(c *gin.Context) {
 		req.SentinelReplicas = 3
 	}
 
-	if isAdmin {
-		if req.Namespace == "" {
-			req.Namespace = "default"
-		}
-	} else {
-		req.Namespace = userNS
+	if req.Team != "" {
+		req.Namespace = models.TeamNamespace(req.Team)
 	}
+	if req.Namespace == "" {
+		req.Namespace = s.requestNamespace(c)
+	}
+	setAuditAction(c, c.GetString("user_email"), models.Action{Action: "create", Name: req.Name, Namespace: req.Namespace}, false)
+	if !s.authorize(c, models.PermInstancesCreate, req.Namespace) {
+		return
+	}
+	isAdmin := s.isPlatformAdmin(c)
 
 	name := req.Name
 	if name == "" {
 		name = "redis-" + time.Now().Format("20060102150405")
 	}
 
+	settings, err := s.db.GetSettings(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to get settings",
+			"details": err.Error(),
+		})
+		return
+	}
+	expiresAt, err := resolveExpiry(time.Now(), req.TTL, req.ExpiresAt, settings.MaxInstanceTTL(), isAdmin)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if req.MaintenanceWindow != nil {
+		if err := req.MaintenanceWindow.Validate(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+	}
+
+	// A soft-deleted instance keeps its name until it is purged, so that it can be undeleted.
+	deleted, err := s.db.GetDeletedInstance(c.Request.Context(), name, req.Namespace)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to get deleted instance",
+			"details": err.Error(),
+		})
+		return
+	}
+	if deleted != nil {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":   "an instance with this name is pending deletion; undelete it or wait until it is purged",
+			"purgeAt": deleted.PurgeAt,
+		})
+		return
+	}
+
 	if err := kube.EnsureNamespace(c.Request.Context(), s.kubeClient, req.Namespace); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error":   "failed to ensure namespace",
@@ -412,6 +858,16 @@ func (s *Server) createInstanceHandler(c *gin.Context) {
 
 	//build the failover
 	rf := kube.BuildRedisFailover(name, req.Namespace, req.RedisReplicas, req.SentinelReplicas)
+	setExpiryAnnotation(rf, expiresAt)
+	setDeletionProtection(rf, req.DeletionProtection)
+	setRequestIDAnnotation(c.Request.Context(), rf)
+	if err := setMaintenanceWindow(rf, req.MaintenanceWindow); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to set maintenance window",
+			"details": err.Error(),
+		})
+		return
+	}
 
 	created, err := s.kubeClient.
 		Resource(kube.RedisFailOver).
@@ -437,6 +893,10 @@ func (s *Server) createInstanceHandler(c *gin.Context) {
 		Status:           "PROVISIONING",
 		CreatedAt:        now,
 		UpdatedAt:        now,
+		ExpiresAt:        expiresAt,
+
+		DeletionProtection: req.DeletionProtection,
+		MaintenanceWindow:  req.MaintenanceWindow,
 	}
 
 	err = resp.GetConnectionInfo(0)
@@ -448,11 +908,17 @@ func (s *Server) createInstanceHandler(c *gin.Context) {
 		return
 	}
 
-	_ = created
+	s.recordRevision(c.Request.Context(), created, "create", c.GetString("user_email"))
 
 	email, _ := c.Get("user_email")
 	if e, ok := email.(string); ok {
 		details := fmt.Sprintf("redisReplicas: %d, sentinelReplicas: %d", req.RedisReplicas, req.SentinelReplicas)
+		if expiresAt != nil {
+			details += ", expiresAt: " + formatExpiry(expiresAt)
+		}
+		if req.DeletionProtection {
+			details += ", deletionProtection: true"
+		}
 		s.logAudit(c, e, models.Action{
 			Action:    "create",
 			Name:      name,
@@ -465,6 +931,12 @@ func (s *Server) createInstanceHandler(c *gin.Context) {
 }
 
 func (s *Server) registerHandler(c *gin.Context) {
+	if s.passwordLoginDisabled {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "password accounts are disabled; sign in with single sign-on",
+		})
+		return
+	}
 
 	var req models.RegisterRequest
 	if err := c.ShouldBindBodyWithJSON(&req); err != nil {
@@ -474,20 +946,35 @@ func (s *Server) registerHandler(c *gin.Context) {
 		return
 	}
 
-	if req.Email == "" || req.Password == "" {
+	req.Email = strings.TrimSpace(req.Email)
+	setAuditAction(c, req.Email, models.Action{Action: "register"}, true)
+	fields := map[string][]string{}
+	if req.Email == "" {
+		fields["email"] = []string{"is required"}
+	} else if problems := policy.CheckEmail(req.Email, s.allowedEmailDomains); len(problems) > 0 {
+		fields["email"] = problems
+	}
+	if req.Password == "" {
+		fields["password"] = []string{"is required"}
+	} else if problems := s.passwordPolicy.Check(req.Password, req.Email); len(problems) > 0 {
+		fields["password"] = problems
+	}
+	if len(fields) > 0 {
 		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "email or password are required",
+			"error":  "validation failed",
+			"fields": fields,
 		})
 		return
 	}
 
 	user := &models.User{
-		ID:        primitive.NewObjectID(),
-		Email:     req.Email,
-		Password:  req.Password,
-		IsAdmin:   false,
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
+		ID:                  primitive.NewObjectID(),
+		Email:               req.Email,
+		Password:            req.Password,
+		IsAdmin:             false,
+		PendingVerification: !s.emailVerificationDisabled,
+		CreatedAt:           time.Now(),
+		UpdatedAt:           time.Now(),
 	}
 	err := user.HashPassword()
 	if err != nil {
@@ -505,14 +992,33 @@ func (s *Server) registerHandler(c *gin.Context) {
 	}
 
 	s.logAudit(c, req.Email, models.Action{Action: "register", Name: "", Namespace: ""}, false)
+	message := "user registered successfully"
+	if user.PendingVerification {
+		if err := s.sendVerificationEmail(c, user); err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{
+				"error":   "user registered, but the verification email could not be sent; request a new one later",
+				"details": err.Error(),
+			})
+			return
+		}
+		message = "user registered; follow the link sent to your email address to activate the account"
+	}
 	c.JSON(http.StatusOK, gin.H{
-		"message": "user registered successfully",
-		"user":    *user,
+		"message":               message,
+		"verification_required": user.PendingVerification,
+		"user":                  *user,
 	})
 
 }
 
 func (s *Server) loginHandler(c *gin.Context) {
+	if s.passwordLoginDisabled {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "password login is disabled; sign in with single sign-on",
+		})
+		return
+	}
+
 	var req models.RegisterRequest
 	if err := c.ShouldBindBodyWithJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
@@ -521,6 +1027,7 @@ func (s *Server) loginHandler(c *gin.Context) {
 		return
 	}
 
+	setAuditAction(c, req.Email, models.Action{Action: "login"}, true)
 	if req.Email == "" || req.Password == "" {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"error": "email or password are required",
@@ -528,6 +1035,20 @@ func (s *Server) loginHandler(c *gin.Context) {
 		return
 	}
 
+	now := time.Now()
+	if s.loginIPThrottle != nil {
+		if retryAfter, blocked := s.loginIPThrottle.blocked(c.ClientIP(), now); blocked {
+			tooManyAttempts(c, "too many failed logins from this address, try again later", retryAfter)
+			return
+		}
+	}
+	loginFailed := func(reason string) {
+		if s.loginIPThrottle != nil {
+			s.loginIPThrottle.fail(c.ClientIP(), now)
+		}
+		s.logAudit(c, req.Email, models.Action{Action: "login_failed", Details: "reason: " + reason}, true)
+	}
+
 	user, err := s.db.FindUserByEmail(c.Request.Context(), req.Email)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
@@ -537,20 +1058,75 @@ func (s *Server) loginHandler(c *gin.Context) {
 		return
 	}
 	if user == nil {
+		loginFailed("unknown user")
 		c.JSON(http.StatusUnauthorized, gin.H{
 			"error": "invalid credentials",
 		})
 		return
 	}
 
+	// A locked account is refused before the password is checked, so guessing during the
+	// lock gains nothing.
+	if user.LockedUntil != nil && user.LockedUntil.After(now) {
+		loginFailed("account locked")
+		tooManyAttempts(c, "account temporarily locked after too many failed logins", user.LockedUntil.Sub(now))
+		return
+	}
+
 	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)); err != nil {
+		loginFailed("wrong password")
+		if locked, until := s.recordLoginFailure(c, user); locked {
+			tooManyAttempts(c, "account temporarily locked after too many failed logins", until.Sub(now))
+			return
+		}
 		c.JSON(http.StatusUnauthorized, gin.H{
 			"error": "invalid credentials",
 		})
 		return
 	}
 
-	token, err := s.generateToken(req.Email, user.IsAdmin)
+	// Checked after the password, so only someone who knows it learns the account is disabled.
+	if user.Disabled {
+		loginFailed("account disabled")
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "account is disabled",
+		})
+		return
+	}
+
+	if user.PendingVerification {
+		loginFailed("email not verified")
+		c.JSON(http.StatusForbidden, gin.H{
+			"error":                 "email address not verified; follow the link we sent or request a new one",
+			"verification_required": true,
+		})
+		return
+	}
+
+	// With 2FA the password only earns a challenge, traded for a session at /auth/login/2fa.
+	// Failures are reset only once the second step succeeds.
+	if user.TwoFactorEnabled {
+		c.JSON(http.StatusOK, gin.H{
+			"two_factor_required": true,
+			"challenge_token":     s.twoFactorChallenge(user, now.Add(twoFactorChallengeTTL)),
+			"expires_in":          int(twoFactorChallengeTTL.Seconds()),
+		})
+		return
+	}
+
+	s.completeLogin(c, user, false, "User logged in Successfully")
+}
+
+// completeLogin starts a session for a user who passed every login step; twoFactor tells
+// whether one of them was a second factor.
+func (s *Server) completeLogin(c *gin.Context, user *models.User, twoFactor bool, details string) {
+	if user.FailedLogins > 0 || user.Lockouts > 0 || user.LockedUntil != nil {
+		if err := s.db.ResetLoginFailures(c.Request.Context(), user.Email); err != nil {
+			log.Printf("[login] failed to reset login failures for %s: %v", user.Email, err)
+		}
+	}
+
+	tokens, err := s.issueSession(c.Request.Context(), user, clientOf(c), twoFactor)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": "failed to generate token",
@@ -558,11 +1134,13 @@ func (s *Server) loginHandler(c *gin.Context) {
 		return
 	}
 
-	s.logAudit(c, req.Email, models.Action{Action: "login", Details: "User logged in Successfully"}, true)
+	s.logAudit(c, user.Email, models.Action{Action: "login", Details: details}, true)
 	c.JSON(http.StatusOK, gin.H{
-		"token": token,
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    s.jwtTTLMinutes * 60,
 		"user": gin.H{
-			"email":    req.Email,
+			"email":    user.Email,
 			"is_admin": user.IsAdmin,
 		},
 	})
@@ -585,12 +1163,6 @@ func (s *Server) getAuditLogsHandler(c *gin.Context) {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "user email not found"})
 		return
 	}
-	admin, _ := c.Get("user_is_admin")
-	isAdmin := false
-	if b, ok := admin.(bool); ok {
-		isAdmin = b
-	}
-
 	page := 1
 	if p := c.Query("page"); p != "" {
 		if n, err := strconv.Atoi(p); err == nil && n > 0 {
@@ -599,14 +1171,17 @@ func (s *Server) getAuditLogsHandler(c *gin.Context) {
 	}
 	limit := 50
 	skip := (page - 1) * limit
-	actionType := strings.TrimSpace(c.Query("type"))
-	includeAdminOnly := c.Query("admin_only") == "true" && isAdmin
 
 	opts := database.GetAuditLogsOptions{
-		Limit:            limit,
-		Skip:             skip,
-		ActionType:       actionType,
-		IncludeAdminOnly: includeAdminOnly,
+		Limit: limit,
+		Skip:  skip,
+	}
+	isAdmin, ok := s.auditLogScope(c, &opts)
+	if !ok {
+		return
+	}
+	if !auditLogFilters(c, isAdmin, &opts) {
+		return
 	}
 	logs, total, err := s.db.GetAuditLogs(c.Request.Context(), email, isAdmin, opts)
 	if err != nil {
@@ -625,6 +1200,37 @@ func (s *Server) getAuditLogsHandler(c *gin.Context) {
 	})
 }
 
+// auditLogScope sets which audit entries the current user may read in opts and reports
+// whether the user is a platform admin, who may read all of them. Others read their own
+// entries plus the non-admin entries of the namespaces where they hold audit:read, which
+// is every namespace for a role bound to "*".
+func (s *Server) auditLogScope(c *gin.Context, opts *database.GetAuditLogsOptions) (isAdmin bool, ok bool) {
+	all, namespaces, err := s.namespacesWith(c, models.PermAuditRead)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to load role bindings",
+			"details": err.Error(),
+		})
+		return false, false
+	}
+	// Only platform admins see admin-only entries such as logins.
+	isAdmin = all && s.isPlatformAdmin(c)
+	// Every team member sees the team's audit trail, whatever their role.
+	teams, err := s.userTeams(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to load teams",
+			"details": err.Error(),
+		})
+		return false, false
+	}
+	for _, team := range teams {
+		namespaces = append(namespaces, team.Namespace)
+	}
+	opts.AllNamespaces, opts.Namespaces = all, namespaces
+	return isAdmin, true
+}
+
 func (s *Server) getInstanceServiceLogsHandler(c *gin.Context) {
 	id := c.Param("id")
 	if id == "" {
@@ -632,13 +1238,8 @@ func (s *Server) getInstanceServiceLogsHandler(c *gin.Context) {
 		return
 	}
 
-	userNS, isAdmin := s.getUserNamespaceAndAdmin(c)
-	namespace := c.Query("namespace")
-	if namespace == "" {
-		namespace = userNS
-	}
-	if !isAdmin && namespace != userNS {
-		c.JSON(http.StatusForbidden, gin.H{"error": "access denied to this instance's service logs"})
+	namespace := s.requestNamespace(c)
+	if !s.authorize(c, models.PermInstancesRead, namespace) {
 		return
 	}
 
@@ -651,12 +1252,8 @@ func (s *Server) getInstanceServiceLogsHandler(c *gin.Context) {
 	limit := 50
 	skip := (page - 1) * limit
 
-	allowedNamespaces := []string{userNS}
-	if isAdmin {
-		allowedNamespaces = nil
-	}
-	opts := database.GetServiceLogsOptions{Limit: limit, Skip: skip}
-	logs, total, err := s.db.GetServiceLogs(c.Request.Context(), isAdmin, allowedNamespaces, id, namespace, opts)
+	opts := database.GetServiceLogsOptions{Limit: limit, Skip: skip, RequestID: strings.TrimSpace(c.Query("request_id"))}
+	logs, total, err := s.db.GetServiceLogs(c.Request.Context(), false, []string{namespace}, id, namespace, opts)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error":   "failed to get service logs",
@@ -674,7 +1271,14 @@ func (s *Server) getInstanceServiceLogsHandler(c *gin.Context) {
 }
 
 func (s *Server) getServiceLogsHandler(c *gin.Context) {
-	userNS, isAdmin := s.getUserNamespaceAndAdmin(c)
+	isAdmin, allowedNamespaces, err := s.namespacesWith(c, models.PermInstancesRead)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to load role bindings",
+			"details": err.Error(),
+		})
+		return
+	}
 
 	page := 1
 	if p := c.Query("page"); p != "" {
@@ -686,12 +1290,14 @@ func (s *Server) getServiceLogsHandler(c *gin.Context) {
 	skip := (page - 1) * limit
 	instanceFilter := strings.TrimSpace(c.Query("instance"))
 	namespaceFilter := strings.TrimSpace(c.Query("namespace"))
-
-	allowedNamespaces := []string{userNS}
-	if isAdmin {
-		allowedNamespaces = nil
+	if namespaceFilter != "" && !s.authorize(c, models.PermInstancesRead, namespaceFilter) {
+		return
+	}
+	from, to, ok := timeRangeQuery(c)
+	if !ok {
+		return
 	}
-	opts := database.GetServiceLogsOptions{Limit: limit, Skip: skip}
+	opts := database.GetServiceLogsOptions{Limit: limit, Skip: skip, From: from, To: to, RequestID: strings.TrimSpace(c.Query("request_id"))}
 	logs, total, err := s.db.GetServiceLogs(c.Request.Context(), isAdmin, allowedNamespaces, instanceFilter, namespaceFilter, opts)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
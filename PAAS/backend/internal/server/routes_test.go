@@ -1,49 +1,758 @@
 package server
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/csv"
 	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
 	"strings"
 	"testing"
+	"time"
 
+	"backend/internal/archive"
 	"backend/internal/database"
 	"backend/internal/kube"
+	"backend/internal/mail"
 	"backend/internal/models"
+	"backend/internal/oidc"
+	"backend/internal/policy"
 
 	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 	"golang.org/x/crypto/bcrypt"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
 )
 
+// testAuditChainKey keys the audit chain the mock database writes.
+var testAuditChainKey = []byte("test-audit-chain-key")
+
 // mockDB implements database.Service for tests (no-op audit, no real DB).
 type mockDB struct {
-	loginUser *models.User // if set, FindUserByEmail returns this user for matching email
+	loginUser   *models.User     // if set, FindUserByEmail returns this user for matching email
+	settings    *models.Settings // if set, GetSettings returns these settings
+	serviceLogs []models.ServiceLog
+	pending     []models.PendingChange
+	revisions   []models.SpecRevision
+	deleted     []models.DeletedInstance
+	sessions    map[string]*models.Session
+	apiTokens   []models.APIToken
+	auditLogs   []models.AuditLog
+	bindings    []models.RoleBinding
+	teams       []models.Team
+	resets      []models.PasswordReset
+	signingKeys []models.SigningKey
+	twoFactor   map[string]*models.TwoFactor
+	anchor      *models.AuditChainAnchor
+	statusCache []models.InstanceStatusCache
+	users       []*models.User               // for the admin user endpoints; FindUserByEmail also searches them
+	auditOpts   database.GetAuditLogsOptions // options of the last GetAuditLogs call
+	exportErr   error                        // if set, exports stop with it after the last row
 }
 
 func (m *mockDB) Health() map[string]string { return map[string]string{"message": "ok"} }
-func (m *mockDB) Register(*models.User, context.Context) error { return nil }
+func (m *mockDB) Register(user *models.User, _ context.Context) error {
+	if m.loginUser == nil {
+		m.loginUser = user
+	}
+	return nil
+}
 func (m *mockDB) FindUserByEmail(ctx context.Context, email string) (*models.User, error) {
 	if m.loginUser != nil && m.loginUser.Email == email {
 		return m.loginUser, nil
 	}
+	for _, user := range m.users {
+		if user.Email == email {
+			return user, nil
+		}
+	}
 	return nil, nil
 }
-func (m *mockDB) InsertAuditLog(context.Context, *models.AuditLog) error { return nil }
-func (m *mockDB) GetAuditLogs(context.Context, string, bool, database.GetAuditLogsOptions) ([]models.AuditLog, int64, error) {
+func (m *mockDB) InsertAuditLog(_ context.Context, entry *models.AuditLog) error {
+	var last *models.AuditLog
+	for i := range m.auditLogs {
+		if m.auditLogs[i].Seq > 0 {
+			last = &m.auditLogs[i]
+		}
+	}
+	entry.Chain(last, testAuditChainKey)
+	m.auditLogs = append(m.auditLogs, *entry)
+	return nil
+}
+func (m *mockDB) WalkAuditChain(_ context.Context, fn func(*models.AuditLog) error) error {
+	for i := range m.auditLogs {
+		if entry := m.auditLogs[i]; entry.Seq > 0 {
+			if err := fn(&entry); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+func (m *mockDB) GetAuditLogs(_ context.Context, _ string, _ bool, opts database.GetAuditLogsOptions) ([]models.AuditLog, int64, error) {
+	m.auditOpts = opts
 	return nil, 0, nil
 }
-func (m *mockDB) InsertServiceLog(context.Context, *models.ServiceLog) error { return nil }
+func (m *mockDB) ExportAuditLogs(_ context.Context, userEmail string, isAdmin bool, opts database.GetAuditLogsOptions, fn func(*models.AuditLog) error) error {
+	m.auditOpts = opts
+	for i := range m.auditLogs {
+		if entry := &m.auditLogs[i]; isAdmin || (entry.UserEmail == userEmail && !entry.AdminInfo) {
+			if err := fn(entry); err != nil {
+				return err
+			}
+		}
+	}
+	return m.exportErr
+}
+func (m *mockDB) InsertServiceLog(_ context.Context, log *models.ServiceLog) error {
+	m.serviceLogs = append(m.serviceLogs, *log)
+	return nil
+}
 func (m *mockDB) GetServiceLogs(context.Context, bool, []string, string, string, database.GetServiceLogsOptions) ([]models.ServiceLog, int64, error) {
 	return nil, 0, nil
 }
-func (m *mockDB) GetInstanceStatusCache(context.Context, string, string) (string, error) { return "", nil }
+func (m *mockDB) ExportServiceLogs(_ context.Context, isAdmin bool, allowedNamespaces []string, _, _ string, opts database.GetServiceLogsOptions, fn func(*models.ServiceLog) error) error {
+	for i := range m.serviceLogs {
+		entry := &m.serviceLogs[i]
+		if opts.To != nil && !entry.Timestamp.Before(*opts.To) {
+			continue
+		}
+		if isAdmin || slices.Contains(allowedNamespaces, entry.Namespace) {
+			if err := fn(entry); err != nil {
+				return err
+			}
+		}
+	}
+	return m.exportErr
+}
+func (m *mockDB) GetInstanceStatusCache(context.Context, string, string) (string, error) {
+	return "", nil
+}
 func (m *mockDB) SetInstanceStatusCache(context.Context, string, string, string) error { return nil }
+func (m *mockDB) GetAuditChainAnchor(context.Context) (*models.AuditChainAnchor, error) {
+	return m.anchor, nil
+}
+func (m *mockDB) GetAuditPurgeBoundary(_ context.Context, before time.Time) (int64, error) {
+	var firstKept, last int64
+	for _, entry := range m.auditLogs {
+		if entry.Seq > 0 && !entry.Timestamp.Before(before) && (firstKept == 0 || entry.Seq < firstKept) {
+			firstKept = entry.Seq
+		}
+		last = max(last, entry.Seq)
+	}
+	if firstKept == 0 {
+		firstKept = last
+	}
+	return max(firstKept-1, 0), nil
+}
+func purgeable(entry *models.AuditLog, before time.Time, throughSeq int64) bool {
+	if entry.Seq > 0 {
+		return entry.Seq <= throughSeq
+	}
+	return entry.Timestamp.Before(before)
+}
+func (m *mockDB) WalkPurgeableAuditLogs(_ context.Context, before time.Time, throughSeq int64, fn func(*models.AuditLog) error) error {
+	for i := range m.auditLogs {
+		if entry := m.auditLogs[i]; purgeable(&entry, before, throughSeq) {
+			if err := fn(&entry); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+func (m *mockDB) PurgeAuditLogs(_ context.Context, before time.Time, throughSeq int64) (int64, error) {
+	kept := m.auditLogs[:0]
+	for _, entry := range m.auditLogs {
+		if entry.Seq == throughSeq && throughSeq > 0 && (m.anchor == nil || m.anchor.Seq < throughSeq) {
+			m.anchor = &models.AuditChainAnchor{
+				ID:       models.AuditChainAnchorID,
+				Seq:      entry.Seq,
+				Hash:     entry.Hash,
+				MAC:      models.AuditAnchorMAC(testAuditChainKey, entry.Seq, entry.Hash),
+				PurgedAt: time.Now(),
+			}
+		}
+		if !purgeable(&entry, before, throughSeq) {
+			kept = append(kept, entry)
+		}
+	}
+	purged := int64(len(m.auditLogs) - len(kept))
+	m.auditLogs = kept
+	return purged, nil
+}
+func (m *mockDB) PurgeServiceLogs(_ context.Context, before time.Time) (int64, error) {
+	kept := m.serviceLogs[:0]
+	for _, entry := range m.serviceLogs {
+		if !entry.Timestamp.Before(before) {
+			kept = append(kept, entry)
+		}
+	}
+	purged := int64(len(m.serviceLogs) - len(kept))
+	m.serviceLogs = kept
+	return purged, nil
+}
+func (m *mockDB) GetInstanceStatusCaches(context.Context) ([]models.InstanceStatusCache, error) {
+	return m.statusCache, nil
+}
+func (m *mockDB) DeleteInstanceStatusCache(_ context.Context, instanceName, namespace string, notAfter time.Time) error {
+	m.statusCache = slices.DeleteFunc(m.statusCache, func(cache models.InstanceStatusCache) bool {
+		return cache.InstanceName == instanceName && cache.Namespace == namespace && cache.UpdatedAt.Before(notAfter)
+	})
+	return nil
+}
+func (m *mockDB) GetSettings(context.Context) (*models.Settings, error) {
+	if m.settings != nil {
+		return m.settings, nil
+	}
+	return &models.Settings{ID: models.SettingsID}, nil
+}
+func (m *mockDB) UpdateSettings(_ context.Context, settings *models.Settings) error {
+	m.settings = settings
+	return nil
+}
+func (m *mockDB) InsertPendingChange(_ context.Context, change *models.PendingChange) error {
+	change.ID = primitive.NewObjectID()
+	m.pending = append(m.pending, *change)
+	return nil
+}
+func (m *mockDB) GetPendingChanges(_ context.Context, opts database.GetPendingChangesOptions) ([]models.PendingChange, error) {
+	out := []models.PendingChange{}
+	for _, p := range m.pending {
+		if (opts.InstanceName == "" || p.InstanceName == opts.InstanceName) &&
+			(opts.Namespace == "" || p.Namespace == opts.Namespace) &&
+			(opts.Status == "" || p.Status == opts.Status) {
+			out = append(out, p)
+		}
+	}
+	return out, nil
+}
+func (m *mockDB) SetPendingChangeStatus(_ context.Context, id primitive.ObjectID, status, errMsg string) error {
+	for i := range m.pending {
+		if m.pending[i].ID == id {
+			m.pending[i].Status = status
+			m.pending[i].Error = errMsg
+		}
+	}
+	return nil
+}
+func (m *mockDB) InsertSpecRevision(_ context.Context, rev *models.SpecRevision) error {
+	revs, _ := m.GetSpecRevisions(context.Background(), rev.InstanceName, rev.Namespace)
+	rev.Revision = len(revs) + 1
+	m.revisions = append(m.revisions, *rev)
+	return nil
+}
+func (m *mockDB) GetSpecRevisions(_ context.Context, instanceName, namespace string) ([]models.SpecRevision, error) {
+	out := []models.SpecRevision{}
+	for _, r := range m.revisions {
+		if r.InstanceName == instanceName && r.Namespace == namespace {
+			out = append(out, r)
+		}
+	}
+	return out, nil
+}
+func (m *mockDB) GetSpecRevision(_ context.Context, instanceName, namespace string, revision int) (*models.SpecRevision, error) {
+	for _, r := range m.revisions {
+		if r.InstanceName == instanceName && r.Namespace == namespace && r.Revision == revision {
+			return &r, nil
+		}
+	}
+	return nil, nil
+}
+func (m *mockDB) InsertDeletedInstance(_ context.Context, instance *models.DeletedInstance) error {
+	if d, _ := m.GetDeletedInstance(context.Background(), instance.Name, instance.Namespace); d != nil {
+		return fmt.Errorf("duplicate key %s/%s", instance.Namespace, instance.Name)
+	}
+	m.deleted = append(m.deleted, *instance)
+	return nil
+}
+func (m *mockDB) GetDeletedInstance(_ context.Context, name, namespace string) (*models.DeletedInstance, error) {
+	for i := range m.deleted {
+		if m.deleted[i].Name == name && m.deleted[i].Namespace == namespace {
+			d := m.deleted[i]
+			return &d, nil
+		}
+	}
+	return nil, nil
+}
+func (m *mockDB) GetDeletedInstances(_ context.Context, namespaces []string) ([]models.DeletedInstance, error) {
+	out := []models.DeletedInstance{}
+	for _, d := range m.deleted {
+		if namespaces == nil || slices.Contains(namespaces, d.Namespace) {
+			out = append(out, d)
+		}
+	}
+	return out, nil
+}
+func (m *mockDB) DeleteDeletedInstance(_ context.Context, name, namespace string) (bool, error) {
+	for i := range m.deleted {
+		if m.deleted[i].Name == name && m.deleted[i].Namespace == namespace {
+			m.deleted = append(m.deleted[:i], m.deleted[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+func (m *mockDB) SupersedePendingChanges(_ context.Context, instanceName, namespace string) error {
+	for i := range m.pending {
+		p := &m.pending[i]
+		if p.InstanceName == instanceName && p.Namespace == namespace && p.Status == models.PendingChangePending {
+			p.Status = models.PendingChangeSuperseded
+		}
+	}
+	return nil
+}
+
+func (m *mockDB) CreateSession(_ context.Context, session *models.Session) error {
+	if m.sessions == nil {
+		m.sessions = map[string]*models.Session{}
+	}
+	copied := *session
+	m.sessions[session.ID] = &copied
+	return nil
+}
+func (m *mockDB) GetSession(_ context.Context, id string) (*models.Session, error) {
+	if session, ok := m.sessions[id]; ok {
+		copied := *session
+		return &copied, nil
+	}
+	return nil, nil
+}
+func (m *mockDB) RotateRefreshToken(_ context.Context, id, oldHash, newHash string, expiresAt time.Time) (bool, error) {
+	session, ok := m.sessions[id]
+	if !ok || session.RevokedAt != nil || session.RefreshTokenHash != oldHash {
+		return false, nil
+	}
+	session.RefreshTokenHash = newHash
+	session.ExpiresAt = expiresAt
+	return true, nil
+}
+func (m *mockDB) RevokeSession(_ context.Context, id, reason string) error {
+	if session, ok := m.sessions[id]; ok && session.RevokedAt == nil {
+		now := time.Now()
+		session.RevokedAt = &now
+		session.RevokedReason = reason
+	}
+	return nil
+}
+func (m *mockDB) GetSessions(_ context.Context, email string) ([]models.Session, error) {
+	sessions := []models.Session{}
+	for _, session := range m.sessions {
+		if session.UserEmail == email && session.Active(time.Now()) {
+			sessions = append(sessions, *session)
+		}
+	}
+	return sessions, nil
+}
+func (m *mockDB) SetSessionTwoFactor(_ context.Context, id string) error {
+	if session, ok := m.sessions[id]; ok {
+		session.TwoFactor = true
+	}
+	return nil
+}
+func (m *mockDB) TouchSession(_ context.Context, id string, usedAt time.Time) error {
+	if session, ok := m.sessions[id]; ok {
+		session.LastUsedAt = &usedAt
+	}
+	return nil
+}
+func (m *mockDB) RevokeUserSessions(_ context.Context, email, reason string) (int64, error) {
+	var revoked int64
+	for _, session := range m.sessions {
+		if session.UserEmail == email && session.RevokedAt == nil {
+			now := time.Now()
+			session.RevokedAt = &now
+			session.RevokedReason = reason
+			revoked++
+		}
+	}
+	return revoked, nil
+}
+
+func (m *mockDB) CreateAPIToken(_ context.Context, token *models.APIToken) error {
+	token.ID = primitive.NewObjectID()
+	m.apiTokens = append(m.apiTokens, *token)
+	return nil
+}
+func (m *mockDB) GetAPITokens(_ context.Context, userEmail string) ([]models.APIToken, error) {
+	out := []models.APIToken{}
+	for _, t := range m.apiTokens {
+		if t.UserEmail == userEmail {
+			out = append(out, t)
+		}
+	}
+	return out, nil
+}
+func (m *mockDB) GetAPITokenByHash(_ context.Context, tokenHash string) (*models.APIToken, error) {
+	for _, t := range m.apiTokens {
+		if t.TokenHash == tokenHash {
+			return &t, nil
+		}
+	}
+	return nil, nil
+}
+func (m *mockDB) RevokeUserAPITokens(_ context.Context, userEmail string) (int64, error) {
+	var revoked int64
+	for i := range m.apiTokens {
+		t := &m.apiTokens[i]
+		if t.UserEmail == userEmail && t.RevokedAt == nil {
+			now := time.Now()
+			t.RevokedAt = &now
+			revoked++
+		}
+	}
+	return revoked, nil
+}
+func (m *mockDB) RevokeAPIToken(_ context.Context, id primitive.ObjectID, userEmail string) (bool, error) {
+	for i := range m.apiTokens {
+		t := &m.apiTokens[i]
+		if t.ID == id && t.UserEmail == userEmail && t.RevokedAt == nil {
+			now := time.Now()
+			t.RevokedAt = &now
+			return true, nil
+		}
+	}
+	return false, nil
+}
+func (m *mockDB) TouchAPIToken(_ context.Context, id primitive.ObjectID, usedAt time.Time) error {
+	for i := range m.apiTokens {
+		if m.apiTokens[i].ID == id {
+			m.apiTokens[i].LastUsedAt = &usedAt
+		}
+	}
+	return nil
+}
+
+func (m *mockDB) CreateRoleBinding(_ context.Context, binding *models.RoleBinding) error {
+	for _, b := range m.bindings {
+		if b.UserEmail == binding.UserEmail && b.Namespace == binding.Namespace {
+			return mongo.WriteException{WriteErrors: []mongo.WriteError{{Code: 11000}}}
+		}
+	}
+	binding.ID = primitive.NewObjectID()
+	m.bindings = append(m.bindings, *binding)
+	return nil
+}
+func (m *mockDB) GetRoleBindings(_ context.Context, opts database.GetRoleBindingsOptions) ([]models.RoleBinding, error) {
+	out := []models.RoleBinding{}
+	for _, b := range m.bindings {
+		if (opts.UserEmail == "" || b.UserEmail == opts.UserEmail) && (opts.Namespace == "" || b.Namespace == opts.Namespace) {
+			out = append(out, b)
+		}
+	}
+	return out, nil
+}
+func (m *mockDB) DeleteRoleBinding(_ context.Context, id primitive.ObjectID) (*models.RoleBinding, error) {
+	for i, b := range m.bindings {
+		if b.ID == id {
+			m.bindings = append(m.bindings[:i], m.bindings[i+1:]...)
+			return &b, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *mockDB) CreateTeam(_ context.Context, team *models.Team) error {
+	for _, t := range m.teams {
+		if t.Slug == team.Slug {
+			return mongo.WriteException{WriteErrors: []mongo.WriteError{{Code: 11000}}}
+		}
+	}
+	team.ID = primitive.NewObjectID()
+	m.teams = append(m.teams, *team)
+	return nil
+}
+func (m *mockDB) GetTeam(_ context.Context, slug string) (*models.Team, error) {
+	for _, t := range m.teams {
+		if t.Slug == slug {
+			t.Members = append([]models.TeamMember(nil), t.Members...)
+			return &t, nil
+		}
+	}
+	return nil, nil
+}
+func (m *mockDB) GetTeams(_ context.Context, memberEmail string) ([]models.Team, error) {
+	out := []models.Team{}
+	for _, t := range m.teams {
+		if memberEmail == "" || t.Member(memberEmail) != nil {
+			out = append(out, t)
+		}
+	}
+	return out, nil
+}
+func (m *mockDB) AddTeamMember(_ context.Context, slug string, member models.TeamMember) (bool, error) {
+	for i := range m.teams {
+		if m.teams[i].Slug == slug && m.teams[i].Member(member.Email) == nil {
+			m.teams[i].Members = append(m.teams[i].Members, member)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+func (m *mockDB) SetTeamMemberRole(_ context.Context, slug, email, role string) (bool, error) {
+	for i := range m.teams {
+		if m.teams[i].Slug == slug {
+			if member := m.teams[i].Member(email); member != nil {
+				member.Role = role
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+func (m *mockDB) RemoveTeamMember(_ context.Context, slug, email string) (bool, error) {
+	for i := range m.teams {
+		if m.teams[i].Slug != slug {
+			continue
+		}
+		for j, member := range m.teams[i].Members {
+			if member.Email == email {
+				m.teams[i].Members = append(m.teams[i].Members[:j], m.teams[i].Members[j+1:]...)
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func (m *mockDB) SetUserAdmin(_ context.Context, email string, isAdmin bool) error {
+	if m.loginUser != nil && m.loginUser.Email == email {
+		m.loginUser.IsAdmin = isAdmin
+	}
+	for _, user := range m.users {
+		if user.Email == email {
+			user.IsAdmin = isAdmin
+		}
+	}
+	return nil
+}
+func (m *mockDB) SetUserOIDCSubject(_ context.Context, email, subject string) error {
+	if m.loginUser != nil && m.loginUser.Email == email {
+		m.loginUser.OIDCSubject = subject
+	}
+	return nil
+}
+func (m *mockDB) IncrementFailedLogins(_ context.Context, email string) (int, error) {
+	if m.loginUser == nil || m.loginUser.Email != email {
+		return 0, nil
+	}
+	m.loginUser.FailedLogins++
+	return m.loginUser.FailedLogins, nil
+}
+func (m *mockDB) LockUser(_ context.Context, email string, until time.Time) error {
+	if m.loginUser != nil && m.loginUser.Email == email {
+		m.loginUser.LockedUntil = &until
+		m.loginUser.FailedLogins = 0
+		m.loginUser.Lockouts++
+	}
+	return nil
+}
+func (m *mockDB) SetUserPassword(_ context.Context, email, passwordHash string) error {
+	if m.loginUser != nil && m.loginUser.Email == email {
+		m.loginUser.Password = passwordHash
+	}
+	return nil
+}
+func (m *mockDB) GetUsers(_ context.Context, opts database.GetUsersOptions) ([]models.User, int64, error) {
+	users := []models.User{}
+	for _, user := range m.users {
+		if (opts.Email == "" || user.Email == opts.Email) && strings.Contains(user.Email, strings.ToLower(opts.Search)) {
+			users = append(users, *user)
+		}
+	}
+	return users, int64(len(users)), nil
+}
+func (m *mockDB) SetUserDisabled(_ context.Context, email string, disabled bool) error {
+	for _, user := range m.users {
+		if user.Email == email {
+			user.Disabled = disabled
+		}
+	}
+	return nil
+}
+func (m *mockDB) DeleteUser(_ context.Context, email string) (bool, error) {
+	for i, user := range m.users {
+		if user.Email == email {
+			m.users = append(m.users[:i], m.users[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+func (m *mockDB) SetVerificationSent(_ context.Context, email string, at time.Time) error {
+	if m.loginUser != nil && m.loginUser.Email == email {
+		m.loginUser.VerificationSentAt = &at
+	}
+	return nil
+}
+func (m *mockDB) SetUserVerified(_ context.Context, email string) (bool, error) {
+	if m.loginUser == nil || m.loginUser.Email != email || !m.loginUser.PendingVerification {
+		return false, nil
+	}
+	m.loginUser.PendingVerification = false
+	m.loginUser.VerificationSentAt = nil
+	return true, nil
+}
+func (m *mockDB) GetTwoFactor(_ context.Context, email string) (*models.TwoFactor, error) {
+	if tf, ok := m.twoFactor[email]; ok {
+		copied := *tf
+		return &copied, nil
+	}
+	return nil, nil
+}
+func (m *mockDB) GetTwoFactors(context.Context) ([]models.TwoFactor, error) {
+	enrolments := []models.TwoFactor{}
+	for _, tf := range m.twoFactor {
+		enrolments = append(enrolments, *tf)
+	}
+	return enrolments, nil
+}
+func (m *mockDB) ResealTwoFactorSecret(_ context.Context, email string, old, sealed []byte) (bool, error) {
+	tf, ok := m.twoFactor[email]
+	if !ok || !bytes.Equal(tf.Secret, old) {
+		return false, nil
+	}
+	tf.Secret = sealed
+	return true, nil
+}
+func (m *mockDB) SaveTwoFactor(_ context.Context, tf *models.TwoFactor) error {
+	if m.twoFactor == nil {
+		m.twoFactor = map[string]*models.TwoFactor{}
+	}
+	m.twoFactor[tf.UserEmail] = tf
+	return nil
+}
+func (m *mockDB) EnableTwoFactor(ctx context.Context, email string, recoveryCodes []string, step int64) (bool, error) {
+	tf, ok := m.twoFactor[email]
+	if !ok || tf.ConfirmedAt != nil {
+		return false, nil
+	}
+	now := time.Now()
+	tf.ConfirmedAt, tf.RecoveryCodes, tf.LastStep = &now, recoveryCodes, step
+	if user, _ := m.FindUserByEmail(ctx, email); user != nil {
+		user.TwoFactorEnabled = true
+	}
+	return true, nil
+}
+func (m *mockDB) DisableTwoFactor(ctx context.Context, email string) error {
+	delete(m.twoFactor, email)
+	if user, _ := m.FindUserByEmail(ctx, email); user != nil {
+		user.TwoFactorEnabled = false
+	}
+	return nil
+}
+func (m *mockDB) SetRecoveryCodes(_ context.Context, email string, recoveryCodes []string) error {
+	if tf, ok := m.twoFactor[email]; ok && tf.ConfirmedAt != nil {
+		tf.RecoveryCodes = recoveryCodes
+	}
+	return nil
+}
+func (m *mockDB) UseTOTPStep(_ context.Context, email string, step int64) (bool, error) {
+	tf, ok := m.twoFactor[email]
+	if !ok || tf.LastStep >= step {
+		return false, nil
+	}
+	tf.LastStep = step
+	return true, nil
+}
+func (m *mockDB) UseRecoveryCode(_ context.Context, email, codeHash string) (bool, error) {
+	tf, ok := m.twoFactor[email]
+	if !ok {
+		return false, nil
+	}
+	for i, hash := range tf.RecoveryCodes {
+		if hash == codeHash {
+			tf.RecoveryCodes = append(tf.RecoveryCodes[:i], tf.RecoveryCodes[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+func (m *mockDB) CreatePasswordReset(_ context.Context, reset *models.PasswordReset) error {
+	m.resets = append(m.resets, *reset)
+	return nil
+}
+func (m *mockDB) GetPasswordReset(_ context.Context, tokenHash string) (*models.PasswordReset, error) {
+	for i := range m.resets {
+		if reset := m.resets[i]; reset.TokenHash == tokenHash && reset.UsedAt == nil && time.Now().Before(reset.ExpiresAt) {
+			return &reset, nil
+		}
+	}
+	return nil, nil
+}
+func (m *mockDB) UsePasswordReset(_ context.Context, tokenHash string) (bool, error) {
+	for i := range m.resets {
+		if reset := &m.resets[i]; reset.TokenHash == tokenHash && reset.UsedAt == nil && time.Now().Before(reset.ExpiresAt) {
+			now := time.Now()
+			reset.UsedAt = &now
+			return true, nil
+		}
+	}
+	return false, nil
+}
+func (m *mockDB) GetSigningKeys(context.Context) ([]models.SigningKey, error) {
+	keys := []models.SigningKey{}
+	for _, key := range m.signingKeys {
+		if key.ExpiresAt == nil || key.ExpiresAt.After(time.Now()) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.After(keys[j].CreatedAt) })
+	return keys, nil
+}
+func (m *mockDB) InsertSigningKey(_ context.Context, key *models.SigningKey) error {
+	m.signingKeys = append(m.signingKeys, *key)
+	return nil
+}
+func (m *mockDB) RetireSigningKeys(_ context.Context, createdBefore, expiresAt time.Time) error {
+	for i := range m.signingKeys {
+		if key := &m.signingKeys[i]; key.CreatedAt.Before(createdBefore) && key.ExpiresAt == nil {
+			key.ExpiresAt = &expiresAt
+		}
+	}
+	return nil
+}
+func (m *mockDB) ResealSigningKey(_ context.Context, id string, old, sealed []byte) (bool, error) {
+	for i := range m.signingKeys {
+		if key := &m.signingKeys[i]; key.ID == id && bytes.Equal(key.PrivateKey, old) {
+			key.PrivateKey = sealed
+			return true, nil
+		}
+	}
+	return false, nil
+}
+func (m *mockDB) ResetLoginFailures(_ context.Context, email string) error {
+	if m.loginUser != nil && m.loginUser.Email == email {
+		m.loginUser.FailedLogins = 0
+		m.loginUser.Lockouts = 0
+		m.loginUser.LockedUntil = nil
+	}
+	return nil
+}
 
 // we can exercise the HTTP handlers without talking to a real cluster.
 func newTestServerWithFakeKube(t *testing.T) *Server {
@@ -59,6 +768,7 @@ func newTestServerWithFakeKube(t *testing.T) *Server {
 		kubeClient:    fakeClient,
 		db:            &mockDB{},
 		jwtSecret:     "test-secret",
+		auditChainKey: testAuditChainKey,
 		jwtTTLMinutes: 60,
 	}
 }
@@ -373,3 +1083,2795 @@ func TestLoginAndProtectedRoute(t *testing.T) {
 		t.Errorf("protected route with token: got %v want %v", status, http.StatusOK)
 	}
 }
+
+func TestCreateInstanceHandlerEnforcesMaxTTL(t *testing.T) {
+	t.Setenv("REDIS_GATEWAY_HOST", "localhost")
+
+	s := newTestServerWithFakeKube(t)
+	s.db = &mockDB{settings: &models.Settings{ID: models.SettingsID, MaxInstanceTTLHours: 24}}
+
+	r := gin.New()
+	r.POST("/instances", s.createInstanceHandler)
+
+	// A non-admin asking for more than the maximum is rejected.
+	body := `{"name":"too-long","ttl":"48h"}`
+	req, err := http.NewRequest(http.MethodPost, "/instances", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("ttl over maximum: got %v want %v", status, http.StatusBadRequest)
+	}
+
+	// Without a ttl the maximum becomes the expiry.
+	body = `{"name":"defaulted"}`
+	req, err = http.NewRequest(http.MethodPost, "/instances", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusCreated {
+		t.Fatalf("Handler returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+
+	var resp models.RedisInstance
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	if resp.ExpiresAt == nil {
+		t.Fatalf("expected expiresAt to default to the maximum TTL")
+	}
+	if d := time.Until(*resp.ExpiresAt); d <= 23*time.Hour || d > 24*time.Hour {
+		t.Errorf("unexpected expiresAt: %v from now", d)
+	}
+
+	created, err := s.kubeClient.Resource(kube.RedisFailOver).Namespace("default").Get(context.Background(), "defaulted", v1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get created resource: %v", err)
+	}
+	if kube.GetAnnotation(created, kube.AnnotationExpiresAt) == "" {
+		t.Errorf("expected %s annotation on created resource", kube.AnnotationExpiresAt)
+	}
+}
+
+func TestReapExpiredInstances(t *testing.T) {
+	s := newTestServerWithFakeKube(t)
+	s.expiryWarning = 24 * time.Hour
+	db := &mockDB{}
+	s.db = db
+
+	const namespace = "default"
+	expired := kube.BuildRedisFailover("expired", namespace, 3, 3)
+	setExpiryAnnotation(expired, ptr(time.Now().Add(-time.Minute)))
+	expiringSoon := kube.BuildRedisFailover("expiring-soon", namespace, 3, 3)
+	setExpiryAnnotation(expiringSoon, ptr(time.Now().Add(time.Hour)))
+	for _, rf := range []*unstructured.Unstructured{expired, expiringSoon} {
+		if _, err := s.kubeClient.Resource(kube.RedisFailOver).Namespace(namespace).Create(context.Background(), rf, v1.CreateOptions{}); err != nil {
+			t.Fatalf("failed to seed fake kube client: %v", err)
+		}
+	}
+
+	s.reapInstancesOnce(context.Background())
+	// A second pass must not warn again for the same expiry.
+	s.reapInstancesOnce(context.Background())
+
+	if _, err := s.kubeClient.Resource(kube.RedisFailOver).Namespace(namespace).Get(context.Background(), "expired", v1.GetOptions{}); err == nil {
+		t.Errorf("expected expired instance to be deleted")
+	}
+	if _, err := s.kubeClient.Resource(kube.RedisFailOver).Namespace(namespace).Get(context.Background(), "expiring-soon", v1.GetOptions{}); err != nil {
+		t.Errorf("expected expiring-soon instance to be kept: %v", err)
+	}
+
+	events := map[string]int{}
+	for _, l := range db.serviceLogs {
+		events[l.InstanceName+"/"+l.EventType]++
+	}
+	if events["expired/expired"] != 1 {
+		t.Errorf("expected one expired service log, got %d", events["expired/expired"])
+	}
+	if events["expiring-soon/expiry_warning"] != 1 {
+		t.Errorf("expected one expiry_warning service log, got %d", events["expiring-soon/expiry_warning"])
+	}
+}
+
+func ptr[T any](v T) *T { return &v }
+
+func TestSoftDeleteAndUndeleteInstance(t *testing.T) {
+	t.Setenv("REDIS_GATEWAY_HOST", "localhost")
+
+	s := newTestServerWithFakeKube(t)
+	s.deleteGracePeriod = time.Hour
+	db := &mockDB{}
+	s.db = db
+
+	// Like the operator, treat zero replicas as unset and default them to 3, so scaling
+	// to zero cannot pass for a deletion.
+	fake := s.kubeClient.(*dynamicfake.FakeDynamicClient)
+	fake.PrependReactor("*", "redisfailovers", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if a, ok := action.(interface{ GetObject() runtime.Object }); ok {
+			if obj, ok := a.GetObject().(*unstructured.Unstructured); ok {
+				for _, role := range []string{"redis", "sentinel"} {
+					if replicas, _, _ := unstructured.NestedInt64(obj.Object, "spec", role, "replicas"); replicas == 0 {
+						_ = unstructured.SetNestedField(obj.Object, int64(3), "spec", role, "replicas")
+					}
+				}
+			}
+		}
+		return false, nil, nil
+	})
+
+	const (
+		namespace = "default"
+		name      = "test-instance"
+	)
+	rf := kube.BuildRedisFailover(name, namespace, 2, 3)
+	if err := unstructured.SetNestedField(rf.Object, "redis:7.2", "spec", "redis", "image"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.kubeClient.Resource(kube.RedisFailOver).Namespace(namespace).Create(context.Background(), rf, v1.CreateOptions{}); err != nil {
+		t.Fatalf("failed to seed fake kube client: %v", err)
+	}
+
+	r := gin.New()
+	r.GET("/instances", s.getAllInstancesHandler)
+	r.GET("/instances/:id", s.getInstanceHandler)
+	r.POST("/instances", s.createInstanceHandler)
+	r.DELETE("/instances/:id", s.deleteInstanceHandler)
+	r.PATCH("/instances/:id", s.updateInstanceHandler)
+	r.POST("/instances/:id/undelete", s.undeleteInstanceHandler)
+
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		req, err := http.NewRequest(method, path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := serve(http.MethodDelete, "/instances/test-instance", ""); rr.Code != http.StatusAccepted {
+		t.Fatalf("delete: got %v want %v", rr.Code, http.StatusAccepted)
+	}
+
+	// Nothing is left for the operator to run: the RedisFailover itself is gone.
+	list, err := s.kubeClient.Resource(kube.RedisFailOver).Namespace(namespace).List(context.Background(), v1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Items) != 0 {
+		t.Fatalf("soft-deleted instance still has %d RedisFailovers", len(list.Items))
+	}
+
+	rr := serve(http.MethodGet, "/instances/test-instance", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("get while deleting: got %v want %v", rr.Code, http.StatusOK)
+	}
+	var got struct {
+		Instance models.RedisInstance `json:"instance"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Instance.Status != "Deleting" || got.Instance.PurgeAt == nil {
+		t.Errorf("get while deleting: got status %q purgeAt %v, want Deleting with a purge time", got.Instance.Status, got.Instance.PurgeAt)
+	}
+	rr = serve(http.MethodGet, "/instances", "")
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"status":"Deleting"`) {
+		t.Errorf("list while deleting: got %v %s, want the instance listed as Deleting", rr.Code, rr.Body.String())
+	}
+
+	if rr := serve(http.MethodPatch, "/instances/test-instance", `{"redisReplicas":5}`); rr.Code != http.StatusConflict {
+		t.Errorf("update while deleting: got %v want %v", rr.Code, http.StatusConflict)
+	}
+	if rr := serve(http.MethodDelete, "/instances/test-instance", ""); rr.Code != http.StatusConflict {
+		t.Errorf("delete while deleting: got %v want %v", rr.Code, http.StatusConflict)
+	}
+	if rr := serve(http.MethodPost, "/instances", `{"name":"test-instance"}`); rr.Code != http.StatusConflict {
+		t.Errorf("create with the name of a deleted instance: got %v want %v", rr.Code, http.StatusConflict)
+	}
+
+	if rr := serve(http.MethodPost, "/instances/test-instance/undelete", ""); rr.Code != http.StatusOK {
+		t.Fatalf("undelete: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	obj, err := s.kubeClient.Resource(kube.RedisFailOver).Namespace(namespace).Get(context.Background(), name, v1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get restored resource: %v", err)
+	}
+	if replicas, _, _ := unstructured.NestedInt64(obj.Object, "spec", "redis", "replicas"); replicas != 2 {
+		t.Errorf("spec.redis.replicas after undelete: got %d want 2", replicas)
+	}
+	if image, _, _ := unstructured.NestedString(obj.Object, "spec", "redis", "image"); image != "redis:7.2" {
+		t.Errorf("spec.redis.image after undelete: got %q want %q", image, "redis:7.2")
+	}
+	if kube.GetAnnotation(obj, kube.AnnotationPurgeAt) != "" {
+		t.Errorf("expected %s annotation to be removed after undelete", kube.AnnotationPurgeAt)
+	}
+	if len(db.deleted) != 0 {
+		t.Errorf("expected the stored copy to be removed after undelete, got %d", len(db.deleted))
+	}
+	if rr := serve(http.MethodPost, "/instances/test-instance/undelete", ""); rr.Code != http.StatusConflict {
+		t.Errorf("undelete a running instance: got %v want %v", rr.Code, http.StatusConflict)
+	}
+
+	// Once the grace period is over the reaper purges the instance for good.
+	if rr := serve(http.MethodDelete, "/instances/test-instance", ""); rr.Code != http.StatusAccepted {
+		t.Fatalf("second delete: got %v want %v", rr.Code, http.StatusAccepted)
+	}
+	if len(db.deleted) != 1 {
+		t.Fatalf("expected one stored copy after the second delete, got %d", len(db.deleted))
+	}
+	db.deleted[0].PurgeAt = time.Now().Add(-time.Minute)
+	s.reapInstancesOnce(context.Background())
+	if len(db.deleted) != 0 {
+		t.Errorf("expected instance to be purged after the grace period")
+	}
+	if rr := serve(http.MethodPost, "/instances/test-instance/undelete", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("undelete after purge: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+}
+
+func TestDeletionProtection(t *testing.T) {
+	t.Setenv("REDIS_GATEWAY_HOST", "localhost")
+
+	s := newTestServerWithFakeKube(t)
+
+	r := gin.New()
+	r.POST("/instances", s.createInstanceHandler)
+	r.PATCH("/instances/:id", s.updateInstanceHandler)
+	r.DELETE("/instances/:id", s.deleteInstanceHandler)
+
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		req, err := http.NewRequest(method, path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := serve(http.MethodPost, "/instances", `{"name":"prod","deletionProtection":true}`); rr.Code != http.StatusCreated {
+		t.Fatalf("create: got %v want %v", rr.Code, http.StatusCreated)
+	}
+	if rr := serve(http.MethodDelete, "/instances/prod", ""); rr.Code != http.StatusConflict {
+		t.Errorf("delete protected instance: got %v want %v", rr.Code, http.StatusConflict)
+	}
+	if rr := serve(http.MethodDelete, "/instances/prod?force=true", ""); rr.Code != http.StatusForbidden {
+		t.Errorf("force delete as non-admin: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+
+	// If the instance cannot be read, its protection cannot be checked, so nothing is deleted.
+	fake := s.kubeClient.(*dynamicfake.FakeDynamicClient)
+	fake.PrependReactor("get", "redisfailovers", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, fmt.Errorf("etcd unavailable")
+	})
+	if rr := serve(http.MethodDelete, "/instances/prod", ""); rr.Code != http.StatusInternalServerError {
+		t.Errorf("delete when get fails: got %v want %v", rr.Code, http.StatusInternalServerError)
+	}
+	fake.ReactionChain = fake.ReactionChain[1:]
+	for _, action := range fake.Actions() {
+		if action.GetVerb() == "delete" {
+			t.Fatalf("instance was deleted although it could not be read")
+		}
+	}
+	if rr := serve(http.MethodDelete, "/instances/missing", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("delete missing instance: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+	if rr := serve(http.MethodPatch, "/instances/prod", `{"deletionProtection":false,"redisReplicas":2}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("clear protection alongside other changes: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+	if rr := serve(http.MethodPatch, "/instances/prod", `{"deletionProtection":false}`); rr.Code != http.StatusOK {
+		t.Fatalf("clear protection: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if rr := serve(http.MethodDelete, "/instances/prod", ""); rr.Code != http.StatusOK {
+		t.Errorf("delete after clearing protection: got %v want %v", rr.Code, http.StatusOK)
+	}
+}
+
+func TestUpdateOutsideMaintenanceWindowIsQueued(t *testing.T) {
+	t.Setenv("REDIS_GATEWAY_HOST", "localhost")
+
+	s := newTestServerWithFakeKube(t)
+	db := &mockDB{}
+	s.db = db
+
+	const (
+		namespace = "default"
+		name      = "test-instance"
+	)
+	// A one-minute window that opened a day ago, so it is closed now.
+	opened := time.Now().UTC().Add(-24 * time.Hour)
+	closed := &models.MaintenanceWindow{
+		Day:             strings.ToLower(opened.Weekday().String()),
+		Start:           opened.Format("15:04"),
+		DurationMinutes: 1,
+	}
+	rf := kube.BuildRedisFailover(name, namespace, 3, 3)
+	if err := setMaintenanceWindow(rf, closed); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.kubeClient.Resource(kube.RedisFailOver).Namespace(namespace).Create(context.Background(), rf, v1.CreateOptions{}); err != nil {
+		t.Fatalf("failed to seed fake kube client: %v", err)
+	}
+
+	r := gin.New()
+	r.PATCH("/instances/:id", s.updateInstanceHandler)
+	r.GET("/instances/:id/pending-changes", s.getPendingChangesHandler)
+
+	req, err := http.NewRequest(http.MethodPatch, "/instances/test-instance", strings.NewReader(`{"redisReplicas":5}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("update outside window: got %v want %v", rr.Code, http.StatusAccepted)
+	}
+
+	obj, err := s.kubeClient.Resource(kube.RedisFailOver).Namespace(namespace).Get(context.Background(), name, v1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replicas, _, _ := unstructured.NestedInt64(obj.Object, "spec", "redis", "replicas"); replicas != 3 {
+		t.Errorf("queued change must not be applied yet: got %d replicas want 3", replicas)
+	}
+
+	req, err = http.NewRequest(http.MethodGet, "/instances/test-instance/pending-changes", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	var listResp struct {
+		Count int `json:"count"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &listResp); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	if listResp.Count != 1 {
+		t.Errorf("pending changes: got %d want 1", listResp.Count)
+	}
+
+	// Once the window is open the applier picks the change up.
+	open := &models.MaintenanceWindow{Day: strings.ToLower(time.Now().UTC().Weekday().String()), Start: "00:00", DurationMinutes: 24 * 60}
+	if err := setMaintenanceWindow(obj, open); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.kubeClient.Resource(kube.RedisFailOver).Namespace(namespace).Update(context.Background(), obj, v1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	s.applyPendingChangesOnce(context.Background())
+
+	obj, err = s.kubeClient.Resource(kube.RedisFailOver).Namespace(namespace).Get(context.Background(), name, v1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replicas, _, _ := unstructured.NestedInt64(obj.Object, "spec", "redis", "replicas"); replicas != 5 {
+		t.Errorf("spec.redis.replicas after window opened: got %d want 5", replicas)
+	}
+	if db.pending[0].Status != models.PendingChangeApplied {
+		t.Errorf("pending change status: got %q want %q", db.pending[0].Status, models.PendingChangeApplied)
+	}
+}
+
+func TestRevisionsAndRollback(t *testing.T) {
+	t.Setenv("REDIS_GATEWAY_HOST", "localhost")
+
+	s := newTestServerWithFakeKube(t)
+	db := &mockDB{bindings: []models.RoleBinding{{UserEmail: "op@example.com", Role: models.RoleOperator, Namespace: "default"}}}
+	s.db = db
+
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		if user := c.GetHeader("X-Test-User"); user != "" {
+			c.Set("user_email", user)
+		}
+	})
+	r.POST("/instances", s.createInstanceHandler)
+	r.PATCH("/instances/:id", s.updateInstanceHandler)
+	r.GET("/instances/:id/revisions", s.getRevisionsHandler)
+	r.POST("/instances/:id/rollback", s.rollbackInstanceHandler)
+
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		req, err := http.NewRequest(method, path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := serve(http.MethodPost, "/instances", `{"name":"test-instance","redisReplicas":3,"sentinelReplicas":3}`); rr.Code != http.StatusCreated {
+		t.Fatalf("create: got %v want %v", rr.Code, http.StatusCreated)
+	}
+	if rr := serve(http.MethodPatch, "/instances/test-instance", `{"redisReplicas":5}`); rr.Code != http.StatusOK {
+		t.Fatalf("update: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	rr := serve(http.MethodGet, "/instances/test-instance/revisions", "")
+	var listResp struct {
+		Revisions []struct {
+			Revision int                 `json:"revision"`
+			Changes  []models.SpecChange `json:"changes"`
+		} `json:"revisions"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &listResp); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	if len(listResp.Revisions) != 2 {
+		t.Fatalf("revisions: got %d want 2", len(listResp.Revisions))
+	}
+	latest := listResp.Revisions[0]
+	if latest.Revision != 2 || len(latest.Changes) != 1 || latest.Changes[0].Path != "redis.replicas" {
+		t.Errorf("unexpected latest revision: %+v", latest)
+	}
+
+	// Rolling back restores the whole spec, not just the replica counts, so it takes
+	// instances:update even where instances:scale would do for the counts.
+	req := httptest.NewRequest(http.MethodPost, "/instances/test-instance/rollback?revision=1&namespace=default", nil)
+	req.Header.Set("X-Test-User", "op@example.com")
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("operator rollback: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+
+	obj, err := s.kubeClient.Resource(kube.RedisFailOver).Namespace("default").Get(context.Background(), "test-instance", v1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := unstructured.SetNestedField(obj.Object, "redis:drifted", "spec", "redis", "image"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.kubeClient.Resource(kube.RedisFailOver).Namespace("default").Update(context.Background(), obj, v1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if rr := serve(http.MethodPost, "/instances/test-instance/rollback?revision=9", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("rollback to unknown revision: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+	if rr := serve(http.MethodPost, "/instances/test-instance/rollback?revision=1", ""); rr.Code != http.StatusOK {
+		t.Fatalf("rollback: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	obj, err = s.kubeClient.Resource(kube.RedisFailOver).Namespace("default").Get(context.Background(), "test-instance", v1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replicas, _, _ := unstructured.NestedInt64(obj.Object, "spec", "redis", "replicas"); replicas != 3 {
+		t.Errorf("spec.redis.replicas after rollback: got %d want 3", replicas)
+	}
+	revs, _ := s.db.GetSpecRevisions(context.Background(), "test-instance", "default")
+	spec, _, _ := unstructured.NestedMap(obj.Object, "spec")
+	if changes := models.DiffSpecs(revs[0].Spec, spec); len(changes) != 0 {
+		t.Errorf("spec after rollback differs from revision 1: %+v", changes)
+	}
+	if len(revs) != 3 || revs[2].Source != "rollback" {
+		t.Errorf("expected rollback to be recorded as revision 3, got %+v", revs)
+	}
+}
+
+func TestRefreshRotationAndLogout(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	loginUser := &models.User{
+		Email:    "user@example.com",
+		Password: string(mustHashPassword(t, "password123")),
+	}
+	s := &Server{
+		db:              &mockDB{loginUser: loginUser},
+		jwtSecret:       "test-secret",
+		jwtTTLMinutes:   15,
+		refreshTokenTTL: time.Hour,
+	}
+
+	r := gin.New()
+	r.POST("/auth/login", s.loginHandler)
+	r.POST("/auth/refresh", s.refreshHandler)
+	r.POST("/auth/logout", s.JWTMiddleware(), s.logoutHandler)
+	r.GET("/api/protected", s.JWTMiddleware(), func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"message": "ok"})
+	})
+
+	serve := func(method, path, body, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+	type tokenResp struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	decode := func(rr *httptest.ResponseRecorder) tokenResp {
+		t.Helper()
+		var resp tokenResp
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("failed to unmarshal token response: %v", err)
+		}
+		return resp
+	}
+
+	rr := serve(http.MethodPost, "/auth/login", `{"email":"user@example.com","password":"password123"}`, "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("login: got %d: %s", rr.Code, rr.Body.String())
+	}
+	first := decode(rr)
+	if first.RefreshToken == "" {
+		t.Fatalf("expected a refresh token from login")
+	}
+
+	// refresh rotates the refresh token
+	rr = serve(http.MethodPost, "/auth/refresh", `{"refresh_token":"`+first.RefreshToken+`"}`, "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("refresh: got %d: %s", rr.Code, rr.Body.String())
+	}
+	second := decode(rr)
+	if second.RefreshToken == "" || second.RefreshToken == first.RefreshToken {
+		t.Fatalf("expected a new refresh token, got %q", second.RefreshToken)
+	}
+	if rr := serve(http.MethodGet, "/api/protected", "", second.Token); rr.Code != http.StatusOK {
+		t.Fatalf("refreshed access token: got %d want 200", rr.Code)
+	}
+
+	// logout revokes the session, so both the access and the refresh token stop working
+	if rr := serve(http.MethodPost, "/auth/logout", "", second.Token); rr.Code != http.StatusOK {
+		t.Fatalf("logout: got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := serve(http.MethodGet, "/api/protected", "", second.Token); rr.Code != http.StatusUnauthorized {
+		t.Errorf("access token after logout: got %d want 401", rr.Code)
+	}
+	if rr := serve(http.MethodPost, "/auth/refresh", `{"refresh_token":"`+second.RefreshToken+`"}`, ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("refresh after logout: got %d want 401", rr.Code)
+	}
+
+	// reusing a rotated refresh token revokes the session it belongs to
+	rr = serve(http.MethodPost, "/auth/login", `{"email":"user@example.com","password":"password123"}`, "")
+	login := decode(rr)
+	rr = serve(http.MethodPost, "/auth/refresh", `{"refresh_token":"`+login.RefreshToken+`"}`, "")
+	rotated := decode(rr)
+	if rr := serve(http.MethodPost, "/auth/refresh", `{"refresh_token":"`+login.RefreshToken+`"}`, ""); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("reused refresh token: got %d want 401", rr.Code)
+	}
+	if rr := serve(http.MethodGet, "/api/protected", "", rotated.Token); rr.Code != http.StatusUnauthorized {
+		t.Errorf("access token after refresh token reuse: got %d want 401", rr.Code)
+	}
+}
+
+func TestAPITokens(t *testing.T) {
+	t.Setenv("REDIS_GATEWAY_HOST", "localhost")
+	gin.SetMode(gin.TestMode)
+
+	s := newTestServerWithFakeKube(t)
+	db := &mockDB{loginUser: &models.User{Email: "ci@example.com"}}
+	s.db = db
+	s.refreshTokenTTL = time.Hour
+
+	sessionTokens, err := s.issueSession(context.Background(), db.loginUser, sessionClient{}, false)
+	if err != nil {
+		t.Fatalf("issueSession: %v", err)
+	}
+
+	r := gin.New()
+	api := r.Group("/api", s.JWTMiddleware())
+	api.GET("/instances", s.getAllInstancesHandler)
+	api.POST("/instances", s.createInstanceHandler)
+	api.POST("/tokens", s.createAPITokenHandler)
+	api.GET("/tokens", s.getAPITokensHandler)
+	api.DELETE("/tokens/:id", s.revokeAPITokenHandler)
+
+	serve := func(method, path, body, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := serve(http.MethodPost, "/api/tokens", `{"name":"pipeline","scopes":["read-only"]}`, sessionTokens.AccessToken)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create token: got %d: %s", rr.Code, rr.Body.String())
+	}
+	var created struct {
+		Token    string          `json:"token"`
+		APIToken models.APIToken `json:"apiToken"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &created); err != nil {
+		t.Fatalf("failed to unmarshal create response: %v", err)
+	}
+	if !strings.HasPrefix(created.Token, models.APITokenPrefix) {
+		t.Fatalf("token %q lacks prefix %q", created.Token, models.APITokenPrefix)
+	}
+	if strings.Contains(rr.Body.String(), db.apiTokens[0].TokenHash) {
+		t.Errorf("create response leaks the token hash")
+	}
+
+	if rr := serve(http.MethodPost, "/api/tokens", `{"name":"bad","scopes":["everything"]}`, sessionTokens.AccessToken); rr.Code != http.StatusBadRequest {
+		t.Errorf("unknown scope: got %d want 400", rr.Code)
+	}
+
+	// the read-only token can list instances but not create them or manage tokens
+	if rr := serve(http.MethodGet, "/api/instances", "", created.Token); rr.Code != http.StatusOK {
+		t.Errorf("list with read-only token: got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := serve(http.MethodPost, "/api/instances", `{"name":"x","redisReplicas":1,"sentinelReplicas":1}`, created.Token); rr.Code != http.StatusForbidden {
+		t.Errorf("create with read-only token: got %d want 403", rr.Code)
+	}
+	if rr := serve(http.MethodGet, "/api/tokens", "", created.Token); rr.Code != http.StatusForbidden {
+		t.Errorf("list tokens with api token: got %d want 403", rr.Code)
+	}
+	if db.apiTokens[0].LastUsedAt == nil {
+		t.Errorf("expected last_used_at to be recorded")
+	}
+
+	// token usage shows up in audit logs under the token name
+	rr = serve(http.MethodPost, "/api/tokens", `{"name":"deployer","scopes":["instances:write"]}`, sessionTokens.AccessToken)
+	var writer struct {
+		Token string `json:"token"`
+	}
+	_ = json.Unmarshal(rr.Body.Bytes(), &writer)
+	if rr := serve(http.MethodPost, "/api/instances", `{"name":"ci-cache","redisReplicas":1,"sentinelReplicas":1}`, writer.Token); rr.Code != http.StatusCreated && rr.Code != http.StatusOK {
+		t.Fatalf("create with instances:write token: got %d: %s", rr.Code, rr.Body.String())
+	}
+	last := db.auditLogs[len(db.auditLogs)-1]
+	if last.Action.Action != "create" || last.TokenName != "deployer" || last.UserEmail != "ci@example.com" {
+		t.Errorf("audit entry: got action %q token %q user %q", last.Action.Action, last.TokenName, last.UserEmail)
+	}
+
+	// revoked tokens stop working
+	if rr := serve(http.MethodDelete, "/api/tokens/"+created.APIToken.ID.Hex(), "", sessionTokens.AccessToken); rr.Code != http.StatusOK {
+		t.Fatalf("revoke: got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := serve(http.MethodGet, "/api/instances", "", created.Token); rr.Code != http.StatusUnauthorized {
+		t.Errorf("revoked token: got %d want 401", rr.Code)
+	}
+}
+
+func TestRoleBindings(t *testing.T) {
+	t.Setenv("REDIS_GATEWAY_HOST", "localhost")
+
+	s := newTestServerWithFakeKube(t)
+	db := s.db.(*mockDB)
+
+	// X-Test-User stands in for JWTMiddleware; "admin@example.com" has is_admin.
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		email := c.GetHeader("X-Test-User")
+		c.Set("user_email", email)
+		c.Set("user_is_admin", email == "admin@example.com")
+	})
+	r.GET("/instances", s.getAllInstancesHandler)
+	r.POST("/instances", s.createInstanceHandler)
+	r.PATCH("/instances/:id", s.updateInstanceHandler)
+	r.DELETE("/instances/:id", s.deleteInstanceHandler)
+	r.GET("/audit-logs", s.getAuditLogsHandler)
+	admin := r.Group("/admin", s.AdminMiddleware())
+	admin.POST("/role-bindings", s.createRoleBindingHandler)
+	admin.DELETE("/role-bindings/:id", s.deleteRoleBindingHandler)
+
+	serve := func(user, method, path, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		req, err := http.NewRequest(method, path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Test-User", user)
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+	const adminUser, opUser = "admin@example.com", "op@example.com"
+
+	if rr := serve(adminUser, http.MethodPost, "/instances", `{"name":"cache","namespace":"team-a"}`); rr.Code != http.StatusCreated {
+		t.Fatalf("admin create: got %v: %s", rr.Code, rr.Body.String())
+	}
+	if rr := serve(opUser, http.MethodPatch, "/instances/cache?namespace=team-a", `{"redisReplicas":2}`); rr.Code != http.StatusForbidden {
+		t.Fatalf("scale without binding: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+	if rr := serve(opUser, http.MethodPost, "/admin/role-bindings", `{"userEmail":"op@example.com","role":"owner","namespace":"team-a"}`); rr.Code != http.StatusForbidden {
+		t.Fatalf("non-admin creating binding: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+	if rr := serve(adminUser, http.MethodPost, "/admin/role-bindings", `{"userEmail":"op@example.com","role":"platform-admin","namespace":"team-a"}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("namespaced platform-admin binding: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+	rr := serve(adminUser, http.MethodPost, "/admin/role-bindings", `{"userEmail":"op@example.com","role":"operator","namespace":"team-a"}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create binding: got %v: %s", rr.Code, rr.Body.String())
+	}
+	if rr := serve(adminUser, http.MethodPost, "/admin/role-bindings", `{"userEmail":"op@example.com","role":"owner","namespace":"team-a"}`); rr.Code != http.StatusConflict {
+		t.Errorf("second role in the same namespace: got %v want %v", rr.Code, http.StatusConflict)
+	}
+
+	// an operator can see and scale the instance but not reconfigure or delete it
+	rr = serve(opUser, http.MethodGet, "/instances", "")
+	var listResp struct {
+		Count int `json:"count"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &listResp); err != nil || listResp.Count != 1 {
+		t.Errorf("operator list: got %v %s", rr.Code, rr.Body.String())
+	}
+	if rr := serve(opUser, http.MethodPatch, "/instances/cache?namespace=team-a", `{"redisReplicas":2}`); rr.Code != http.StatusOK {
+		t.Errorf("operator scale: got %v: %s", rr.Code, rr.Body.String())
+	}
+	if rr := serve(opUser, http.MethodPatch, "/instances/cache?namespace=team-a", `{"ttl":"1h"}`); rr.Code != http.StatusForbidden {
+		t.Errorf("operator ttl change: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+	if rr := serve(opUser, http.MethodDelete, "/instances/cache?namespace=team-a", ""); rr.Code != http.StatusForbidden {
+		t.Errorf("operator delete: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+
+	// removing the binding removes the access
+	if rr := serve(adminUser, http.MethodDelete, "/admin/role-bindings/"+db.bindings[0].ID.Hex(), ""); rr.Code != http.StatusOK {
+		t.Fatalf("delete binding: got %v: %s", rr.Code, rr.Body.String())
+	}
+	if rr := serve(opUser, http.MethodPatch, "/instances/cache?namespace=team-a", `{"redisReplicas":3}`); rr.Code != http.StatusForbidden {
+		t.Errorf("scale after unbinding: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+
+	// a role bound in every namespace reads the audit trail of every namespace, but still
+	// not the admin-only entries
+	if rr := serve(adminUser, http.MethodPost, "/admin/role-bindings", `{"userEmail":"auditor@example.com","role":"operator","namespace":"*"}`); rr.Code != http.StatusCreated {
+		t.Fatalf("create * binding: got %v: %s", rr.Code, rr.Body.String())
+	}
+	if rr := serve("auditor@example.com", http.MethodGet, "/audit-logs?admin_only=true", ""); rr.Code != http.StatusOK {
+		t.Fatalf("audit logs: got %v: %s", rr.Code, rr.Body.String())
+	}
+	if !db.auditOpts.AllNamespaces || db.auditOpts.IncludeAdminOnly {
+		t.Errorf("audit log scope of a * operator: got %+v", db.auditOpts)
+	}
+	if rr := serve(opUser, http.MethodGet, "/audit-logs", ""); rr.Code != http.StatusOK || db.auditOpts.AllNamespaces {
+		t.Errorf("audit log scope without a * binding: got %v, %+v", rr.Code, db.auditOpts)
+	}
+}
+
+func TestTeams(t *testing.T) {
+	t.Setenv("REDIS_GATEWAY_HOST", "localhost")
+
+	s := newTestServerWithFakeKube(t)
+	db := s.db.(*mockDB)
+
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Set("user_email", c.GetHeader("X-Test-User"))
+	})
+	r.POST("/teams", s.createTeamHandler)
+	r.POST("/teams/:slug/members", s.addTeamMemberHandler)
+	r.PATCH("/teams/:slug/members/:email", s.updateTeamMemberHandler)
+	r.DELETE("/teams/:slug/members/:email", s.removeTeamMemberHandler)
+	r.GET("/instances", s.getAllInstancesHandler)
+	r.POST("/instances", s.createInstanceHandler)
+	r.DELETE("/instances/:id", s.deleteInstanceHandler)
+	r.GET("/audit-logs", s.getAuditLogsHandler)
+
+	serve := func(user, method, path, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		req, err := http.NewRequest(method, path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Test-User", user)
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+	const alice, bob, carol = "alice@example.com", "bob@example.com", "carol@example.com"
+
+	rr := serve(alice, http.MethodPost, "/teams", `{"name":"Payments Squad"}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create team: got %v: %s", rr.Code, rr.Body.String())
+	}
+	if db.teams[0].Slug != "payments-squad" || db.teams[0].Namespace != "team-payments-squad" {
+		t.Fatalf("unexpected slug/namespace %q/%q", db.teams[0].Slug, db.teams[0].Namespace)
+	}
+	if rr := serve(bob, http.MethodPost, "/teams", `{"name":"payments squad"}`); rr.Code != http.StatusConflict {
+		t.Errorf("duplicate team: got %v want %v", rr.Code, http.StatusConflict)
+	}
+	// team-acme@x.io owns team-acme-at-x-io; no team may take that namespace
+	for _, name := range []string{"acme at x.io", "At Home"} {
+		if rr := serve(bob, http.MethodPost, "/teams", `{"name":"`+name+`"}`); rr.Code != http.StatusBadRequest {
+			t.Errorf("team %q: got %v want %v", name, rr.Code, http.StatusBadRequest)
+		}
+	}
+
+	// alice creates an instance in the team context; bob cannot see it until he joins
+	rr = serve(alice, http.MethodPost, "/instances", `{"name":"ledger","team":"payments-squad"}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create in team: got %v: %s", rr.Code, rr.Body.String())
+	}
+	if rr := serve(bob, http.MethodPost, "/instances", `{"name":"sneaky","team":"payments-squad"}`); rr.Code != http.StatusForbidden {
+		t.Errorf("non-member create in team: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+	if rr := serve(bob, http.MethodPost, "/teams/payments-squad/members", `{"email":"carol@example.com"}`); rr.Code != http.StatusNotFound {
+		t.Errorf("non-member adding members: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+	if rr := serve(alice, http.MethodPost, "/teams/payments-squad/members", `{"email":"bob@example.com","role":"viewer"}`); rr.Code != http.StatusCreated {
+		t.Fatalf("add member: got %v: %s", rr.Code, rr.Body.String())
+	}
+
+	// membership is matched whatever the casing of the email bob logs in with
+	rr = serve("Bob@Example.com", http.MethodGet, "/instances", "")
+	var listResp struct {
+		Count int `json:"count"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &listResp); err != nil || listResp.Count != 1 {
+		t.Errorf("member list: got %v %s", rr.Code, rr.Body.String())
+	}
+	if rr := serve(bob, http.MethodDelete, "/instances/ledger?team=payments-squad", ""); rr.Code != http.StatusForbidden {
+		t.Errorf("viewer delete: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+	if rr := serve(bob, http.MethodPost, "/teams/payments-squad/members", `{"email":"carol@example.com"}`); rr.Code != http.StatusForbidden {
+		t.Errorf("viewer adding members: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+
+	// team audit logs are visible to every member, even viewers
+	if rr := serve(bob, http.MethodGet, "/audit-logs", ""); rr.Code != http.StatusOK {
+		t.Fatalf("audit logs: got %v: %s", rr.Code, rr.Body.String())
+	}
+	found := false
+	for _, ns := range db.auditOpts.Namespaces {
+		found = found || ns == "team-payments-squad"
+	}
+	if !found {
+		t.Errorf("audit log namespaces %v do not include the team namespace", db.auditOpts.Namespaces)
+	}
+
+	// the last owner can neither be demoted nor leave
+	if rr := serve(alice, http.MethodPatch, "/teams/payments-squad/members/"+alice, `{"role":"viewer"}`); rr.Code != http.StatusConflict {
+		t.Errorf("demote last owner: got %v want %v", rr.Code, http.StatusConflict)
+	}
+	if rr := serve(alice, http.MethodDelete, "/teams/payments-squad/members/"+alice, ""); rr.Code != http.StatusConflict {
+		t.Errorf("last owner leaving: got %v want %v", rr.Code, http.StatusConflict)
+	}
+	if rr := serve(alice, http.MethodPatch, "/teams/payments-squad/members/"+bob, `{"role":"owner"}`); rr.Code != http.StatusOK {
+		t.Fatalf("promote: got %v: %s", rr.Code, rr.Body.String())
+	}
+	if rr := serve(bob, http.MethodPost, "/teams/payments-squad/members", `{"email":"carol@example.com","role":"operator"}`); rr.Code != http.StatusCreated {
+		t.Errorf("new owner adding members: got %v: %s", rr.Code, rr.Body.String())
+	}
+	if rr := serve(carol, http.MethodDelete, "/teams/payments-squad/members/"+carol, ""); rr.Code != http.StatusOK {
+		t.Errorf("member leaving: got %v: %s", rr.Code, rr.Body.String())
+	}
+}
+
+// fakeIdP is a minimal OpenID Connect provider: discovery, JWKS, and a token endpoint that
+// checks the PKCE verifier of codes handed out through authorize.
+type fakeIdP struct {
+	*httptest.Server
+	key    *rsa.PrivateKey
+	groups []string
+	codes  map[string]url.Values // code -> authorize request parameters
+}
+
+func newFakeIdP(t *testing.T) *fakeIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &fakeIdP{key: key, codes: map[string]url.Values{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.URL,
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+			"jwks_uri":               idp.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test-key",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		auth, ok := idp.codes[r.PostForm.Get("code")]
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != auth.Get("code_challenge") {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+			"iss":            idp.URL,
+			"aud":            auth.Get("client_id"),
+			"sub":            "user-123",
+			"email":          "sso@example.com",
+			"email_verified": true,
+			"groups":         idp.groups,
+			"nonce":          auth.Get("nonce"),
+			"exp":            time.Now().Add(time.Minute).Unix(),
+		})
+		idToken.Header["kid"] = "test-key"
+		signed, _ := idToken.SignedString(key)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "idp-access-token",
+			"token_type":   "Bearer",
+			"id_token":     signed,
+		})
+	})
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+// authorize plays the user approving the login and returns the callback query.
+func (idp *fakeIdP) authorize(t *testing.T, location string) url.Values {
+	t.Helper()
+	u, err := url.Parse(location)
+	if err != nil || !strings.HasPrefix(location, idp.URL+"/authorize") {
+		t.Fatalf("unexpected authorize redirect %q", location)
+	}
+	q := u.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		t.Fatalf("authorize request without PKCE: %v", q)
+	}
+	code := "code-" + q.Get("state")
+	idp.codes[code] = q
+	return url.Values{"code": {code}, "state": {q.Get("state")}}
+}
+
+func TestOIDCLogin(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	idp := newFakeIdP(t)
+	idp.groups = []string{"developers", "paas-admins"}
+	db := &mockDB{}
+	s := &Server{
+		db:              db,
+		jwtSecret:       "test-secret",
+		secretsKey:      "test-secrets-key",
+		jwtTTLMinutes:   15,
+		refreshTokenTTL: time.Hour,
+		oidc: oidc.New(oidc.Config{
+			IssuerURL:   idp.URL,
+			ClientID:    "paas",
+			RedirectURL: "http://paas.test/auth/oidc/callback",
+		}),
+		oidcAdminGroups:       []string{"paas-admins"},
+		passwordLoginDisabled: true,
+	}
+
+	r := gin.New()
+	r.POST("/auth/login", s.loginHandler)
+	r.POST("/auth/login/2fa", s.loginTwoFactorHandler)
+	r.GET("/auth/oidc/login", s.oidcLoginHandler)
+	r.GET("/auth/oidc/callback", s.oidcCallbackHandler)
+	api := r.Group("/api", s.JWTMiddleware())
+	api.POST("/2fa/enroll", s.enrollTwoFactorHandler)
+	api.POST("/2fa/confirm", s.confirmTwoFactorHandler)
+
+	login := func() (url.Values, *http.Cookie) {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/auth/oidc/login", nil))
+		if rr.Code != http.StatusFound {
+			t.Fatalf("oidc login: got %d: %s", rr.Code, rr.Body.String())
+		}
+		cookies := rr.Result().Cookies()
+		if len(cookies) != 1 {
+			t.Fatalf("expected a login state cookie, got %v", cookies)
+		}
+		return idp.authorize(t, rr.Header().Get("Location")), cookies[0]
+	}
+	callback := func(query url.Values, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/auth/oidc/callback?"+query.Encode(), nil)
+		req.AddCookie(cookie)
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// a callback whose state does not match the cookie is rejected
+	query, cookie := login()
+	query.Set("state", "forged")
+	if rr := callback(query, cookie); rr.Code != http.StatusBadRequest {
+		t.Errorf("forged state: got %d want %d", rr.Code, http.StatusBadRequest)
+	}
+
+	// the first login creates the user and maps the admin group
+	query, cookie = login()
+	rr := callback(query, cookie)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("callback: got %d: %s", rr.Code, rr.Body.String())
+	}
+	var resp struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil || resp.Token == "" {
+		t.Fatalf("expected a token, got %s", rr.Body.String())
+	}
+	if db.loginUser == nil || db.loginUser.Email != "sso@example.com" || db.loginUser.OIDCSubject != "user-123" || !db.loginUser.IsAdmin {
+		t.Fatalf("unexpected user after first login: %+v", db.loginUser)
+	}
+
+	// leaving the admin group revokes admin on the next login
+	idp.groups = []string{"developers"}
+	query, cookie = login()
+	if rr := callback(query, cookie); rr.Code != http.StatusOK {
+		t.Fatalf("second callback: got %d: %s", rr.Code, rr.Body.String())
+	}
+	if db.loginUser.IsAdmin {
+		t.Errorf("expected admin to be revoked after leaving the admin group")
+	}
+	// without a password the provider vouches for the second factor
+	for _, session := range db.sessions {
+		if !session.TwoFactor {
+			t.Errorf("single sign-on session of a user without a password should count as two-factor")
+		}
+	}
+
+	// an account that also has a password can enrol in 2FA, and then single sign-on only earns a challenge
+	db.loginUser.Password = string(mustHashPassword(t, "password123"))
+	serveJSON := func(method, path, body, token string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+	rr = serveJSON(http.MethodPost, "/api/2fa/enroll", "", resp.Token)
+	var enrolment struct {
+		Secret string `json:"secret"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &enrolment); err != nil || rr.Code != http.StatusOK {
+		t.Fatalf("enroll: got %d: %s", rr.Code, rr.Body.String())
+	}
+	secret, err := base32NoPad.DecodeString(enrolment.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	step := time.Now().Unix() / totpPeriod
+	if rr := serveJSON(http.MethodPost, "/api/2fa/confirm", `{"code":"`+totpCode(secret, step)+`"}`, resp.Token); rr.Code != http.StatusOK {
+		t.Fatalf("confirm: got %d: %s", rr.Code, rr.Body.String())
+	}
+	query, cookie = login()
+	rr = callback(query, cookie)
+	var challenge struct {
+		Token          string `json:"token"`
+		ChallengeToken string `json:"challenge_token"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &challenge); err != nil || rr.Code != http.StatusOK || challenge.Token != "" || challenge.ChallengeToken == "" {
+		t.Fatalf("callback with 2FA enrolled: got %d: %s", rr.Code, rr.Body.String())
+	}
+	rr = serveJSON(http.MethodPost, "/auth/login/2fa", `{"challenge_token":"`+challenge.ChallengeToken+`","code":"`+totpCode(secret, step+1)+`"}`, "")
+	if err := json.Unmarshal(rr.Body.Bytes(), &challenge); err != nil || rr.Code != http.StatusOK || challenge.Token == "" {
+		t.Fatalf("second step after single sign-on: got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// password login is switched off
+	req := httptest.NewRequest(http.MethodPost, "/auth/login", strings.NewReader(`{"email":"sso@example.com","password":"x"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("password login while disabled: got %d want %d", rr.Code, http.StatusForbidden)
+	}
+}
+
+func TestRegisterValidation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	s := &Server{
+		db:                  &mockDB{},
+		passwordPolicy:      policy.PasswordPolicy{MinLength: 12, RequireClasses: []string{policy.ClassDigit}, RejectCommon: true},
+		allowedEmailDomains: []string{"example.com"},
+		// no mailer to send verification links with
+		emailVerificationDisabled: true,
+	}
+	r := gin.New()
+	r.POST("/auth/register", s.registerHandler)
+
+	register := func(body string) (int, map[string][]string) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/auth/register", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		var resp struct {
+			Fields map[string][]string `json:"fields"`
+		}
+		_ = json.Unmarshal(rr.Body.Bytes(), &resp)
+		return rr.Code, resp.Fields
+	}
+
+	tests := []struct {
+		name       string
+		body       string
+		wantFields []string
+	}{
+		{"bad email and short password", `{"email":"not-an-email","password":"a"}`, []string{"email", "password"}},
+		{"display name is not a bare address", `{"email":"Bob <bob@example.com>","password":"correct horse 42 battery"}`, []string{"email"}},
+		{"domain not allowed", `{"email":"bob@gmail.com","password":"correct horse 42 battery"}`, []string{"email"}},
+		{"missing digit", `{"email":"bob@example.com","password":"correct horse battery"}`, []string{"password"}},
+		{"common password", `{"email":"bob@example.com","password":"Password1234"}`, []string{"password"}},
+		{"password is the email", `{"email":"bob12345678@example.com","password":"bob12345678"}`, []string{"password"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, fields := register(tt.body)
+			if code != http.StatusBadRequest {
+				t.Fatalf("got %d want %d", code, http.StatusBadRequest)
+			}
+			if len(fields) != len(tt.wantFields) {
+				t.Fatalf("fields: got %v want keys %v", fields, tt.wantFields)
+			}
+			for _, f := range tt.wantFields {
+				if len(fields[f]) == 0 {
+					t.Errorf("expected an error for %q, got %v", f, fields)
+				}
+			}
+		})
+	}
+
+	if code, fields := register(`{"email":"bob@Example.com","password":"correct horse 42 battery"}`); code != http.StatusOK {
+		t.Errorf("valid registration: got %d %v", code, fields)
+	}
+}
+
+func TestLoginThrottleAndLockout(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	db := &mockDB{loginUser: &models.User{
+		Email:    "bob@example.com",
+		Password: string(mustHashPassword(t, "password123")),
+	}}
+	s := &Server{
+		db:               db,
+		jwtSecret:        "test-secret",
+		jwtTTLMinutes:    60,
+		loginMaxFailures: 3,
+		loginLockout:     time.Minute,
+		loginMaxLockout:  4 * time.Minute,
+	}
+	r := gin.New()
+	r.POST("/auth/login", s.loginHandler)
+	r.POST("/api/admin/users/:email/unlock", func(c *gin.Context) {
+		c.Set("user_email", "admin@example.com")
+		c.Set("user_is_admin", true)
+	}, s.unlockUserHandler)
+
+	serve := func(path, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+	login := func(password string) *httptest.ResponseRecorder {
+		t.Helper()
+		return serve("/auth/login", `{"email":"bob@example.com","password":"`+password+`"}`)
+	}
+
+	for i := 0; i < 2; i++ {
+		if rr := login("wrong"); rr.Code != http.StatusUnauthorized {
+			t.Fatalf("failure %d: got %d want 401", i+1, rr.Code)
+		}
+	}
+	rr := login("wrong")
+	if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") == "" {
+		t.Fatalf("third failure should lock the account: got %d, Retry-After %q", rr.Code, rr.Header().Get("Retry-After"))
+	}
+	if db.loginUser.LockedUntil == nil || db.loginUser.Lockouts != 1 {
+		t.Fatalf("account not locked: %+v", db.loginUser)
+	}
+	if rr := login("password123"); rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("correct password while locked: got %d want 429", rr.Code)
+	}
+
+	var failed, locked int
+	for _, entry := range db.auditLogs {
+		switch entry.Action.Action {
+		case "login_failed":
+			failed++
+		case "account_locked":
+			locked++
+		default:
+			continue
+		}
+		if !entry.AdminInfo || entry.ClientIP == "" {
+			t.Errorf("%s audit should be admin-only with the client IP: %+v", entry.Action.Action, entry)
+		}
+	}
+	if failed != 4 || locked != 1 {
+		t.Errorf("got %d login_failed and %d account_locked audits, want 4 and 1", failed, locked)
+	}
+
+	// Each further lockout doubles the lock, up to the maximum.
+	if got := lockoutDuration(s.loginLockout, s.loginMaxLockout, 1); got != 2*time.Minute {
+		t.Errorf("second lockout: got %v want 2m", got)
+	}
+	if got := lockoutDuration(s.loginLockout, s.loginMaxLockout, 5); got != 4*time.Minute {
+		t.Errorf("capped lockout: got %v want 4m", got)
+	}
+
+	// An admin unlock lets the user straight back in; success clears the counters.
+	if rr := serve("/api/admin/users/nobody@example.com/unlock", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("unlock unknown user: got %d want 404", rr.Code)
+	}
+	if rr := serve("/api/admin/users/bob@example.com/unlock", ""); rr.Code != http.StatusOK {
+		t.Fatalf("unlock: got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := login("password123"); rr.Code != http.StatusOK {
+		t.Fatalf("login after unlock: got %d: %s", rr.Code, rr.Body.String())
+	}
+	if db.loginUser.FailedLogins != 0 || db.loginUser.Lockouts != 0 || db.loginUser.LockedUntil != nil {
+		t.Errorf("counters not reset after login: %+v", db.loginUser)
+	}
+
+	// The per-IP limit applies whichever accounts are tried.
+	s.loginIPThrottle = newIPThrottle(2, time.Minute)
+	for i := 0; i < 2; i++ {
+		serve("/auth/login", `{"email":"nobody@example.com","password":"wrong"}`)
+	}
+	if rr := login("password123"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("login from a throttled IP: got %d want 429", rr.Code)
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	attempt := func(s *Server, remoteAddr, forwardedFor string) int {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/auth/login", strings.NewReader(`{"email":"nobody@example.com","password":"wrong"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		req.RemoteAddr = remoteAddr
+		rr := httptest.NewRecorder()
+		s.RegisterRoutes().ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// By default X-Forwarded-For is ignored, so changing it does not get around the per-IP limit.
+	s := &Server{db: &mockDB{}, jwtSecret: "test-secret", loginIPThrottle: newIPThrottle(2, time.Minute)}
+	for i := 0; i < 2; i++ {
+		attempt(s, "203.0.113.9:4000", fmt.Sprintf("198.51.100.%d", i))
+	}
+	if code := attempt(s, "203.0.113.9:4000", "198.51.100.99"); code != http.StatusTooManyRequests {
+		t.Errorf("spoofed X-Forwarded-For: got %d want 429", code)
+	}
+
+	// Behind a trusted proxy every client is counted on its own.
+	s = &Server{db: &mockDB{}, jwtSecret: "test-secret", loginIPThrottle: newIPThrottle(2, time.Minute), trustedProxies: []string{"10.0.0.0/8"}}
+	for i := 0; i < 2; i++ {
+		attempt(s, "10.0.0.2:4000", fmt.Sprintf("198.51.100.%d", i))
+	}
+	if code := attempt(s, "10.0.0.2:4000", "198.51.100.99"); code != http.StatusUnauthorized {
+		t.Errorf("another client behind a trusted proxy: got %d want 401", code)
+	}
+}
+
+// fakeSMTP is a minimal SMTP server that accepts every message and hands its data to messages.
+func fakeSMTP(t *testing.T) (addr string, messages <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	out := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				tp := textproto.NewConn(conn)
+				_ = tp.PrintfLine("220 localhost ESMTP")
+				for {
+					line, err := tp.ReadLine()
+					if err != nil {
+						return
+					}
+					switch verb := strings.ToUpper(strings.Fields(line + " ")[0]); verb {
+					case "EHLO", "HELO", "MAIL", "RCPT":
+						_ = tp.PrintfLine("250 OK")
+					case "DATA":
+						_ = tp.PrintfLine("354 go ahead")
+						data, err := tp.ReadDotBytes()
+						if err != nil {
+							return
+						}
+						out <- string(data)
+						_ = tp.PrintfLine("250 queued")
+					case "QUIT":
+						_ = tp.PrintfLine("221 bye")
+						return
+					default:
+						_ = tp.PrintfLine("502 not implemented")
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), out
+}
+
+func TestChangeAndResetPassword(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	smtpAddr, messages := fakeSMTP(t)
+	db := &mockDB{loginUser: &models.User{
+		Email:    "bob@example.com",
+		Password: string(mustHashPassword(t, "old password 1")),
+	}}
+	s := &Server{
+		db:               db,
+		jwtSecret:        "test-secret",
+		jwtTTLMinutes:    15,
+		refreshTokenTTL:  time.Hour,
+		passwordPolicy:   policy.PasswordPolicy{MinLength: 12},
+		mailer:           &mail.SMTPSender{Addr: smtpAddr, From: "paas@example.com", Timeout: 5 * time.Second},
+		passwordResetTTL: 30 * time.Minute,
+		passwordResetURL: "https://paas.example.com/reset-password",
+	}
+	r := gin.New()
+	r.POST("/auth/login", s.loginHandler)
+	r.POST("/auth/password", s.JWTMiddleware(), s.changePasswordHandler)
+	r.POST("/auth/password/forgot", s.forgotPasswordHandler)
+	r.POST("/auth/password/reset", s.resetPasswordHandler)
+
+	serve := func(path, body, token string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+	activeSessions := func() int {
+		n := 0
+		for _, session := range db.sessions {
+			if session.RevokedAt == nil {
+				n++
+			}
+		}
+		return n
+	}
+	activeAPITokens := func(email string) int {
+		n := 0
+		for _, token := range db.apiTokens {
+			if token.UserEmail == email && token.RevokedAt == nil {
+				n++
+			}
+		}
+		return n
+	}
+	addAPIToken := func(email string) {
+		db.apiTokens = append(db.apiTokens, models.APIToken{ID: primitive.NewObjectID(), UserEmail: email, ExpiresAt: time.Now().Add(time.Hour)})
+	}
+	addAPIToken("bob@example.com")
+	addAPIToken("carol@example.com")
+
+	first, err := s.issueSession(context.Background(), db.loginUser, sessionClient{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.issueSession(context.Background(), db.loginUser, sessionClient{}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if rr := serve("/auth/password", `{"old_password":"wrong","new_password":"new password 2"}`, first.AccessToken); rr.Code != http.StatusUnauthorized {
+		t.Errorf("wrong old password: got %d want 401", rr.Code)
+	}
+	if rr := serve("/auth/password", `{"old_password":"old password 1","new_password":"short"}`, first.AccessToken); rr.Code != http.StatusBadRequest {
+		t.Errorf("weak new password: got %d want 400", rr.Code)
+	}
+	rr := serve("/auth/password", `{"old_password":"old password 1","new_password":"new password 2"}`, first.AccessToken)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("change password: got %d: %s", rr.Code, rr.Body.String())
+	}
+	if n := activeSessions(); n != 1 {
+		t.Errorf("after change: %d active sessions, want only the new one", n)
+	}
+	if n := activeAPITokens("bob@example.com"); n != 0 {
+		t.Errorf("after change: %d active API tokens, want 0", n)
+	}
+	if n := activeAPITokens("carol@example.com"); n != 1 {
+		t.Errorf("after change: another user has %d active API tokens, want 1", n)
+	}
+	addAPIToken("bob@example.com")
+	if rr := serve("/auth/password", `{"old_password":"new password 2","new_password":"new password 3"}`, first.AccessToken); rr.Code != http.StatusUnauthorized {
+		t.Errorf("old session after change: got %d want 401", rr.Code)
+	}
+
+	// Unknown addresses get the same answer and no email.
+	if rr := serve("/auth/password/forgot", `{"email":"nobody@example.com"}`, ""); rr.Code != http.StatusAccepted {
+		t.Errorf("forgot for unknown user: got %d want 202", rr.Code)
+	}
+	if rr := serve("/auth/password/forgot", `{"email":"bob@example.com"}`, ""); rr.Code != http.StatusAccepted {
+		t.Fatalf("forgot: got %d want 202", rr.Code)
+	}
+	if len(db.resets) != 1 {
+		t.Fatalf("got %d password resets, want 1", len(db.resets))
+	}
+
+	var message string
+	select {
+	case message = <-messages:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reset email was sent")
+	}
+	if !strings.Contains(message, "To: bob@example.com") {
+		t.Errorf("email not addressed to bob:\n%s", message)
+	}
+	match := regexp.MustCompile(`reset-password\?token=([A-Za-z0-9_-]+)`).FindStringSubmatch(message)
+	if match == nil {
+		t.Fatalf("no reset link in email:\n%s", message)
+	}
+	resetToken := match[1]
+
+	if rr := serve("/auth/password/reset", `{"token":"`+resetToken+`","new_password":"short"}`, ""); rr.Code != http.StatusBadRequest {
+		t.Errorf("reset with weak password: got %d want 400", rr.Code)
+	}
+	if rr := serve("/auth/password/reset", `{"token":"`+resetToken+`","new_password":"reset password 4"}`, ""); rr.Code != http.StatusOK {
+		t.Fatalf("reset: got %d: %s", rr.Code, rr.Body.String())
+	}
+	if n := activeSessions(); n != 0 {
+		t.Errorf("after reset: %d active sessions, want 0", n)
+	}
+	if n := activeAPITokens("bob@example.com"); n != 0 {
+		t.Errorf("after reset: %d active API tokens, want 0", n)
+	}
+	if rr := serve("/auth/password/reset", `{"token":"`+resetToken+`","new_password":"reset password 5"}`, ""); rr.Code != http.StatusBadRequest {
+		t.Errorf("reusing a reset token: got %d want 400", rr.Code)
+	}
+	if rr := serve("/auth/login", `{"email":"bob@example.com","password":"reset password 4"}`, ""); rr.Code != http.StatusOK {
+		t.Errorf("login with reset password: got %d want 200", rr.Code)
+	}
+}
+
+func TestAdminUsers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	admin := &models.User{Email: "admin@example.com", IsAdmin: true}
+	bob := &models.User{Email: "bob@example.com", Password: string(mustHashPassword(t, "password123"))}
+	db := &mockDB{users: []*models.User{admin, bob, {Email: "carol@example.com"}}}
+	s := &Server{
+		db:              db,
+		jwtSecret:       "test-secret",
+		jwtTTLMinutes:   15,
+		refreshTokenTTL: time.Hour,
+	}
+	r := gin.New()
+	r.POST("/auth/login", s.loginHandler)
+	adminGroup := r.Group("/api/admin", s.JWTMiddleware(), s.AdminMiddleware())
+	adminGroup.GET("/users", s.getUsersHandler)
+	adminGroup.GET("/users/:email", s.getUserHandler)
+	adminGroup.PATCH("/users/:email", s.updateUserHandler)
+	adminGroup.DELETE("/users/:email", s.deleteUserHandler)
+
+	serve := func(method, path, body, token string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+	session := func(user *models.User) string {
+		t.Helper()
+		tokens, err := s.issueSession(context.Background(), user, sessionClient{}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tokens.AccessToken
+	}
+	adminToken, bobToken := session(admin), session(bob)
+
+	rr := serve(http.MethodGet, "/api/admin/users?search=BO", "", adminToken)
+	var list struct {
+		Users []map[string]interface{} `json:"users"`
+		Total int                      `json:"total"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &list); err != nil || rr.Code != http.StatusOK {
+		t.Fatalf("list users: got %d: %s", rr.Code, rr.Body.String())
+	}
+	if list.Total != 1 || len(list.Users) != 1 || list.Users[0]["email"] != "bob@example.com" {
+		t.Fatalf("list users: got %d users, total %d", len(list.Users), list.Total)
+	}
+	if _, ok := list.Users[0]["password"]; ok {
+		t.Errorf("user listing exposes the password field: %v", list.Users[0])
+	}
+	if rr := serve(http.MethodGet, "/api/admin/users/nobody@example.com", "", adminToken); rr.Code != http.StatusNotFound {
+		t.Errorf("get unknown user: got %d want 404", rr.Code)
+	}
+	if rr := serve(http.MethodGet, "/api/admin/users", "", bobToken); rr.Code != http.StatusForbidden {
+		t.Errorf("list users as non-admin: got %d want 403", rr.Code)
+	}
+
+	if rr := serve(http.MethodPatch, "/api/admin/users/admin@example.com", `{"is_admin":false}`, adminToken); rr.Code != http.StatusBadRequest {
+		t.Errorf("demote self: got %d want 400", rr.Code)
+	}
+	// Promotion takes effect on bob's existing token, without a new login.
+	if rr := serve(http.MethodPatch, "/api/admin/users/bob@example.com", `{"is_admin":true}`, adminToken); rr.Code != http.StatusOK || !bob.IsAdmin {
+		t.Fatalf("promote bob: got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := serve(http.MethodGet, "/api/admin/users", "", bobToken); rr.Code != http.StatusOK {
+		t.Errorf("list users after promotion: got %d want 200", rr.Code)
+	}
+
+	if rr := serve(http.MethodPatch, "/api/admin/users/bob@example.com", `{"is_admin":false,"disabled":true}`, adminToken); rr.Code != http.StatusOK || bob.IsAdmin || !bob.Disabled {
+		t.Fatalf("demote and disable bob: got %d, user %+v", rr.Code, bob)
+	}
+	if rr := serve(http.MethodGet, "/api/admin/users", "", bobToken); rr.Code != http.StatusUnauthorized {
+		t.Errorf("revoked session of disabled user: got %d want 401", rr.Code)
+	}
+	if rr := serve(http.MethodGet, "/api/admin/users", "", session(bob)); rr.Code != http.StatusForbidden {
+		t.Errorf("new session of disabled user: got %d want 403", rr.Code)
+	}
+	if rr := serve(http.MethodPost, "/auth/login", `{"email":"bob@example.com","password":"password123"}`, ""); rr.Code != http.StatusForbidden {
+		t.Errorf("login of disabled user: got %d want 403", rr.Code)
+	}
+	if rr := serve(http.MethodPatch, "/api/admin/users/bob@example.com", `{"disabled":false}`, adminToken); rr.Code != http.StatusOK {
+		t.Fatalf("enable bob: got %d", rr.Code)
+	}
+	if rr := serve(http.MethodPost, "/auth/login", `{"email":"bob@example.com","password":"password123"}`, ""); rr.Code != http.StatusOK {
+		t.Errorf("login after enabling: got %d want 200", rr.Code)
+	}
+
+	if rr := serve(http.MethodDelete, "/api/admin/users/admin@example.com", "", adminToken); rr.Code != http.StatusBadRequest {
+		t.Errorf("delete self: got %d want 400", rr.Code)
+	}
+	if rr := serve(http.MethodDelete, "/api/admin/users/bob@example.com", "", adminToken); rr.Code != http.StatusOK {
+		t.Fatalf("delete bob: got %d", rr.Code)
+	}
+	if rr := serve(http.MethodDelete, "/api/admin/users/bob@example.com", "", adminToken); rr.Code != http.StatusNotFound {
+		t.Errorf("delete bob twice: got %d want 404", rr.Code)
+	}
+	// A session whose user is gone is rejected, even if it was never revoked and claims admin.
+	if rr := serve(http.MethodGet, "/api/admin/users", "", session(&models.User{Email: "ghost@example.com", IsAdmin: true})); rr.Code != http.StatusUnauthorized {
+		t.Errorf("session of a missing user: got %d want 401", rr.Code)
+	}
+
+	want := []string{"promote_admin", "demote_admin", "disable_user", "enable_user", "delete_user"}
+	var got []string
+	for _, entry := range db.auditLogs {
+		if entry.Action.Action == "login" || entry.Action.Action == "login_failed" {
+			continue
+		}
+		if !entry.AdminInfo || entry.UserEmail != "admin@example.com" {
+			t.Errorf("%s audit should be admin-only and by the admin: %+v", entry.Action.Action, entry)
+		}
+		got = append(got, entry.Action.Action)
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("audits: got %v want %v", got, want)
+	}
+}
+
+func TestSigningKeysAndJWKS(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	for _, alg := range []string{models.SigningRS256, models.SigningEdDSA} {
+		t.Run(alg, func(t *testing.T) {
+			user := &models.User{ID: primitive.NewObjectID(), Email: "bob@example.com"}
+			db := &mockDB{loginUser: user}
+			keys, err := newKeyring(db, alg, "test-secrets-key", "", time.Hour, time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := keys.rotate(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			s := &Server{
+				db:              db,
+				jwtSecret:       "test-secret",
+				keys:            keys,
+				jwtIssuer:       "paas",
+				jwtAudience:     "paas-api",
+				jwtTTLMinutes:   15,
+				refreshTokenTTL: time.Hour,
+			}
+			r := gin.New()
+			r.GET("/.well-known/jwks.json", s.jwksHandler)
+			r.GET("/api/protected", s.JWTMiddleware(), func(c *gin.Context) {
+				c.JSON(http.StatusOK, gin.H{"message": "ok"})
+			})
+			get := func(path, token string) *httptest.ResponseRecorder {
+				req := httptest.NewRequest(http.MethodGet, path, nil)
+				if token != "" {
+					req.Header.Set("Authorization", "Bearer "+token)
+				}
+				rr := httptest.NewRecorder()
+				r.ServeHTTP(rr, req)
+				return rr
+			}
+			jwks := func() map[string]jsonWebKeyForTest {
+				t.Helper()
+				var resp struct {
+					Keys []jsonWebKeyForTest `json:"keys"`
+				}
+				if err := json.Unmarshal(get("/.well-known/jwks.json", "").Body.Bytes(), &resp); err != nil {
+					t.Fatal(err)
+				}
+				byKid := map[string]jsonWebKeyForTest{}
+				for _, k := range resp.Keys {
+					byKid[k.Kid] = k
+				}
+				return byKid
+			}
+
+			first, err := s.issueSession(context.Background(), user, sessionClient{}, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rr := get("/api/protected", first.AccessToken); rr.Code != http.StatusOK {
+				t.Fatalf("signed token rejected: got %d: %s", rr.Code, rr.Body.String())
+			}
+
+			// Anyone holding the JWKS can verify the token, and the claims name the user by ID.
+			published := jwks()
+			claims := &jwtClaims{}
+			token, err := jwt.ParseWithClaims(first.AccessToken, claims, func(tok *jwt.Token) (interface{}, error) {
+				return published[tok.Header["kid"].(string)].publicKey(t), nil
+			}, jwt.WithValidMethods([]string{alg}), jwt.WithIssuer("paas"), jwt.WithAudience("paas-api"))
+			if err != nil || !token.Valid {
+				t.Fatalf("verify with JWKS: %v", err)
+			}
+			if claims.Subject != user.ID.Hex() {
+				t.Errorf("subject: got %q want %q", claims.Subject, user.ID.Hex())
+			}
+
+			// A token signed with the old shared secret must not be accepted.
+			hs256, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("test-secret"))
+			if rr := get("/api/protected", hs256); rr.Code != http.StatusUnauthorized {
+				t.Errorf("HS256 token with a keyring: got %d want 401", rr.Code)
+			}
+
+			// After rotation new tokens use the new key and old tokens keep working until
+			// the old key expires.
+			db.signingKeys[0].CreatedAt = time.Now().Add(-2 * time.Hour)
+			if err := keys.rotate(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			second, err := s.issueSession(context.Background(), user, sessionClient{}, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if kidOf(t, first.AccessToken) == kidOf(t, second.AccessToken) {
+				t.Fatal("rotation did not change the signing key")
+			}
+			if n := len(jwks()); n != 2 {
+				t.Errorf("JWKS after rotation: got %d keys want 2", n)
+			}
+			if rr := get("/api/protected", first.AccessToken); rr.Code != http.StatusOK {
+				t.Errorf("token signed before rotation: got %d want 200", rr.Code)
+			}
+
+			// Another replica sharing the database verifies tokens it did not sign.
+			other, err := newKeyring(db, alg, "test-secrets-key", "", time.Hour, time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.keys = other
+			if rr := get("/api/protected", second.AccessToken); rr.Code != http.StatusOK {
+				t.Errorf("token from another replica: got %d want 200", rr.Code)
+			}
+
+			expired := time.Now().Add(-time.Second)
+			db.signingKeys[0].ExpiresAt = &expired
+			if err := other.load(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if rr := get("/api/protected", first.AccessToken); rr.Code != http.StatusUnauthorized {
+				t.Errorf("token signed with an expired key: got %d want 401", rr.Code)
+			}
+		})
+	}
+}
+
+// racingKeyDB lets a test run a second replica's key rotation in the middle of another:
+// when the first replica inserts its new key, onInsert runs, and the second replica reads
+// the keys as they were before that insert.
+type racingKeyDB struct {
+	*mockDB
+	before   []models.SigningKey
+	onInsert func()
+}
+
+func (db *racingKeyDB) GetSigningKeys(ctx context.Context) ([]models.SigningKey, error) {
+	if db.before != nil {
+		keys := db.before
+		db.before = nil
+		return keys, nil
+	}
+	return db.mockDB.GetSigningKeys(ctx)
+}
+
+func (db *racingKeyDB) InsertSigningKey(ctx context.Context, key *models.SigningKey) error {
+	if db.onInsert != nil {
+		db.before, _ = db.mockDB.GetSigningKeys(ctx)
+	}
+	if err := db.mockDB.InsertSigningKey(ctx, key); err != nil {
+		return err
+	}
+	if onInsert := db.onInsert; onInsert != nil {
+		db.onInsert = nil
+		onInsert()
+	}
+	return nil
+}
+
+func TestConcurrentKeyRotation(t *testing.T) {
+	db := &racingKeyDB{mockDB: &mockDB{}}
+	first, err := newKeyring(db, models.SigningEdDSA, "test-secrets-key", "", time.Hour, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := newKeyring(db, models.SigningEdDSA, "test-secrets-key", "", time.Hour, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := first.rotate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both replicas find the signing key due for rotation. The first inserts its key, then
+	// the second inserts and retires before the first gets to retire.
+	db.signingKeys[0].CreatedAt = time.Now().Add(-2 * time.Hour)
+	db.onInsert = func() {
+		time.Sleep(2 * time.Millisecond) // creation times are kept to the millisecond
+		if err := second.rotate(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := first.rotate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.signingKeys) != 3 {
+		t.Fatalf("expected both replicas to add a key, got %d keys", len(db.signingKeys))
+	}
+
+	active := 0
+	for _, key := range db.signingKeys {
+		if key.ExpiresAt == nil {
+			active++
+		}
+	}
+	if active != 1 || db.signingKeys[2].ExpiresAt != nil {
+		t.Errorf("expected only the newest key to stay active, got %d active keys", active)
+	}
+	for _, keys := range []*keyring{first, second} {
+		token, err := keys.sign(jwt.MapClaims{"sub": "bob"})
+		if err != nil {
+			t.Fatalf("sign after racing rotations: %v", err)
+		}
+		if kidOf(t, token) != db.signingKeys[2].ID {
+			t.Errorf("signed with %s, want the newest key %s", kidOf(t, token), db.signingKeys[2].ID)
+		}
+	}
+}
+
+func TestSecretsKeyRotation(t *testing.T) {
+	ctx := context.Background()
+	db := &mockDB{}
+	s := &Server{db: db, secretsKey: "old-secrets-key"}
+
+	// A signing key and a TOTP secret sealed under the old key.
+	keys, err := newKeyring(db, models.SigningEdDSA, s.secretsKey, "", time.Hour, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.rotate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	box, err := s.twoFactorBox()
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := []byte("12345678901234567890")
+	sealed, err := box.seal(secret, []byte("bob@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SaveTwoFactor(ctx, &models.TwoFactor{UserEmail: "bob@example.com", Secret: sealed}); err != nil {
+		t.Fatal(err)
+	}
+
+	// With the old key as SECRETS_KEY_PREVIOUS both still open, so no signing key is replaced.
+	s.secretsKey, s.oldSecretsKey = "new-secrets-key", "old-secrets-key"
+	if _, opened, err := s.openTwoFactor(ctx, "bob@example.com"); err != nil || !bytes.Equal(opened, secret) {
+		t.Fatalf("totp secret during rotation: %q, %v", opened, err)
+	}
+	keys, err = newKeyring(db, models.SigningEdDSA, s.secretsKey, s.oldSecretsKey, time.Hour, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.rotate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.signingKeys) != 1 {
+		t.Fatalf("signing key replaced during rotation: %d keys", len(db.signingKeys))
+	}
+
+	resealed, err := s.ResealSecrets(ctx)
+	if err != nil || resealed != 2 {
+		t.Fatalf("reseal: %d resealed, %v", resealed, err)
+	}
+	if resealed, err := s.ResealSecrets(ctx); err != nil || resealed != 0 {
+		t.Errorf("second reseal: %d resealed, %v", resealed, err)
+	}
+
+	// Once resealed, the old key is no longer needed.
+	s.oldSecretsKey = ""
+	if _, opened, err := s.openTwoFactor(ctx, "bob@example.com"); err != nil || !bytes.Equal(opened, secret) {
+		t.Errorf("totp secret after rotation: %q, %v", opened, err)
+	}
+	keys, err = newKeyring(db, models.SigningEdDSA, s.secretsKey, "", time.Hour, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.rotate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.signingKeys) != 1 || keys.signing == nil {
+		t.Errorf("signing key not usable after rotation: %d keys", len(db.signingKeys))
+	}
+	if _, err := s.ResealSecrets(ctx); err == nil {
+		t.Error("reseal without SECRETS_KEY_PREVIOUS should fail")
+	}
+
+	// Under a key it was never sealed with, a secret does not open.
+	s.secretsKey = "other-secrets-key"
+	if _, _, err := s.openTwoFactor(ctx, "bob@example.com"); err == nil {
+		t.Error("totp secret opened under the wrong key")
+	}
+}
+
+type jsonWebKeyForTest struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+}
+
+func (k jsonWebKeyForTest) publicKey(t *testing.T) interface{} {
+	t.Helper()
+	decode := func(s string) []byte {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	if k.Kty == "OKP" {
+		return ed25519.PublicKey(decode(k.X))
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(decode(k.N)), E: int(new(big.Int).SetBytes(decode(k.E)).Int64())}
+}
+
+func kidOf(t *testing.T, token string) string {
+	t.Helper()
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, &jwtClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kid, _ := parsed.Header["kid"].(string)
+	return kid
+}
+
+func TestMaintenanceCommands(t *testing.T) {
+	db := &mockDB{}
+	s := &Server{db: db, passwordPolicy: policy.PasswordPolicy{MinLength: 12}}
+	ctx := context.Background()
+
+	if _, err := s.CreateAdmin(ctx, "root@example.com", "short"); err == nil {
+		t.Error("create-admin accepted a password that fails the policy")
+	}
+	created, err := s.CreateAdmin(ctx, "root@example.com", "a long enough password")
+	if err != nil || !created {
+		t.Fatalf("create-admin: created %v, err %v", created, err)
+	}
+	if db.loginUser == nil || !db.loginUser.IsAdmin || db.loginUser.Password == "a long enough password" {
+		t.Fatalf("unexpected user after create-admin: %+v", db.loginUser)
+	}
+
+	db.loginUser.IsAdmin = false
+	if created, err := s.CreateAdmin(ctx, "root@example.com", ""); err != nil || created || !db.loginUser.IsAdmin {
+		t.Errorf("create-admin on an existing user should promote it: created %v, err %v, user %+v", created, err, db.loginUser)
+	}
+
+	session, err := s.issueSession(ctx, db.loginUser, sessionClient{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ResetPassword(ctx, "nobody@example.com", "another long password"); err == nil {
+		t.Error("reset-password for an unknown user should fail")
+	}
+	if err := s.ResetPassword(ctx, "root@example.com", "another long password"); err != nil {
+		t.Fatalf("reset-password: %v", err)
+	}
+	if bcrypt.CompareHashAndPassword([]byte(db.loginUser.Password), []byte("another long password")) != nil {
+		t.Error("reset-password did not set the new password")
+	}
+	if sessionID, _, _ := strings.Cut(session.RefreshToken, "."); db.sessions[sessionID].RevokedAt == nil {
+		t.Error("reset-password did not revoke the user's sessions")
+	}
+
+	var actions []string
+	for _, entry := range db.auditLogs {
+		if entry.UserEmail != commandActor || !entry.AdminInfo {
+			t.Errorf("command audit should be admin-only by %q: %+v", commandActor, entry)
+		}
+		actions = append(actions, entry.Action.Action)
+	}
+	if strings.Join(actions, ",") != "create_admin,promote_admin,reset_password" {
+		t.Errorf("audits: got %v", actions)
+	}
+}
+
+func TestEmailVerification(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	smtpAddr, messages := fakeSMTP(t)
+	db := &mockDB{}
+	s := &Server{
+		db:                   db,
+		jwtSecret:            "test-secret",
+		jwtTTLMinutes:        15,
+		refreshTokenTTL:      time.Hour,
+		mailer:               &mail.SMTPSender{Addr: smtpAddr, From: "paas@example.com", Timeout: 5 * time.Second},
+		emailVerificationTTL: time.Hour,
+		emailVerificationURL: "https://paas.example.com/verify",
+	}
+	r := gin.New()
+	r.POST("/auth/register", s.registerHandler)
+	r.POST("/auth/login", s.loginHandler)
+	r.POST("/auth/verify-email", s.verifyEmailHandler)
+	r.POST("/auth/verify-email/resend", s.resendVerificationHandler)
+
+	serve := func(path, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+	nextLink := func() url.Values {
+		t.Helper()
+		select {
+		case message := <-messages:
+			match := regexp.MustCompile(`https://paas\.example\.com/verify\?\S+`).FindString(message)
+			link, err := url.Parse(match)
+			if match == "" || err != nil {
+				t.Fatalf("no verification link in email:\n%s", message)
+			}
+			return link.Query()
+		case <-time.After(5 * time.Second):
+			t.Fatal("no verification email was sent")
+		}
+		return nil
+	}
+	login := `{"email":"new@example.com","password":"password123"}`
+	verify := func(email, token string) *httptest.ResponseRecorder {
+		t.Helper()
+		return serve("/auth/verify-email", `{"email":"`+email+`","token":"`+token+`"}`)
+	}
+
+	if rr := serve("/auth/register", login); rr.Code != http.StatusOK {
+		t.Fatalf("register: got %d: %s", rr.Code, rr.Body.String())
+	}
+	if db.loginUser == nil || !db.loginUser.PendingVerification {
+		t.Fatalf("new user should be pending verification: %+v", db.loginUser)
+	}
+	first := nextLink()
+	if first.Get("email") != "new@example.com" || first.Get("token") == "" {
+		t.Fatalf("unexpected link query: %v", first)
+	}
+	if rr := serve("/auth/login", login); rr.Code != http.StatusForbidden {
+		t.Errorf("login before verifying: got %d want 403", rr.Code)
+	}
+
+	if rr := verify("new@example.com", first.Get("token")+"0"); rr.Code != http.StatusBadRequest {
+		t.Errorf("tampered token: got %d want 400", rr.Code)
+	}
+	expired := s.verificationToken(db.loginUser, time.Now().Add(-time.Minute))
+	if rr := verify("new@example.com", expired); rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "expired") {
+		t.Errorf("expired token: got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// A resend right after the first email is swallowed; once the interval passed, it sends.
+	if rr := serve("/auth/verify-email/resend", `{"email":"new@example.com"}`); rr.Code != http.StatusAccepted {
+		t.Errorf("resend: got %d want 202", rr.Code)
+	}
+	sentAt := time.Now().Add(-2 * verificationResendInterval)
+	db.loginUser.VerificationSentAt = &sentAt
+	if rr := serve("/auth/verify-email/resend", `{"email":"new@example.com"}`); rr.Code != http.StatusAccepted {
+		t.Errorf("resend: got %d want 202", rr.Code)
+	}
+	second := nextLink()
+
+	if rr := verify("new@example.com", second.Get("token")); rr.Code != http.StatusOK {
+		t.Fatalf("verify: got %d: %s", rr.Code, rr.Body.String())
+	}
+	if db.loginUser.PendingVerification {
+		t.Error("user still pending after verification")
+	}
+	if rr := serve("/auth/login", login); rr.Code != http.StatusOK {
+		t.Errorf("login after verifying: got %d want 200", rr.Code)
+	}
+
+	counts := map[string]int{}
+	for _, entry := range db.auditLogs {
+		counts[entry.Action.Action]++
+	}
+	if counts["send_verification"] != 2 || counts["verify_email_failed"] != 2 || counts["verify_email"] != 1 {
+		t.Errorf("unexpected verification audits: %v", counts)
+	}
+
+	// An email that could not be sent is reported, not passed off as sent.
+	s.mailer = nil
+	if rr := serve("/auth/register", `{"email":"later@example.com","password":"password123"}`); rr.Code != http.StatusBadGateway {
+		t.Errorf("register without a mailer: got %d want 502", rr.Code)
+	}
+	db.loginUser.PendingVerification, db.loginUser.VerificationSentAt = true, &sentAt
+	if rr := serve("/auth/verify-email/resend", `{"email":"new@example.com"}`); rr.Code != http.StatusBadGateway {
+		t.Errorf("resend without a mailer: got %d want 502", rr.Code)
+	}
+}
+
+func TestTwoFactor(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	db := &mockDB{
+		loginUser: &models.User{ID: primitive.NewObjectID(), Email: "root@example.com", Password: string(mustHashPassword(t, "password123")), IsAdmin: true},
+		users:     []*models.User{{ID: primitive.NewObjectID(), Email: "ops@example.com", Password: string(mustHashPassword(t, "password123")), IsAdmin: true}},
+	}
+	s := &Server{db: db, jwtSecret: "test-secret", secretsKey: "test-secrets-key", jwtTTLMinutes: 15, refreshTokenTTL: time.Hour, loginMaxFailures: 5, loginLockout: time.Minute}
+	r := gin.New()
+	r.POST("/auth/login", s.loginHandler)
+	r.POST("/auth/login/2fa", s.loginTwoFactorHandler)
+	api := r.Group("/api", s.JWTMiddleware())
+	api.GET("/2fa", s.twoFactorStatusHandler)
+	api.POST("/2fa/enroll", s.enrollTwoFactorHandler)
+	api.POST("/2fa/confirm", s.confirmTwoFactorHandler)
+	api.POST("/2fa/disable", s.disableTwoFactorHandler)
+	api.PATCH("/admin/settings", s.AdminMiddleware(), s.updateSettingsHandler)
+
+	serve := func(method, path, body, token string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+	decode := func(rr *httptest.ResponseRecorder) map[string]interface{} {
+		t.Helper()
+		var body map[string]interface{}
+		if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+			t.Fatalf("decode %s: %v", rr.Body.String(), err)
+		}
+		return body
+	}
+	root, err := s.issueSession(context.Background(), db.loginUser, sessionClient{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requireAdmin2FA := `{"require_admin_2fa":true}`
+	if rr := serve(http.MethodPatch, "/api/admin/settings", requireAdmin2FA, root.AccessToken); rr.Code != http.StatusBadRequest {
+		t.Errorf("requiring 2FA without having it: got %d want 400", rr.Code)
+	}
+
+	// Enrolment: nothing changes until a code from the authenticator confirms it.
+	rr := serve(http.MethodPost, "/api/2fa/enroll", "", root.AccessToken)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("enroll: got %d: %s", rr.Code, rr.Body.String())
+	}
+	enrolment := decode(rr)
+	if uri, _ := enrolment["provisioning_uri"].(string); !strings.HasPrefix(uri, "otpauth://totp/PaaS:root@example.com?") {
+		t.Errorf("unexpected provisioning URI %q", uri)
+	}
+	secret, err := base32NoPad.DecodeString(enrolment["secret"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	step := time.Now().Unix() / totpPeriod
+	if rr := serve(http.MethodPost, "/api/2fa/confirm", `{"code":"`+totpCode(secret, step+5)+`"}`, root.AccessToken); rr.Code != http.StatusBadRequest {
+		t.Errorf("confirm with a wrong code: got %d want 400", rr.Code)
+	}
+	rr = serve(http.MethodPost, "/api/2fa/confirm", `{"code":"`+totpCode(secret, step)+`"}`, root.AccessToken)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("confirm: got %d: %s", rr.Code, rr.Body.String())
+	}
+	recoveryCodes := decode(rr)["recovery_codes"].([]interface{})
+	if len(recoveryCodes) != recoveryCodeCount || !db.loginUser.TwoFactorEnabled {
+		t.Fatalf("2FA not enabled: %d recovery codes, enabled=%v", len(recoveryCodes), db.loginUser.TwoFactorEnabled)
+	}
+
+	// Login now stops at a challenge. The confirming code cannot be replayed; the next one works.
+	rr = serve(http.MethodPost, "/auth/login", `{"email":"root@example.com","password":"password123"}`, "")
+	challenge, _ := decode(rr)["challenge_token"].(string)
+	if rr.Code != http.StatusOK || challenge == "" || strings.Contains(rr.Body.String(), `"token"`) {
+		t.Fatalf("password step: got %d: %s", rr.Code, rr.Body.String())
+	}
+	secondStep := func(challenge, field, code string) *httptest.ResponseRecorder {
+		t.Helper()
+		return serve(http.MethodPost, "/auth/login/2fa", `{"challenge_token":"`+challenge+`","`+field+`":"`+code+`"}`, "")
+	}
+	if rr := secondStep(challenge, "code", totpCode(secret, step)); rr.Code != http.StatusUnauthorized {
+		t.Errorf("replayed code: got %d want 401", rr.Code)
+	}
+	tampered := challenge[:len(challenge)-1] + "0"
+	if strings.HasSuffix(challenge, "0") {
+		tampered = challenge[:len(challenge)-1] + "1"
+	}
+	if rr := secondStep(tampered, "code", totpCode(secret, step+1)); rr.Code != http.StatusUnauthorized {
+		t.Errorf("tampered challenge: got %d want 401", rr.Code)
+	}
+	rr = secondStep(challenge, "code", totpCode(secret, step+1))
+	verified, _ := decode(rr)["token"].(string)
+	if rr.Code != http.StatusOK || verified == "" {
+		t.Fatalf("second step: got %d: %s", rr.Code, rr.Body.String())
+	}
+	recovery := strings.ToUpper(recoveryCodes[0].(string))
+	if rr := secondStep(challenge, "recovery_code", recovery); rr.Code != http.StatusOK {
+		t.Errorf("recovery code: got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := secondStep(challenge, "recovery_code", recovery); rr.Code != http.StatusUnauthorized {
+		t.Errorf("reused recovery code: got %d want 401", rr.Code)
+	}
+
+	// With 2FA required, an admin without it is a regular user until they enable it.
+	if rr := serve(http.MethodPatch, "/api/admin/settings", requireAdmin2FA, root.AccessToken); rr.Code != http.StatusOK {
+		t.Fatalf("require admin 2FA: got %d: %s", rr.Code, rr.Body.String())
+	}
+	ops, err := s.issueSession(context.Background(), db.users[0], sessionClient{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = serve(http.MethodPatch, "/api/admin/settings", `{"max_instance_ttl_hours":1}`, ops.AccessToken)
+	if rr.Code != http.StatusForbidden || decode(rr)["two_factor_required"] != true {
+		t.Errorf("admin without 2FA: got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := serve(http.MethodGet, "/api/2fa", "", ops.AccessToken); decode(rr)["required"] != true {
+		t.Errorf("status should say 2FA is required: %s", rr.Body.String())
+	}
+	// Having 2FA is not enough: only sessions that passed it get admin access.
+	skipped, err := s.issueSession(context.Background(), db.loginUser, sessionClient{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rr := serve(http.MethodPatch, "/api/admin/settings", `{"max_instance_ttl_hours":1}`, skipped.AccessToken); rr.Code != http.StatusForbidden {
+		t.Errorf("admin session that skipped 2FA: got %d want 403", rr.Code)
+	}
+	if rr := serve(http.MethodPatch, "/api/admin/settings", `{"max_instance_ttl_hours":1}`, verified); rr.Code != http.StatusOK {
+		t.Errorf("admin session that passed 2FA: got %d: %s", rr.Code, rr.Body.String())
+	}
+	disable := `{"password":"password123","code":"` + totpCode(secret, step+2) + `"}`
+	if rr := serve(http.MethodPost, "/api/2fa/disable", disable, root.AccessToken); rr.Code != http.StatusForbidden {
+		t.Errorf("disabling required 2FA: got %d want 403", rr.Code)
+	}
+
+	counts := map[string]int{}
+	for _, entry := range db.auditLogs {
+		counts[entry.Action.Action]++
+	}
+	if counts["enable_2fa"] != 1 || counts["login_failed"] != 2 || counts["login"] != 2 {
+		t.Errorf("unexpected audits: %v", counts)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	db := &mockDB{users: []*models.User{
+		{Email: "root@example.com", IsAdmin: true},
+		{Email: "alice@example.com", Password: string(mustHashPassword(t, "password123"))},
+	}}
+	s := &Server{db: db, jwtSecret: "test-secret", jwtTTLMinutes: 15, refreshTokenTTL: time.Hour}
+	r := gin.New()
+	r.POST("/auth/login", s.loginHandler)
+	api := r.Group("/api", s.JWTMiddleware())
+	api.GET("/sessions", s.getSessionsHandler)
+	api.DELETE("/sessions/:id", s.revokeSessionHandler)
+	api.DELETE("/admin/users/:email/sessions", s.AdminMiddleware(), s.revokeUserSessionsHandler)
+
+	serve := func(method, path, body, token string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "laptop/1.0")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+	login := func() string {
+		t.Helper()
+		rr := serve(http.MethodPost, "/auth/login", `{"email":"alice@example.com","password":"password123"}`, "")
+		var body struct {
+			Token string `json:"token"`
+		}
+		if rr.Code != http.StatusOK || json.Unmarshal(rr.Body.Bytes(), &body) != nil {
+			t.Fatalf("login: got %d: %s", rr.Code, rr.Body.String())
+		}
+		return body.Token
+	}
+	laptop, phone := login(), login()
+
+	// Listing shows where each session came from and which one is asking.
+	rr := serve(http.MethodGet, "/api/sessions", "", laptop)
+	var listed struct {
+		Sessions []models.Session `json:"sessions"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &listed); err != nil || len(listed.Sessions) != 2 {
+		t.Fatalf("list: got %d: %s", rr.Code, rr.Body.String())
+	}
+	var phoneID string
+	for _, session := range listed.Sessions {
+		if session.UserAgent != "laptop/1.0" || session.ClientIP == "" || session.LastUsedAt == nil {
+			t.Errorf("session missing client details: %+v", session)
+		}
+		if !session.Current {
+			phoneID = session.ID
+		}
+	}
+	if phoneID == "" {
+		t.Fatal("no session was marked current")
+	}
+
+	// The phone is revoked from the laptop and stops working at once.
+	root, err := s.issueSession(context.Background(), db.users[0], sessionClient{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootSessionID, _, _ := strings.Cut(root.RefreshToken, ".")
+	if rr := serve(http.MethodDelete, "/api/sessions/"+rootSessionID, "", laptop); rr.Code != http.StatusNotFound {
+		t.Errorf("revoking another user's session: got %d want 404", rr.Code)
+	}
+	if rr := serve(http.MethodDelete, "/api/sessions/"+phoneID, "", laptop); rr.Code != http.StatusOK {
+		t.Fatalf("revoke: got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := serve(http.MethodGet, "/api/sessions", "", phone); rr.Code != http.StatusUnauthorized {
+		t.Errorf("revoked session: got %d want 401", rr.Code)
+	}
+
+	// An admin signs alice out everywhere.
+	rr = serve(http.MethodDelete, "/api/admin/users/alice@example.com/sessions", "", root.AccessToken)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"revoked":1`) {
+		t.Fatalf("admin revoke: got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := serve(http.MethodGet, "/api/sessions", "", laptop); rr.Code != http.StatusUnauthorized {
+		t.Errorf("session revoked by admin: got %d want 401", rr.Code)
+	}
+}
+
+func TestAuditLogFilters(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	db := &mockDB{}
+	s := &Server{db: db}
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Set("user_email", c.GetHeader("X-Test-User"))
+		c.Set("user_is_admin", c.GetHeader("X-Test-User") == "root@example.com")
+	})
+	r.GET("/audit-logs", s.getAuditLogsHandler)
+
+	get := func(user, query string) int {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/audit-logs?"+query, nil)
+		req.Header.Set("X-Test-User", user)
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	query := url.Values{
+		"from":       {"2024-05-01T00:00:00Z"},
+		"to":         {"2024-05-02T00:00:00+02:00"},
+		"user_email": {"alice@example.com"},
+		"instance":   {"cache"},
+		"namespace":  {"alice-example-com"},
+		"client_ip":  {"10.0.0.7"},
+		"search":     {"maxmemory"},
+		"type":       {"update"},
+	}.Encode()
+	if code := get("root@example.com", query); code != http.StatusOK {
+		t.Fatalf("admin filters: got %d want 200", code)
+	}
+	opts := db.auditOpts
+	from := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2024, 5, 1, 22, 0, 0, 0, time.UTC)
+	if opts.From == nil || !opts.From.Equal(from) || opts.To == nil || !opts.To.Equal(to) {
+		t.Errorf("time range: got %v - %v", opts.From, opts.To)
+	}
+	if opts.UserEmail != "alice@example.com" || opts.InstanceName != "cache" || opts.Namespace != "alice-example-com" ||
+		opts.ClientIP != "10.0.0.7" || opts.Search != "maxmemory" || opts.ActionType != "update" {
+		t.Errorf("filters not passed on: %+v", opts)
+	}
+
+	for _, tc := range []struct {
+		user, query string
+		want        int
+	}{
+		{"alice@example.com", "user_email=bob@example.com", http.StatusForbidden},
+		{"alice@example.com", "instance=cache&search=flush", http.StatusOK},
+		{"alice@example.com", "from=yesterday", http.StatusBadRequest},
+		{"root@example.com", "from=2024-05-02T00:00:00Z&to=2024-05-01T00:00:00Z", http.StatusBadRequest},
+	} {
+		if code := get(tc.user, tc.query); code != tc.want {
+			t.Errorf("%s ?%s: got %d want %d", tc.user, tc.query, code, tc.want)
+		}
+	}
+}
+
+func TestExportLogs(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	now := time.Now()
+	db := &mockDB{
+		auditLogs: []models.AuditLog{
+			{UserEmail: "alice@example.com", Action: models.Action{Action: "create", Name: "cache", Namespace: "alice-at-example-com", Details: "=HYPERLINK(\"http://evil\")"}, Timestamp: now},
+			{UserEmail: "alice@example.com", Action: models.Action{Action: "login"}, AdminInfo: true, Timestamp: now},
+			{UserEmail: "bob@example.com", Action: models.Action{Action: "create", Name: "queue", Namespace: "bob-at-example-com"}, Timestamp: now},
+		},
+		serviceLogs: []models.ServiceLog{
+			{InstanceName: "cache", Namespace: "alice-at-example-com", EventType: "status_change", ToStatus: "Running", Timestamp: now},
+			{InstanceName: "queue", Namespace: "bob-at-example-com", EventType: "status_change", ToStatus: "Failed", Timestamp: now},
+		},
+	}
+	s := &Server{db: db}
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Set("user_email", c.GetHeader("X-Test-User"))
+		c.Set("user_is_admin", c.GetHeader("X-Test-User") == "root@example.com")
+	})
+	r.GET("/audit-logs/export", s.exportAuditLogsHandler)
+	r.GET("/service-logs/export", s.exportServiceLogsHandler)
+
+	get := func(user, path string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("X-Test-User", user)
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// An admin's CSV export holds every entry, with formula-like cells defused. The export
+	// itself is recorded once it has ended, with the number of rows sent.
+	rr := get("root@example.com", "/audit-logs/export?type=create")
+	if rr.Code != http.StatusOK || !strings.HasPrefix(rr.Header().Get("Content-Type"), "text/csv") {
+		t.Fatalf("csv export: got %d %q", rr.Code, rr.Header().Get("Content-Type"))
+	}
+	records, err := csv.NewReader(rr.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1+3 || records[0][0] != "timestamp" || records[1][5] != `'=HYPERLINK("http://evil")` {
+		t.Errorf("unexpected csv export: %q", records)
+	}
+	if trailer := rr.Result().Trailer; trailer.Get("X-Export-Status") != "complete" || trailer.Get("X-Export-Rows") != "3" {
+		t.Errorf("unexpected trailers: %v", trailer)
+	}
+	if db.auditOpts.ActionType != "create" {
+		t.Errorf("export ignored the filters: %+v", db.auditOpts)
+	}
+	exports := 0
+	for _, entry := range db.auditLogs {
+		if entry.Action.Action == "export_audit_logs" && entry.UserEmail == "root@example.com" && strings.Contains(entry.Action.Details, "type=create") &&
+			strings.HasSuffix(entry.Action.Details, ", 3 rows") && entry.Outcome == models.AuditSuccess {
+			exports++
+		}
+	}
+	if exports != 1 {
+		t.Errorf("got %d export audit entries, want 1", exports)
+	}
+
+	// A user's NDJSON export is limited to what they may read.
+	rr = get("alice@example.com", "/service-logs/export?format=ndjson")
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("ndjson export: got %d %q", rr.Code, rr.Header().Get("Content-Type"))
+	}
+	lines := strings.Split(strings.TrimSpace(rr.Body.String()), "\n")
+	var entry models.ServiceLog
+	if len(lines) != 1 || json.Unmarshal([]byte(lines[0]), &entry) != nil || entry.InstanceName != "cache" {
+		t.Errorf("unexpected ndjson export: %q", lines)
+	}
+	if rr := get("alice@example.com", "/audit-logs/export"); strings.Count(rr.Body.String(), "\n") != 1+1 {
+		t.Errorf("user audit export should hold only their non-admin entry:\n%s", rr.Body.String())
+	}
+
+	if rr := get("alice@example.com", "/service-logs/export?format=xml"); rr.Code != http.StatusBadRequest {
+		t.Errorf("unknown format: got %d want 400", rr.Code)
+	}
+
+	// An export cut off halfway is recorded as a failure with the rows sent so far.
+	db.exportErr = fmt.Errorf("cursor lost")
+	rr = get("alice@example.com", "/service-logs/export")
+	if trailer := rr.Result().Trailer; trailer.Get("X-Export-Status") != "failed" || trailer.Get("X-Export-Rows") != "1" {
+		t.Errorf("unexpected trailers of a failed export: %v", trailer)
+	}
+	last := db.auditLogs[len(db.auditLogs)-1]
+	if last.Action.Action != "export_service_logs" || !strings.HasSuffix(last.Action.Details, ", 1 rows") ||
+		last.Outcome != models.AuditFailure || last.Error != "cursor lost" {
+		t.Errorf("unexpected audit entry of a failed export: %+v", last)
+	}
+}
+
+func TestAuditChain(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	db := &mockDB{auditLogs: []models.AuditLog{{UserEmail: "legacy@example.com", Action: models.Action{Action: "login"}}}}
+	s := &Server{db: db, auditChainKey: testAuditChainKey}
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Set("user_email", "root@example.com")
+		c.Set("user_is_admin", true)
+	})
+	r.GET("/api/admin/audit-logs/verify", s.verifyAuditLogsHandler)
+
+	verify := func() auditChainReport {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/admin/audit-logs/verify", nil))
+		var report auditChainReport
+		if rr.Code != http.StatusOK || json.Unmarshal(rr.Body.Bytes(), &report) != nil {
+			t.Fatalf("verify: got %d: %s", rr.Code, rr.Body.String())
+		}
+		return report
+	}
+
+	for i := 0; i < 4; i++ {
+		s.logSystemAudit(context.Background(), models.Action{Action: "expire", Name: fmt.Sprintf("cache-%d", i), Namespace: "default"})
+	}
+	entries := db.auditLogs[1:]
+	if entries[0].Seq != 1 || entries[0].PrevHash != "" || entries[3].Seq != 4 || entries[3].PrevHash != entries[2].Hash {
+		t.Fatalf("entries not chained: %+v", entries)
+	}
+	if report := verify(); !report.Valid || report.Checked != 4 || report.LastSeq != 4 {
+		t.Errorf("intact chain: %+v", report)
+	}
+
+	// Editing an entry breaks its own hash; re-hashing it breaks the link to the next one.
+	original := db.auditLogs[2]
+	db.auditLogs[2].Action.Name = "something-else"
+	if report := verify(); report.Valid || report.BrokenAt != 2 {
+		t.Errorf("edited entry: %+v", report)
+	}
+	db.auditLogs[2].Hash = db.auditLogs[2].ChainHash(testAuditChainKey)
+	if report := verify(); report.Valid || report.BrokenAt != 3 || !strings.Contains(report.Problem, "entry 2 was changed") {
+		t.Errorf("edited and re-hashed entry: %+v", report)
+	}
+	db.auditLogs[2] = original
+
+	// Without the key, re-hashing the rest of the chain after an edit does not help.
+	forged := append([]models.AuditLog(nil), db.auditLogs...)
+	forged[2].Action.Name = "something-else"
+	for i := 2; i < len(forged); i++ {
+		forged[i].Chain(&forged[i-1], []byte("guessed-key"))
+	}
+	db.auditLogs, forged = forged, db.auditLogs
+	if report := verify(); report.Valid || report.BrokenAt != 2 {
+		t.Errorf("chain re-hashed without the key: %+v", report)
+	}
+	db.auditLogs = forged
+
+	// Deleting an entry leaves a gap.
+	db.auditLogs = append(db.auditLogs[:3], db.auditLogs[4:]...)
+	if report := verify(); report.Valid || report.BrokenAt != 4 || !strings.Contains(report.Problem, "entries 3 to 3 are missing") {
+		t.Errorf("deleted entry: %+v", report)
+	}
+}
+
+func TestAuditOutcomes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	db := &mockDB{users: []*models.User{
+		{Email: "root@example.com", IsAdmin: true, Password: string(mustHashPassword(t, "password123"))},
+		{Email: "alice@example.com", Password: string(mustHashPassword(t, "password123"))},
+		{Email: "bob@example.com"},
+	}}
+	s := &Server{db: db, jwtSecret: "test-secret", jwtTTLMinutes: 15, refreshTokenTTL: time.Hour}
+	r := gin.New()
+	r.Use(s.AuditMiddleware())
+	r.POST("/auth/login", s.loginHandler)
+	api := r.Group("/api", s.JWTMiddleware())
+	api.GET("/sessions", s.getSessionsHandler)
+	api.DELETE("/admin/users/:email", s.AdminMiddleware(), s.deleteUserHandler)
+
+	serve := func(method, path, body, token string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+	login := func(email string) string {
+		t.Helper()
+		rr := serve(http.MethodPost, "/auth/login", `{"email":"`+email+`","password":"password123"}`, "")
+		var body struct {
+			Token string `json:"token"`
+		}
+		if rr.Code != http.StatusOK || json.Unmarshal(rr.Body.Bytes(), &body) != nil {
+			t.Fatalf("login: got %d: %s", rr.Code, rr.Body.String())
+		}
+		return body.Token
+	}
+	expect := func(name string, want models.AuditLog) {
+		t.Helper()
+		got := db.auditLogs[len(db.auditLogs)-1]
+		if got.UserEmail != want.UserEmail || got.Action.Action != want.Action.Action || got.Outcome != want.Outcome || got.Error != want.Error {
+			t.Errorf("%s: got entry %+v, want %+v", name, got, want)
+		}
+		if got.Seq == 0 || got.Hash != got.ChainHash(testAuditChainKey) {
+			t.Errorf("%s: entry not chained with its outcome: %+v", name, got)
+		}
+	}
+
+	serve(http.MethodPost, "/auth/login", `{"email":"alice@example.com","password":"wrong"}`, "")
+	expect("wrong password", models.AuditLog{UserEmail: "alice@example.com", Action: models.Action{Action: "login_failed"},
+		Outcome: models.AuditDenied, Error: "invalid credentials"})
+	serve(http.MethodPost, "/auth/login", `{"email":"alice@example.com"}`, "")
+	expect("missing password", models.AuditLog{UserEmail: "alice@example.com", Action: models.Action{Action: "login"},
+		Outcome: models.AuditFailure, Error: "email or password are required"})
+	alice, root := login("alice@example.com"), login("root@example.com")
+	expect("login", models.AuditLog{UserEmail: "root@example.com", Action: models.Action{Action: "login"}, Outcome: models.AuditSuccess})
+
+	// Rejected by a middleware before the handler knew what it was about.
+	serve(http.MethodDelete, "/api/admin/users/bob@example.com", "", alice)
+	expect("non-admin", models.AuditLog{UserEmail: "alice@example.com", Action: models.Action{Action: "request"},
+		Outcome: models.AuditDenied, Error: "admin access required"})
+	serve(http.MethodDelete, "/api/admin/users/bob@example.com", "", "")
+	expect("no token", models.AuditLog{Action: models.Action{Action: "request"},
+		Outcome: models.AuditDenied, Error: "missing Authorization header"})
+	serve(http.MethodDelete, "/api/admin/users/root@example.com", "", root)
+	expect("self-delete", models.AuditLog{UserEmail: "root@example.com", Action: models.Action{Action: "delete_user"},
+		Outcome: models.AuditFailure, Error: "you cannot delete your own account"})
+	serve(http.MethodDelete, "/api/admin/users/carol@example.com", "", root)
+	expect("unknown user", models.AuditLog{UserEmail: "root@example.com", Action: models.Action{Action: "delete_user"},
+		Outcome: models.AuditFailure, Error: "user not found"})
+	serve(http.MethodDelete, "/api/admin/users/bob@example.com", "", root)
+	expect("delete", models.AuditLog{UserEmail: "root@example.com", Action: models.Action{Action: "delete_user"}, Outcome: models.AuditSuccess})
+
+	// Reads are not recorded unless their handler logs them.
+	before := len(db.auditLogs)
+	if rr := serve(http.MethodGet, "/api/sessions", "", root); rr.Code != http.StatusOK || len(db.auditLogs) != before {
+		t.Errorf("read: got %d and %d new entries", rr.Code, len(db.auditLogs)-before)
+	}
+	if rr := serve(http.MethodPost, "/api/nowhere", "", root); rr.Code != http.StatusNotFound || len(db.auditLogs) != before {
+		t.Errorf("unknown route: got %d and %d new entries", rr.Code, len(db.auditLogs)-before)
+	}
+
+	if got := auditOutcome(http.StatusAccepted); got != models.AuditSuccess {
+		t.Errorf("auditOutcome(202) = %q", got)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	t.Setenv("REDIS_GATEWAY_HOST", "localhost")
+	gin.SetMode(gin.TestMode)
+
+	s := newTestServerWithFakeKube(t)
+	db := s.db.(*mockDB)
+	r := gin.New()
+	r.Use(s.RequestIDMiddleware(), s.AuditMiddleware())
+	r.POST("/instances", s.createInstanceHandler)
+
+	create := func(name, requestID string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/instances", strings.NewReader(`{"name":"`+name+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+		if requestID != "" {
+			req.Header.Set("X-Request-ID", requestID)
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("create %s: got %d: %s", name, rr.Code, rr.Body.String())
+		}
+		return rr
+	}
+
+	// A usable client ID is kept and follows the instance into the audit and service logs.
+	rr := create("cache", "deploy-42")
+	if got := rr.Header().Get("X-Request-ID"); got != "deploy-42" {
+		t.Errorf("response header: got %q", got)
+	}
+	if got := db.auditLogs[len(db.auditLogs)-1]; got.Action.Action != "create" || got.RequestID != "deploy-42" {
+		t.Errorf("audit entry: got %+v", got)
+	}
+	obj, err := s.kubeClient.Resource(kube.RedisFailOver).Namespace("default").Get(context.Background(), "cache", v1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := kube.GetAnnotation(obj, kube.AnnotationRequestID); got != "deploy-42" {
+		t.Errorf("annotation: got %q", got)
+	}
+	if _, err := s.processInstanceStatus(context.Background(), obj); err != nil {
+		t.Fatal(err)
+	}
+	if got := db.serviceLogs[len(db.serviceLogs)-1]; got.RequestID != "deploy-42" {
+		t.Errorf("service log: got %+v", got)
+	}
+
+	// Missing or unusable IDs are replaced with a new one.
+	seen := map[string]bool{}
+	for i, requestID := range []string{"", "has spaces", strings.Repeat("x", maxRequestIDLength+1)} {
+		got := create(fmt.Sprintf("cache-%d", i), requestID).Header().Get("X-Request-ID")
+		if !regexp.MustCompile(`^[0-9a-f]{32}$`).MatchString(got) || seen[got] {
+			t.Errorf("request ID for %q: got %q", requestID, got)
+		}
+		seen[got] = true
+	}
+
+	// A background change drops the annotation, so later service logs do not point to a stale request.
+	setRequestIDAnnotation(context.Background(), obj)
+	if got := kube.GetAnnotation(obj, kube.AnnotationRequestID); got != "" {
+		t.Errorf("annotation after background change: got %q", got)
+	}
+
+	line := requestLogFormatter(gin.LogFormatterParams{StatusCode: http.StatusCreated, Method: http.MethodPost, Path: "/api/instances",
+		Keys: map[any]any{"request_id": "deploy-42"}})
+	if !strings.Contains(line, "request_id=deploy-42") {
+		t.Errorf("log line: got %q", line)
+	}
+}
+
+func TestLogRetention(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	s := newTestServerWithFakeKube(t)
+	db := s.db.(*mockDB)
+	r := gin.New()
+	r.POST("/api/admin/retention/run", s.runRetentionHandler)
+	r.PATCH("/api/admin/settings", s.updateSettingsHandler)
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Archiving needs somewhere to archive to.
+	if rr := serve(http.MethodPatch, "/api/admin/settings", `{"audit_log_retention_days":30,"service_log_retention_days":30,"archive_logs":true}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("archive without a location: got %d: %s", rr.Code, rr.Body.String())
+	}
+	dir := t.TempDir()
+	s.archive = &archive.Dir{Path: dir}
+	if rr := serve(http.MethodPatch, "/api/admin/settings", `{"audit_log_retention_days":30,"service_log_retention_days":30,"archive_logs":true}`); rr.Code != http.StatusOK {
+		t.Fatalf("settings: got %d: %s", rr.Code, rr.Body.String())
+	}
+	db.auditLogs = nil
+
+	now := time.Now()
+	old, recent := now.AddDate(0, 0, -40), now.Add(-time.Hour)
+	db.auditLogs = append(db.auditLogs, models.AuditLog{UserEmail: "legacy@example.com", Action: models.Action{Action: "login"}, Timestamp: old})
+	// Entry 3 is old but was written after the recent entry 2, so it has to stay for the chain to stay whole.
+	for _, ts := range []time.Time{old, recent, old, recent} {
+		if err := db.InsertAuditLog(context.Background(), &models.AuditLog{UserEmail: "alice@example.com", Action: models.Action{Action: "create"}, Timestamp: ts}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.serviceLogs = []models.ServiceLog{
+		{InstanceName: "cache", Namespace: "default", EventType: "status_change", Timestamp: old},
+		{InstanceName: "cache", Namespace: "default", EventType: "status_change", Timestamp: recent},
+	}
+	if _, err := s.kubeClient.Resource(kube.RedisFailOver).Namespace("default").Create(context.Background(), kube.BuildRedisFailover("cache", "default", 3, 3), v1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	db.statusCache = []models.InstanceStatusCache{
+		{InstanceName: "cache", Namespace: "default", Status: "Running", UpdatedAt: old},
+		{InstanceName: "gone", Namespace: "default", Status: "Running", UpdatedAt: old},
+	}
+
+	rr := serve(http.MethodPost, "/api/admin/retention/run", "")
+	var body struct {
+		Report retentionReport `json:"report"`
+	}
+	if rr.Code != http.StatusOK || json.Unmarshal(rr.Body.Bytes(), &body) != nil {
+		t.Fatalf("run: got %d: %s", rr.Code, rr.Body.String())
+	}
+	if report := body.Report; report.AuditLogs != 2 || report.ServiceLogs != 1 || report.StatusCache != 1 || len(report.Archives) != 2 {
+		t.Errorf("report: got %+v", report)
+	}
+	if len(db.serviceLogs) != 1 || len(db.statusCache) != 1 || db.statusCache[0].InstanceName != "cache" {
+		t.Errorf("left over: service logs %+v, status cache %+v", db.serviceLogs, db.statusCache)
+	}
+	if got := db.auditLogs[len(db.auditLogs)-1]; got.Action.Action != "purge_logs" || !strings.Contains(got.Action.Details, "audit_logs: 2 entries") {
+		t.Errorf("purge audit entry: got %+v", got)
+	}
+
+	// The archive holds exactly what was purged, as gzip-compressed NDJSON.
+	file, err := os.Open(filepath.Join(dir, filepath.FromSlash(body.Report.Archives[0][len(dir)+1:])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var archived []models.AuditLog
+	for dec := json.NewDecoder(gz); dec.More(); {
+		var entry models.AuditLog
+		if err := dec.Decode(&entry); err != nil {
+			t.Fatal(err)
+		}
+		archived = append(archived, entry)
+	}
+	if len(archived) != 2 || archived[0].UserEmail != "legacy@example.com" || archived[1].Seq != 1 {
+		t.Errorf("archived audit entries: got %+v", archived)
+	}
+
+	// The chain still verifies from the anchor on, and still notices a broken first link.
+	if report, err := s.verifyAuditChain(context.Background()); err != nil || !report.Valid || report.PurgedThrough != 1 || report.FirstSeq != 2 {
+		t.Errorf("verify after purge: got %+v, %v", report, err)
+	}
+	anchor := *db.anchor
+	db.anchor.Hash = strings.Repeat("0", 64)
+	if report, _ := s.verifyAuditChain(context.Background()); report.Valid || report.BrokenAt != 1 || !strings.Contains(report.Problem, "anchor") {
+		t.Errorf("verify with an edited anchor: got %+v", report)
+	}
+	db.anchor.MAC = models.AuditAnchorMAC(testAuditChainKey, db.anchor.Seq, db.anchor.Hash)
+	if report, _ := s.verifyAuditChain(context.Background()); report.Valid || report.BrokenAt != 2 || !strings.Contains(report.Problem, "last purged entry") {
+		t.Errorf("verify with a wrong anchor: got %+v", report)
+	}
+	*db.anchor = anchor
+
+	// Nothing is purged if it cannot be archived first.
+	s.archive = nil
+	db.serviceLogs = append(db.serviceLogs, models.ServiceLog{InstanceName: "cache", Namespace: "default", Timestamp: old})
+	if rr := serve(http.MethodPost, "/api/admin/retention/run", ""); rr.Code != http.StatusInternalServerError || len(db.serviceLogs) != 2 {
+		t.Errorf("run without an archive: got %d, %d service logs: %s", rr.Code, len(db.serviceLogs), rr.Body.String())
+	}
+}
@@ -4,27 +4,98 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/golang-jwt/jwt/v5"
 	_ "github.com/joho/godotenv/autoload"
 	"k8s.io/client-go/dynamic"
 
+	"backend/internal/archive"
 	"backend/internal/database"
 	"backend/internal/kube"
+	"backend/internal/mail"
+	"backend/internal/models"
+	"backend/internal/oidc"
+	"backend/internal/policy"
 )
 
 type Server struct {
-	port          int
-	kubeClient    dynamic.Interface
-	db            database.Service
-	jwtSecret     string
-	jwtTTLMinutes int
+	port              int
+	kubeClient        dynamic.Interface
+	db                database.Service
+	jwtSecret         string   // signs access tokens when there is no keyring
+	keys              *keyring // nil signs access tokens with HS256 and jwtSecret
+	secretsKey        string   // seals secrets stored in the database and signs the SSO state cookie
+	oldSecretsKey     string   // the SECRETS_KEY being rotated out; see New
+	auditChainKey     []byte   // keys the audit hash chain; the database holds the same key
+	jwtIssuer         string
+	jwtAudience       string
+	jwtTTLMinutes     int
+	refreshTokenTTL   time.Duration // how long a refresh token stays usable; each refresh extends it
+	expiryWarning     time.Duration // how long before expiry the reaper warns in service logs
+	deleteGracePeriod time.Duration // how long deleted instances stay recoverable; 0 deletes immediately
+
+	passwordLoginDisabled bool           // only single sign-on may be used to log in
+	oidc                  *oidc.Provider // nil when single sign-on is not configured
+	oidcAdminGroups       []string       // provider groups whose members are admins; empty leaves is_admin alone
+	oidcTrustEmail        bool           // accept emails the provider has not marked as verified
+	oidcPostLoginURL      string         // frontend URL that receives the tokens after single sign-on
+
+	passwordPolicy      policy.PasswordPolicy
+	allowedEmailDomains []string // self-registration is limited to these domains; empty allows any
+
+	trustedProxies   []string      // proxies whose X-Forwarded-For gives the client address; empty trusts none
+	loginIPThrottle  *ipThrottle   // nil disables the per-IP limit
+	loginMaxFailures int           // consecutive failures that lock an account; 0 disables lockout
+	loginLockout     time.Duration // first lock; each further lockout doubles it
+	loginMaxLockout  time.Duration
+
+	mailer           mail.Sender
+	passwordResetTTL time.Duration
+	passwordResetURL string // frontend page that takes the reset token as ?token=; empty mails the bare token
+
+	emailVerificationDisabled bool // self-registered accounts can log in without verifying their address
+	emailVerificationTTL      time.Duration
+	emailVerificationURL      string // frontend page that takes ?email= and ?token=; empty mails the bare token
+
+	archive     archive.Store // where logs are archived before they are purged; nil if nowhere
+	retentionMu sync.Mutex    // held by the running retention job
 }
 
+// NewServer builds the API server from the environment, starts its background jobs and
+// returns the HTTP server to run.
 func NewServer() *http.Server {
+	srv := New()
+
+	go srv.RunStatusPoller(context.Background())
+	go srv.RunInstanceReaper(context.Background())
+	go srv.RunMaintenanceApplier(context.Background())
+	go srv.RunLogRetention(context.Background())
+	if srv.keys != nil {
+		go srv.RunKeyRotation(context.Background())
+	}
+
+	// Declare Server config
+	server := &http.Server{
+		Addr:         fmt.Sprintf(":%d", srv.port),
+		Handler:      srv.RegisterRoutes(),
+		IdleTimeout:  time.Minute,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 30 * time.Second,
+	}
+
+	return server
+}
+
+// New reads the configuration from the environment and connects to MongoDB and the cluster.
+// It starts nothing, so the maintenance commands in cmd/api can use it too.
+func New() *Server {
 	port, _ := strconv.Atoi(os.Getenv("PORT"))
 	if port == 0 {
 		port = 8080
@@ -35,35 +106,299 @@ func NewServer() *http.Server {
 		log.Fatal("JWT_SECRET environment variable is required")
 	}
 
-	jwtTTLMinutes := 60
+	// SECRETS_KEY seals the secrets kept in MongoDB (signing keys and TOTP secrets) and signs
+	// the SSO state cookie. It is separate from JWT_SECRET, so that a leaked token signing
+	// secret does not also open them. To rotate it: move the old key to SECRETS_KEY_PREVIOUS
+	// and set a new SECRETS_KEY on every replica, run "api reseal-secrets", then remove
+	// SECRETS_KEY_PREVIOUS. Deployments from before SECRETS_KEY move over the same way, with
+	// JWT_SECRET as the previous key. Single sign-on logins in progress have to start again.
+	secretsKey := os.Getenv("SECRETS_KEY")
+	if secretsKey == "" {
+		log.Fatal("SECRETS_KEY environment variable is required")
+	}
+	if secretsKey == jwtSecret {
+		log.Fatal("SECRETS_KEY must differ from JWT_SECRET")
+	}
+	oldSecretsKey := os.Getenv("SECRETS_KEY_PREVIOUS")
+
+	// Keys the audit log's hash chain. It lives outside MongoDB, so write access there is not
+	// enough to edit an entry and re-hash the chain. Entries hashed under one key do not
+	// verify under another, so it must stay the same for as long as entries are kept.
+	auditChainKey := os.Getenv("AUDIT_CHAIN_KEY")
+	if auditChainKey == "" {
+		log.Fatal("AUDIT_CHAIN_KEY environment variable is required")
+	}
+
+	jwtTTLMinutes := 15
 	if v := os.Getenv("JWT_TTL_MINUTES"); v != "" {
 		if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 {
 			jwtTTLMinutes = parsed
 		}
 	}
 
+	signingAlg := os.Getenv("JWT_SIGNING_ALG")
+	if signingAlg == "" {
+		signingAlg = models.SigningRS256
+	}
+	keyRotationHours := 24 * 30
+	if v := os.Getenv("JWT_KEY_ROTATION_HOURS"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 {
+			keyRotationHours = parsed
+		}
+	}
+	jwtIssuer := os.Getenv("JWT_ISSUER")
+	if jwtIssuer == "" {
+		jwtIssuer = "paas"
+	}
+	jwtAudience := os.Getenv("JWT_AUDIENCE")
+	if jwtAudience == "" {
+		jwtAudience = "paas-api"
+	}
+
+	refreshTokenHours := 168
+	if v := os.Getenv("REFRESH_TOKEN_TTL_HOURS"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 {
+			refreshTokenHours = parsed
+		}
+	}
+
+	expiryWarningHours := 24
+	if v := os.Getenv("INSTANCE_EXPIRY_WARNING_HOURS"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed >= 0 {
+			expiryWarningHours = parsed
+		}
+	}
+
+	deleteGraceHours := 24
+	if v := os.Getenv("INSTANCE_DELETE_GRACE_HOURS"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed >= 0 {
+			deleteGraceHours = parsed
+		}
+	}
+
+	var oidcProvider *oidc.Provider
+	if issuer := os.Getenv("OIDC_ISSUER_URL"); issuer != "" {
+		scopes := strings.Fields(os.Getenv("OIDC_SCOPES"))
+		if len(scopes) == 0 {
+			scopes = []string{"email", "profile"}
+		}
+		oidcProvider = oidc.New(oidc.Config{
+			IssuerURL:    issuer,
+			ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+			ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+			RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+			Scopes:       scopes,
+			GroupsClaim:  os.Getenv("OIDC_GROUPS_CLAIM"),
+		})
+	}
+	var oidcAdminGroups []string
+	for _, g := range strings.Split(os.Getenv("OIDC_ADMIN_GROUPS"), ",") {
+		if g = strings.TrimSpace(g); g != "" {
+			oidcAdminGroups = append(oidcAdminGroups, g)
+		}
+	}
+
+	passwordLoginDisabled := os.Getenv("PASSWORD_LOGIN_ENABLED") == "false"
+	if passwordLoginDisabled && oidcProvider == nil {
+		log.Fatal("PASSWORD_LOGIN_ENABLED=false requires OIDC_ISSUER_URL, otherwise nobody can log in")
+	}
+
+	passwordPolicy := policy.PasswordPolicy{MinLength: 12, RejectCommon: true}
+	if v := os.Getenv("PASSWORD_MIN_LENGTH"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 {
+			passwordPolicy.MinLength = parsed
+		}
+	}
+	for _, class := range strings.Split(os.Getenv("PASSWORD_REQUIRE_CLASSES"), ",") {
+		if class = strings.TrimSpace(class); class == "" {
+			continue
+		}
+		if !policy.ValidClass(class) {
+			log.Fatalf("PASSWORD_REQUIRE_CLASSES: unknown class %q (use upper, lower, digit, symbol)", class)
+		}
+		passwordPolicy.RequireClasses = append(passwordPolicy.RequireClasses, class)
+	}
+	if os.Getenv("PASSWORD_REJECT_COMMON") == "false" {
+		passwordPolicy.RejectCommon = false
+	}
+	var allowedEmailDomains []string
+	for _, d := range strings.Split(os.Getenv("REGISTRATION_ALLOWED_DOMAINS"), ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			allowedEmailDomains = append(allowedEmailDomains, d)
+		}
+	}
+
+	// The client address feeds the per-IP login throttle and the audit log, so it is only
+	// taken from X-Forwarded-For when the request came through one of these proxies.
+	var trustedProxies []string
+	for _, p := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(p); err != nil && net.ParseIP(p) == nil {
+			log.Fatalf("TRUSTED_PROXIES: %q is neither an IP address nor a CIDR", p)
+		}
+		trustedProxies = append(trustedProxies, p)
+	}
+
+	loginIPMaxFailures := 20
+	if v := os.Getenv("LOGIN_IP_MAX_FAILURES"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed >= 0 {
+			loginIPMaxFailures = parsed
+		}
+	}
+	loginIPWindowMinutes := 15
+	if v := os.Getenv("LOGIN_IP_WINDOW_MINUTES"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 {
+			loginIPWindowMinutes = parsed
+		}
+	}
+	var loginIPThrottle *ipThrottle
+	if loginIPMaxFailures > 0 {
+		loginIPThrottle = newIPThrottle(loginIPMaxFailures, time.Duration(loginIPWindowMinutes)*time.Minute)
+	}
+
+	loginMaxFailures := 5
+	if v := os.Getenv("LOGIN_MAX_FAILURES"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed >= 0 {
+			loginMaxFailures = parsed
+		}
+	}
+	loginLockoutMinutes := 1
+	if v := os.Getenv("LOGIN_LOCKOUT_MINUTES"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 {
+			loginLockoutMinutes = parsed
+		}
+	}
+	loginMaxLockoutMinutes := 24 * 60
+	if v := os.Getenv("LOGIN_LOCKOUT_MAX_MINUTES"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed >= loginLockoutMinutes {
+			loginMaxLockoutMinutes = parsed
+		}
+	}
+
+	// Without a mail relay, password resets are off and verification emails are not sent,
+	// unless MAIL_LOG=true asks for emails, reset tokens and all, to go to the log instead.
+	var mailer mail.Sender
+	if addr := os.Getenv("SMTP_ADDR"); addr != "" {
+		from := os.Getenv("SMTP_FROM")
+		if from == "" {
+			log.Fatal("SMTP_FROM is required when SMTP_ADDR is set")
+		}
+		mailer = &mail.SMTPSender{
+			Addr:     addr,
+			From:     from,
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+		}
+	} else if os.Getenv("MAIL_LOG") == "true" {
+		mailer = mail.LogSender{}
+		log.Print("WARNING: MAIL_LOG is set; emails, including password reset tokens, are written to the log. Do not use this in production")
+	} else {
+		log.Print("SMTP_ADDR is not set; password reset is disabled")
+	}
+	// Self-registered accounts cannot log in before following the emailed link, so without a
+	// mailer nobody could finish registering.
+	emailVerificationDisabled := os.Getenv("EMAIL_VERIFICATION_REQUIRED") == "false"
+	if mailer == nil && !emailVerificationDisabled && !passwordLoginDisabled {
+		log.Fatal("email verification needs a mailer: set SMTP_ADDR (or MAIL_LOG=true in development), or EMAIL_VERIFICATION_REQUIRED=false")
+	}
+	passwordResetMinutes := 30
+	if v := os.Getenv("PASSWORD_RESET_TTL_MINUTES"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 {
+			passwordResetMinutes = parsed
+		}
+	}
+
+	emailVerificationHours := 48
+	if v := os.Getenv("EMAIL_VERIFICATION_TTL_HOURS"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 {
+			emailVerificationHours = parsed
+		}
+	}
+
+	var logArchive archive.Store
+	if dir := os.Getenv("LOG_ARCHIVE_DIR"); dir != "" {
+		logArchive = &archive.Dir{Path: dir}
+	}
+	if bucket := os.Getenv("LOG_ARCHIVE_S3_BUCKET"); bucket != "" {
+		if logArchive != nil {
+			log.Fatal("set only one of LOG_ARCHIVE_DIR and LOG_ARCHIVE_S3_BUCKET")
+		}
+		store := &archive.S3{
+			Endpoint:        os.Getenv("LOG_ARCHIVE_S3_ENDPOINT"),
+			Region:          os.Getenv("LOG_ARCHIVE_S3_REGION"),
+			Bucket:          bucket,
+			Prefix:          os.Getenv("LOG_ARCHIVE_S3_PREFIX"),
+			AccessKeyID:     os.Getenv("LOG_ARCHIVE_S3_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("LOG_ARCHIVE_S3_SECRET_ACCESS_KEY"),
+		}
+		if store.Endpoint == "" || store.AccessKeyID == "" || store.SecretAccessKey == "" {
+			log.Fatal("LOG_ARCHIVE_S3_ENDPOINT, LOG_ARCHIVE_S3_ACCESS_KEY_ID and LOG_ARCHIVE_S3_SECRET_ACCESS_KEY are required when LOG_ARCHIVE_S3_BUCKET is set")
+		}
+		logArchive = store
+	}
+
 	kubeClient, err := kube.NewClient()
 	if err != nil {
 		log.Fatalf("failed to initialise kube client: %v", err)
 	}
-	srv := &Server{
-		port:          port,
-		kubeClient:    kubeClient,
-		db:            database.New(),
-		jwtSecret:     jwtSecret,
-		jwtTTLMinutes: jwtTTLMinutes,
+	db := database.New([]byte(auditChainKey))
+
+	// HS256 keeps the old behaviour of signing with JWT_SECRET; anything else uses rotating
+	// key pairs whose public halves are served at /.well-known/jwks.json.
+	var keys *keyring
+	if signingAlg != jwt.SigningMethodHS256.Alg() {
+		// A replaced key keeps verifying for the access token TTL plus a minute of clock skew.
+		keys, err = newKeyring(db, signingAlg, secretsKey, oldSecretsKey, time.Duration(keyRotationHours)*time.Hour, time.Duration(jwtTTLMinutes+1)*time.Minute)
+		if err != nil {
+			log.Fatalf("JWT_SIGNING_ALG: %v", err)
+		}
+		if err := keys.rotate(context.Background()); err != nil {
+			log.Fatalf("failed to load signing keys: %v", err)
+		}
 	}
 
-	go srv.RunStatusPoller(context.Background())
+	srv := &Server{
+		port:              port,
+		kubeClient:        kubeClient,
+		db:                db,
+		jwtSecret:         jwtSecret,
+		keys:              keys,
+		secretsKey:        secretsKey,
+		oldSecretsKey:     oldSecretsKey,
+		auditChainKey:     []byte(auditChainKey),
+		jwtIssuer:         jwtIssuer,
+		jwtAudience:       jwtAudience,
+		jwtTTLMinutes:     jwtTTLMinutes,
+		refreshTokenTTL:   time.Duration(refreshTokenHours) * time.Hour,
+		expiryWarning:     time.Duration(expiryWarningHours) * time.Hour,
+		deleteGracePeriod: time.Duration(deleteGraceHours) * time.Hour,
 
-	// Declare Server config
-	server := &http.Server{
-		Addr:         fmt.Sprintf(":%d", srv.port),
-		Handler:      srv.RegisterRoutes(),
-		IdleTimeout:  time.Minute,
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 30 * time.Second,
-	}
+		passwordLoginDisabled: passwordLoginDisabled,
+		oidc:                  oidcProvider,
+		oidcAdminGroups:       oidcAdminGroups,
+		oidcTrustEmail:        os.Getenv("OIDC_TRUST_UNVERIFIED_EMAIL") == "true",
+		oidcPostLoginURL:      os.Getenv("OIDC_POST_LOGIN_URL"),
 
-	return server
+		passwordPolicy:      passwordPolicy,
+		allowedEmailDomains: allowedEmailDomains,
+
+		trustedProxies:   trustedProxies,
+		loginIPThrottle:  loginIPThrottle,
+		loginMaxFailures: loginMaxFailures,
+		loginLockout:     time.Duration(loginLockoutMinutes) * time.Minute,
+		loginMaxLockout:  time.Duration(loginMaxLockoutMinutes) * time.Minute,
+
+		mailer:           mailer,
+		passwordResetTTL: time.Duration(passwordResetMinutes) * time.Minute,
+		passwordResetURL: os.Getenv("PASSWORD_RESET_URL"),
+
+		emailVerificationDisabled: emailVerificationDisabled,
+		emailVerificationTTL:      time.Duration(emailVerificationHours) * time.Hour,
+		emailVerificationURL:      os.Getenv("EMAIL_VERIFICATION_URL"),
+
+		archive: logArchive,
+	}
+	return srv
 }
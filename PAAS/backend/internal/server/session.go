@@ -0,0 +1,300 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"backend/internal/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Session revocation reasons.
+const (
+	revokedLogout      = "logout"
+	revokedTokenReused = "refresh token reused"
+	revokedByUser      = "revoked by user"
+	revokedByAdmin     = "revoked by admin"
+)
+
+// sessionTouchInterval limits how often a session's last-used time is written back.
+const sessionTouchInterval = time.Minute
+
+// randomToken returns n random bytes, URL-safe base64 encoded.
+func randomToken(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newRefreshToken returns a refresh token for sessionID and the hash to store for it.
+// The session ID is part of the token so a refresh can find its session without a scan.
+func newRefreshToken(sessionID string) (token, hash string, err error) {
+	secret, err := randomToken(32)
+	if err != nil {
+		return "", "", err
+	}
+	token = sessionID + "." + secret
+	return token, hashToken(token), nil
+}
+
+type sessionTokens struct {
+	AccessToken  string
+	RefreshToken string
+}
+
+// sessionClient is where a session was started from, shown when the user lists sessions.
+type sessionClient struct {
+	IP        string
+	UserAgent string
+}
+
+func clientOf(c *gin.Context) sessionClient {
+	return sessionClient{IP: c.ClientIP(), UserAgent: c.Request.UserAgent()}
+}
+
+// issueSession starts a new session for user and returns its first token pair. twoFactor
+// records whether the login passed a second factor, which admin access may require.
+func (s *Server) issueSession(ctx context.Context, user *models.User, client sessionClient, twoFactor bool) (*sessionTokens, error) {
+	sessionID, err := randomToken(16)
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, refreshHash, err := newRefreshToken(sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	session := &models.Session{
+		ID:               sessionID,
+		UserEmail:        user.Email,
+		RefreshTokenHash: refreshHash,
+		ClientIP:         client.IP,
+		UserAgent:        client.UserAgent,
+		TwoFactor:        twoFactor,
+		CreatedAt:        now,
+		LastUsedAt:       &now,
+		ExpiresAt:        now.Add(s.refreshTokenTTL),
+	}
+	if err := s.db.CreateSession(ctx, session); err != nil {
+		return nil, err
+	}
+
+	accessToken, err := s.generateToken(user, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	return &sessionTokens{AccessToken: accessToken, RefreshToken: refreshToken}, nil
+}
+
+// refreshHandler trades a refresh token for a new access token and a new refresh token.
+// Each refresh token works once; presenting one that was already rotated means it leaked,
+// so the whole session is revoked.
+func (s *Server) refreshHandler(c *gin.Context) {
+	var req models.RefreshRequest
+	if err := c.ShouldBindBodyWithJSON(&req); err != nil || req.RefreshToken == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "refresh_token is required",
+		})
+		return
+	}
+
+	sessionID, _, ok := strings.Cut(req.RefreshToken, ".")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid refresh token"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	session, err := s.db.GetSession(ctx, sessionID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to look up session",
+			"details": err.Error(),
+		})
+		return
+	}
+	now := time.Now()
+	if session == nil || !session.Active(now) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired refresh token"})
+		return
+	}
+
+	presentedHash := hashToken(req.RefreshToken)
+	if presentedHash != session.RefreshTokenHash {
+		s.revokeReusedSession(c, session)
+		return
+	}
+
+	user, err := s.db.FindUserByEmail(ctx, session.UserEmail)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to look up user",
+			"details": err.Error(),
+		})
+		return
+	}
+	if user == nil || user.Disabled {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired refresh token"})
+		return
+	}
+
+	refreshToken, refreshHash, err := newRefreshToken(session.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
+		return
+	}
+	// The swap only succeeds if nobody rotated this token in the meantime, so two concurrent
+	// refreshes with the same token cannot both get a new pair.
+	rotated, err := s.db.RotateRefreshToken(ctx, session.ID, presentedHash, refreshHash, now.Add(s.refreshTokenTTL))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to rotate refresh token",
+			"details": err.Error(),
+		})
+		return
+	}
+	if !rotated {
+		s.revokeReusedSession(c, session)
+		return
+	}
+
+	accessToken, err := s.generateToken(user, session.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"token":         accessToken,
+		"refresh_token": refreshToken,
+		"expires_in":    s.jwtTTLMinutes * 60,
+	})
+}
+
+func (s *Server) revokeReusedSession(c *gin.Context, session *models.Session) {
+	if err := s.db.RevokeSession(c.Request.Context(), session.ID, revokedTokenReused); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to revoke session",
+			"details": err.Error(),
+		})
+		return
+	}
+	s.logAudit(c, session.UserEmail, models.Action{Action: "session_revoked", Details: "refresh token reused, session " + session.ID}, true)
+	c.JSON(http.StatusUnauthorized, gin.H{"error": "refresh token already used; session revoked"})
+}
+
+// logoutHandler revokes the caller's session, which invalidates its access and refresh tokens.
+func (s *Server) logoutHandler(c *gin.Context) {
+	if err := s.db.RevokeSession(c.Request.Context(), c.GetString("session_id"), revokedLogout); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to revoke session",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	s.logAudit(c, c.GetString("user_email"), models.Action{Action: "logout", Details: "User logged out"}, true)
+	c.JSON(http.StatusOK, gin.H{"message": "logged out"})
+}
+
+// getSessionsHandler lists the caller's active sessions, so they can spot logins they do
+// not recognise.
+func (s *Server) getSessionsHandler(c *gin.Context) {
+	sessions, err := s.db.GetSessions(c.Request.Context(), c.GetString("user_email"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to get sessions",
+			"details": err.Error(),
+		})
+		return
+	}
+	current := c.GetString("session_id")
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == current
+	}
+	c.JSON(http.StatusOK, gin.H{"sessions": sessions})
+}
+
+// revokeSessionHandler signs the caller out of one of their sessions, e.g. on a lost laptop.
+func (s *Server) revokeSessionHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	email := c.GetString("user_email")
+	session, err := s.db.GetSession(ctx, c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to look up session",
+			"details": err.Error(),
+		})
+		return
+	}
+	// Other users' sessions are reported as missing, so their IDs cannot be probed.
+	if session == nil || session.UserEmail != email || !session.Active(time.Now()) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+		return
+	}
+
+	if err := s.db.RevokeSession(ctx, session.ID, revokedByUser); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to revoke session",
+			"details": err.Error(),
+		})
+		return
+	}
+	s.logAudit(c, email, models.Action{Action: "revoke_session", Details: "session " + session.ID + " from " + session.ClientIP}, true)
+	c.JSON(http.StatusOK, gin.H{"message": "session revoked"})
+}
+
+// getUserSessionsHandler lists a user's active sessions for an admin.
+func (s *Server) getUserSessionsHandler(c *gin.Context) {
+	user, ok := s.loadUser(c)
+	if !ok {
+		return
+	}
+	sessions, err := s.db.GetSessions(c.Request.Context(), user.Email)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to get sessions",
+			"details": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"sessions": sessions})
+}
+
+// revokeUserSessionsHandler signs a user out everywhere, e.g. when their account may be
+// compromised. Their API tokens are left alone; those are revoked separately.
+func (s *Server) revokeUserSessionsHandler(c *gin.Context) {
+	user, ok := s.loadUser(c)
+	if !ok {
+		return
+	}
+	revoked, err := s.db.RevokeUserSessions(c.Request.Context(), user.Email, revokedByAdmin)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to revoke sessions",
+			"details": err.Error(),
+		})
+		return
+	}
+	s.logAudit(c, c.GetString("user_email"), models.Action{
+		Action:  "revoke_user_sessions",
+		Details: fmt.Sprintf("user %s, %d sessions revoked", user.Email, revoked),
+	}, true)
+	c.JSON(http.StatusOK, gin.H{"message": "sessions revoked", "revoked": revoked})
+}
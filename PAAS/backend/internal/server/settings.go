@@ -0,0 +1,120 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"backend/internal/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (s *Server) getSettingsHandler(c *gin.Context) {
+	settings, err := s.db.GetSettings(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to get settings",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"settings": settings,
+	})
+}
+
+func (s *Server) updateSettingsHandler(c *gin.Context) {
+	var req models.UpdateSettingsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid request body",
+		})
+		return
+	}
+	if req.MaxInstanceTTLHours != nil && *req.MaxInstanceTTLHours < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "max_instance_ttl_hours must be 0 (no limit) or greater",
+		})
+		return
+	}
+
+	for _, days := range []struct {
+		name  string
+		value *int
+	}{{"audit_log_retention_days", req.AuditLogRetentionDays}, {"service_log_retention_days", req.ServiceLogRetentionDays}} {
+		if days.value != nil && *days.value < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": days.name + " must be 0 (keep forever) or greater",
+			})
+			return
+		}
+	}
+	if req.ArchiveLogs != nil && *req.ArchiveLogs && s.archive == nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": errNoArchive.Error(),
+		})
+		return
+	}
+
+	// Otherwise the admin turning it on would lose admin access with the same request.
+	if req.RequireAdmin2FA != nil && *req.RequireAdmin2FA && !c.GetBool("two_factor_ok") {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "enable two-factor authentication on your own account before requiring it for admins",
+		})
+		return
+	}
+
+	settings, err := s.db.GetSettings(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to get settings",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	email := c.GetString("user_email")
+	changes := make([]string, 0, 5)
+	if req.MaxInstanceTTLHours != nil && *req.MaxInstanceTTLHours != settings.MaxInstanceTTLHours {
+		changes = append(changes, fmt.Sprintf("maxInstanceTtlHours: %d -> %d", settings.MaxInstanceTTLHours, *req.MaxInstanceTTLHours))
+		settings.MaxInstanceTTLHours = *req.MaxInstanceTTLHours
+	}
+	if req.RequireAdmin2FA != nil && *req.RequireAdmin2FA != settings.RequireAdmin2FA {
+		changes = append(changes, fmt.Sprintf("requireAdmin2fa: %t -> %t", settings.RequireAdmin2FA, *req.RequireAdmin2FA))
+		settings.RequireAdmin2FA = *req.RequireAdmin2FA
+	}
+	if req.AuditLogRetentionDays != nil && *req.AuditLogRetentionDays != settings.AuditLogRetentionDays {
+		changes = append(changes, fmt.Sprintf("auditLogRetentionDays: %d -> %d", settings.AuditLogRetentionDays, *req.AuditLogRetentionDays))
+		settings.AuditLogRetentionDays = *req.AuditLogRetentionDays
+	}
+	if req.ServiceLogRetentionDays != nil && *req.ServiceLogRetentionDays != settings.ServiceLogRetentionDays {
+		changes = append(changes, fmt.Sprintf("serviceLogRetentionDays: %d -> %d", settings.ServiceLogRetentionDays, *req.ServiceLogRetentionDays))
+		settings.ServiceLogRetentionDays = *req.ServiceLogRetentionDays
+	}
+	if req.ArchiveLogs != nil && *req.ArchiveLogs != settings.ArchiveLogs {
+		changes = append(changes, fmt.Sprintf("archiveLogs: %t -> %t", settings.ArchiveLogs, *req.ArchiveLogs))
+		settings.ArchiveLogs = *req.ArchiveLogs
+	}
+	settings.UpdatedAt = time.Now()
+	settings.UpdatedBy = email
+
+	if err := s.db.UpdateSettings(c.Request.Context(), settings); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to update settings",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	s.logAudit(c, email, models.Action{
+		Action:  "update_settings",
+		Details: strings.Join(changes, ", "),
+	}, true)
+	c.JSON(http.StatusOK, gin.H{
+		"message":  "settings updated successfully",
+		"settings": settings,
+	})
+}
@@ -0,0 +1,357 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"backend/internal/database"
+	"backend/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// keyReloadInterval limits how often an unknown kid makes a replica reload keys from the
+// database, in case another replica has just rotated.
+const keyReloadInterval = 10 * time.Second
+
+// loadedKey is a decoded SigningKey.
+type loadedKey struct {
+	id        string
+	alg       string
+	private   crypto.Signer
+	public    crypto.PublicKey
+	createdAt time.Time
+	expiresAt *time.Time
+}
+
+// keyring signs access tokens with the newest key in the signing_keys collection and
+// verifies them with any key that has not expired. Keys are shared between replicas
+// through the database; private keys are stored sealed with a key derived from SECRETS_KEY.
+type keyring struct {
+	db       database.Service
+	alg      string        // algorithm for new keys
+	rotation time.Duration // age at which the signing key is replaced
+	overlap  time.Duration // how long a replaced key keeps verifying: the access token TTL
+	box      *secretBox
+
+	mu       sync.RWMutex
+	signing  *loadedKey
+	keys     map[string]*loadedKey
+	loadedAt time.Time
+}
+
+// secretBox seals secrets stored in the database with a key derived from SECRETS_KEY and a
+// label, so each kind of secret has its own key. While SECRETS_KEY is being rotated it also
+// opens values sealed under SECRETS_KEY_PREVIOUS, until ResealSecrets has moved them over.
+type secretBox struct {
+	current  cipher.AEAD
+	previous cipher.AEAD // nil outside a rotation
+}
+
+func newSecretBox(label, key, previousKey string) (*secretBox, error) {
+	current, err := secretAEAD(label, key)
+	if err != nil {
+		return nil, err
+	}
+	box := &secretBox{current: current}
+	if previousKey != "" {
+		if box.previous, err = secretAEAD(label, previousKey); err != nil {
+			return nil, err
+		}
+	}
+	return box, nil
+}
+
+// secretAEAD returns the AES-GCM cipher with the key derived from key and label.
+func secretAEAD(label, key string) (cipher.AEAD, error) {
+	sealKey := sha256.Sum256([]byte(label + "\x00" + key))
+	block, err := aes.NewCipher(sealKey[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext with a random nonce, which it prepends. additional binds the
+// result to its owner (e.g. a key ID), so a sealed value cannot be moved to another one.
+func seal(aead cipher.AEAD, plaintext, additional []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additional), nil
+}
+
+func unseal(aead cipher.AEAD, sealed, additional []byte) ([]byte, error) {
+	nonceSize := aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return nil, errors.New("sealed value is too short")
+	}
+	return aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], additional)
+}
+
+// seal seals plaintext under the current key.
+func (b *secretBox) seal(plaintext, additional []byte) ([]byte, error) {
+	return seal(b.current, plaintext, additional)
+}
+
+// open opens a value sealed under either key. stale reports that it was sealed under the
+// previous key and should be sealed again.
+func (b *secretBox) open(sealed, additional []byte) (plaintext []byte, stale bool, err error) {
+	plaintext, err = unseal(b.current, sealed, additional)
+	if err != nil && b.previous != nil {
+		if previous, previousErr := unseal(b.previous, sealed, additional); previousErr == nil {
+			return previous, true, nil
+		}
+	}
+	return plaintext, false, err
+}
+
+func newKeyring(db database.Service, alg, secretsKey, oldSecretsKey string, rotation, overlap time.Duration) (*keyring, error) {
+	if alg != models.SigningRS256 && alg != models.SigningEdDSA {
+		return nil, fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+	box, err := newSigningKeyBox(secretsKey, oldSecretsKey)
+	if err != nil {
+		return nil, err
+	}
+	return &keyring{db: db, alg: alg, rotation: rotation, overlap: overlap, box: box, keys: map[string]*loadedKey{}}, nil
+}
+
+func newSigningKeyBox(secretsKey, oldSecretsKey string) (*secretBox, error) {
+	return newSecretBox("paas signing keys", secretsKey, oldSecretsKey)
+}
+
+// load replaces the in-memory keys with those in the database. Keys that cannot be opened
+// (e.g. SECRETS_KEY changed without SECRETS_KEY_PREVIOUS) are skipped, which makes rotate
+// generate a fresh one.
+func (k *keyring) load(ctx context.Context) error {
+	stored, err := k.db.GetSigningKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	keys := map[string]*loadedKey{}
+	var signing *loadedKey
+	for i := range stored {
+		key, err := k.open(&stored[i])
+		if err != nil {
+			log.Printf("[keys] skipping signing key %s: %v", stored[i].ID, err)
+			continue
+		}
+		keys[key.id] = key
+		if stored[i].ExpiresAt == nil && key.alg == k.alg && (signing == nil || key.createdAt.After(signing.createdAt)) {
+			signing = key
+		}
+	}
+
+	k.mu.Lock()
+	k.keys, k.signing, k.loadedAt = keys, signing, time.Now()
+	k.mu.Unlock()
+	return nil
+}
+
+// rotate reloads the keys and, if the signing key is missing or older than the rotation
+// period, generates a new one and retires the keys created before it. Replicas racing here
+// may both add a key. Neither retires a key newer than its own, so the newest key stays
+// active, and every replica signs with the newest and verifies with all.
+func (k *keyring) rotate(ctx context.Context) error {
+	if err := k.load(ctx); err != nil {
+		return err
+	}
+	k.mu.RLock()
+	signing := k.signing
+	k.mu.RUnlock()
+	if signing != nil && time.Since(signing.createdAt) < k.rotation {
+		return nil
+	}
+
+	key, err := k.generate()
+	if err != nil {
+		return err
+	}
+	if err := k.db.InsertSigningKey(ctx, key); err != nil {
+		return err
+	}
+	if err := k.db.RetireSigningKeys(ctx, key.CreatedAt, time.Now().Add(k.overlap)); err != nil {
+		return err
+	}
+	log.Printf("[keys] new %s signing key %s", key.Algorithm, key.ID)
+	return k.load(ctx)
+}
+
+func (k *keyring) generate() (*models.SigningKey, error) {
+	var private crypto.Signer
+	var err error
+	switch k.alg {
+	case models.SigningEdDSA:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(private.Public())
+	if err != nil {
+		return nil, err
+	}
+	kid, err := randomToken(12)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := k.box.seal(privateDER, []byte(kid))
+	if err != nil {
+		return nil, err
+	}
+	return &models.SigningKey{
+		ID:         kid,
+		Algorithm:  k.alg,
+		PrivateKey: sealed,
+		PublicKey:  publicDER,
+		// Truncated to what MongoDB stores, so that rotate compares creation times as stored.
+		CreatedAt: time.Now().Truncate(time.Millisecond),
+	}, nil
+}
+
+func (k *keyring) open(stored *models.SigningKey) (*loadedKey, error) {
+	privateDER, _, err := k.box.open(stored.PrivateKey, []byte(stored.ID))
+	if err != nil {
+		return nil, fmt.Errorf("unseal private key: %w", err)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(privateDER)
+	if err != nil {
+		return nil, err
+	}
+	private, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", parsed)
+	}
+	return &loadedKey{
+		id:        stored.ID,
+		alg:       stored.Algorithm,
+		private:   private,
+		public:    private.Public(),
+		createdAt: stored.CreatedAt,
+		expiresAt: stored.ExpiresAt,
+	}, nil
+}
+
+// sign signs claims with the current signing key, naming it in the kid header.
+func (k *keyring) sign(claims jwt.Claims) (string, error) {
+	k.mu.RLock()
+	signing := k.signing
+	k.mu.RUnlock()
+	if signing == nil {
+		return "", errors.New("no signing key available")
+	}
+
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(signing.alg), claims)
+	token.Header["kid"] = signing.id
+	return token.SignedString(signing.private)
+}
+
+// verificationKey is a jwt.Keyfunc: it finds the key named by the token's kid, reloading
+// from the database (at most every keyReloadInterval) if another replica rotated.
+func (k *keyring) verificationKey(t *jwt.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+	k.mu.RLock()
+	key, ok := k.keys[kid]
+	stale := time.Since(k.loadedAt) > keyReloadInterval
+	k.mu.RUnlock()
+
+	if !ok && stale {
+		if err := k.load(context.Background()); err != nil {
+			return nil, err
+		}
+		k.mu.RLock()
+		key, ok = k.keys[kid]
+		k.mu.RUnlock()
+	}
+	if !ok || (key.expiresAt != nil && time.Now().After(*key.expiresAt)) {
+		return nil, fmt.Errorf("unknown or expired signing key %q", kid)
+	}
+	if t.Method.Alg() != key.alg {
+		return nil, fmt.Errorf("token algorithm %s does not match key %s", t.Method.Alg(), kid)
+	}
+	return key.public, nil
+}
+
+// publicJWKS returns the verification keys as a JSON Web Key Set, newest first.
+func (k *keyring) publicJWKS() []gin.H {
+	k.mu.RLock()
+	keys := make([]*loadedKey, 0, len(k.keys))
+	for _, key := range k.keys {
+		keys = append(keys, key)
+	}
+	k.mu.RUnlock()
+	sort.Slice(keys, func(i, j int) bool { return keys[i].createdAt.After(keys[j].createdAt) })
+
+	set := make([]gin.H, 0, len(keys))
+	for _, key := range keys {
+		jwk := gin.H{"kid": key.id, "alg": key.alg, "use": "sig"}
+		switch public := key.public.(type) {
+		case *rsa.PublicKey:
+			jwk["kty"] = "RSA"
+			jwk["n"] = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk["e"] = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk["kty"] = "OKP"
+			jwk["crv"] = "Ed25519"
+			jwk["x"] = base64.RawURLEncoding.EncodeToString(public)
+		default:
+			continue
+		}
+		set = append(set, jwk)
+	}
+	return set
+}
+
+// RunKeyRotation periodically picks up keys added by other replicas and rotates the signing
+// key once it is older than the rotation period.
+func (s *Server) RunKeyRotation(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.keys.rotate(ctx); err != nil {
+				log.Printf("[keys] ERROR rotate signing keys: %v", err)
+			}
+		}
+	}
+}
+
+// jwksHandler publishes the public keys so other services can verify our access tokens.
+func (s *Server) jwksHandler(c *gin.Context) {
+	keys := []gin.H{}
+	if s.keys != nil {
+		keys = s.keys.publicJWKS()
+	}
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, gin.H{"keys": keys})
+}
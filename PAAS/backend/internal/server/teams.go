@@ -0,0 +1,255 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"backend/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// loadTeam returns the team named by the slug parameter if the current user may see it,
+// i.e. is a member or a platform admin; with manage set, only owners and platform admins
+// pass. On failure it has already written the error response.
+func (s *Server) loadTeam(c *gin.Context, manage bool) (*models.Team, bool) {
+	team, err := s.db.GetTeam(c.Request.Context(), c.Param("slug"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to get team",
+			"details": err.Error(),
+		})
+		return nil, false
+	}
+	admin := s.isPlatformAdmin(c)
+	var member *models.TeamMember
+	if team != nil {
+		member = team.Member(c.GetString("user_email"))
+	}
+	if team == nil || (member == nil && !admin) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "team not found"})
+		return nil, false
+	}
+	if manage && !admin && member.Role != models.RoleOwner {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only team owners can manage members"})
+		return nil, false
+	}
+	return team, true
+}
+
+func (s *Server) createTeamHandler(c *gin.Context) {
+	var req models.CreateTeamRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid request body",
+		})
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	slug, err := models.TeamSlug(req.Name)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	email := c.GetString("user_email")
+	now := time.Now()
+	team := &models.Team{
+		Name:      req.Name,
+		Slug:      slug,
+		Namespace: models.TeamNamespace(slug),
+		Members:   []models.TeamMember{{Email: models.NormalizeMemberEmail(email), Role: models.RoleOwner, AddedBy: email, AddedAt: now}},
+		CreatedBy: email,
+		CreatedAt: now,
+	}
+	if err := s.db.CreateTeam(c.Request.Context(), team); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			c.JSON(http.StatusConflict, gin.H{
+				"error": "a team with this name already exists",
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to create team",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	s.logAudit(c, email, models.Action{Action: "create_team", Name: team.Slug, Namespace: team.Namespace}, false)
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "team created successfully",
+		"team":    team,
+	})
+}
+
+// getTeamsHandler lists the caller's teams; platform admins can pass all=true to list every team.
+func (s *Server) getTeamsHandler(c *gin.Context) {
+	memberEmail := models.NormalizeMemberEmail(c.GetString("user_email"))
+	if c.Query("all") == "true" && s.isPlatformAdmin(c) {
+		memberEmail = ""
+	}
+
+	teams, err := s.db.GetTeams(c.Request.Context(), memberEmail)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to get teams",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"teams": teams,
+		"count": len(teams),
+	})
+}
+
+func (s *Server) getTeamHandler(c *gin.Context) {
+	team, ok := s.loadTeam(c, false)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"team": team,
+	})
+}
+
+func (s *Server) addTeamMemberHandler(c *gin.Context) {
+	team, ok := s.loadTeam(c, true)
+	if !ok {
+		return
+	}
+
+	var req models.TeamMemberRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid request body",
+		})
+		return
+	}
+	req.Email = models.NormalizeMemberEmail(req.Email)
+	if req.Role == "" {
+		req.Role = models.RoleViewer
+	}
+	if req.Email == "" || !strings.Contains(req.Email, "@") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "a valid email is required"})
+		return
+	}
+	if !models.ValidTeamRole(req.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role must be one of viewer, operator or owner"})
+		return
+	}
+
+	// Members are added by email and need not have registered yet; the role applies once they log in.
+	email := c.GetString("user_email")
+	member := models.TeamMember{Email: req.Email, Role: req.Role, AddedBy: email, AddedAt: time.Now()}
+	added, err := s.db.AddTeamMember(c.Request.Context(), team.Slug, member)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to add team member",
+			"details": err.Error(),
+		})
+		return
+	}
+	if !added {
+		c.JSON(http.StatusConflict, gin.H{"error": "user is already a member of this team"})
+		return
+	}
+
+	s.logAudit(c, email, models.Action{
+		Action:    "add_team_member",
+		Name:      team.Slug,
+		Namespace: team.Namespace,
+		Details:   "member: " + member.Email + ", role: " + member.Role,
+	}, false)
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "team member added",
+		"member":  member,
+	})
+}
+
+func (s *Server) updateTeamMemberHandler(c *gin.Context) {
+	team, ok := s.loadTeam(c, true)
+	if !ok {
+		return
+	}
+
+	var req models.TeamMemberRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid request body",
+		})
+		return
+	}
+	if !models.ValidTeamRole(req.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role must be one of viewer, operator or owner"})
+		return
+	}
+
+	target := team.Member(c.Param("email"))
+	if target == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "team member not found"})
+		return
+	}
+	if target.Role == models.RoleOwner && req.Role != models.RoleOwner && team.OwnerCount() == 1 {
+		c.JSON(http.StatusConflict, gin.H{"error": "a team needs at least one owner"})
+		return
+	}
+
+	if _, err := s.db.SetTeamMemberRole(c.Request.Context(), team.Slug, target.Email, req.Role); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to update team member",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	s.logAudit(c, c.GetString("user_email"), models.Action{
+		Action:    "update_team_member",
+		Name:      team.Slug,
+		Namespace: team.Namespace,
+		Details:   "member: " + target.Email + ", role: " + target.Role + " -> " + req.Role,
+	}, false)
+	c.JSON(http.StatusOK, gin.H{"message": "team member updated"})
+}
+
+// removeTeamMemberHandler removes a member; members may also remove themselves to leave a team.
+func (s *Server) removeTeamMemberHandler(c *gin.Context) {
+	email := c.GetString("user_email")
+	leaving := models.NormalizeMemberEmail(c.Param("email")) == models.NormalizeMemberEmail(email)
+	team, ok := s.loadTeam(c, !leaving)
+	if !ok {
+		return
+	}
+
+	target := team.Member(c.Param("email"))
+	if target == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "team member not found"})
+		return
+	}
+	if target.Role == models.RoleOwner && team.OwnerCount() == 1 {
+		c.JSON(http.StatusConflict, gin.H{"error": "a team needs at least one owner"})
+		return
+	}
+
+	if _, err := s.db.RemoveTeamMember(c.Request.Context(), team.Slug, target.Email); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to remove team member",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	s.logAudit(c, email, models.Action{
+		Action:    "remove_team_member",
+		Name:      team.Slug,
+		Namespace: team.Namespace,
+		Details:   "member: " + target.Email + ", role: " + target.Role,
+	}, false)
+	c.JSON(http.StatusOK, gin.H{"message": "team member removed"})
+}
@@ -0,0 +1,534 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"backend/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TOTP parameters (RFC 6238). These are the defaults every authenticator app supports.
+const (
+	totpPeriod = 30 // seconds
+	totpDigits = 6
+	totpSkew   = 1 // steps accepted either side of the current one, for clock drift
+)
+
+const (
+	twoFactorIssuer       = "PaaS" // shown in authenticator apps
+	twoFactorChallengeTTL = 5 * time.Minute
+	recoveryCodeCount     = 10
+)
+
+var base32NoPad = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpCode is the HOTP value (RFC 4226) of secret at the given time step.
+func totpCode(secret []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1_000_000)
+}
+
+// totpMatch returns the time step whose code is code, if it is within the allowed skew.
+func totpMatch(secret []byte, code string, now time.Time) (int64, bool) {
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// provisioningURI is the otpauth:// URI authenticator apps import, usually as a QR code.
+func provisioningURI(secret []byte, email string) string {
+	query := url.Values{}
+	query.Set("secret", base32NoPad.EncodeToString(secret))
+	query.Set("issuer", twoFactorIssuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", strconv.Itoa(totpDigits))
+	query.Set("period", strconv.Itoa(totpPeriod))
+	uri := url.URL{Scheme: "otpauth", Host: "totp", Path: "/" + twoFactorIssuer + ":" + email, RawQuery: query.Encode()}
+	return uri.String()
+}
+
+// normalizeRecoveryCode lets users type recovery codes in any case, with or without the dash.
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// newRecoveryCodes returns fresh recovery codes, formatted for the user, and their hashes.
+func newRecoveryCodes() (codes, hashes []string, err error) {
+	for i := 0; i < recoveryCodeCount; i++ {
+		buf := make([]byte, 7)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(base32NoPad.EncodeToString(buf))[:10]
+		codes = append(codes, code[:5]+"-"+code[5:])
+		hashes = append(hashes, hashToken(code))
+	}
+	return codes, hashes, nil
+}
+
+// twoFactorBox seals TOTP secrets at rest.
+func (s *Server) twoFactorBox() (*secretBox, error) {
+	return newSecretBox("paas totp secrets", s.secretsKey, s.oldSecretsKey)
+}
+
+// openTwoFactor returns the user's confirmed enrolment and its secret, or nil if 2FA is off.
+func (s *Server) openTwoFactor(ctx context.Context, email string) (*models.TwoFactor, []byte, error) {
+	tf, err := s.db.GetTwoFactor(ctx, email)
+	if err != nil || tf == nil {
+		return nil, nil, err
+	}
+	box, err := s.twoFactorBox()
+	if err != nil {
+		return nil, nil, err
+	}
+	secret, _, err := box.open(tf.Secret, []byte(email))
+	if err != nil {
+		return nil, nil, fmt.Errorf("unseal totp secret: %w", err)
+	}
+	return tf, secret, nil
+}
+
+// checkSecondFactor verifies a TOTP code or, if given instead, a recovery code, using it up.
+// It returns how the user proved themselves, or "" if they did not.
+func (s *Server) checkSecondFactor(ctx context.Context, email, code, recoveryCode string) (string, error) {
+	if recoveryCode != "" {
+		used, err := s.db.UseRecoveryCode(ctx, email, hashToken(normalizeRecoveryCode(recoveryCode)))
+		if err != nil || !used {
+			return "", err
+		}
+		return "recovery code", nil
+	}
+
+	tf, secret, err := s.openTwoFactor(ctx, email)
+	if err != nil || tf == nil || tf.ConfirmedAt == nil {
+		return "", err
+	}
+	step, ok := totpMatch(secret, code, time.Now())
+	if !ok {
+		return "", nil
+	}
+	used, err := s.db.UseTOTPStep(ctx, email, step)
+	if err != nil || !used {
+		return "", err
+	}
+	return "totp", nil
+}
+
+// twoFactorChallengeMAC binds a challenge to the account and its current password hash, so
+// changing the password invalidates challenges issued before.
+func (s *Server) twoFactorChallengeMAC(user *models.User, expires string) string {
+	mac := hmac.New(sha256.New, []byte(s.jwtSecret))
+	mac.Write([]byte("login-2fa\x00" + user.ID.Hex() + "\x00" + user.Email + "\x00" + user.Password + "\x00" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// twoFactorChallenge returns "<base64 email>.<expiry unix>.<mac>": proof that the password
+// step succeeded, which the second login step trades in along with a code.
+func (s *Server) twoFactorChallenge(user *models.User, expiresAt time.Time) string {
+	expires := strconv.FormatInt(expiresAt.Unix(), 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(user.Email)) + "." + expires + "." + s.twoFactorChallengeMAC(user, expires)
+}
+
+// challengeEmail returns the email a challenge was issued for; it is not verified yet.
+func challengeEmail(token string) string {
+	encoded, _, _ := strings.Cut(token, ".")
+	email, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return ""
+	}
+	return string(email)
+}
+
+func (s *Server) checkTwoFactorChallenge(user *models.User, token string) bool {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || !hmac.Equal([]byte(parts[2]), []byte(s.twoFactorChallengeMAC(user, parts[1]))) {
+		return false
+	}
+	unix, err := strconv.ParseInt(parts[1], 10, 64)
+	return err == nil && time.Now().Before(time.Unix(unix, 0))
+}
+
+// loginTwoFactorHandler is the second login step for users with 2FA, after either a password
+// or single sign-on. Wrong codes count as failed logins, so they lead to the same lockout as
+// wrong passwords.
+func (s *Server) loginTwoFactorHandler(c *gin.Context) {
+	var req models.TwoFactorLoginRequest
+	if err := c.ShouldBindBodyWithJSON(&req); err != nil || req.ChallengeToken == "" || (req.Code == "") == (req.RecoveryCode == "") {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "challenge_token and either code or recovery_code are required",
+		})
+		return
+	}
+
+	now := time.Now()
+	if s.loginIPThrottle != nil {
+		if retryAfter, blocked := s.loginIPThrottle.blocked(c.ClientIP(), now); blocked {
+			tooManyAttempts(c, "too many failed logins from this address, try again later", retryAfter)
+			return
+		}
+	}
+
+	ctx := c.Request.Context()
+	user, err := s.db.FindUserByEmail(ctx, challengeEmail(req.ChallengeToken))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to look up user",
+			"details": err.Error(),
+		})
+		return
+	}
+	if user == nil || !user.TwoFactorEnabled || !s.checkTwoFactorChallenge(user, req.ChallengeToken) {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "invalid or expired challenge; log in again",
+		})
+		return
+	}
+	if user.LockedUntil != nil && user.LockedUntil.After(now) {
+		tooManyAttempts(c, "account temporarily locked after too many failed logins", user.LockedUntil.Sub(now))
+		return
+	}
+	if user.Disabled {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "account is disabled",
+		})
+		return
+	}
+
+	method, err := s.checkSecondFactor(ctx, user.Email, req.Code, req.RecoveryCode)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to check two-factor code",
+			"details": err.Error(),
+		})
+		return
+	}
+	if method == "" {
+		if s.loginIPThrottle != nil {
+			s.loginIPThrottle.fail(c.ClientIP(), now)
+		}
+		s.logAudit(c, user.Email, models.Action{Action: "login_failed", Details: "reason: wrong two-factor code"}, true)
+		if locked, until := s.recordLoginFailure(c, user); locked {
+			tooManyAttempts(c, "account temporarily locked after too many failed logins", until.Sub(now))
+			return
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "invalid two-factor code",
+		})
+		return
+	}
+
+	s.completeLogin(c, user, true, "User logged in Successfully with "+method)
+}
+
+// twoFactorStatusHandler tells the caller whether 2FA is on and whether they must enable it.
+func (s *Server) twoFactorStatusHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	email := c.GetString("user_email")
+	tf, err := s.db.GetTwoFactor(ctx, email)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to get two-factor status",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	s.isPlatformAdmin(c) // notes whether admin access waits for 2FA
+	status := gin.H{"enabled": false, "pending": false, "required": c.GetBool("admin_2fa_required")}
+	if tf != nil {
+		status["enabled"] = tf.ConfirmedAt != nil
+		status["pending"] = tf.ConfirmedAt == nil
+		if tf.ConfirmedAt != nil {
+			status["confirmed_at"] = tf.ConfirmedAt
+			status["recovery_codes_left"] = len(tf.RecoveryCodes)
+		}
+	}
+	c.JSON(http.StatusOK, status)
+}
+
+// enrollTwoFactorHandler starts enrolment: it returns a new secret and its provisioning URI.
+// 2FA is not on until the user confirms with a code from their authenticator.
+func (s *Server) enrollTwoFactorHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	email := c.GetString("user_email")
+	user, err := s.db.FindUserByEmail(ctx, email)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to look up user",
+			"details": err.Error(),
+		})
+		return
+	}
+	if user == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "user not found"})
+		return
+	}
+	if user.Password == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "this account signs in with single sign-on; set up two-factor authentication with your identity provider"})
+		return
+	}
+	if user.TwoFactorEnabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "two-factor authentication is already enabled; disable it first to enrol a new device"})
+		return
+	}
+
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate secret"})
+		return
+	}
+	box, err := s.twoFactorBox()
+	if err == nil {
+		var sealed []byte
+		if sealed, err = box.seal(secret, []byte(email)); err == nil {
+			err = s.db.SaveTwoFactor(ctx, &models.TwoFactor{UserEmail: email, Secret: sealed, CreatedAt: time.Now()})
+		}
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to start two-factor enrolment",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"secret":           base32NoPad.EncodeToString(secret),
+		"provisioning_uri": provisioningURI(secret, email),
+		"message":          "add the secret to your authenticator app, then confirm with a code from it",
+	})
+}
+
+// confirmTwoFactorHandler turns 2FA on once the user proves their authenticator works. The
+// recovery codes are shown only in this response.
+func (s *Server) confirmTwoFactorHandler(c *gin.Context) {
+	var req models.TwoFactorCodeRequest
+	if err := c.ShouldBindBodyWithJSON(&req); err != nil || req.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "code is required"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	email := c.GetString("user_email")
+	tf, secret, err := s.openTwoFactor(ctx, email)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to get two-factor enrolment",
+			"details": err.Error(),
+		})
+		return
+	}
+	if tf == nil || tf.ConfirmedAt != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "no two-factor enrolment is pending; start one first"})
+		return
+	}
+	step, ok := totpMatch(secret, req.Code, time.Now())
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid code; check the time on your device"})
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate recovery codes"})
+		return
+	}
+	enabled, err := s.db.EnableTwoFactor(ctx, email, hashes, step)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to enable two-factor authentication",
+			"details": err.Error(),
+		})
+		return
+	}
+	if !enabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "no two-factor enrolment is pending; start one first"})
+		return
+	}
+
+	// The code just proved the second factor, so this session counts as having passed it.
+	if sessionID := c.GetString("session_id"); sessionID != "" {
+		if err := s.db.SetSessionTwoFactor(ctx, sessionID); err != nil {
+			log.Printf("[2fa] failed to mark session of %s: %v", email, err)
+		}
+	}
+	s.logAudit(c, email, models.Action{Action: "enable_2fa"}, true)
+	c.JSON(http.StatusOK, gin.H{
+		"message":        "two-factor authentication enabled; store the recovery codes somewhere safe",
+		"recovery_codes": codes,
+	})
+}
+
+// disableTwoFactorHandler turns 2FA off. It takes the password and a code, so a stolen
+// session alone cannot do it; admins cannot while the platform requires 2FA for them.
+func (s *Server) disableTwoFactorHandler(c *gin.Context) {
+	var req models.DisableTwoFactorRequest
+	if err := c.ShouldBindBodyWithJSON(&req); err != nil || req.Password == "" || req.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "password and code are required"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	email := c.GetString("user_email")
+	user, err := s.db.FindUserByEmail(ctx, email)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to look up user",
+			"details": err.Error(),
+		})
+		return
+	}
+	if user == nil || !user.TwoFactorEnabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "two-factor authentication is not enabled"})
+		return
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "password is incorrect"})
+		return
+	}
+	if user.IsAdmin {
+		settings, err := s.db.GetSettings(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":   "failed to get settings",
+				"details": err.Error(),
+			})
+			return
+		}
+		if settings.RequireAdmin2FA {
+			c.JSON(http.StatusForbidden, gin.H{"error": "two-factor authentication is required for admins"})
+			return
+		}
+	}
+
+	// A recovery code also works, for users who lost their authenticator.
+	code, recoveryCode := req.Code, ""
+	if len(normalizeRecoveryCode(req.Code)) == 10 {
+		code, recoveryCode = "", req.Code
+	}
+	method, err := s.checkSecondFactor(ctx, email, code, recoveryCode)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to check two-factor code",
+			"details": err.Error(),
+		})
+		return
+	}
+	if method == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid two-factor code"})
+		return
+	}
+
+	if err := s.db.DisableTwoFactor(ctx, email); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to disable two-factor authentication",
+			"details": err.Error(),
+		})
+		return
+	}
+	s.logAudit(c, email, models.Action{Action: "disable_2fa", Details: "confirmed with " + method}, true)
+	c.JSON(http.StatusOK, gin.H{"message": "two-factor authentication disabled"})
+}
+
+// regenerateRecoveryCodesHandler replaces all recovery codes, e.g. once most are used up.
+func (s *Server) regenerateRecoveryCodesHandler(c *gin.Context) {
+	var req models.TwoFactorCodeRequest
+	if err := c.ShouldBindBodyWithJSON(&req); err != nil || req.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "code is required"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	email := c.GetString("user_email")
+	method, err := s.checkSecondFactor(ctx, email, req.Code, "")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to check two-factor code",
+			"details": err.Error(),
+		})
+		return
+	}
+	if method == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid two-factor code"})
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate recovery codes"})
+		return
+	}
+	if err := s.db.SetRecoveryCodes(ctx, email, hashes); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to store recovery codes",
+			"details": err.Error(),
+		})
+		return
+	}
+	s.logAudit(c, email, models.Action{Action: "regenerate_recovery_codes"}, true)
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+// resetTwoFactorHandler lets an admin turn off 2FA for a user who lost both their device
+// and their recovery codes.
+func (s *Server) resetTwoFactorHandler(c *gin.Context) {
+	user, ok := s.loadUser(c)
+	if !ok {
+		return
+	}
+	if err := s.db.DisableTwoFactor(c.Request.Context(), user.Email); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to reset two-factor authentication",
+			"details": err.Error(),
+		})
+		return
+	}
+	s.logAudit(c, c.GetString("user_email"), models.Action{Action: "reset_2fa", Details: "user " + user.Email}, true)
+	c.JSON(http.StatusOK, gin.H{"message": "two-factor authentication reset for " + user.Email})
+}
+
+// adminTwoFactorMissing reports whether the platform requires 2FA for admins and the current
+// session did not pass it. Single sign-on sessions of users without a password pass, since
+// the identity provider is responsible for their second factor.
+func (s *Server) adminTwoFactorMissing(c *gin.Context) (bool, error) {
+	if c.GetBool("two_factor_ok") {
+		return false, nil
+	}
+	settings, err := s.db.GetSettings(c.Request.Context())
+	if err != nil {
+		return false, err
+	}
+	return settings.RequireAdmin2FA, nil
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"backend/internal/database"
+	"backend/internal/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+const revokedUserDisabled = "user disabled"
+
+func (s *Server) getUsersHandler(c *gin.Context) {
+	page := 1
+	if p := c.Query("page"); p != "" {
+		if n, err := strconv.Atoi(p); err == nil && n > 0 {
+			page = n
+		}
+	}
+	limit := 50
+
+	users, total, err := s.db.GetUsers(c.Request.Context(), database.GetUsersOptions{
+		Search: strings.TrimSpace(c.Query("search")),
+		Limit:  limit,
+		Skip:   (page - 1) * limit,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to get users",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	infos := make([]models.UserInfo, 0, len(users))
+	for i := range users {
+		infos = append(infos, users[i].Info())
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"users": infos,
+		"count": len(infos),
+		"total": total,
+		"page":  page,
+	})
+}
+
+// loadUser fetches the user named in the path, writing a 404 or 500 if that fails.
+func (s *Server) loadUser(c *gin.Context) (*models.User, bool) {
+	users, _, err := s.db.GetUsers(c.Request.Context(), database.GetUsersOptions{Email: c.Param("email"), Limit: 1})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to get user",
+			"details": err.Error(),
+		})
+		return nil, false
+	}
+	if len(users) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return nil, false
+	}
+	return &users[0], true
+}
+
+func (s *Server) getUserHandler(c *gin.Context) {
+	user, ok := s.loadUser(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"user": user.Info()})
+}
+
+// updateUserHandler promotes or demotes an admin and disables or enables an account.
+// Admins cannot do either to themselves, so the last admin cannot lock everyone out.
+func (s *Server) updateUserHandler(c *gin.Context) {
+	var req models.UpdateUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+	if req.IsAdmin == nil && req.Disabled == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "nothing to update; set is_admin or disabled"})
+		return
+	}
+
+	user, ok := s.loadUser(c)
+	if !ok {
+		return
+	}
+	actor := c.GetString("user_email")
+	if user.Email == actor {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "you cannot change your own admin or disabled status"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	if req.IsAdmin != nil && *req.IsAdmin != user.IsAdmin {
+		if err := s.db.SetUserAdmin(ctx, user.Email, *req.IsAdmin); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":   "failed to update user",
+				"details": err.Error(),
+			})
+			return
+		}
+		user.IsAdmin = *req.IsAdmin
+		action := "demote_admin"
+		if user.IsAdmin {
+			action = "promote_admin"
+		}
+		s.logAudit(c, actor, models.Action{Action: action, Details: "user: " + user.Email}, true)
+	}
+
+	if req.Disabled != nil && *req.Disabled != user.Disabled {
+		if err := s.db.SetUserDisabled(ctx, user.Email, *req.Disabled); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":   "failed to update user",
+				"details": err.Error(),
+			})
+			return
+		}
+		user.Disabled = *req.Disabled
+		action, details := "enable_user", "user: "+user.Email
+		if user.Disabled {
+			// JWTMiddleware refuses disabled users anyway; revoking also stops refreshes.
+			revoked, err := s.db.RevokeUserSessions(ctx, user.Email, revokedUserDisabled)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"error":   "failed to revoke sessions",
+					"details": err.Error(),
+				})
+				return
+			}
+			action, details = "disable_user", details+", sessions revoked: "+strconv.FormatInt(revoked, 10)
+		}
+		s.logAudit(c, actor, models.Action{Action: action, Details: details}, true)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"user": user.Info()})
+}
+
+func (s *Server) deleteUserHandler(c *gin.Context) {
+	email := c.Param("email")
+	actor := c.GetString("user_email")
+	setAuditAction(c, actor, models.Action{Action: "delete_user", Details: "user: " + email}, true)
+	if email == actor {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "you cannot delete your own account"})
+		return
+	}
+
+	deleted, err := s.db.DeleteUser(c.Request.Context(), email)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "failed to delete user",
+			"details": err.Error(),
+		})
+		return
+	}
+	if !deleted {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+
+	s.logAudit(c, actor, models.Action{Action: "delete_user", Details: "user: " + email}, true)
+	c.JSON(http.StatusOK, gin.H{"message": "user deleted"})
+}
@@ -1,4 +1,5 @@
-import axios from 'axios'
+import axios, { type AxiosRequestConfig } from 'axios'
+import { useAuth } from '@/stores/auth'
 
 const baseURL =
   import.meta.env.VITE_API_URL ||
@@ -19,3 +20,34 @@ api.interceptors.request.use((config) => {
   }
   return config
 })
+
+// Access tokens are short-lived: on a 401, trade the refresh token for a new pair once and
+// retry. Concurrent failures share a single refresh, since each refresh token works only once.
+let refreshing: Promise<string | null> | null = null
+
+async function refreshAccessToken(): Promise<string | null> {
+  const refreshToken = localStorage.getItem('refresh_token')
+  if (!refreshToken) return null
+  const { setToken, clearToken } = useAuth()
+  try {
+    const response = await axios.post(`${baseURL}/auth/refresh`, { refresh_token: refreshToken })
+    const token = response.data?.token as string
+    setToken(token, undefined, response.data?.refresh_token as string)
+    return token
+  } catch {
+    clearToken()
+    return null
+  }
+}
+
+api.interceptors.response.use(undefined, async (error) => {
+  const config = error.config as (AxiosRequestConfig & { _retried?: boolean }) | undefined
+  if (error.response?.status !== 401 || !config || config._retried || config.url?.startsWith('/auth/')) {
+    return Promise.reject(error)
+  }
+  config._retried = true
+  refreshing = refreshing ?? refreshAccessToken().finally(() => (refreshing = null))
+  const token = await refreshing
+  if (!token) return Promise.reject(error)
+  return api(config)
+})
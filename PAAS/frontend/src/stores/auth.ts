@@ -21,9 +21,16 @@ const user = ref<{ email: string; isAdmin: boolean } | null>(loadUser())
 export function useAuth() {
   const isAuthenticated = computed(() => !!token.value)
 
-  function setToken(value: string, userPayload?: { email: string; is_admin: boolean }) {
+  function setToken(
+    value: string,
+    userPayload?: { email: string; is_admin: boolean },
+    refreshToken?: string,
+  ) {
     token.value = value
     localStorage.setItem('jwt_token', value)
+    if (refreshToken) {
+      localStorage.setItem('refresh_token', refreshToken)
+    }
     if (userPayload) {
       const u = { email: userPayload.email, isAdmin: !!userPayload.is_admin }
       user.value = u
@@ -35,6 +42,7 @@ export function useAuth() {
     token.value = null
     user.value = null
     localStorage.removeItem('jwt_token')
+    localStorage.removeItem('refresh_token')
     localStorage.removeItem(USER_KEY)
   }
 